@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/brightbox/brightbox-volume-device-plugin/logging"
+	"github.com/brightbox/brightbox-volume-device-plugin/volwatch"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Allocations records which volumes have been allocated
+type Allocations interface {
+	// Claim records the allocation of the volume, returning an
+	// AlreadyExists error if it is already allocated
+	Claim(volumeID string) error
+	// Release makes the volume available for allocation again
+	Release(volumeID string)
+	// Allocated reports whether the volume is currently allocated
+	Allocated(volumeID string) bool
+}
+
+var _ Allocations = (*AllocationTracker)(nil)
+var _ Allocations = (*PersistentAllocationTracker)(nil)
+
+// AllocationTracker records which volumes have been allocated, so that a
+// volume is only handed to one container at a time. One tracker is
+// shared by all the plugins created by a VolumeLister.
+//
+// The device plugin API does not say which pod an allocation is for, so
+// a volume stays allocated until its plugin stops when the volume is
+// detached from the node.
+type AllocationTracker struct {
+	allocations sync.Map // volume ID -> time.Time allocated
+}
+
+// NewAllocationTracker creates an empty AllocationTracker
+func NewAllocationTracker() *AllocationTracker {
+	return &AllocationTracker{}
+}
+
+// Claim records the allocation of the volume, returning an AlreadyExists
+// error if it is already allocated
+func (at *AllocationTracker) Claim(volumeID string) error {
+	if since, loaded := at.allocations.LoadOrStore(volumeID, time.Now()); loaded {
+		return status.Errorf(codes.AlreadyExists,
+			"volume %s already allocated at %s", volumeID, since.(time.Time).Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Release makes the volume available for allocation again
+func (at *AllocationTracker) Release(volumeID string) {
+	at.allocations.Delete(volumeID)
+}
+
+// Allocated reports whether the volume is currently allocated
+func (at *AllocationTracker) Allocated(volumeID string) bool {
+	_, ok := at.allocations.Load(volumeID)
+	return ok
+}
+
+// snapshot returns the allocated volumes along with when they were
+// allocated
+func (at *AllocationTracker) snapshot() map[string]time.Time {
+	result := make(map[string]time.Time)
+	at.allocations.Range(func(key, value any) bool {
+		result[key.(string)] = value.(time.Time)
+		return true
+	})
+	return result
+}
+
+// PersistentAllocationTracker is an AllocationTracker that saves the
+// allocations to a JSON file after every change, and loads them again
+// when created. This stops a volume that was allocated before the plugin
+// restarted from being allocated again.
+//
+// Create a PersistentAllocationTracker by calling the
+// NewPersistentAllocationTracker function
+type PersistentAllocationTracker struct {
+	AllocationTracker
+	path   string
+	mutex  sync.Mutex // serialises saves and guards closed
+	closed bool
+}
+
+// NewPersistentAllocationTracker creates a tracker saving its state to
+// path, starting from the allocations already recorded there. A missing
+// file starts with no allocations, as does one that cannot be parsed,
+// which is logged and overwritten on the next change. Entries that are
+// not valid volume IDs are dropped.
+func NewPersistentAllocationTracker(path string) (*PersistentAllocationTracker, error) {
+	pt := &PersistentAllocationTracker{path: path}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return pt, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var state map[string]time.Time
+	if err := json.Unmarshal(data, &state); err != nil {
+		logging.Warn("Ignoring corrupt allocation state file", "path", path, "err", err)
+		return pt, nil
+	}
+	loaded := 0
+	for volumeID, since := range state {
+		if err := volwatch.ValidateVolumeID(volumeID); err != nil {
+			logging.Warn("Ignoring invalid allocation state entry", "path", path, "err", err)
+			continue
+		}
+		pt.allocations.Store(volumeID, since)
+		loaded++
+	}
+	logging.Info("Loaded allocation state", "path", path, "allocations", loaded)
+	return pt, nil
+}
+
+// Claim records the allocation of the volume and saves the state,
+// returning an AlreadyExists error if it is already allocated. Failure
+// to save is logged, leaving the allocation recorded in memory only.
+func (pt *PersistentAllocationTracker) Claim(volumeID string) error {
+	if err := pt.AllocationTracker.Claim(volumeID); err != nil {
+		return err
+	}
+	pt.save()
+	return nil
+}
+
+// Release makes the volume available for allocation again and saves the
+// state
+func (pt *PersistentAllocationTracker) Release(volumeID string) {
+	pt.AllocationTracker.Release(volumeID)
+	pt.save()
+}
+
+// Close stops further changes being saved. Calling it before the
+// plugins are stopped at shutdown keeps their releases out of the state
+// file, so the allocations survive a restart.
+func (pt *PersistentAllocationTracker) Close() {
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+	pt.closed = true
+}
+
+// save atomically replaces the state file with the current allocations
+func (pt *PersistentAllocationTracker) save() {
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+	if pt.closed {
+		return
+	}
+	if err := writeFileAtomic(pt.path, pt.snapshot()); err != nil {
+		logging.Warn("Unable to save allocation state", "path", pt.path, "err", err)
+	}
+}
+
+// writeFileAtomic writes value as JSON to a temporary file alongside
+// path and renames it over path, so that readers never see a partial
+// file
+func writeFileAtomic(path string, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing %s: %w", tmp.Name(), err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("syncing %s: %w", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestAllocationTracker(t *testing.T) {
+	tracker := NewAllocationTracker()
+	if err := tracker.Claim("vol-aaaaa"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tracker.Claim("vol-aaaaa"); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("Expected AlreadyExists, got %v", err)
+	}
+	if err := tracker.Claim("vol-bbbbb"); err != nil {
+		t.Errorf("Expected a different volume to be claimed, got %v", err)
+	}
+	tracker.Release("vol-aaaaa")
+	if tracker.Allocated("vol-aaaaa") {
+		t.Error("Expected vol-aaaaa to be released")
+	}
+	if err := tracker.Claim("vol-aaaaa"); err != nil {
+		t.Errorf("Expected released volume to be claimed, got %v", err)
+	}
+}
+
+func allocate(vdp *volumeDevicePlugin, ids ...string) error {
+	_, err := vdp.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: ids},
+		},
+	})
+	return err
+}
+
+func TestAllocateExclusive(t *testing.T) {
+	vl := newTestLister(t)
+	vdp := vl.NewPlugin("vol-aaaaa").(*volumeDevicePlugin)
+	const callers = 10
+	errs := make(chan error, callers)
+	var start, done sync.WaitGroup
+	start.Add(1)
+	for i := 0; i < callers; i++ {
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			start.Wait()
+			errs <- allocate(vdp, "vol-aaaaa")
+		}()
+	}
+	start.Done()
+	done.Wait()
+	close(errs)
+	succeeded := 0
+	for err := range errs {
+		switch status.Code(err) {
+		case codes.OK:
+			succeeded++
+		case codes.AlreadyExists:
+		default:
+			t.Errorf("Unexpected error %v", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("Expected exactly one allocation to succeed, got %d", succeeded)
+	}
+	vdp.Stop()
+	if err := allocate(vdp, "vol-aaaaa"); err != nil {
+		t.Errorf("Expected allocation after the plugin stopped, got %v", err)
+	}
+}
+
+func TestAllocateReleasesOnConflict(t *testing.T) {
+	tracker := NewAllocationTracker()
+	vdp := newVolumeDevicePlugin("vol-aaaaa", nil, WithAllocationTracker(tracker))
+	tracker.Claim("vol-bbbbb")
+	if err := allocate(vdp, "vol-aaaaa", "vol-bbbbb"); status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("Expected AlreadyExists, got %v", err)
+	}
+	if tracker.Allocated("vol-aaaaa") {
+		t.Error("Expected vol-aaaaa to be released after the conflict")
+	}
+}
+
+func TestAllowMultiAttach(t *testing.T) {
+	vl := newTestLister(t, WithAllowMultiAttach(true))
+	vdp := vl.NewPlugin("vol-aaaaa").(*volumeDevicePlugin)
+	for i := 0; i < 2; i++ {
+		if err := allocate(vdp, "vol-aaaaa"); err != nil {
+			t.Errorf("Expected repeat allocation to succeed, got %v", err)
+		}
+	}
+}
+
+func TestMaxVolumes(t *testing.T) {
+	const limit = 2
+	vl := newTestLister(t, WithMaxVolumes(limit))
+	var plugins []*volumeDevicePlugin
+	for _, id := range []string{"vol-aaaaa", "vol-bbbbb", "vol-ccccc"} {
+		plugins = append(plugins, vl.NewPlugin(id).(*volumeDevicePlugin))
+	}
+	for _, vdp := range plugins[:limit] {
+		if err := allocate(vdp, vdp.volumeID); err != nil {
+			t.Fatalf("Expected allocation within the limit, got %v", err)
+		}
+	}
+	if err := allocate(plugins[limit], "vol-ccccc"); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Expected ResourceExhausted beyond the limit, got %v", err)
+	}
+	plugins[0].Stop()
+	if err := allocate(plugins[limit], "vol-ccccc"); err != nil {
+		t.Errorf("Expected allocation after a plugin stopped, got %v", err)
+	}
+}
+
+func TestMaxVolumesRepeatAllocation(t *testing.T) {
+	vl := newTestLister(t, WithMaxVolumes(1), WithAllowMultiAttach(true))
+	vdp := vl.NewPlugin("vol-aaaaa").(*volumeDevicePlugin)
+	for i := 0; i < 2; i++ {
+		if err := allocate(vdp, "vol-aaaaa"); err != nil {
+			t.Errorf("Expected the same volume to count once, got %v", err)
+		}
+	}
+}
+
+func TestMaxVolumesReleasedOnConflict(t *testing.T) {
+	vl := newTestLister(t, WithMaxVolumes(1))
+	vl.allocations.Claim("vol-aaaaa")
+	if err := allocate(vl.NewPlugin("vol-aaaaa").(*volumeDevicePlugin), "vol-aaaaa"); status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("Expected AlreadyExists, got %v", err)
+	}
+	if err := allocate(vl.NewPlugin("vol-bbbbb").(*volumeDevicePlugin), "vol-bbbbb"); err != nil {
+		t.Errorf("Expected the rejected allocation not to count, got %v", err)
+	}
+}
+
+func readAllocationState(t *testing.T, path string) map[string]time.Time {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state map[string]time.Time
+	if err := json.Unmarshal(data, &state); err != nil {
+		t.Fatalf("Invalid state file %q: %v", data, err)
+	}
+	return state
+}
+
+func TestPersistentAllocationTrackerLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "allocations.json")
+	since := time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC)
+	state := fmt.Sprintf(`{"vol-aaaaa": %q, "../../etc": %q}`, since.Format(time.RFC3339), since.Format(time.RFC3339))
+	if err := os.WriteFile(path, []byte(state), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tracker, err := NewPersistentAllocationTracker(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tracker.Claim("vol-aaaaa"); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("Expected loaded volume to be allocated, got %v", err)
+	}
+	if tracker.Allocated("../../etc") {
+		t.Error("Expected invalid entry to be dropped")
+	}
+	if err := tracker.Claim("vol-bbbbb"); err != nil {
+		t.Fatal(err)
+	}
+	tracker.Release("vol-aaaaa")
+	saved := readAllocationState(t, path)
+	if len(saved) != 1 || saved["vol-bbbbb"].IsZero() {
+		t.Errorf("Expected only vol-bbbbb to be saved, got %v", saved)
+	}
+}
+
+func TestPersistentAllocationTrackerMissingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "allocations.json")
+	tracker, err := NewPersistentAllocationTracker(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tracker.Claim("vol-aaaaa"); err != nil {
+		t.Fatal(err)
+	}
+	restarted, err := NewPersistentAllocationTracker(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !restarted.Allocated("vol-aaaaa") {
+		t.Error("Expected allocation to survive a restart")
+	}
+}
+
+func TestPersistentAllocationTrackerCorruptFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "allocations.json")
+	if err := os.WriteFile(path, []byte(`{"vol-aaaaa": `), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tracker, err := NewPersistentAllocationTracker(path)
+	if err != nil {
+		t.Fatalf("Expected corrupt state to be ignored, got %v", err)
+	}
+	if tracker.Allocated("vol-aaaaa") {
+		t.Error("Expected to start with no allocations")
+	}
+	if err := tracker.Claim("vol-bbbbb"); err != nil {
+		t.Fatal(err)
+	}
+	if saved := readAllocationState(t, path); len(saved) != 1 {
+		t.Errorf("Expected corrupt file to be replaced, got %v", saved)
+	}
+}
+
+func TestPersistentAllocationTrackerConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "allocations.json")
+	tracker, err := NewPersistentAllocationTracker(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const volumes = 50
+	var wg sync.WaitGroup
+	for i := 0; i < volumes; i++ {
+		wg.Add(1)
+		go func(id string, release bool) {
+			defer wg.Done()
+			if err := tracker.Claim(id); err != nil {
+				t.Error(err)
+			}
+			if release {
+				tracker.Release(id)
+			}
+		}(fmt.Sprintf("vol-%05d", i), i%2 == 0)
+	}
+	wg.Wait()
+	if saved := readAllocationState(t, path); len(saved) != volumes/2 {
+		t.Errorf("Expected %d saved allocations, got %d", volumes/2, len(saved))
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Expected temporary files to be cleaned up, got %v", entries)
+	}
+}
+
+func TestPersistentAllocationTrackerClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "allocations.json")
+	tracker, err := NewPersistentAllocationTracker(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tracker.Claim("vol-aaaaa"); err != nil {
+		t.Fatal(err)
+	}
+	tracker.Close()
+	tracker.Release("vol-aaaaa")
+	if saved := readAllocationState(t, path); len(saved) != 1 {
+		t.Errorf("Expected release after Close not to be saved, got %v", saved)
+	}
+}
@@ -0,0 +1,84 @@
+// Package buildinfo identifies the running binary.
+//
+// Version, Commit and BuildDate are set at link time, e.g.
+//
+//	go build -ldflags "-X github.com/brightbox/brightbox-volume-device-plugin/buildinfo.BuildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// Version and Commit fall back to the module version and VCS revision
+// the Go toolchain embeds in the binary.
+package buildinfo
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// Set at link time with -ldflags -X
+var (
+	Version   string
+	Commit    string
+	BuildDate string
+)
+
+const unknown = "unknown"
+
+// Info describes the build of the running binary
+type Info struct {
+	Version   string
+	Commit    string
+	BuildDate string
+	GoVersion string
+}
+
+// Get returns the build information, preferring the values set at link
+// time to those embedded by the toolchain
+func Get() Info {
+	info := Info{
+		Version:   Version,
+		Commit:    Commit,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if info.Version == "" {
+			info.Version = bi.Main.Version
+		}
+		if info.Commit == "" {
+			info.Commit = vcsCommit(bi.Settings)
+		}
+	}
+	if info.Version == "" {
+		info.Version = unknown
+	}
+	if info.Commit == "" {
+		info.Commit = unknown
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = unknown
+	}
+	return info
+}
+
+// vcsCommit returns the embedded VCS revision, marked if the working tree
+// had uncommitted changes
+func vcsCommit(settings []debug.BuildSetting) string {
+	var revision, modified string
+	for _, s := range settings {
+		switch s.Key {
+		case "vcs.revision":
+			revision = s.Value
+		case "vcs.modified":
+			modified = s.Value
+		}
+	}
+	if revision != "" && modified == "true" {
+		revision += "-dirty"
+	}
+	return revision
+}
+
+func (i Info) String() string {
+	return fmt.Sprintf("version: %s\ncommit: %s\nbuild date: %s\ngo version: %s\n",
+		i.Version, i.Commit, i.BuildDate, i.GoVersion)
+}
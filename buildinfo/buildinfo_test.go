@@ -0,0 +1,39 @@
+package buildinfo
+
+import (
+	"runtime"
+	"runtime/debug"
+	"testing"
+)
+
+func TestGet(t *testing.T) {
+	defer func(v, c, d string) { Version, Commit, BuildDate = v, c, d }(Version, Commit, BuildDate)
+	Version, Commit, BuildDate = "v1.2.3", "abc123", "2024-01-02T03:04:05Z"
+	info := Get()
+	expected := Info{"v1.2.3", "abc123", "2024-01-02T03:04:05Z", runtime.Version()}
+	if info != expected {
+		t.Errorf("Expected %+v, got %+v", expected, info)
+	}
+
+	Version, Commit, BuildDate = "", "", ""
+	info = Get()
+	if info.Version == "" || info.Commit == "" || info.BuildDate != unknown {
+		t.Errorf("Expected fallback values, got %+v", info)
+	}
+}
+
+func TestVCSCommit(t *testing.T) {
+	tests := []struct {
+		settings []debug.BuildSetting
+		expected string
+	}{
+		{nil, ""},
+		{[]debug.BuildSetting{{Key: "vcs.revision", Value: "abc123"}}, "abc123"},
+		{[]debug.BuildSetting{{Key: "vcs.revision", Value: "abc123"}, {Key: "vcs.modified", Value: "true"}}, "abc123-dirty"},
+	}
+	for _, test := range tests {
+		if got := vcsCommit(test.settings); got != test.expected {
+			t.Errorf("vcsCommit(%v) = %q, want %q", test.settings, got, test.expected)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+// Package cdi writes Container Device Interface specs, describing the
+// device nodes and environment a container runtime should give a
+// container using a device.
+//
+// The types mirror the parts of the CDI specs-go package the plugin
+// needs, following version 0.6.0 of the spec schema.
+package cdi
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// CurrentVersion is the version of the CDI spec schema written
+const CurrentVersion = "0.6.0"
+
+// Spec is a CDI spec file, describing the devices of a single kind
+type Spec struct {
+	Version        string          `json:"cdiVersion"`
+	Kind           string          `json:"kind"`
+	Devices        []Device        `json:"devices"`
+	ContainerEdits *ContainerEdits `json:"containerEdits,omitempty"`
+}
+
+// Device is a named device and the changes made to a container using it
+type Device struct {
+	Name           string         `json:"name"`
+	ContainerEdits ContainerEdits `json:"containerEdits"`
+}
+
+// ContainerEdits are the changes made to a container's OCI spec
+type ContainerEdits struct {
+	Env         []string      `json:"env,omitempty"`
+	DeviceNodes []*DeviceNode `json:"deviceNodes,omitempty"`
+}
+
+// DeviceNode is a device node made available in the container
+type DeviceNode struct {
+	Path        string `json:"path"`
+	HostPath    string `json:"hostPath,omitempty"`
+	Type        string `json:"type,omitempty"`
+	Permissions string `json:"permissions,omitempty"`
+}
+
+var (
+	vendorRe = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9_.-]*[A-Za-z0-9])?$`)
+	classRe  = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9_-]*[A-Za-z0-9])?$`)
+	nameRe   = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9_.:-]*[A-Za-z0-9])?$`)
+)
+
+// QualifiedName gives the fully qualified name by which a container
+// requests the named device of kind, e.g.
+// volumes.brightbox.com/volume=vol-12345
+func QualifiedName(kind string, name string) string {
+	return kind + "=" + name
+}
+
+// Validate checks the spec against the rules of the CDI schema
+func (s *Spec) Validate() error {
+	if s.Version != CurrentVersion {
+		return fmt.Errorf("unsupported cdiVersion %q", s.Version)
+	}
+	vendor, class, ok := strings.Cut(s.Kind, "/")
+	if !ok || !vendorRe.MatchString(vendor) || !classRe.MatchString(class) {
+		return fmt.Errorf("invalid kind %q: must be vendor/class", s.Kind)
+	}
+	if len(s.Devices) == 0 {
+		return fmt.Errorf("no devices in spec")
+	}
+	seen := make(map[string]bool)
+	for _, device := range s.Devices {
+		if !nameRe.MatchString(device.Name) {
+			return fmt.Errorf("invalid device name %q", device.Name)
+		}
+		if seen[device.Name] {
+			return fmt.Errorf("duplicate device name %q", device.Name)
+		}
+		seen[device.Name] = true
+		if err := device.ContainerEdits.validate(); err != nil {
+			return fmt.Errorf("device %q: %w", device.Name, err)
+		}
+	}
+	if s.ContainerEdits != nil {
+		return s.ContainerEdits.validate()
+	}
+	return nil
+}
+
+func (e *ContainerEdits) validate() error {
+	for _, env := range e.Env {
+		if name, _, ok := strings.Cut(env, "="); !ok || name == "" {
+			return fmt.Errorf("invalid environment variable %q", env)
+		}
+	}
+	for _, node := range e.DeviceNodes {
+		if !filepath.IsAbs(node.Path) {
+			return fmt.Errorf("device node path %q is not absolute", node.Path)
+		}
+		if node.HostPath != "" && !filepath.IsAbs(node.HostPath) {
+			return fmt.Errorf("device node host path %q is not absolute", node.HostPath)
+		}
+		switch node.Type {
+		case "", "b", "c", "u", "p":
+		default:
+			return fmt.Errorf("invalid device node type %q", node.Type)
+		}
+		if strings.Trim(node.Permissions, "rwm") != "" {
+			return fmt.Errorf("invalid device node permissions %q", node.Permissions)
+		}
+	}
+	return nil
+}
+
+// WriteSpec validates spec and writes it as JSON to name.json in dir,
+// replacing any existing file atomically so that runtimes never read a
+// partial spec
+func WriteSpec(dir string, name string, spec *Spec) error {
+	if err := spec.Validate(); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, name+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, name+".json"))
+}
+
+// ReadSpec reads and validates the spec in the file at path
+func ReadSpec(path string) (*Spec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	spec := new(Spec)
+	if err := json.Unmarshal(data, spec); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if err := spec.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return spec, nil
+}
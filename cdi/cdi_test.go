@@ -0,0 +1,98 @@
+package cdi
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func validSpec() *Spec {
+	return &Spec{
+		Version: CurrentVersion,
+		Kind:    "volumes.example.com/volume",
+		Devices: []Device{
+			{
+				Name: "vol-12345",
+				ContainerEdits: ContainerEdits{
+					Env: []string{"VOLUME=vol-12345"},
+					DeviceNodes: []*DeviceNode{
+						{Path: "/dev/disk/by-id/virtio-vol-12345", Permissions: "rw"},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := validSpec().Validate(); err != nil {
+		t.Fatalf("Expected valid spec, got %v", err)
+	}
+	invalid := map[string]func(*Spec){
+		"version":     func(s *Spec) { s.Version = "0.1.0" },
+		"kind":        func(s *Spec) { s.Kind = "volumes.example.com" },
+		"class":       func(s *Spec) { s.Kind = "volumes.example.com/vol.ume" },
+		"no devices":  func(s *Spec) { s.Devices = nil },
+		"name":        func(s *Spec) { s.Devices[0].Name = "vol/12345" },
+		"duplicate":   func(s *Spec) { s.Devices = append(s.Devices, s.Devices[0]) },
+		"env":         func(s *Spec) { s.Devices[0].ContainerEdits.Env = []string{"VOLUME"} },
+		"path":        func(s *Spec) { s.Devices[0].ContainerEdits.DeviceNodes[0].Path = "vda" },
+		"host path":   func(s *Spec) { s.Devices[0].ContainerEdits.DeviceNodes[0].HostPath = "vda" },
+		"type":        func(s *Spec) { s.Devices[0].ContainerEdits.DeviceNodes[0].Type = "x" },
+		"permissions": func(s *Spec) { s.Devices[0].ContainerEdits.DeviceNodes[0].Permissions = "rwx" },
+	}
+	for name, mutate := range invalid {
+		spec := validSpec()
+		mutate(spec)
+		if err := spec.Validate(); err == nil {
+			t.Errorf("Expected invalid %s to be rejected", name)
+		}
+	}
+}
+
+func TestWriteSpec(t *testing.T) {
+	dir := t.TempDir()
+	if err := WriteSpec(dir, "volumes.example.com-volume-vol-12345", validSpec()); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "volumes.example.com-volume-vol-12345.json")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{`"cdiVersion": "0.6.0"`, `"kind": "volumes.example.com/volume"`, `"deviceNodes"`} {
+		if !strings.Contains(string(data), field) {
+			t.Errorf("Expected %s in %s", field, data)
+		}
+	}
+	spec, err := ReadSpec(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.Devices[0].ContainerEdits.DeviceNodes[0].Path != "/dev/disk/by-id/virtio-vol-12345" {
+		t.Errorf("Unexpected spec %+v", spec)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("Expected only the spec file, got %v", entries)
+	}
+}
+
+func TestWriteSpecInvalid(t *testing.T) {
+	dir := t.TempDir()
+	spec := validSpec()
+	spec.Kind = "invalid"
+	if err := WriteSpec(dir, "invalid", spec); err == nil {
+		t.Error("Expected invalid spec to be rejected")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Expected nothing written, got %v", entries)
+	}
+}
+
+func TestQualifiedName(t *testing.T) {
+	if name := QualifiedName("volumes.example.com/volume", "vol-12345"); name != "volumes.example.com/volume=vol-12345" {
+		t.Errorf("Unexpected name %q", name)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brightbox/brightbox-volume-device-plugin/logging"
+	"golang.org/x/time/rate"
+)
+
+// VolumeMetadata holds the details of a volume known to Brightbox Cloud
+type VolumeMetadata struct {
+	Description string
+	ServerID    string
+	Zone        string
+	Status      string
+}
+
+// volumeStatusFailed is the status of a volume Brightbox Cloud can no
+// longer use
+const volumeStatusFailed = "failed"
+
+// CloudClient looks up volumes in Brightbox Cloud
+type CloudClient interface {
+	GetVolume(ctx context.Context, id string) (VolumeMetadata, error)
+}
+
+// ErrCloudNotConfigured is returned when the Brightbox API credentials
+// are not set in the environment
+var ErrCloudNotConfigured = errors.New("brightbox API credentials not configured")
+
+// apiClient fetches volumes from the Brightbox API, authenticating with
+// API client credentials
+type apiClient struct {
+	apiURL       string
+	clientID     string
+	clientSecret string
+	client       *http.Client
+
+	mutex   sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// newAPIClient creates a client for the Brightbox API at apiURL
+func newAPIClient(apiURL string, clientID string, clientSecret string, client *http.Client) *apiClient {
+	return &apiClient{
+		apiURL:       strings.TrimSuffix(apiURL, "/"),
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		client:       client,
+	}
+}
+
+// newAPIClientFromEnv creates a client using the API URL and credentials
+// in the BRIGHTBOX_API_URL, BRIGHTBOX_CLIENT_ID and
+// BRIGHTBOX_CLIENT_SECRET environment variables
+func newAPIClientFromEnv() (*apiClient, error) {
+	apiURL := os.Getenv(cloudAPIURLEnv)
+	clientID := os.Getenv(cloudClientIDEnv)
+	clientSecret := os.Getenv(cloudClientSecretEnv)
+	if apiURL == "" || clientID == "" || clientSecret == "" {
+		return nil, ErrCloudNotConfigured
+	}
+	return newAPIClient(apiURL, clientID, clientSecret, &http.Client{Timeout: cloudRequestTimeout}), nil
+}
+
+// GetVolume fetches the volume with the given ID
+func (ac *apiClient) GetVolume(ctx context.Context, id string) (VolumeMetadata, error) {
+	token, err := ac.accessToken(ctx)
+	if err != nil {
+		return VolumeMetadata{}, fmt.Errorf("authenticating: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ac.apiURL+"/1.0/volumes/"+url.PathEscape(id), nil)
+	if err != nil {
+		return VolumeMetadata{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/json")
+	var volume struct {
+		Description string `json:"description"`
+		Status      string `json:"status"`
+		Server      *struct {
+			ID string `json:"id"`
+		} `json:"server"`
+		Zone *struct {
+			Handle string `json:"handle"`
+		} `json:"zone"`
+	}
+	if err := ac.do(req, &volume); err != nil {
+		return VolumeMetadata{}, fmt.Errorf("fetching volume %s: %w", id, err)
+	}
+	metadata := VolumeMetadata{Description: volume.Description, Status: volume.Status}
+	if volume.Server != nil {
+		metadata.ServerID = volume.Server.ID
+	}
+	if volume.Zone != nil {
+		metadata.Zone = volume.Zone.Handle
+	}
+	return metadata, nil
+}
+
+// accessToken returns the current API token, requesting a new one with
+// the client credentials once it has expired
+func (ac *apiClient) accessToken(ctx context.Context) (string, error) {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+	if ac.token != "" && time.Now().Before(ac.expires) {
+		return ac.token, nil
+	}
+	logging.V(4).Info("Requesting Brightbox API token", "url", ac.apiURL)
+	form := url.Values{"grant_type": {"client_credentials"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ac.apiURL+"/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(ac.clientID, ac.clientSecret)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := ac.do(req, &token); err != nil {
+		return "", err
+	}
+	if token.AccessToken == "" {
+		return "", errors.New("no access token in response")
+	}
+	ac.token = token.AccessToken
+	// Renew a little early so a token doesn't expire in flight
+	ac.expires = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - cloudTokenMargin)
+	return ac.token, nil
+}
+
+// do sends req and decodes the JSON response into result
+func (ac *apiClient) do(req *http.Request, result any) error {
+	resp, err := ac.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("decoding response: %w", err)
+	}
+	return nil
+}
+
+// cachedVolume is a volume lookup and when it was made
+type cachedVolume struct {
+	id       string
+	metadata VolumeMetadata
+	fetched  time.Time
+}
+
+// cachingCloudClient remembers the volumes fetched by another client for
+// a short period, dropping the least recently used once it holds more
+// than size. Failed lookups are not cached.
+type cachingCloudClient struct {
+	client CloudClient
+	ttl    time.Duration
+	size   int
+	now    func() time.Time
+
+	mutex   sync.Mutex
+	volumes map[string]*list.Element
+	recent  *list.List // of *cachedVolume, most recently used first
+}
+
+// newCachingCloudClient caches up to size of the volumes fetched by
+// client for ttl
+func newCachingCloudClient(client CloudClient, ttl time.Duration, size int) *cachingCloudClient {
+	return &cachingCloudClient{
+		client:  client,
+		ttl:     ttl,
+		size:    size,
+		now:     time.Now,
+		volumes: make(map[string]*list.Element),
+		recent:  list.New(),
+	}
+}
+
+// GetVolume returns the cached volume with the given ID, fetching it if
+// it is missing or stale. The cache is not locked during the fetch, so a
+// slow lookup doesn't hold up others.
+func (cc *cachingCloudClient) GetVolume(ctx context.Context, id string) (VolumeMetadata, error) {
+	cc.mutex.Lock()
+	if element, ok := cc.volumes[id]; ok {
+		cached := element.Value.(*cachedVolume)
+		if cc.now().Sub(cached.fetched) < cc.ttl {
+			cc.recent.MoveToFront(element)
+			cc.mutex.Unlock()
+			return cached.metadata, nil
+		}
+	}
+	cc.mutex.Unlock()
+	return cc.fetch(ctx, id)
+}
+
+// RefreshVolume fetches the volume with the given ID into the cache
+// whether or not the cached copy is stale. A failed refresh leaves the
+// cache as it was.
+func (cc *cachingCloudClient) RefreshVolume(ctx context.Context, id string) error {
+	_, err := cc.fetch(ctx, id)
+	return err
+}
+
+// fetch looks up the volume with the given ID and caches the result
+func (cc *cachingCloudClient) fetch(ctx context.Context, id string) (VolumeMetadata, error) {
+	metadata, err := cc.client.GetVolume(ctx, id)
+	if err != nil {
+		return VolumeMetadata{}, err
+	}
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	cached := &cachedVolume{id: id, metadata: metadata, fetched: cc.now()}
+	if element, ok := cc.volumes[id]; ok {
+		element.Value = cached
+		cc.recent.MoveToFront(element)
+		return metadata, nil
+	}
+	cc.volumes[id] = cc.recent.PushFront(cached)
+	for cc.recent.Len() > cc.size {
+		oldest := cc.recent.Back()
+		cc.recent.Remove(oldest)
+		delete(cc.volumes, oldest.Value.(*cachedVolume).id)
+	}
+	return metadata, nil
+}
+
+// rateLimitedCloudClient spaces out the lookups of another client, so
+// that the plugins sharing it stay within the API's rate limits
+type rateLimitedCloudClient struct {
+	client  CloudClient
+	limiter *rate.Limiter
+}
+
+// newRateLimitedCloudClient allows client limit lookups a second, with
+// bursts of up to burst lookups
+func newRateLimitedCloudClient(client CloudClient, limit rate.Limit, burst int) *rateLimitedCloudClient {
+	return &rateLimitedCloudClient{
+		client:  client,
+		limiter: rate.NewLimiter(limit, burst),
+	}
+}
+
+// GetVolume waits for the rate limit to allow a lookup, then fetches the
+// volume with the given ID. Gives the context's error if it is done
+// first.
+func (rc *rateLimitedCloudClient) GetVolume(ctx context.Context, id string) (VolumeMetadata, error) {
+	if err := rc.limiter.Wait(ctx); err != nil {
+		return VolumeMetadata{}, fmt.Errorf("waiting to fetch volume %s: %w", id, err)
+	}
+	return rc.client.GetVolume(ctx, id)
+}
+
+const (
+	cloudAPIURLEnv        = "BRIGHTBOX_API_URL"
+	cloudClientIDEnv      = "BRIGHTBOX_CLIENT_ID"
+	cloudClientSecretEnv  = "BRIGHTBOX_CLIENT_SECRET"
+	cloudCacheTTL         = 60 * time.Second
+	defaultCloudCacheSize = 1000
+	cloudRequestTimeout   = 10 * time.Second
+	cloudTokenMargin      = 30 * time.Second
+)
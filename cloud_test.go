@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// fakeCloudClient is a CloudClient backed by a map, counting lookups
+type fakeCloudClient struct {
+	mutex   sync.Mutex
+	volumes map[string]VolumeMetadata
+	lookups int
+}
+
+func (f *fakeCloudClient) GetVolume(ctx context.Context, id string) (VolumeMetadata, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.lookups++
+	metadata, ok := f.volumes[id]
+	if !ok {
+		return VolumeMetadata{}, errors.New("volume not found")
+	}
+	return metadata, nil
+}
+
+// setStatus changes the status of the volume with the given ID
+func (f *fakeCloudClient) setStatus(id string, status string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	metadata := f.volumes[id]
+	metadata.Status = status
+	f.volumes[id] = metadata
+}
+
+func TestAPIClientGetVolume(t *testing.T) {
+	tokens := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			id, secret, ok := r.BasicAuth()
+			if !ok || id != "cli-abcde" || secret != "secret" || r.FormValue("grant_type") != "client_credentials" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			tokens++
+			w.Write([]byte(`{"access_token":"token","token_type":"Bearer","expires_in":7200}`))
+		case "/1.0/volumes/vol-aaaaa":
+			if r.Header.Get("Authorization") != "Bearer token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"id":"vol-aaaaa","description":"database","status":"attached","server":{"id":"srv-abcde"},"zone":{"handle":"gb1s-a"}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	client := newAPIClient(server.URL+"/", "cli-abcde", "secret", server.Client())
+	metadata, err := client.GetVolume(context.Background(), "vol-aaaaa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := VolumeMetadata{Description: "database", ServerID: "srv-abcde", Zone: "gb1s-a", Status: "attached"}
+	if metadata != expected {
+		t.Errorf("Expected %+v, got %+v", expected, metadata)
+	}
+	if _, err := client.GetVolume(context.Background(), "vol-bbbbb"); err == nil {
+		t.Error("Expected error for missing volume")
+	}
+	if tokens != 1 {
+		t.Errorf("Expected the token to be reused, got %d token requests", tokens)
+	}
+}
+
+func TestAPIClientBadCredentials(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+	client := newAPIClient(server.URL, "cli-abcde", "wrong", server.Client())
+	if _, err := client.GetVolume(context.Background(), "vol-aaaaa"); err == nil {
+		t.Error("Expected error with bad credentials")
+	}
+}
+
+func TestCachingCloudClient(t *testing.T) {
+	fake := &fakeCloudClient{volumes: map[string]VolumeMetadata{"vol-aaaaa": {Zone: "gb1s-a"}}}
+	now := time.Unix(0, 0)
+	client := newCachingCloudClient(fake, time.Minute, defaultCloudCacheSize)
+	client.now = func() time.Time { return now }
+	for i := 0; i < 2; i++ {
+		if metadata, err := client.GetVolume(context.Background(), "vol-aaaaa"); err != nil || metadata.Zone != "gb1s-a" {
+			t.Fatalf("Unexpected lookup %+v, %v", metadata, err)
+		}
+	}
+	if fake.lookups != 1 {
+		t.Errorf("Expected a cached volume, got %d lookups", fake.lookups)
+	}
+	now = now.Add(time.Minute)
+	client.GetVolume(context.Background(), "vol-aaaaa")
+	if fake.lookups != 2 {
+		t.Errorf("Expected an expired volume to be fetched again, got %d lookups", fake.lookups)
+	}
+	client.GetVolume(context.Background(), "vol-bbbbb")
+	client.GetVolume(context.Background(), "vol-bbbbb")
+	if fake.lookups != 4 {
+		t.Errorf("Expected failed lookups not to be cached, got %d lookups", fake.lookups)
+	}
+}
+
+func TestCachingCloudClientRefresh(t *testing.T) {
+	fake := &fakeCloudClient{volumes: map[string]VolumeMetadata{"vol-aaaaa": {Status: "attached"}}}
+	client := newCachingCloudClient(fake, time.Hour, defaultCloudCacheSize)
+	client.GetVolume(context.Background(), "vol-aaaaa")
+	fake.setStatus("vol-aaaaa", "failed")
+	if metadata, _ := client.GetVolume(context.Background(), "vol-aaaaa"); metadata.Status != "attached" {
+		t.Errorf("Expected the cached status before a refresh, got %q", metadata.Status)
+	}
+	if err := client.RefreshVolume(context.Background(), "vol-aaaaa"); err != nil {
+		t.Fatal(err)
+	}
+	if metadata, _ := client.GetVolume(context.Background(), "vol-aaaaa"); metadata.Status != "failed" {
+		t.Errorf("Expected the refreshed status, got %q", metadata.Status)
+	}
+	if fake.lookups != 2 {
+		t.Errorf("Expected one lookup and one refresh, got %d lookups", fake.lookups)
+	}
+	if err := client.RefreshVolume(context.Background(), "vol-bbbbb"); err == nil {
+		t.Error("Expected refreshing a missing volume to fail")
+	}
+}
+
+func TestCachingCloudClientEviction(t *testing.T) {
+	fake := &fakeCloudClient{volumes: map[string]VolumeMetadata{
+		"vol-aaaaa": {}, "vol-bbbbb": {}, "vol-ccccc": {},
+	}}
+	client := newCachingCloudClient(fake, time.Hour, 2)
+	for _, id := range []string{"vol-aaaaa", "vol-bbbbb", "vol-aaaaa", "vol-ccccc"} {
+		client.GetVolume(context.Background(), id)
+	}
+	if client.recent.Len() != 2 || len(client.volumes) != 2 {
+		t.Fatalf("Expected 2 cached volumes, got %d", client.recent.Len())
+	}
+	if _, ok := client.volumes["vol-bbbbb"]; ok {
+		t.Error("Expected the least recently used volume to be evicted")
+	}
+	lookups := fake.lookups
+	client.GetVolume(context.Background(), "vol-aaaaa")
+	client.GetVolume(context.Background(), "vol-ccccc")
+	if fake.lookups != lookups {
+		t.Errorf("Expected recently used volumes to stay cached, got %d more lookups", fake.lookups-lookups)
+	}
+	client.GetVolume(context.Background(), "vol-bbbbb")
+	if fake.lookups != lookups+1 {
+		t.Error("Expected an evicted volume to be fetched again")
+	}
+}
+
+func TestRateLimitedCloudClient(t *testing.T) {
+	fake := &fakeCloudClient{volumes: map[string]VolumeMetadata{"vol-aaaaa": {}}}
+	client := newRateLimitedCloudClient(fake, rate.Every(time.Hour), 1)
+	if _, err := client.GetVolume(context.Background(), "vol-aaaaa"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := client.GetVolume(ctx, "vol-aaaaa"); err == nil {
+		t.Error("Expected a lookup beyond the rate limit to give up with its context")
+	}
+	if fake.lookups != 1 {
+		t.Errorf("Expected one lookup within the rate limit, got %d", fake.lookups)
+	}
+}
+
+func TestAPIClientFromEnv(t *testing.T) {
+	t.Setenv(cloudAPIURLEnv, "https://api.gb1.brightbox.com/")
+	t.Setenv(cloudClientIDEnv, "cli-abcde")
+	t.Setenv(cloudClientSecretEnv, "")
+	if _, err := newAPIClientFromEnv(); !errors.Is(err, ErrCloudNotConfigured) {
+		t.Errorf("Expected %v without a secret, got %v", ErrCloudNotConfigured, err)
+	}
+	t.Setenv(cloudClientSecretEnv, "secret")
+	client, err := newAPIClientFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.apiURL != "https://api.gb1.brightbox.com" || client.clientID != "cli-abcde" || client.clientSecret != "secret" {
+		t.Errorf("Unexpected client settings %+v", client)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/brightbox/brightbox-volume-device-plugin/volwatch"
+	"gopkg.in/yaml.v3"
+)
+
+// resourceNamespaceEnv names the environment variable overriding the
+// built in resource namespace
+const resourceNamespaceEnv = "BRIGHTBOX_RESOURCE_NAMESPACE"
+
+var namespaceRe = regexp.MustCompile(`^[a-z0-9.-]+$`)
+
+// selinuxLabelRe matches a full SELinux context, user:role:type:level,
+// where the level is an MLS sensitivity, or range of them, each with
+// optional categories such as s0:c1,c2 or s0-s0:c0.c1023
+var selinuxLabelRe = regexp.MustCompile(`^[a-z0-9_]+:[a-z0-9_]+:[a-z0-9_]+:s[0-9]+(:[a-z0-9.,]+)?(-s[0-9]+(:[a-z0-9.,]+)?)?$`)
+
+// appArmorProfileRe matches the AppArmor profiles Kubernetes accepts:
+// the runtime default, unconfined, or a profile loaded on the node
+var appArmorProfileRe = regexp.MustCompile(`^(runtime/default|unconfined|localhost/[A-Za-z0-9][A-Za-z0-9._/-]*)$`)
+
+// Config holds the plugin settings that can be supplied in a
+// configuration file. Fields omitted from the file keep the value
+// given by the command line flags or built in defaults.
+type Config struct {
+	DeviceDir          string `json:"deviceDir" yaml:"deviceDir"`
+	SocketDir          string `json:"socketDir" yaml:"socketDir"`
+	ResourceNamespace  string `json:"resourceNamespace" yaml:"resourceNamespace"`
+	DebounceMs         int    `json:"debounceMs" yaml:"debounceMs"`
+	ShutdownTimeoutSec int    `json:"shutdownTimeoutSec" yaml:"shutdownTimeoutSec"`
+	HealthAddr         string `json:"healthAddr" yaml:"healthAddr"`
+	LogLevel           int    `json:"logLevel" yaml:"logLevel"`
+	VolumeRegex        string `json:"volumeRegex" yaml:"volumeRegex"`
+
+	ExtraNamespaces []ExtraNamespaceConfig `json:"extraNamespaces" yaml:"extraNamespaces"`
+}
+
+// ExtraNamespaceConfig describes a further class of volumes, advertised
+// under its own resource namespace alongside the main one, e.g. SSD
+// volumes matching `ssd-.....$`. An empty WatchDir watches the main
+// device directory.
+type ExtraNamespaceConfig struct {
+	Namespace   string `json:"namespace" yaml:"namespace"`
+	VolumeRegex string `json:"volumeRegex" yaml:"volumeRegex"`
+	WatchDir    string `json:"watchDir" yaml:"watchDir"`
+}
+
+// extraNamespaceList is a flag.Value collecting extra namespaces given as
+// comma separated NAMESPACE:WATCHDIR:REGEX entries. The flag may also be
+// repeated. WATCHDIR may be empty. A regex containing a comma must be
+// given in the configuration file instead.
+type extraNamespaceList []ExtraNamespaceConfig
+
+func (l *extraNamespaceList) String() string {
+	if l == nil {
+		return ""
+	}
+	entries := make([]string, len(*l))
+	for i, extra := range *l {
+		entries[i] = extra.Namespace + ":" + extra.WatchDir + ":" + extra.VolumeRegex
+	}
+	return strings.Join(entries, ",")
+}
+
+func (l *extraNamespaceList) Set(value string) error {
+	for _, entry := range strings.Split(value, ",") {
+		fields := strings.SplitN(entry, ":", 3)
+		if len(fields) != 3 {
+			return fmt.Errorf("%q is not of the form NAMESPACE:WATCHDIR:REGEX", entry)
+		}
+		*l = append(*l, ExtraNamespaceConfig{
+			Namespace:   fields[0],
+			WatchDir:    fields[1],
+			VolumeRegex: fields[2],
+		})
+	}
+	return nil
+}
+
+// defaultConfig returns the configuration given by the command line
+// flags, used as the base for any configuration file
+func defaultConfig() *Config {
+	return &Config{
+		DeviceDir:          *deviceDir,
+		SocketDir:          *socketDir,
+		ResourceNamespace:  resourceNamespaceFromEnv(),
+		ShutdownTimeoutSec: int(*shutdownTimeout / time.Second),
+		HealthAddr:         *healthAddr,
+		VolumeRegex:        volwatch.DefaultVolumeRegex().String(),
+		ExtraNamespaces:    append([]ExtraNamespaceConfig(nil), extraNamespaces...),
+	}
+}
+
+// loadConfig reads the YAML or JSON file at path over the top of base.
+// Files ending in .json are parsed as JSON, anything else as YAML.
+func loadConfig(path string, base *Config) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := *base
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = json.Unmarshal(data, &c)
+	} else {
+		err = yaml.Unmarshal(data, &c)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return &c, nil
+}
+
+// ValidateConfig checks the volume regex compiles, the device and socket
+// directories exist and the numeric settings are in range
+func ValidateConfig(c *Config) error {
+	if _, err := regexp.Compile(c.VolumeRegex); err != nil {
+		return fmt.Errorf("invalid volumeRegex %q: %w", c.VolumeRegex, err)
+	}
+	if err := checkDir("deviceDir", c.DeviceDir); err != nil {
+		return err
+	}
+	if err := checkDir("socketDir", c.SocketDir); err != nil {
+		return err
+	}
+	if err := ValidateResourceNamespace(c.ResourceNamespace); err != nil {
+		return err
+	}
+	if err := ValidateExtraNamespaces(c); err != nil {
+		return err
+	}
+	if c.DebounceMs < 0 {
+		return fmt.Errorf("invalid debounceMs %d: must not be negative", c.DebounceMs)
+	}
+	if c.ShutdownTimeoutSec < 0 {
+		return fmt.Errorf("invalid shutdownTimeoutSec %d: must not be negative", c.ShutdownTimeoutSec)
+	}
+	if c.LogLevel < 0 {
+		return fmt.Errorf("invalid logLevel %d: must not be negative", c.LogLevel)
+	}
+	return nil
+}
+
+// resourceNamespaceFromEnv returns the resource namespace given by the
+// BRIGHTBOX_RESOURCE_NAMESPACE environment variable, or the built in
+// namespace if it is unset or empty
+func resourceNamespaceFromEnv() string {
+	if ns := os.Getenv(resourceNamespaceEnv); ns != "" {
+		return ns
+	}
+	return resourceNamespace
+}
+
+// ValidateResourceNamespace checks ns is a non-empty string of lower case
+// letters, digits, dots and hyphens, as used in a domain name
+func ValidateResourceNamespace(ns string) error {
+	if !namespaceRe.MatchString(ns) {
+		return fmt.Errorf("invalid resourceNamespace %q: must match %s", ns, namespaceRe)
+	}
+	return nil
+}
+
+// ValidateAppArmorProfile checks profile is runtime/default, unconfined
+// or localhost/ followed by the name of a profile loaded on the node
+func ValidateAppArmorProfile(profile string) error {
+	if !appArmorProfileRe.MatchString(profile) {
+		return fmt.Errorf("invalid AppArmor profile %q: must be runtime/default, unconfined or localhost/<profile>", profile)
+	}
+	return nil
+}
+
+// ValidateSELinuxLabel checks label is a full SELinux context of the
+// form user:role:type:level, e.g. system_u:object_r:fixed_disk_device_t:s0
+func ValidateSELinuxLabel(label string) error {
+	if !selinuxLabelRe.MatchString(label) {
+		return fmt.Errorf("invalid SELinux label %q: must be user:role:type:level", label)
+	}
+	return nil
+}
+
+// ValidateExtraNamespaces checks each extra namespace is valid and
+// distinct from the others and the main namespace, its volume regex
+// compiles and its watch directory, if given, exists
+func ValidateExtraNamespaces(c *Config) error {
+	seen := map[string]bool{c.ResourceNamespace: true}
+	for _, extra := range c.ExtraNamespaces {
+		if err := ValidateResourceNamespace(extra.Namespace); err != nil {
+			return fmt.Errorf("extra namespace: %w", err)
+		}
+		if seen[extra.Namespace] {
+			return fmt.Errorf("invalid extra namespace %q: already in use", extra.Namespace)
+		}
+		seen[extra.Namespace] = true
+		if _, err := regexp.Compile(extra.VolumeRegex); err != nil {
+			return fmt.Errorf("invalid volumeRegex %q for %s: %w", extra.VolumeRegex, extra.Namespace, err)
+		}
+		if extra.WatchDir != "" {
+			if err := checkDir("watchDir for "+extra.Namespace, extra.WatchDir); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkDir returns an error naming field unless dir is an existing
+// directory
+func checkDir(field string, dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", field, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("invalid %s: %s is not a directory", field, dir)
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/brightbox/brightbox-volume-device-plugin/volwatch"
+	"golang.org/x/exp/slices"
+)
+
+func validConfig(t *testing.T) *Config {
+	return &Config{
+		DeviceDir:          t.TempDir(),
+		SocketDir:          t.TempDir(),
+		ResourceNamespace:  resourceNamespace,
+		DebounceMs:         100,
+		ShutdownTimeoutSec: 30,
+		VolumeRegex:        `vol-.....$`,
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	if err := ValidateConfig(validConfig(t)); err != nil {
+		t.Errorf("Expected valid config, got %s", err)
+	}
+}
+
+func TestValidateConfigErrors(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]func(*Config){
+		"bad regex":         func(c *Config) { c.VolumeRegex = `vol-(` },
+		"missing directory": func(c *Config) { c.DeviceDir = filepath.Join(c.DeviceDir, "missing") },
+		"not a directory":   func(c *Config) { c.DeviceDir = file },
+		"missing sockets":   func(c *Config) { c.SocketDir = filepath.Join(c.SocketDir, "missing") },
+		"empty namespace":   func(c *Config) { c.ResourceNamespace = "" },
+		"invalid namespace": func(c *Config) { c.ResourceNamespace = "Volumes/Brightbox" },
+		"negative debounce": func(c *Config) { c.DebounceMs = -1 },
+		"negative timeout":  func(c *Config) { c.ShutdownTimeoutSec = -1 },
+		"negative loglevel": func(c *Config) { c.LogLevel = -1 },
+		"extra namespace invalid": func(c *Config) {
+			c.ExtraNamespaces = []ExtraNamespaceConfig{{Namespace: "SSD", VolumeRegex: `ssd-.....$`}}
+		},
+		"extra namespace duplicate": func(c *Config) {
+			c.ExtraNamespaces = []ExtraNamespaceConfig{{Namespace: c.ResourceNamespace, VolumeRegex: `ssd-.....$`}}
+		},
+		"extra namespace bad regex": func(c *Config) {
+			c.ExtraNamespaces = []ExtraNamespaceConfig{{Namespace: "ssd.example.com", VolumeRegex: `ssd-(`}}
+		},
+		"extra namespace missing directory": func(c *Config) {
+			c.ExtraNamespaces = []ExtraNamespaceConfig{{Namespace: "ssd.example.com", VolumeRegex: `ssd-.....$`, WatchDir: filepath.Join(c.DeviceDir, "missing")}}
+		},
+	}
+	for name, mutate := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := validConfig(t)
+			mutate(c)
+			if err := ValidateConfig(c); err == nil {
+				t.Errorf("Expected error for %+v", c)
+			}
+		})
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"config.yaml": "deviceDir: /tmp/disks\ndebounceMs: 250\n",
+		"config.json": `{"deviceDir": "/tmp/disks", "debounceMs": 250}`,
+	}
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			base := &Config{ResourceNamespace: resourceNamespace, VolumeRegex: `vol-.....$`}
+			c, err := loadConfig(path, base)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.DeviceDir != "/tmp/disks" || c.DebounceMs != 250 {
+				t.Errorf("File settings not applied: %+v", c)
+			}
+			if c.ResourceNamespace != resourceNamespace || c.VolumeRegex != `vol-.....$` {
+				t.Errorf("Defaults not kept: %+v", c)
+			}
+		})
+	}
+}
+
+func TestLoadConfigParseError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(path, &Config{}); err == nil {
+		t.Error("Expected parse error")
+	}
+}
+
+func TestValidateResourceNamespace(t *testing.T) {
+	for _, ns := range []string{"volumes.brightbox.com", "example-1.org", "local"} {
+		if err := ValidateResourceNamespace(ns); err != nil {
+			t.Errorf("Expected %q to be valid, got %s", ns, err)
+		}
+	}
+	for _, ns := range []string{"", "Volumes.Brightbox.com", "volumes/brightbox", "volumes_brightbox", "volumes brightbox"} {
+		if err := ValidateResourceNamespace(ns); err == nil {
+			t.Errorf("Expected %q to be rejected", ns)
+		}
+	}
+}
+
+func TestValidateAppArmorProfile(t *testing.T) {
+	for _, profile := range []string{"runtime/default", "unconfined", "localhost/block-devices", "localhost/usr.bin.dd"} {
+		if err := ValidateAppArmorProfile(profile); err != nil {
+			t.Errorf("Expected %q to be valid, got %s", profile, err)
+		}
+	}
+	for _, profile := range []string{"", "block-devices", "localhost/", "localhost/bad profile", "runtime/other", "docker-default"} {
+		if err := ValidateAppArmorProfile(profile); err == nil {
+			t.Errorf("Expected %q to be rejected", profile)
+		}
+	}
+}
+
+func TestValidateSELinuxLabel(t *testing.T) {
+	for _, label := range []string{
+		"system_u:object_r:fixed_disk_device_t:s0",
+		"system_u:object_r:container_file_t:s0:c1,c2",
+		"system_u:object_r:fixed_disk_device_t:s0-s0:c0.c1023",
+	} {
+		if err := ValidateSELinuxLabel(label); err != nil {
+			t.Errorf("Expected %q to be valid, got %s", label, err)
+		}
+	}
+	for _, label := range []string{"", "fixed_disk_device_t", "system_u:object_r:fixed_disk_device_t", "system_u:object_r:fixed disk:s0", "system_u:object_r:fixed_disk_device_t:c1"} {
+		if err := ValidateSELinuxLabel(label); err == nil {
+			t.Errorf("Expected %q to be rejected", label)
+		}
+	}
+}
+
+func TestResourceNamespaceFromEnv(t *testing.T) {
+	t.Setenv("BRIGHTBOX_RESOURCE_NAMESPACE", "volumes.example.com")
+	config := defaultConfig()
+	if config.ResourceNamespace != "volumes.example.com" {
+		t.Errorf("Expected namespace from the environment, got %q", config.ResourceNamespace)
+	}
+	vl := NewListerWithNamespace(nil, config.ResourceNamespace)
+	if ns := vl.GetResourceNamespace(); ns != "volumes.example.com" {
+		t.Errorf("Expected lister namespace from the environment, got %q", ns)
+	}
+}
+
+func TestDeviceDirFlag(t *testing.T) {
+	if dir := defaultConfig().DeviceDir; dir != volwatch.DefaultDeviceDir {
+		t.Errorf("Expected default device directory, got %q", dir)
+	}
+	dir := t.TempDir()
+	if err := flag.Set("device-dir", dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { flag.Set("device-dir", volwatch.DefaultDeviceDir) })
+	if config := defaultConfig(); config.DeviceDir != dir {
+		t.Errorf("Expected device directory %q from the flag, got %q", dir, config.DeviceDir)
+	}
+}
+
+func TestResourceNamespaceDefault(t *testing.T) {
+	t.Setenv("BRIGHTBOX_RESOURCE_NAMESPACE", "")
+	if ns := defaultConfig().ResourceNamespace; ns != resourceNamespace {
+		t.Errorf("Expected built in namespace, got %q", ns)
+	}
+}
+
+func TestExtraNamespacesFlag(t *testing.T) {
+	var l extraNamespaceList
+	if err := l.Set("ssd.example.com::ssd-.....$,nvme.example.com:/dev/disk/by-id:(?:nvme)-.....$"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Set("local.example.com:/tmp:lv-.....$"); err != nil {
+		t.Fatal(err)
+	}
+	expected := extraNamespaceList{
+		{Namespace: "ssd.example.com", VolumeRegex: `ssd-.....$`},
+		{Namespace: "nvme.example.com", VolumeRegex: `(?:nvme)-.....$`, WatchDir: "/dev/disk/by-id"},
+		{Namespace: "local.example.com", VolumeRegex: `lv-.....$`, WatchDir: "/tmp"},
+	}
+	if !slices.Equal(l, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, l)
+	}
+	if l.String() != "ssd.example.com::ssd-.....$,nvme.example.com:/dev/disk/by-id:(?:nvme)-.....$,local.example.com:/tmp:lv-.....$" {
+		t.Errorf("Unexpected flag value %q", l.String())
+	}
+	if err := l.Set("ssd.example.com"); err == nil {
+		t.Error("Expected error for an entry without a regex")
+	}
+}
+
+func TestLoadConfigExtraNamespaces(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	content := "extraNamespaces:\n  - namespace: ssd.example.com\n    volumeRegex: 'ssd-.{5}$'\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := loadConfig(path, validConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ExtraNamespaceConfig{{Namespace: "ssd.example.com", VolumeRegex: `ssd-.{5}$`}}
+	if !slices.Equal(c.ExtraNamespaces, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, c.ExtraNamespaces)
+	}
+	if err := ValidateConfig(c); err != nil {
+		t.Errorf("Expected valid config, got %s", err)
+	}
+}
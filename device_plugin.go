@@ -2,12 +2,30 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"golang.org/x/exp/maps"
 	"golang.org/x/exp/slices"
 
+	"github.com/brightbox/brightbox-volume-device-plugin/cdi"
+	"github.com/brightbox/brightbox-volume-device-plugin/logging"
+	"github.com/brightbox/brightbox-volume-device-plugin/metrics"
+	"github.com/brightbox/brightbox-volume-device-plugin/tracing"
 	"github.com/brightbox/brightbox-volume-device-plugin/volwatch"
 	"github.com/fsnotify/fsnotify"
-	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
@@ -15,14 +33,292 @@ type volumeDevicePlugin struct {
 	volumeID     string
 	volumeUpdate chan Completion
 	volLister    *VolumeLister
+	sysBlockDir  string
+	idDevicePath func(string) (string, error)
+	resolvePath  func(string) (string, error)
+	volRe        *regexp.Regexp
+	preStart     bool
+	permissions  string
+	annotations  AnnotationStore
+	pods         PodAnnotationStore
+	injectEnv    bool
+	topology     NodeTopology
+	cloud        CloudClient
+	multipath    bool
+	allocations  Allocations
+	tracer       tracing.Tracer
+	dryRun       bool
+
+	openTimeout  time.Duration
+	openInterval time.Duration
+	openDevice   func(string) error
+	cdiDir       string
+	apparmor     string
+	selinuxLabel string
+
+	healthInterval time.Duration
+	healthUpdate   chan string
+	stopHealth     chan struct{}
+	healthDone     sync.WaitGroup
+
+	cloudHealth         CloudClient
+	cloudHealthInterval time.Duration
+
+	statsInterval time.Duration
+	stopStats     chan struct{}
+	statsDone     sync.WaitGroup
+
+	keepaliveInterval time.Duration
+
+	reserved atomic.Bool // counted against the lister's maximum volumes
+	thin     atomic.Bool // counted in metrics.ThinProvisionedVolumes
+}
+
+// PluginOption configures a volumeDevicePlugin at construction time
+type PluginOption func(*volumeDevicePlugin)
+
+// WithSysBlockDir sets the directory listing the block devices known to
+// the kernel, used to decide whether a volume is fully enumerated
+func WithSysBlockDir(dir string) PluginOption {
+	return func(vdp *volumeDevicePlugin) {
+		vdp.sysBlockDir = dir
+	}
+}
+
+// WithPreStartCheck asks kubelet to call PreStartContainer before each
+// container start, which verifies the allocated devices can be opened
+func WithPreStartCheck(enabled bool) PluginOption {
+	return func(vdp *volumeDevicePlugin) {
+		vdp.preStart = enabled
+	}
+}
+
+// WithDefaultPermissions sets the device permissions used when no node
+// annotation overrides them. See validPermissions for accepted values.
+func WithDefaultPermissions(permissions string) PluginOption {
+	return func(vdp *volumeDevicePlugin) {
+		vdp.permissions = permissions
+	}
+}
+
+// WithAnnotationStore supplies the node annotations consulted for per
+// volume permission overrides
+func WithAnnotationStore(store AnnotationStore) PluginOption {
+	return func(vdp *volumeDevicePlugin) {
+		vdp.annotations = store
+	}
+}
+
+// WithPodAnnotationStore supplies the pod annotations consulted for per
+// volume container path overrides
+func WithPodAnnotationStore(store PodAnnotationStore) PluginOption {
+	return func(vdp *volumeDevicePlugin) {
+		vdp.pods = store
+	}
+}
+
+// WithInjectEnv controls whether allocated containers are given
+// environment variables describing their volumes
+func WithInjectEnv(enabled bool) PluginOption {
+	return func(vdp *volumeDevicePlugin) {
+		vdp.injectEnv = enabled
+	}
+}
+
+// WithNodeTopology supplies the topology of the node the plugin runs on
+func WithNodeTopology(topology NodeTopology) PluginOption {
+	return func(vdp *volumeDevicePlugin) {
+		vdp.topology = topology
+	}
+}
+
+// WithCloudClient annotates each container given a volume with the
+// volume's description, server and zone from Brightbox Cloud
+func WithCloudClient(client CloudClient) PluginOption {
+	return func(vdp *volumeDevicePlugin) {
+		vdp.cloud = client
+	}
+}
+
+// WithHealthCheckInterval periodically checks the volume's block device
+// and reports it to kubelet as unhealthy while it is missing. A zero
+// interval disables the check.
+func WithHealthCheckInterval(interval time.Duration) PluginOption {
+	return func(vdp *volumeDevicePlugin) {
+		vdp.healthInterval = interval
+	}
+}
+
+// WithCloudHealthChecker periodically asks Brightbox Cloud for the
+// volume's status and reports the volume to kubelet as unhealthy while
+// it has failed. A zero interval disables the check.
+func WithCloudHealthChecker(client CloudClient, interval time.Duration) PluginOption {
+	return func(vdp *volumeDevicePlugin) {
+		vdp.cloudHealth = client
+		vdp.cloudHealthInterval = interval
+		if client == nil {
+			vdp.cloudHealthInterval = 0
+		}
+	}
+}
+
+// WithStatsInterval periodically reads the I/O statistics of the
+// volume's block device into the volume read and write byte metrics. A
+// zero interval disables collection.
+func WithStatsInterval(interval time.Duration) PluginOption {
+	return func(vdp *volumeDevicePlugin) {
+		vdp.statsInterval = interval
+	}
+}
+
+// WithKeepaliveInterval resends the current device list to kubelet
+// every interval, even when nothing has changed, so a stalled
+// ListAndWatch stream is noticed and the plugin re-registered. A zero
+// interval disables keepalives.
+func WithKeepaliveInterval(interval time.Duration) PluginOption {
+	return func(vdp *volumeDevicePlugin) {
+		vdp.keepaliveInterval = interval
+	}
+}
+
+// WithMultipathSupport also exposes the underlying paths of volumes
+// attached via multipath, whose symlink resolves to a device-mapper node
+func WithMultipathSupport(enabled bool) PluginOption {
+	return func(vdp *volumeDevicePlugin) {
+		vdp.multipath = enabled
+	}
+}
+
+// WithAllocationTracker rejects allocation of a volume that is already
+// allocated, according to the shared tracker. Without a tracker a volume
+// may be allocated any number of times.
+func WithAllocationTracker(tracker Allocations) PluginOption {
+	return func(vdp *volumeDevicePlugin) {
+		vdp.allocations = tracker
+	}
+}
+
+// WithTracer records spans for Allocate and ListAndWatch with a tracer
+// from tp. Without it nothing is recorded.
+func WithTracer(tp tracing.TracerProvider) PluginOption {
+	return func(vdp *volumeDevicePlugin) {
+		vdp.tracer = tp.Tracer(tracerName)
+	}
+}
+
+// WithDryRun logs the devices each allocation would supply but returns
+// none, and reports volumes as healthy without resolving their device
+// symlinks. It exercises the plugin's logic on nodes without the
+// volumes attached and must not be used in production.
+func WithDryRun(enabled bool) PluginOption {
+	return func(vdp *volumeDevicePlugin) {
+		vdp.dryRun = enabled
+	}
+}
+
+// WithDeviceOpenWait makes Allocate wait up to timeout for each volume's
+// block device to be openable, retrying every interval while the kernel
+// reports it is not yet initialised. A zero timeout disables the wait.
+func WithDeviceOpenWait(timeout time.Duration, interval time.Duration) PluginOption {
+	return func(vdp *volumeDevicePlugin) {
+		vdp.openTimeout = timeout
+		if interval > 0 {
+			vdp.openInterval = interval
+		}
+	}
+}
+
+// WithCDIOutputDir makes Allocate also write a Container Device
+// Interface spec for each allocated volume to dir, giving the same
+// device nodes and environment variables as the Allocate response. The
+// spec is removed again when the plugin stops. An empty dir writes no
+// specs.
+func WithCDIOutputDir(dir string) PluginOption {
+	return func(vdp *volumeDevicePlugin) {
+		vdp.cdiDir = dir
+	}
+}
+
+// WithAppArmorProfile asks the container runtime to run containers
+// given volumes under the AppArmor profile, which should have passed
+// ValidateAppArmorProfile. An empty profile leaves the runtime's choice
+// alone.
+func WithAppArmorProfile(profile string) PluginOption {
+	return func(vdp *volumeDevicePlugin) {
+		vdp.apparmor = profile
+	}
+}
+
+// WithSELinuxLabel asks kubelet to relabel each device given to a
+// container with label, which should have passed ValidateSELinuxLabel.
+// An empty label leaves the devices' labels alone.
+func WithSELinuxLabel(label string) PluginOption {
+	return func(vdp *volumeDevicePlugin) {
+		vdp.selinuxLabel = label
+	}
+}
+
+// WithVolumeIDRegex makes Allocate accept volume IDs matching re, the
+// pattern the volumes were found with, in place of the default pattern
+func WithVolumeIDRegex(re *regexp.Regexp) PluginOption {
+	return func(vdp *volumeDevicePlugin) {
+		vdp.volRe = re
+	}
+}
+
+// withDeviceOpener substitutes the check that a device node can be opened
+func withDeviceOpener(fn func(string) error) PluginOption {
+	return func(vdp *volumeDevicePlugin) {
+		vdp.openDevice = fn
+	}
+}
+
+// withIDDevicePath substitutes the mapping from volume ID to device symlink
+func withIDDevicePath(fn func(string) (string, error)) PluginOption {
+	return func(vdp *volumeDevicePlugin) {
+		vdp.idDevicePath = fn
+	}
+}
+
+// withDeviceResolver substitutes the mapping from volume ID to device
+// node, such as a watcher's cached ResolveDevicePath, for following the
+// symlink given by the idDevicePath mapping
+func withDeviceResolver(fn func(string) (string, error)) PluginOption {
+	return func(vdp *volumeDevicePlugin) {
+		vdp.resolvePath = fn
+	}
+}
+
+func newVolumeDevicePlugin(volumeID string, vl *VolumeLister, opts ...PluginOption) *volumeDevicePlugin {
+	vdp := &volumeDevicePlugin{
+		volumeID:     volumeID,
+		volumeUpdate: make(chan Completion),
+		healthUpdate: make(chan string),
+		volLister:    vl,
+		sysBlockDir:  sysBlockDir,
+		idDevicePath: volwatch.IDDevicePath,
+		volRe:        volwatch.DefaultVolumeRegex(),
+		permissions:  defaultPermissions,
+		injectEnv:    true,
+		openInterval: defaultDeviceOpenInterval,
+		openDevice:   openDevice,
+		tracer:       tracing.NoopTracerProvider().Tracer(tracerName),
+	}
+	for _, opt := range opts {
+		opt(vdp)
+	}
+	return vdp
 }
 
 // GetDevicePluginOptions returns options to be communicated with Device
 // Manager
 func (vdp *volumeDevicePlugin) GetDevicePluginOptions(context.Context, *pluginapi.Empty) (*pluginapi.DevicePluginOptions, error) {
-	glog.V(3).Info("Volume GetDevicePluginOptions Called")
+	logging.V(3).Info("Volume GetDevicePluginOptions Called", "volumeID", vdp.volumeID)
 
-	return &pluginapi.DevicePluginOptions{}, nil
+	return &pluginapi.DevicePluginOptions{
+		PreStartRequired:                vdp.preStart,
+		GetPreferredAllocationAvailable: true,
+	}, nil
 }
 
 func isRemoved(event fsnotify.Event) bool {
@@ -34,59 +330,272 @@ var volMissing = &pluginapi.ListAndWatchResponse{Devices: []*pluginapi.Device{}}
 // Start is executed by Manager after plugin instantiation but before registration with kubelet
 func (vdp *volumeDevicePlugin) Start() error {
 	vdp.volLister.Subscribe(vdp.volumeID, vdp.volumeUpdate)
+	if vdp.healthInterval > 0 || vdp.cloudHealthInterval > 0 {
+		vdp.stopHealth = make(chan struct{})
+		vdp.healthDone.Add(1)
+		go vdp.monitorHealth()
+	}
+	if vdp.statsInterval > 0 {
+		vdp.stopStats = make(chan struct{})
+		vdp.statsDone.Add(1)
+		go vdp.collectStats()
+	}
 	return nil
 }
 
 // Stop is executred by Manager after the plugin is unregistered with kubelet
 func (vdp *volumeDevicePlugin) Stop() error {
 	vdp.volLister.Unsubscribe(vdp.volumeID)
+	if vdp.allocations != nil {
+		vdp.allocations.Release(vdp.volumeID)
+	}
+	vdp.unreserve()
+	if vdp.thin.Swap(false) {
+		metrics.ThinProvisionedVolumes.Add(-1)
+	}
+	if vdp.cdiDir != "" {
+		if err := os.Remove(vdp.cdiSpecPath(vdp.volumeID)); err != nil && !os.IsNotExist(err) {
+			logging.Warn("Unable to remove CDI spec", "volumeID", vdp.volumeID, "err", err)
+		}
+	}
+	if vdp.stopHealth != nil {
+		close(vdp.stopHealth)
+		vdp.healthDone.Wait()
+		vdp.stopHealth = nil
+	}
+	if vdp.stopStats != nil {
+		close(vdp.stopStats)
+		vdp.statsDone.Wait()
+		vdp.stopStats = nil
+		metrics.VolumeReadBytes.Delete(vdp.volumeID)
+		metrics.VolumeWriteBytes.Delete(vdp.volumeID)
+	}
 	return nil
 }
 
-// ListAndWatch returns a stream of List of Devices
-// Whenever a Device state change or a Device disappears, ListAndWatch
-// returns the new list
-func (vdp *volumeDevicePlugin) ListAndWatch(empty *pluginapi.Empty, srv pluginapi.DevicePlugin_ListAndWatchServer) error {
-	glog.V(3).Info("Volume ListAndWatch Called")
-	glog.V(3).Infof("Volume %s: Notifying kubelet", vdp.volumeID)
-	volPresent := &pluginapi.ListAndWatchResponse{
+// monitorHealth checks the block device every health check interval and
+// the volume's status in Brightbox Cloud every cloud health interval,
+// passing any change in health to ListAndWatch. The volume is unhealthy
+// if either check fails.
+func (vdp *volumeDevicePlugin) monitorHealth() {
+	defer vdp.healthDone.Done()
+	logging.V(3).Info("Monitoring device health", "volumeID", vdp.volumeID,
+		"interval", vdp.healthInterval, "cloudInterval", vdp.cloudHealthInterval)
+	var deviceChecks, cloudChecks <-chan time.Time
+	if vdp.healthInterval > 0 {
+		ticker := time.NewTicker(vdp.healthInterval)
+		defer ticker.Stop()
+		deviceChecks = ticker.C
+	}
+	if vdp.cloudHealthInterval > 0 {
+		ticker := time.NewTicker(vdp.cloudHealthInterval)
+		defer ticker.Stop()
+		cloudChecks = ticker.C
+	}
+	// Abandon a cloud lookup waiting on the API rate limit when stopped
+	stop := vdp.stopHealth
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+	current := pluginapi.Healthy
+	deviceHealth, cloudHealth := pluginapi.Healthy, pluginapi.Healthy
+	for {
+		select {
+		case <-vdp.stopHealth:
+			logging.V(3).Info("Stopping device health monitor", "volumeID", vdp.volumeID)
+			return
+		case <-deviceChecks:
+			deviceHealth = vdp.deviceHealth()
+		case <-cloudChecks:
+			cloudHealth = vdp.cloudVolumeHealth(ctx, cloudHealth)
+		}
+		health := pluginapi.Healthy
+		if deviceHealth != pluginapi.Healthy || cloudHealth != pluginapi.Healthy {
+			health = pluginapi.Unhealthy
+		}
+		if health == current {
+			continue
+		}
+		logging.V(3).Info("Device health changed", "volumeID", vdp.volumeID, "health", health)
+		select {
+		case vdp.healthUpdate <- health:
+			current = health
+		case <-vdp.stopHealth:
+			return
+		}
+	}
+}
+
+// cloudVolumeHealth reports whether Brightbox Cloud considers the volume
+// usable. An API failure says nothing about the volume, so gives the
+// previous health.
+func (vdp *volumeDevicePlugin) cloudVolumeHealth(ctx context.Context, previous string) string {
+	metadata, err := vdp.cloudHealth.GetVolume(ctx, vdp.volumeID)
+	if ctx.Err() != nil {
+		return previous
+	}
+	if err != nil {
+		logging.Warn("Unable to fetch volume status", "volumeID", vdp.volumeID, "err", err)
+		return previous
+	}
+	if metadata.Status == volumeStatusFailed {
+		logging.V(4).Info("Volume has failed", "volumeID", vdp.volumeID)
+		return pluginapi.Unhealthy
+	}
+	return pluginapi.Healthy
+}
+
+// collectStats updates the volume's read and write byte metrics every
+// stats interval
+func (vdp *volumeDevicePlugin) collectStats() {
+	defer vdp.statsDone.Done()
+	logging.V(3).Info("Collecting device statistics", "volumeID", vdp.volumeID, "interval", vdp.statsInterval)
+	ticker := time.NewTicker(vdp.statsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-vdp.stopStats:
+			logging.V(3).Info("Stopping device statistics collection", "volumeID", vdp.volumeID)
+			return
+		case <-ticker.C:
+			vdp.updateStats()
+		}
+	}
+}
+
+// updateStats copies the block device's I/O totals into the volume
+// metrics. A missing device leaves the last values in place.
+func (vdp *volumeDevicePlugin) updateStats() {
+	if vdp.dryRun {
+		return
+	}
+	target, err := vdp.resolveDevice(vdp.volumeID)
+	if err != nil {
+		logging.V(4).Info("Unable to find device for statistics", "volumeID", vdp.volumeID, "err", err)
+		return
+	}
+	stats, err := volwatch.CollectStatsIn(vdp.sysBlockDir, target)
+	if err != nil {
+		logging.V(4).Info("Unable to read device statistics", "volumeID", vdp.volumeID, "err", err)
+		return
+	}
+	metrics.VolumeReadBytes.WithLabelValue(vdp.volumeID).Set(stats.ReadBytes)
+	metrics.VolumeWriteBytes.WithLabelValue(vdp.volumeID).Set(stats.WriteBytes)
+}
+
+// deviceHealth reports whether the block device behind the volume's
+// symlink is present
+func (vdp *volumeDevicePlugin) deviceHealth() string {
+	if vdp.dryRun {
+		return pluginapi.Healthy
+	}
+	devicePath, err := vdp.resolveDevice(vdp.volumeID)
+	if err == nil {
+		_, err = os.Stat(devicePath)
+	}
+	if err != nil {
+		logging.V(4).Info("Device check failed", "volumeID", vdp.volumeID, "err", err)
+		return pluginapi.Unhealthy
+	}
+	return pluginapi.Healthy
+}
+
+// deviceList builds a ListAndWatch response for the volume with the given
+// health
+func (vdp *volumeDevicePlugin) deviceList(health string) *pluginapi.ListAndWatchResponse {
+	return &pluginapi.ListAndWatchResponse{
 		Devices: []*pluginapi.Device{
-			&pluginapi.Device{
+			{
 				ID:     vdp.volumeID,
-				Health: pluginapi.Healthy,
+				Health: health,
 			},
 		},
 	}
-	if err := srv.Send(volPresent); err != nil {
-		glog.V(3).Infof("Volume %s: Failed to send volume present: %s", vdp.volumeID, err)
+}
+
+// ListAndWatch returns a stream of List of Devices
+// Whenever a Device state change or a Device disappears, ListAndWatch
+// returns the new list
+func (vdp *volumeDevicePlugin) ListAndWatch(empty *pluginapi.Empty, srv pluginapi.DevicePlugin_ListAndWatchServer) error {
+	_, span := vdp.startSpan(srv.Context(), "ListAndWatch")
+	defer span.End()
+	span.SetAttributes(
+		tracing.String("volume.id", vdp.volumeID),
+		tracing.String("device.path", vdp.devicePath(vdp.volumeID)),
+	)
+	err := vdp.listAndWatch(srv)
+	if err != nil {
+		span.RecordError(err)
+	}
+	return err
+}
+
+func (vdp *volumeDevicePlugin) listAndWatch(srv pluginapi.DevicePlugin_ListAndWatchServer) error {
+	logging.V(3).Info("Volume ListAndWatch Called, notifying kubelet", "volumeID", vdp.volumeID)
+	if err := srv.Send(vdp.deviceList(pluginapi.Healthy)); err != nil {
+		logging.V(3).Info("Failed to send volume present", "volumeID", vdp.volumeID, "err", err)
 		return err
 	}
-	glog.V(3).Infof("Volume %s: Waiting for updates", vdp.volumeID)
+	if vdp.volLister != nil {
+		vdp.volLister.markReady()
+	}
+	current := pluginapi.Healthy
+	var keepalive <-chan time.Time
+	if vdp.keepaliveInterval > 0 {
+		ticker := time.NewTicker(vdp.keepaliveInterval)
+		defer ticker.Stop()
+		keepalive = ticker.C
+	}
+	logging.V(3).Info("Waiting for updates", "volumeID", vdp.volumeID)
 	for {
 		select {
 		case <-vdp.volLister.Done():
-			glog.V(3).Infof("Volume %s: Exiting ListAndWatch: %s\n", vdp.volumeID, vdp.volLister.Err())
+			logging.V(3).Info("Exiting ListAndWatch", "volumeID", vdp.volumeID, "reason", vdp.volLister.Err())
 			err := srv.Send(volMissing)
 			if err != nil {
-				glog.V(3).Infof("Volume %s: Failed to send volume missing: %s", vdp.volumeID, err)
+				logging.V(3).Info("Failed to send volume missing", "volumeID", vdp.volumeID, "err", err)
 				return err
 			}
 			return vdp.volLister.Err()
 		case completion, ok := <-vdp.volumeUpdate:
-			glog.V(3).Infof("Volume %s: Received update", vdp.volumeID)
 			if !(ok && slices.Contains(completion.Volumes, vdp.volumeID)) {
-				glog.V(3).Infof("Volume %s: missing from list, updating and exiting", vdp.volumeID)
+				logging.V(3).Info("Received update without volume, updating and exiting", "volumeID", vdp.volumeID)
 				err := srv.Send(volMissing)
-				completion.CompleteFunc()
+				completion.CompleteFunc(err)
 				if err != nil {
-					glog.V(3).Infof("Volume %s: Failed to send volume missing: %s", vdp.volumeID, err)
+					logging.V(3).Info("Failed to send volume missing", "volumeID", vdp.volumeID, "err", err)
 					return err
 				}
 				return nil
 			}
-			completion.CompleteFunc()
-			glog.V(3).Infof("Volume %s: still in list", vdp.volumeID)
-			glog.V(3).Infof("Volume %s: Waiting for updates", vdp.volumeID)
+			var err error
+			if !vdp.dryRun {
+				_, err = vdp.resolveDevice(vdp.volumeID)
+				if err != nil {
+					logging.V(3).Info("Failed to resolve device path", "volumeID", vdp.volumeID, "err", err)
+				}
+			}
+			completion.CompleteFunc(err)
+			logging.V(3).Info("Received update with volume still in list, waiting for updates", "volumeID", vdp.volumeID)
+		case health := <-vdp.healthUpdate:
+			logging.V(3).Info("Notifying kubelet of device health", "volumeID", vdp.volumeID, "health", health)
+			if err := srv.Send(vdp.deviceList(health)); err != nil {
+				logging.V(3).Info("Failed to send device health", "volumeID", vdp.volumeID, "err", err)
+				return err
+			}
+			current = health
+		case <-keepalive:
+			logging.V(4).Info("Sending keepalive", "volumeID", vdp.volumeID, "health", current)
+			if err := srv.Send(vdp.deviceList(current)); err != nil {
+				logging.V(3).Info("Failed to send keepalive", "volumeID", vdp.volumeID, "err", err)
+				return err
+			}
 		}
 	}
 }
@@ -96,41 +605,694 @@ func (vdp *volumeDevicePlugin) ListAndWatch(empty *pluginapi.Empty, srv pluginap
 // guaranteed to be the allocation ultimately performed by the
 // devicemanager. It is only designed to help the devicemanager make a more
 // informed allocation decision when possible.
-func (vdp *volumeDevicePlugin) GetPreferredAllocation(context.Context, *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
-	return nil, nil
+//
+// Devices whose block device has already appeared in /sys/block are
+// preferred over those the kernel is still enumerating.
+//
+// The device plugin API can only express NUMA topology, so the node's
+// zone is logged alongside the preference rather than returned as a hint.
+func (vdp *volumeDevicePlugin) GetPreferredAllocation(ctx context.Context, request *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
+	logging.V(3).Info("Volume GetPreferredAllocation Called", "volumeID", vdp.volumeID)
+	logging.V(4).Info("Request received", "requests", request.ContainerRequests)
+
+	resp := new(pluginapi.PreferredAllocationResponse)
+	zone := vdp.zone()
+
+	for _, container := range request.ContainerRequests {
+		deviceIDs := vdp.preferredDevices(container)
+		logging.V(4).Info("Preferring devices", "devices", deviceIDs, "zone", zone)
+		resp.ContainerResponses = append(resp.ContainerResponses,
+			&pluginapi.ContainerPreferredAllocationResponse{
+				DeviceIDs: deviceIDs,
+			},
+		)
+	}
+
+	return resp, nil
+}
+
+// zone returns the node's zone, or an empty string if it is unknown
+func (vdp *volumeDevicePlugin) zone() string {
+	if vdp.topology == nil {
+		return ""
+	}
+	zone, err := vdp.topology.Zone()
+	if err != nil {
+		logging.Warn("Unable to determine node zone", "err", err)
+		return ""
+	}
+	return zone
+}
+
+// preferredDevices orders the must-include devices first, followed by
+// the ready devices, trimmed to the allocation size. If no available
+// device is ready there is no preference and all are returned.
+func (vdp *volumeDevicePlugin) preferredDevices(container *pluginapi.ContainerPreferredAllocationRequest) []string {
+	result := slices.Clone(container.MustIncludeDeviceIDs)
+	ready := 0
+	for _, id := range container.AvailableDeviceIDs {
+		if slices.Contains(result, id) {
+			continue
+		}
+		if vdp.isReady(id) {
+			result = append(result, id)
+			ready++
+		} else {
+			logging.V(4).Info("Block device not yet enumerated", "volumeID", id)
+		}
+	}
+	if ready == 0 {
+		return container.AvailableDeviceIDs
+	}
+	if size := int(container.AllocationSize); size > 0 && len(result) > size {
+		result = result[:size]
+	}
+	return result
+}
+
+// devicePath gives the volume's device symlink, whether or not it exists
+func (vdp *volumeDevicePlugin) devicePath(id string) string {
+	path, _ := vdp.idDevicePath(id)
+	return path
+}
+
+// resolveDevice follows the volume's device symlink to the device node
+// behind it. Gives an error wrapping volwatch.ErrDeviceNotFound if there
+// is no symlink and volwatch.ErrCircularSymlink if the links loop.
+func (vdp *volumeDevicePlugin) resolveDevice(id string) (string, error) {
+	if vdp.resolvePath != nil {
+		return vdp.resolvePath(id)
+	}
+	symlink, err := vdp.idDevicePath(id)
+	if err != nil {
+		return "", err
+	}
+	target, err := volwatch.ResolveSymlink(symlink, maxSymlinkDepth)
+	if err != nil {
+		return "", fmt.Errorf("volume %s: %w", id, err)
+	}
+	return target, nil
+}
+
+// isReady reports whether the device symlink for id resolves to a block
+// device known to the kernel
+func (vdp *volumeDevicePlugin) isReady(id string) bool {
+	target, err := vdp.resolveDevice(id)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(filepath.Join(vdp.sysBlockDir, filepath.Base(target)))
+	return err == nil
 }
 
 // Allocate is called during container creation so that the Device
 // Plugin can run device specific operations and instruct Kubelet
 // of the steps to make the Device available in the container
 func (vdp *volumeDevicePlugin) Allocate(ctx context.Context, request *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
-	glog.V(3).Info("Volume Allocate Called")
-	glog.V(4).Infof("Request is %#v", request.ContainerRequests)
+	_, span := vdp.startSpan(ctx, "Allocate")
+	defer span.End()
+	span.SetAttributes(
+		tracing.String("volume.id", vdp.volumeID),
+		tracing.Int("container.count", len(request.ContainerRequests)),
+	)
+	resp, err := vdp.allocate(ctx, request)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	var paths []string
+	for _, container := range resp.ContainerResponses {
+		for _, device := range container.Devices {
+			paths = append(paths, device.HostPath)
+		}
+	}
+	span.SetAttributes(tracing.String("device.path", strings.Join(paths, ",")))
+	return resp, nil
+}
+
+func (vdp *volumeDevicePlugin) allocate(ctx context.Context, request *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
+	logging.V(3).Info("Volume Allocate Called", "volumeID", vdp.volumeID)
+	metrics.AllocateRequests.Inc()
+	logging.V(4).Info("Request received", "requests", request.ContainerRequests)
 
 	resp := new(pluginapi.AllocateResponse)
+	cdiDevices := make(map[string][]*pluginapi.DeviceSpec)
 
 	for _, container := range request.ContainerRequests {
 		containerResponse := new(pluginapi.ContainerAllocateResponse)
 		for _, id := range container.DevicesIDs {
-			idMountPath := volwatch.IDDevicePath(id)
-			glog.V(4).Infof("supplying mount at %q", idMountPath)
+			if err := volwatch.ValidateVolumeIDMatching(id, vdp.volRe); err != nil {
+				logging.Error("Rejecting allocation", "volumeID", id, "err", err)
+				metrics.AllocateErrors.Inc()
+				return nil, err
+			}
+			if vdp.openTimeout > 0 && !vdp.dryRun {
+				if err := vdp.waitForDevice(ctx, id); err != nil {
+					logging.Error("Device not ready", "volumeID", id, "err", err)
+					metrics.AllocateErrors.Inc()
+					return nil, err
+				}
+				if err := vdp.waitForBlockDevice(id); err != nil {
+					logging.Error("Block device not ready", "volumeID", id, "err", err)
+					metrics.AllocateErrors.Inc()
+					return nil, err
+				}
+			}
+			idMountPath := vdp.devicePath(id)
+			permissions, err := vdp.devicePermissions(id)
+			if err != nil {
+				logging.Error("Unable to determine device permissions", "volumeID", id, "err", err)
+				metrics.AllocateErrors.Inc()
+				return nil, err
+			}
+			containerPath, err := vdp.containerPath(id)
+			if err != nil {
+				logging.Error("Unable to determine container path", "volumeID", id, "err", err)
+				metrics.AllocateErrors.Inc()
+				return nil, err
+			}
+			logging.V(4).Info("Supplying mount", "path", idMountPath, "containerPath", containerPath, "permissions", permissions)
+			first := len(containerResponse.Devices)
 			containerResponse.Devices = append(containerResponse.Devices,
 				&pluginapi.DeviceSpec{
-					ContainerPath: idMountPath,
+					ContainerPath: containerPath,
 					HostPath:      idMountPath,
-					Permissions:   "rw",
+					Permissions:   permissions,
 				},
 			)
+			if vdp.dryRun {
+				continue
+			}
+			containerResponse.Devices = append(containerResponse.Devices,
+				vdp.nvmeDevices(id, permissions)...)
+			if vdp.multipath {
+				containerResponse.Devices = append(containerResponse.Devices,
+					vdp.multipathDevices(id, permissions)...)
+			}
+			cdiDevices[id] = containerResponse.Devices[first:]
 		}
+		if vdp.dryRun {
+			resp.ContainerResponses = append(resp.ContainerResponses, containerResponse)
+			continue
+		}
+		if vdp.injectEnv {
+			containerResponse.Envs = vdp.volumeEnvs(container.DevicesIDs)
+		}
+		containerResponse.Annotations = vdp.deviceAnnotations(container.DevicesIDs)
+		if vdp.apparmor != "" {
+			containerResponse.Annotations[appArmorAnnotation] = vdp.apparmor
+		}
+		vdp.addSELinuxAnnotations(containerResponse)
+		vdp.addCloudAnnotations(ctx, containerResponse, container.DevicesIDs)
 		resp.ContainerResponses = append(resp.ContainerResponses, containerResponse)
 	}
+	if vdp.dryRun {
+		return vdp.dryRunResponse(resp), nil
+	}
+	reserved, err := vdp.reserve()
+	if err != nil {
+		logging.Error("Rejecting allocation", "volumeID", vdp.volumeID, "err", err)
+		metrics.AllocateErrors.Inc()
+		return nil, err
+	}
+	if err := vdp.claim(request); err != nil {
+		if reserved {
+			vdp.unreserve()
+		}
+		logging.Error("Rejecting allocation", "volumeID", vdp.volumeID, "err", err)
+		metrics.AllocateErrors.Inc()
+		return nil, err
+	}
+	vdp.checkThinProvisioning()
+	if vdp.cdiDir != "" {
+		for id, devices := range cdiDevices {
+			if err := vdp.writeCDISpec(id, devices); err != nil {
+				logging.Warn("Unable to write CDI spec", "volumeID", id, "err", err)
+			}
+		}
+	}
 
 	return resp, nil
 }
 
+// writeCDISpec writes a CDI spec for the volume giving the container the
+// devices, along with the volume's environment variables if they are
+// being injected
+func (vdp *volumeDevicePlugin) writeCDISpec(id string, devices []*pluginapi.DeviceSpec) error {
+	var edits cdi.ContainerEdits
+	for _, device := range devices {
+		edits.DeviceNodes = append(edits.DeviceNodes, &cdi.DeviceNode{
+			Path:        device.ContainerPath,
+			HostPath:    device.HostPath,
+			Permissions: device.Permissions,
+		})
+	}
+	if vdp.injectEnv {
+		envs := vdp.volumeEnvs([]string{id})
+		names := maps.Keys(envs)
+		slices.Sort(names)
+		for _, name := range names {
+			edits.Env = append(edits.Env, name+"="+envs[name])
+		}
+	}
+	spec := &cdi.Spec{
+		Version: cdi.CurrentVersion,
+		Kind:    cdiKind,
+		Devices: []cdi.Device{{Name: id, ContainerEdits: edits}},
+	}
+	logging.V(4).Info("Writing CDI spec", "volumeID", id, "device", cdi.QualifiedName(cdiKind, id))
+	return cdi.WriteSpec(vdp.cdiDir, cdiSpecName(id), spec)
+}
+
+// cdiSpecName gives the name of the CDI spec file for the volume, without
+// the extension
+func cdiSpecName(id string) string {
+	return strings.ReplaceAll(cdiKind, "/", "-") + "-" + id
+}
+
+// cdiSpecPath gives the path of the CDI spec file for the volume
+func (vdp *volumeDevicePlugin) cdiSpecPath(id string) string {
+	return filepath.Join(vdp.cdiDir, cdiSpecName(id)+".json")
+}
+
+// dryRunResponse logs the devices resp would supply to each container
+// and returns a response supplying none
+func (vdp *volumeDevicePlugin) dryRunResponse(resp *pluginapi.AllocateResponse) *pluginapi.AllocateResponse {
+	result := new(pluginapi.AllocateResponse)
+	for i, container := range resp.ContainerResponses {
+		for _, device := range container.Devices {
+			logging.Info("Dry run: not allocating device", "volumeID", vdp.volumeID, "container", i,
+				"path", device.HostPath, "permissions", device.Permissions)
+		}
+		result.ContainerResponses = append(result.ContainerResponses, new(pluginapi.ContainerAllocateResponse))
+	}
+	return result
+}
+
+// reserve counts the plugin's volume against the lister's maximum the
+// first time it is allocated, reporting whether this call counted it
+func (vdp *volumeDevicePlugin) reserve() (bool, error) {
+	if vdp.volLister == nil || !vdp.reserved.CompareAndSwap(false, true) {
+		return false, nil
+	}
+	if err := vdp.volLister.reserveVolume(vdp.volumeID); err != nil {
+		vdp.reserved.Store(false)
+		return false, err
+	}
+	return true, nil
+}
+
+// unreserve undoes a reservation made by reserve
+func (vdp *volumeDevicePlugin) unreserve() {
+	if vdp.reserved.Swap(false) {
+		vdp.volLister.releaseVolume()
+	}
+}
+
+// checkThinProvisioning warns if the plugin's volume has just been
+// allocated on a thin provisioned block device, which may run out of
+// space before the volume fills, and counts it in the metrics until the
+// plugin stops
+func (vdp *volumeDevicePlugin) checkThinProvisioning() {
+	devicePath, err := vdp.resolveDevice(vdp.volumeID)
+	if err != nil {
+		return
+	}
+	thin, err := volwatch.DetectThinProvisioningIn(vdp.sysBlockDir, devicePath)
+	if err != nil {
+		logging.V(4).Info("Unable to detect thin provisioning", "volumeID", vdp.volumeID, "err", err)
+		return
+	}
+	if !thin {
+		return
+	}
+	logging.Warn("Volume is thin provisioned and may be overcommitted", "volumeID", vdp.volumeID, "device", devicePath)
+	if vdp.thin.CompareAndSwap(false, true) {
+		metrics.ThinProvisionedVolumes.Add(1)
+	}
+}
+
+// claim records every volume in the request with the allocation
+// tracker, if there is one. If any volume is already allocated, those
+// claimed so far are released again and the error returned.
+func (vdp *volumeDevicePlugin) claim(request *pluginapi.AllocateRequest) error {
+	if vdp.allocations == nil {
+		return nil
+	}
+	var claimed []string
+	for _, container := range request.ContainerRequests {
+		for _, id := range container.DevicesIDs {
+			if err := vdp.allocations.Claim(id); err != nil {
+				for _, id := range claimed {
+					vdp.allocations.Release(id)
+				}
+				return err
+			}
+			claimed = append(claimed, id)
+		}
+	}
+	return nil
+}
+
+// nvmeDevices returns a spec for the controller character device if the
+// volume's symlink resolves to an NVMe namespace, e.g. /dev/nvme0 for
+// /dev/nvme0n1, and nothing otherwise
+func (vdp *volumeDevicePlugin) nvmeDevices(id string, permissions string) []*pluginapi.DeviceSpec {
+	target, err := vdp.resolveDevice(id)
+	if err != nil || !volwatch.IsNVMe(target) {
+		return nil
+	}
+	controller := target[:strings.LastIndex(target, "n")]
+	logging.V(4).Info("Supplying NVMe controller", "volumeID", id, "path", controller, "permissions", permissions)
+	return []*pluginapi.DeviceSpec{
+		{
+			ContainerPath: controller,
+			HostPath:      controller,
+			Permissions:   permissions,
+		},
+	}
+}
+
+// multipathDevices returns a spec for each path underlying the volume if
+// its symlink resolves to a device-mapper node, and nothing otherwise.
+// The paths are found in the node's slaves directory in /sys/block.
+func (vdp *volumeDevicePlugin) multipathDevices(id string, permissions string) []*pluginapi.DeviceSpec {
+	target, err := vdp.resolveDevice(id)
+	if err != nil {
+		logging.Warn("Unable to resolve device path", "volumeID", id, "err", err)
+		return nil
+	}
+	name := filepath.Base(target)
+	if !strings.HasPrefix(name, "dm-") {
+		return nil
+	}
+	slaves, err := os.ReadDir(filepath.Join(vdp.sysBlockDir, name, "slaves"))
+	if err != nil {
+		logging.Warn("Unable to read multipath devices", "volumeID", id, "device", target, "err", err)
+		return nil
+	}
+	var result []*pluginapi.DeviceSpec
+	for _, slave := range slaves {
+		path := filepath.Join(filepath.Dir(target), slave.Name())
+		logging.V(4).Info("Supplying multipath device", "volumeID", id, "path", path, "permissions", permissions)
+		result = append(result, &pluginapi.DeviceSpec{
+			ContainerPath: path,
+			HostPath:      path,
+			Permissions:   permissions,
+		})
+	}
+	return result
+}
+
+// startSpan starts a span for an RPC, continuing the trace in any
+// traceparent header sent by the caller
+func (vdp *volumeDevicePlugin) startSpan(ctx context.Context, name string) (context.Context, tracing.Span) {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("traceparent"); len(values) > 0 {
+			parent, err := tracing.ContextWithRemoteParent(ctx, values[0])
+			if err != nil {
+				logging.V(4).Info("Ignoring trace context", "err", err)
+			}
+			ctx = parent
+		}
+	}
+	return vdp.tracer.Start(ctx, name)
+}
+
+// volumeEnvs describes the allocated volumes to the container. Each
+// variable holds a comma separated list with one entry per volume, in
+// allocation order.
+func (vdp *volumeDevicePlugin) volumeEnvs(ids []string) map[string]string {
+	devices := make([]string, len(ids))
+	symlinks := make([]string, len(ids))
+	for i, id := range ids {
+		symlinks[i] = vdp.devicePath(id)
+		devicePath, err := vdp.resolveDevice(id)
+		if err != nil {
+			logging.Warn("Unable to resolve device path", "volumeID", id, "err", err)
+			continue
+		}
+		devices[i] = devicePath
+	}
+	return map[string]string{
+		"BRIGHTBOX_VOLUME_ID":      strings.Join(ids, ","),
+		"BRIGHTBOX_VOLUME_DEVICE":  strings.Join(devices, ","),
+		"BRIGHTBOX_VOLUME_SYMLINK": strings.Join(symlinks, ","),
+	}
+}
+
+// deviceAnnotations gives the container runtime the major and minor
+// numbers of the allocated volumes' block devices, so the container can
+// be correlated with the devices on the host, along with the filesystem
+// found on each and its size in bytes. Like the environment variables, each annotation holds a comma
+// separated list with one entry per volume, in allocation order.
+func (vdp *volumeDevicePlugin) deviceAnnotations(ids []string) map[string]string {
+	majors := make([]string, len(ids))
+	minors := make([]string, len(ids))
+	filesystems := make([]string, len(ids))
+	sizes := make([]string, len(ids))
+	for i, id := range ids {
+		devicePath := vdp.devicePath(id)
+		if major, minor, err := volwatch.DeviceMajorMinor(devicePath); err == nil {
+			majors[i] = strconv.FormatUint(uint64(major), 10)
+			minors[i] = strconv.FormatUint(uint64(minor), 10)
+		} else {
+			logging.Warn("Unable to read device numbers", "volumeID", id, "err", err)
+		}
+		if filesystem, err := volwatch.DetectFilesystem(devicePath); err == nil {
+			filesystems[i] = filesystem
+		} else {
+			logging.Warn("Unable to detect filesystem", "volumeID", id, "err", err)
+		}
+		if size, err := volwatch.BlockDeviceSize(devicePath); err == nil {
+			sizes[i] = strconv.FormatInt(size, 10)
+		} else {
+			logging.Warn("Unable to read device size", "volumeID", id, "err", err)
+		}
+	}
+	return map[string]string{
+		resourceNamespace + "/major":      strings.Join(majors, ","),
+		resourceNamespace + "/minor":      strings.Join(minors, ","),
+		resourceNamespace + "/filesystem": strings.Join(filesystems, ","),
+		resourceNamespace + "/size-bytes": strings.Join(sizes, ","),
+	}
+}
+
+// addSELinuxAnnotations adds an annotation for each of the response's
+// devices giving the SELinux label it should be relabelled with, keyed
+// by the name of the device on the host. The device plugin API has no
+// field for this in DeviceSpec.
+func (vdp *volumeDevicePlugin) addSELinuxAnnotations(resp *pluginapi.ContainerAllocateResponse) {
+	if vdp.selinuxLabel == "" {
+		return
+	}
+	for _, device := range resp.Devices {
+		resp.Annotations[selinuxAnnotationPrefix+filepath.Base(device.HostPath)] = vdp.selinuxLabel
+	}
+}
+
+// devicePermissions returns the cgroup device permissions for the volume,
+// taken from the node annotation if there is one and the default
+// otherwise. Annotation lookup failures fall back to the default.
+func (vdp *volumeDevicePlugin) devicePermissions(id string) (string, error) {
+	permissions := vdp.permissions
+	if vdp.annotations != nil {
+		annotations, err := vdp.annotations.Annotations()
+		if err != nil {
+			logging.Warn("Unable to read node annotations", "volumeID", id, "err", err)
+		} else if value, ok := annotations[permissionsAnnotation(id)]; ok {
+			permissions = value
+		}
+	}
+	cgroupPermissions, ok := validPermissions[permissions]
+	if !ok {
+		return "", fmt.Errorf("invalid device permissions %q", permissions)
+	}
+	return cgroupPermissions, nil
+}
+
+// addCloudAnnotations adds the Brightbox Cloud metadata of each volume
+// to the response's annotations, e.g.
+// "volumes.brightbox.com/vol-tgl4c-zone". Lookup failures are logged and
+// leave the volume unannotated.
+func (vdp *volumeDevicePlugin) addCloudAnnotations(ctx context.Context, resp *pluginapi.ContainerAllocateResponse, ids []string) {
+	if vdp.cloud == nil {
+		return
+	}
+	for _, id := range ids {
+		metadata, err := vdp.cloud.GetVolume(ctx, id)
+		if err != nil {
+			logging.Warn("Unable to fetch volume metadata", "volumeID", id, "err", err)
+			continue
+		}
+		for suffix, value := range map[string]string{
+			"-description": metadata.Description,
+			"-server":      metadata.ServerID,
+			"-zone":        metadata.Zone,
+		} {
+			if value != "" {
+				resp.Annotations[resourceNamespace+"/"+id+suffix] = value
+			}
+		}
+	}
+}
+
+// permissionsAnnotation is the node annotation overriding the permissions
+// of a volume, e.g. "volumes.brightbox.com/vol-tgl4c-permissions"
+func permissionsAnnotation(id string) string {
+	return resourceNamespace + "/" + id + "-permissions"
+}
+
+// containerPath returns where the volume's device appears in the
+// container: the path given by the annotation on the pod requesting it if
+// there is one, and the host's by-id path otherwise. Annotation lookup
+// failures fall back to the host path.
+func (vdp *volumeDevicePlugin) containerPath(id string) (string, error) {
+	hostPath := vdp.devicePath(id)
+	if vdp.pods == nil {
+		return hostPath, nil
+	}
+	annotations, err := vdp.pods.PodAnnotations(vdp.resourceName(id))
+	if err != nil {
+		logging.Warn("Unable to read pod annotations", "volumeID", id, "err", err)
+		return hostPath, nil
+	}
+	value, ok := annotations[containerPathAnnotation(id)]
+	if !ok {
+		return hostPath, nil
+	}
+	if !filepath.IsAbs(value) || filepath.Clean(value) != value {
+		return "", status.Errorf(codes.InvalidArgument, "invalid container path %q for volume %s: must be a clean absolute path", value, id)
+	}
+	return value, nil
+}
+
+// resourceName is the extended resource name a pod requests the volume by
+func (vdp *volumeDevicePlugin) resourceName(id string) string {
+	namespace := resourceNamespace
+	if vdp.volLister != nil {
+		namespace = vdp.volLister.GetResourceNamespace()
+	}
+	return namespace + "/" + id
+}
+
+// containerPathAnnotation is the pod annotation overriding where a volume
+// appears in the container, e.g.
+// "volumes.brightbox.com/vol-tgl4c-container-path"
+func containerPathAnnotation(id string) string {
+	return resourceNamespace + "/" + id + "-container-path"
+}
+
 // PreStartContainer is called, if indicated by Device Plugin during registeration phase,
 // before each container start. Device plugin can run device specific operations
 // such as resetting the device before making devices available to the container
-func (vdp *volumeDevicePlugin) PreStartContainer(context.Context, *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
-	return nil, nil
+//
+// When the pre-start check is enabled each device is opened and closed
+// again to confirm the kernel has finished probing it.
+func (vdp *volumeDevicePlugin) PreStartContainer(ctx context.Context, request *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
+	logging.V(3).Info("Volume PreStartContainer Called", "volumeID", vdp.volumeID)
+
+	if vdp.preStart && !vdp.dryRun {
+		for _, id := range request.DevicesIDs {
+			if err := vdp.checkDevice(id); err != nil {
+				logging.Error("Device not ready", "volumeID", id, "err", err)
+				return nil, err
+			}
+		}
+	}
+
+	return &pluginapi.PreStartContainerResponse{}, nil
+}
+
+// checkDevice opens the block device behind the volume's symlink and
+// closes it again, returning any error encountered
+func (vdp *volumeDevicePlugin) checkDevice(id string) error {
+	devicePath, err := vdp.resolveDevice(id)
+	if err != nil {
+		return err
+	}
+	logging.V(4).Info("Opening device", "volumeID", id, "path", devicePath)
+	if err := vdp.openDevice(devicePath); err != nil {
+		return fmt.Errorf("volume %s: %w", id, err)
+	}
+	return nil
+}
+
+// waitForDevice opens the block device behind the volume's symlink,
+// retrying every open interval while the kernel reports there is no such
+// device yet. Gives a DeadlineExceeded error if the device is still not
+// ready after the open timeout.
+func (vdp *volumeDevicePlugin) waitForDevice(ctx context.Context, id string) error {
+	devicePath, err := vdp.resolveDevice(id)
+	if err != nil {
+		return err
+	}
+	timeout := time.NewTimer(vdp.openTimeout)
+	defer timeout.Stop()
+	retry := time.NewTicker(vdp.openInterval)
+	defer retry.Stop()
+	for {
+		err := vdp.openDevice(devicePath)
+		if err == nil {
+			return nil
+		} else if !errors.Is(err, syscall.ENXIO) {
+			return fmt.Errorf("volume %s: %w", id, err)
+		}
+		logging.V(4).Info("Device not yet initialised, retrying", "volumeID", id, "path", devicePath, "interval", vdp.openInterval)
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-timeout.C:
+			return status.Errorf(codes.DeadlineExceeded,
+				"volume %s: device %s not ready after %s", id, devicePath, vdp.openTimeout)
+		case <-retry.C:
+		}
+	}
+}
+
+// waitForBlockDevice waits up to the open timeout for the kernel to
+// finish scanning the block device behind the volume's symlink. Gives a
+// DeadlineExceeded error if it is still not ready.
+func (vdp *volumeDevicePlugin) waitForBlockDevice(id string) error {
+	devicePath, err := vdp.resolveDevice(id)
+	if err != nil {
+		return err
+	}
+	err = volwatch.WaitForBlockDeviceReadyIn(vdp.sysBlockDir, devicePath, vdp.openTimeout)
+	if errors.Is(err, volwatch.ErrBlockDeviceNotReady) {
+		return status.Errorf(codes.DeadlineExceeded,
+			"volume %s: %s after %s", id, err, vdp.openTimeout)
+	} else if err != nil {
+		return fmt.Errorf("volume %s: %w", id, err)
+	}
+	return nil
+}
+
+// openDevice opens the device node at path without blocking and closes
+// it again
+func openDevice(path string) error {
+	device, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return err
+	}
+	return device.Close()
+}
+
+const (
+	sysBlockDir               = volwatch.DefaultSysBlockDir
+	defaultPermissions        = "rw"
+	defaultDeviceOpenInterval = 500 * time.Millisecond
+	cdiKind                   = resourceNamespace + "/volume"
+	tracerName                = "github.com/brightbox/brightbox-volume-device-plugin"
+	maxSymlinkDepth           = volwatch.DefaultMaxSymlinkDepth
+	appArmorAnnotation        = "container.apparmor.security.beta.kubernetes.io/volume-device-plugin"
+	selinuxAnnotationPrefix   = resourceNamespace + "/selinux-label."
+)
+
+// validPermissions maps the accepted permission settings to cgroup device
+// permissions
+var validPermissions = map[string]string{
+	"rw":  "rw",
+	"ro":  "r",
+	"mrw": "mrw",
 }
@@ -0,0 +1,1185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/brightbox/brightbox-volume-device-plugin/cdi"
+	"github.com/brightbox/brightbox-volume-device-plugin/metrics"
+	"github.com/brightbox/brightbox-volume-device-plugin/tracing"
+	"github.com/brightbox/brightbox-volume-device-plugin/volwatch"
+	"golang.org/x/exp/slices"
+	"golang.org/x/sys/unix"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// fakeDevices creates a by-id directory with symlinks for each volume to a
+// device node, and a sys/block directory containing the listed devices
+func fakeDevices(t *testing.T, links map[string]string, enumerated ...string) []PluginOption {
+	t.Helper()
+	baseDir := t.TempDir()
+	byID := filepath.Join(baseDir, "by-id")
+	sysBlock := filepath.Join(baseDir, "sys", "block")
+	os.Mkdir(byID, 0755)
+	os.MkdirAll(sysBlock, 0755)
+	for vol, dev := range links {
+		if err := os.WriteFile(filepath.Join(baseDir, dev), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(filepath.Join("..", dev), filepath.Join(byID, "virtio-"+vol)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, dev := range enumerated {
+		os.Mkdir(filepath.Join(sysBlock, dev), 0755)
+		os.WriteFile(filepath.Join(sysBlock, dev, "stat"), nil, 0644)
+		os.WriteFile(filepath.Join(sysBlock, dev, "size"), []byte("2048\n"), 0644)
+	}
+	return []PluginOption{
+		WithSysBlockDir(sysBlock),
+		withIDDevicePath(func(id string) (string, error) {
+			return volwatch.DevicePathIn(byID, id)
+		}),
+	}
+}
+
+func preferredAllocation(t *testing.T, vdp *volumeDevicePlugin, available []string, size int32) []string {
+	t.Helper()
+	resp, err := vdp.GetPreferredAllocation(context.Background(), &pluginapi.PreferredAllocationRequest{
+		ContainerRequests: []*pluginapi.ContainerPreferredAllocationRequest{
+			{
+				AvailableDeviceIDs: available,
+				AllocationSize:     size,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.ContainerResponses) != 1 {
+		t.Fatalf("Expected 1 container response, got %d", len(resp.ContainerResponses))
+	}
+	return resp.ContainerResponses[0].DeviceIDs
+}
+
+func TestPreferredAllocationReady(t *testing.T) {
+	opts := fakeDevices(t, map[string]string{"vol-aaaaa": "vda", "vol-bbbbb": "vdb"}, "vda")
+	vdp := newVolumeDevicePlugin("vol-aaaaa", nil, opts...)
+	ids := preferredAllocation(t, vdp, []string{"vol-bbbbb", "vol-aaaaa"}, 1)
+	if len(ids) != 1 || ids[0] != "vol-aaaaa" {
+		t.Errorf("Expected [vol-aaaaa], got %v", ids)
+	}
+}
+
+func TestPreferredAllocationNoPreference(t *testing.T) {
+	opts := fakeDevices(t, map[string]string{"vol-aaaaa": "vda", "vol-bbbbb": "vdb"})
+	vdp := newVolumeDevicePlugin("vol-aaaaa", nil, opts...)
+	ids := preferredAllocation(t, vdp, []string{"vol-bbbbb", "vol-aaaaa"}, 1)
+	if len(ids) != 2 {
+		t.Errorf("Expected full set, got %v", ids)
+	}
+}
+
+func TestNewVolumeDevicePluginDefaults(t *testing.T) {
+	vdp := newVolumeDevicePlugin("vol-aaaaa", nil)
+	if vdp.volumeID != "vol-aaaaa" || vdp.volumeUpdate == nil || vdp.healthUpdate == nil {
+		t.Fatalf("Plugin not initialised: %+v", vdp)
+	}
+	if vdp.permissions != defaultPermissions || !vdp.injectEnv || vdp.dryRun || vdp.preStart {
+		t.Errorf("Unexpected defaults: %+v", vdp)
+	}
+	if vdp.healthInterval != 0 || vdp.allocations != nil || vdp.tracer == nil {
+		t.Errorf("Unexpected defaults: %+v", vdp)
+	}
+	if path := vdp.devicePath("vol-aaaaa"); path != filepath.Join(volwatch.DefaultDeviceDir, "virtio-vol-aaaaa") {
+		t.Errorf("Expected default device path, got %s", path)
+	}
+}
+
+func TestNewVolumeDevicePluginOptions(t *testing.T) {
+	recorder := &tracing.Recorder{}
+	tracker := NewAllocationTracker()
+	vdp := newVolumeDevicePlugin("vol-aaaaa", nil,
+		WithDefaultPermissions("ro"),
+		WithHealthCheckInterval(time.Minute),
+		WithDryRun(true),
+		WithTracer(tracing.NewProvider(recorder)),
+		WithAllocationTracker(tracker),
+	)
+	if vdp.permissions != "ro" || vdp.healthInterval != time.Minute || !vdp.dryRun || vdp.allocations != tracker {
+		t.Errorf("Options not stored: %+v", vdp)
+	}
+	resp, err := vdp.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"vol-aaaaa"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spans := recorder.Ended(); len(spans) != 1 {
+		t.Errorf("Expected Allocate to use the tracer, got %d spans", len(spans))
+	}
+	if len(resp.ContainerResponses) != 1 || len(resp.ContainerResponses[0].Devices) != 0 {
+		t.Errorf("Expected a dry run to supply no devices, got %+v", resp.ContainerResponses)
+	}
+	if tracker.Allocated("vol-aaaaa") {
+		t.Error("Expected a dry run not to claim the volume")
+	}
+}
+
+func TestStartHealthCheckInterval(t *testing.T) {
+	for _, interval := range []time.Duration{0, time.Minute} {
+		vdp := newVolumeDevicePlugin("vol-aaaaa", newTestLister(t), WithHealthCheckInterval(interval))
+		if err := vdp.Start(); err != nil {
+			t.Fatal(err)
+		}
+		if running := vdp.stopHealth != nil; running != (interval > 0) {
+			t.Errorf("Interval %s: expected health monitor running %t, got %t", interval, interval > 0, running)
+		}
+		if err := vdp.Stop(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestNewPluginAppliesListerOptions(t *testing.T) {
+	vl := newTestLister(t, WithPluginOptions(WithDefaultPermissions("mrw"), WithDryRun(true)))
+	vdp := vl.NewPlugin("vol-aaaaa").(*volumeDevicePlugin)
+	if vdp.volumeID != "vol-aaaaa" || vdp.volLister != vl {
+		t.Errorf("Plugin not created for the lister's volume: %+v", vdp)
+	}
+	if vdp.permissions != "mrw" || !vdp.dryRun {
+		t.Errorf("Lister plugin options not applied: %+v", vdp)
+	}
+	if vdp.allocations != vl.allocations {
+		t.Error("Expected the plugin to share the lister's allocations")
+	}
+}
+
+func TestPreStartContainerMissingDevice(t *testing.T) {
+	opts := fakeDevices(t, map[string]string{"vol-aaaaa": "vda"})
+	vdp := newVolumeDevicePlugin("vol-bbbbb", nil, append(opts, WithPreStartCheck(true))...)
+	_, err := vdp.PreStartContainer(context.Background(), &pluginapi.PreStartContainerRequest{
+		DevicesIDs: []string{"vol-bbbbb"},
+	})
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected not exist error, got %v", err)
+	}
+}
+
+func TestPreStartContainerPresentDevice(t *testing.T) {
+	opts := fakeDevices(t, map[string]string{"vol-aaaaa": "vda"})
+	vdp := newVolumeDevicePlugin("vol-aaaaa", nil, append(opts, WithPreStartCheck(true))...)
+	_, err := vdp.PreStartContainer(context.Background(), &pluginapi.PreStartContainerRequest{
+		DevicesIDs: []string{"vol-aaaaa"},
+	})
+	if err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	options, _ := vdp.GetDevicePluginOptions(context.Background(), &pluginapi.Empty{})
+	if !options.PreStartRequired {
+		t.Error("Expected PreStartRequired to be set")
+	}
+}
+
+// fakeAnnotations is an AnnotationStore backed by a map
+type fakeAnnotations map[string]string
+
+func (f fakeAnnotations) Annotations() (map[string]string, error) {
+	return f, nil
+}
+
+// fakePodAnnotations is a PodAnnotationStore giving the annotations of
+// the pod requesting each resource
+type fakePodAnnotations map[string]map[string]string
+
+func (f fakePodAnnotations) PodAnnotations(resourceName string) (map[string]string, error) {
+	return f[resourceName], nil
+}
+
+func containerPaths(t *testing.T, vdp *volumeDevicePlugin, ids ...string) ([]string, error) {
+	t.Helper()
+	resp, err := vdp.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: ids},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, device := range resp.ContainerResponses[0].Devices {
+		result = append(result, device.ContainerPath)
+	}
+	return result, nil
+}
+
+func TestAllocateContainerPath(t *testing.T) {
+	opts := fakeDevices(t, map[string]string{"vol-aaaaa": "vda", "vol-bbbbb": "vdb"})
+	vdp := newVolumeDevicePlugin("vol-aaaaa", nil, append(opts,
+		WithPodAnnotationStore(fakePodAnnotations{
+			"volumes.brightbox.com/vol-aaaaa": {"volumes.brightbox.com/vol-aaaaa-container-path": "/dev/data-volume"},
+			"volumes.brightbox.com/vol-bbbbb": {"volumes.brightbox.com/vol-aaaaa-container-path": "/dev/elsewhere"},
+		}),
+	)...)
+	paths, err := containerPaths(t, vdp, "vol-aaaaa", "vol-bbbbb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"/dev/data-volume", vdp.devicePath("vol-bbbbb")}
+	if !slices.Equal(paths, expected) {
+		t.Errorf("Expected %v, got %v", expected, paths)
+	}
+}
+
+func TestAllocateContainerPathUnannotated(t *testing.T) {
+	opts := fakeDevices(t, map[string]string{"vol-aaaaa": "vda"})
+	for name, vdp := range map[string]*volumeDevicePlugin{
+		"no store":      newVolumeDevicePlugin("vol-aaaaa", nil, opts...),
+		"no annotation": newVolumeDevicePlugin("vol-aaaaa", nil, append(opts, WithPodAnnotationStore(fakePodAnnotations{}))...),
+	} {
+		paths, err := containerPaths(t, vdp, "vol-aaaaa")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := []string{vdp.devicePath("vol-aaaaa")}; !slices.Equal(paths, expected) {
+			t.Errorf("%s: expected host path %v, got %v", name, expected, paths)
+		}
+	}
+}
+
+func TestAllocateContainerPathInvalid(t *testing.T) {
+	for _, path := range []string{"dev/data", "/dev/../etc/data", ""} {
+		vdp := newVolumeDevicePlugin("vol-aaaaa", nil, WithPodAnnotationStore(fakePodAnnotations{
+			"volumes.brightbox.com/vol-aaaaa": {"volumes.brightbox.com/vol-aaaaa-container-path": path},
+		}))
+		if _, err := containerPaths(t, vdp, "vol-aaaaa"); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("Expected InvalidArgument for %q, got %v", path, err)
+		}
+	}
+}
+
+func allocatePermissions(t *testing.T, vdp *volumeDevicePlugin, ids ...string) ([]string, error) {
+	t.Helper()
+	resp, err := vdp.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: ids},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, device := range resp.ContainerResponses[0].Devices {
+		result = append(result, device.Permissions)
+	}
+	return result, nil
+}
+
+func TestAllocatePermissions(t *testing.T) {
+	vdp := newVolumeDevicePlugin("vol-aaaaa", nil,
+		WithDefaultPermissions("ro"),
+		WithAnnotationStore(fakeAnnotations{
+			"volumes.brightbox.com/vol-bbbbb-permissions": "mrw",
+		}),
+	)
+	permissions, err := allocatePermissions(t, vdp, "vol-aaaaa", "vol-bbbbb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(permissions) != 2 || permissions[0] != "r" || permissions[1] != "mrw" {
+		t.Errorf("Expected [r mrw], got %v", permissions)
+	}
+}
+
+func TestAllocateInvalidPermissions(t *testing.T) {
+	vdp := newVolumeDevicePlugin("vol-aaaaa", nil,
+		WithAnnotationStore(fakeAnnotations{
+			"volumes.brightbox.com/vol-aaaaa-permissions": "rwx",
+		}),
+	)
+	if _, err := allocatePermissions(t, vdp, "vol-aaaaa"); err == nil {
+		t.Error("Expected invalid permissions to be rejected")
+	}
+}
+
+func TestAllocateEnvs(t *testing.T) {
+	opts := fakeDevices(t, map[string]string{"vol-aaaaa": "vda", "vol-bbbbb": "vdb"})
+	vdp := newVolumeDevicePlugin("vol-aaaaa", nil, opts...)
+	resp, err := vdp.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"vol-aaaaa", "vol-bbbbb"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	envs := resp.ContainerResponses[0].Envs
+	if envs["BRIGHTBOX_VOLUME_ID"] != "vol-aaaaa,vol-bbbbb" {
+		t.Errorf("Unexpected BRIGHTBOX_VOLUME_ID %q", envs["BRIGHTBOX_VOLUME_ID"])
+	}
+	symlinks := strings.Split(envs["BRIGHTBOX_VOLUME_SYMLINK"], ",")
+	devices := strings.Split(envs["BRIGHTBOX_VOLUME_DEVICE"], ",")
+	if len(symlinks) != 2 || len(devices) != 2 {
+		t.Fatalf("Expected two symlinks and devices, got %v and %v", symlinks, devices)
+	}
+	for i, dev := range []string{"vda", "vdb"} {
+		if filepath.Base(devices[i]) != dev {
+			t.Errorf("Expected device %s, got %q", dev, devices[i])
+		}
+		if resolved, _ := filepath.EvalSymlinks(symlinks[i]); resolved != devices[i] {
+			t.Errorf("Symlink %q does not resolve to %q", symlinks[i], devices[i])
+		}
+	}
+}
+
+func TestAllocateNoEnvs(t *testing.T) {
+	vdp := newVolumeDevicePlugin("vol-aaaaa", nil, WithInjectEnv(false))
+	resp, err := vdp.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"vol-aaaaa"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.ContainerResponses[0].Envs) != 0 {
+		t.Errorf("Expected no envs, got %v", resp.ContainerResponses[0].Envs)
+	}
+}
+
+// fakeTopology is a NodeTopology reporting a fixed zone
+type fakeTopology struct {
+	zone  string
+	calls int
+}
+
+func (f *fakeTopology) Zone() (string, error) {
+	f.calls++
+	return f.zone, nil
+}
+
+func TestPreferredAllocationTopology(t *testing.T) {
+	topology := &fakeTopology{zone: "gb1s-a"}
+	opts := fakeDevices(t, map[string]string{"vol-aaaaa": "vda"}, "vda")
+	vdp := newVolumeDevicePlugin("vol-aaaaa", nil, append(opts, WithNodeTopology(topology))...)
+	ids := preferredAllocation(t, vdp, []string{"vol-aaaaa"}, 1)
+	if len(ids) != 1 || ids[0] != "vol-aaaaa" {
+		t.Errorf("Expected [vol-aaaaa], got %v", ids)
+	}
+	if topology.calls != 1 {
+		t.Errorf("Expected node zone to be consulted once, got %d", topology.calls)
+	}
+}
+
+// fakeListAndWatchServer records the responses sent by ListAndWatch,
+// failing each send with err once failAfter responses have been sent
+type fakeListAndWatchServer struct {
+	grpc.ServerStream
+	responses chan *pluginapi.ListAndWatchResponse
+	err       error
+	failAfter int
+	sent      int
+}
+
+func (f *fakeListAndWatchServer) Context() context.Context {
+	return context.Background()
+}
+
+func (f *fakeListAndWatchServer) Send(resp *pluginapi.ListAndWatchResponse) error {
+	if f.err != nil && f.sent >= f.failAfter {
+		return f.err
+	}
+	f.sent++
+	f.responses <- resp
+	return nil
+}
+
+func nextHealth(t *testing.T, srv *fakeListAndWatchServer) string {
+	t.Helper()
+	select {
+	case resp := <-srv.responses:
+		if len(resp.Devices) != 1 {
+			t.Fatalf("Expected one device, got %v", resp.Devices)
+		}
+		return resp.Devices[0].Health
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for ListAndWatch response")
+	}
+	return ""
+}
+
+func TestHealthMonitorDeviceRemoved(t *testing.T) {
+	opts := fakeDevices(t, map[string]string{"vol-aaaaa": "vda"})
+	vl := newTestLister(t)
+	vdp := newVolumeDevicePlugin("vol-aaaaa", vl,
+		append(opts, WithHealthCheckInterval(10*time.Millisecond))...)
+	vdp.Start()
+	defer vdp.Stop()
+	srv := &fakeListAndWatchServer{responses: make(chan *pluginapi.ListAndWatchResponse, 4)}
+	go vdp.ListAndWatch(&pluginapi.Empty{}, srv)
+	if health := nextHealth(t, srv); health != pluginapi.Healthy {
+		t.Errorf("Expected initial health %s, got %s", pluginapi.Healthy, health)
+	}
+	devicePath, err := filepath.EvalSymlinks(vdp.devicePath("vol-aaaaa"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(devicePath)
+	if health := nextHealth(t, srv); health != pluginapi.Unhealthy {
+		t.Errorf("Expected health %s after device removal, got %s", pluginapi.Unhealthy, health)
+	}
+	os.WriteFile(devicePath, nil, 0644)
+	if health := nextHealth(t, srv); health != pluginapi.Healthy {
+		t.Errorf("Expected health %s after device returned, got %s", pluginapi.Healthy, health)
+	}
+}
+
+func TestCloudHealthVolumeFailed(t *testing.T) {
+	cloud := &fakeCloudClient{volumes: map[string]VolumeMetadata{"vol-aaaaa": {Status: "attached"}}}
+	vl := newTestLister(t)
+	vdp := newVolumeDevicePlugin("vol-aaaaa", vl, WithDryRun(true),
+		WithCloudHealthChecker(cloud, 10*time.Millisecond))
+	vdp.Start()
+	defer vdp.Stop()
+	srv := &fakeListAndWatchServer{responses: make(chan *pluginapi.ListAndWatchResponse, 4)}
+	go vdp.ListAndWatch(&pluginapi.Empty{}, srv)
+	if health := nextHealth(t, srv); health != pluginapi.Healthy {
+		t.Errorf("Expected initial health %s, got %s", pluginapi.Healthy, health)
+	}
+	cloud.setStatus("vol-aaaaa", "failed")
+	if health := nextHealth(t, srv); health != pluginapi.Unhealthy {
+		t.Errorf("Expected health %s after the volume failed, got %s", pluginapi.Unhealthy, health)
+	}
+	cloud.setStatus("vol-aaaaa", "available")
+	if health := nextHealth(t, srv); health != pluginapi.Healthy {
+		t.Errorf("Expected health %s after the volume recovered, got %s", pluginapi.Healthy, health)
+	}
+}
+
+func TestCloudHealthLookupFailure(t *testing.T) {
+	vdp := newVolumeDevicePlugin("vol-aaaaa", nil,
+		WithCloudHealthChecker(&fakeCloudClient{}, time.Minute))
+	for _, previous := range []string{pluginapi.Healthy, pluginapi.Unhealthy} {
+		if health := vdp.cloudVolumeHealth(context.Background(), previous); health != previous {
+			t.Errorf("Expected a failed lookup to keep health %s, got %s", previous, health)
+		}
+	}
+	if vdp := newVolumeDevicePlugin("vol-aaaaa", nil, WithCloudHealthChecker(nil, time.Minute)); vdp.cloudHealthInterval != 0 {
+		t.Error("Expected no cloud health check without a client")
+	}
+}
+
+func TestCloudHealthSharedRateLimit(t *testing.T) {
+	const plugins, limit, burst = 50, 200, 5
+	fake := &fakeCloudClient{volumes: make(map[string]VolumeMetadata)}
+	cloud := newRateLimitedCloudClient(fake, limit, burst)
+	var vdps []*volumeDevicePlugin
+	for i := 0; i < plugins; i++ {
+		id := fmt.Sprintf("vol-%05d", i)
+		fake.volumes[id] = VolumeMetadata{Status: "attached"}
+		vdps = append(vdps, newVolumeDevicePlugin(id, nil, WithCloudHealthChecker(cloud, time.Minute)))
+	}
+	var wg sync.WaitGroup
+	start := time.Now()
+	for _, vdp := range vdps {
+		wg.Add(1)
+		go func(vdp *volumeDevicePlugin) {
+			defer wg.Done()
+			if health := vdp.cloudVolumeHealth(context.Background(), pluginapi.Unhealthy); health != pluginapi.Healthy {
+				t.Errorf("Expected %s to be %s, got %s", vdp.volumeID, pluginapi.Healthy, health)
+			}
+		}(vdp)
+	}
+	wg.Wait()
+	// The burst is free, after which each lookup waits its turn
+	minimum := time.Duration(plugins-burst) * time.Second / limit
+	if elapsed := time.Since(start); elapsed < minimum {
+		t.Errorf("Expected %d lookups to take at least %s, took %s", plugins, minimum, elapsed)
+	}
+	if fake.lookups != plugins {
+		t.Errorf("Expected %d lookups, got %d", plugins, fake.lookups)
+	}
+}
+
+func TestCloudHealthStopWhileRateLimited(t *testing.T) {
+	fake := &fakeCloudClient{volumes: map[string]VolumeMetadata{"vol-aaaaa": {}}}
+	cloud := newRateLimitedCloudClient(fake, rate.Every(time.Hour), 1)
+	cloud.GetVolume(context.Background(), "vol-aaaaa")
+	vdp := newVolumeDevicePlugin("vol-aaaaa", newTestLister(t), WithDryRun(true),
+		WithCloudHealthChecker(cloud, time.Millisecond))
+	vdp.Start()
+	time.Sleep(20 * time.Millisecond)
+	stopped := make(chan struct{})
+	go func() {
+		vdp.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out stopping a plugin waiting on the API rate limit")
+	}
+}
+
+func TestStatsCollection(t *testing.T) {
+	opts := fakeDevices(t, map[string]string{"vol-aaaaa": "vda"}, "vda")
+	vl := newTestLister(t)
+	vdp := newVolumeDevicePlugin("vol-aaaaa", vl,
+		append(opts, WithStatsInterval(10*time.Millisecond))...)
+	stat := filepath.Join(vdp.sysBlockDir, "vda", "stat")
+	if err := os.WriteFile(stat, []byte("10 0 8 0 20 0 16 0 0 0 0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	vdp.Start()
+	deadline := time.Now().Add(5 * time.Second)
+	for metrics.VolumeWriteBytes.WithLabelValue("vol-aaaaa").Value() != 16*512 {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for statistics to be collected")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if read := metrics.VolumeReadBytes.WithLabelValue("vol-aaaaa").Value(); read != 8*512 {
+		t.Errorf("Expected %d bytes read, got %d", 8*512, read)
+	}
+	vdp.Stop()
+	var b strings.Builder
+	metrics.DefaultRegistry.Write(&b)
+	if strings.Contains(b.String(), `volume_id="vol-aaaaa"`) {
+		t.Error("Expected the stopped volume's statistics to be removed")
+	}
+}
+
+func TestKeepaliveResendsDeviceList(t *testing.T) {
+	vl := newTestLister(t)
+	vdp := newVolumeDevicePlugin("vol-aaaaa", vl, WithKeepaliveInterval(10*time.Millisecond))
+	vdp.Start()
+	defer vdp.Stop()
+	srv := &fakeListAndWatchServer{responses: make(chan *pluginapi.ListAndWatchResponse, 4)}
+	go vdp.ListAndWatch(&pluginapi.Empty{}, srv)
+	for i := 0; i < 3; i++ {
+		if health := nextHealth(t, srv); health != pluginapi.Healthy {
+			t.Errorf("Expected response %d to be %s, got %s", i, pluginapi.Healthy, health)
+		}
+	}
+}
+
+func TestKeepaliveKeepsDeviceHealth(t *testing.T) {
+	opts := fakeDevices(t, map[string]string{"vol-aaaaa": "vda"})
+	vl := newTestLister(t)
+	vdp := newVolumeDevicePlugin("vol-aaaaa", vl,
+		append(opts, WithHealthCheckInterval(10*time.Millisecond), WithKeepaliveInterval(20*time.Millisecond))...)
+	devicePath, err := filepath.EvalSymlinks(vdp.devicePath("vol-aaaaa"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vdp.Start()
+	defer vdp.Stop()
+	srv := &fakeListAndWatchServer{responses: make(chan *pluginapi.ListAndWatchResponse, 4)}
+	go vdp.ListAndWatch(&pluginapi.Empty{}, srv)
+	if health := nextHealth(t, srv); health != pluginapi.Healthy {
+		t.Errorf("Expected initial health %s, got %s", pluginapi.Healthy, health)
+	}
+	os.Remove(devicePath)
+	health := nextHealth(t, srv)
+	for health == pluginapi.Healthy {
+		health = nextHealth(t, srv)
+	}
+	for i := 0; i < 2; i++ {
+		if health := nextHealth(t, srv); health != pluginapi.Unhealthy {
+			t.Errorf("Expected keepalive to report %s, got %s", pluginapi.Unhealthy, health)
+		}
+	}
+}
+
+func TestKeepaliveSendFailure(t *testing.T) {
+	vl := newTestLister(t)
+	vdp := newVolumeDevicePlugin("vol-aaaaa", vl, WithKeepaliveInterval(10*time.Millisecond))
+	vdp.Start()
+	defer vdp.Stop()
+	sendErr := errors.New("connection reset")
+	srv := &fakeListAndWatchServer{responses: make(chan *pluginapi.ListAndWatchResponse, 4), err: sendErr, failAfter: 1}
+	done := make(chan error, 1)
+	go func() {
+		done <- vdp.ListAndWatch(&pluginapi.Empty{}, srv)
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, sendErr) {
+			t.Errorf("Expected keepalive send error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListAndWatch did not return after keepalive failed")
+	}
+	if srv.sent != 1 {
+		t.Errorf("Expected only the initial device list to be sent, got %d", srv.sent)
+	}
+}
+
+func TestAllocateRejectsInvalidID(t *testing.T) {
+	vdp := newVolumeDevicePlugin("vol-aaaaa", nil)
+	_, err := vdp.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"vol-aaaaa", "../../../dev/sda"}},
+		},
+	})
+	if !errors.Is(err, volwatch.ErrInvalidVolumeID) {
+		t.Errorf("Expected ErrInvalidVolumeID, got %v", err)
+	}
+}
+
+func TestAllocateVolumeIDRegex(t *testing.T) {
+	opts := fakeDevices(t, map[string]string{"ssd-aaaaa": "vdb"}, "vdb")
+	vdp := newVolumeDevicePlugin("ssd-aaaaa", nil, append(opts, WithVolumeIDRegex(regexp.MustCompile(`ssd-.....$`)))...)
+	if devices := allocateDevices(t, vdp, "ssd-aaaaa"); !slices.Equal(devices, []string{"virtio-ssd-aaaaa"}) {
+		t.Errorf("Expected virtio-ssd-aaaaa, got %v", devices)
+	}
+	_, err := vdp.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"vol-aaaaa"}},
+		},
+	})
+	if !errors.Is(err, volwatch.ErrInvalidVolumeID) {
+		t.Errorf("Expected ErrInvalidVolumeID for an ID from another namespace, got %v", err)
+	}
+}
+
+func TestAllocateCustomDeviceDir(t *testing.T) {
+	baseDir := t.TempDir()
+	deviceDir := filepath.Join(baseDir, "brightbox")
+	os.Mkdir(deviceDir, 0755)
+	if err := os.WriteFile(filepath.Join(baseDir, "vda"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Symlink("../vda", filepath.Join(deviceDir, "virtio-vol-aaaaa"))
+	watcher := volwatch.NewWatchDir(deviceDir)
+	defer watcher.Cancel()
+	vdp := newVolumeDevicePlugin("vol-aaaaa", nil, volumePathOptions(watcher, volwatch.DefaultVolumeRegex())...)
+	resp, err := vdp.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"vol-aaaaa"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := filepath.Join(deviceDir, "virtio-vol-aaaaa")
+	if device := resp.ContainerResponses[0].Devices[0]; device.HostPath != expected || device.ContainerPath != expected {
+		t.Errorf("Expected device at %s, got %+v", expected, device)
+	}
+	if envs := resp.ContainerResponses[0].Envs; envs["BRIGHTBOX_VOLUME_SYMLINK"] != expected {
+		t.Errorf("Expected symlink %s in the environment, got %v", expected, envs)
+	}
+}
+
+func allocateDevices(t *testing.T, vdp *volumeDevicePlugin, ids ...string) []string {
+	t.Helper()
+	resp, err := vdp.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: ids},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result []string
+	for _, device := range resp.ContainerResponses[0].Devices {
+		result = append(result, filepath.Base(device.HostPath))
+	}
+	return result
+}
+
+func TestAllocateMultipath(t *testing.T) {
+	opts := fakeDevices(t, map[string]string{"vol-aaaaa": "dm-0", "vol-bbbbb": "vdb"}, "dm-0", "vdb")
+	vdp := newVolumeDevicePlugin("vol-aaaaa", nil, append(opts, WithMultipathSupport(true))...)
+	slaves := filepath.Join(vdp.sysBlockDir, "dm-0", "slaves")
+	for _, dev := range []string{"sda", "sdb"} {
+		if err := os.MkdirAll(filepath.Join(slaves, dev), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	devices := allocateDevices(t, vdp, "vol-aaaaa", "vol-bbbbb")
+	expected := []string{"virtio-vol-aaaaa", "sda", "sdb", "virtio-vol-bbbbb"}
+	if !slices.Equal(devices, expected) {
+		t.Errorf("Expected %v, got %v", expected, devices)
+	}
+}
+
+func TestAllocateMultipathDisabled(t *testing.T) {
+	opts := fakeDevices(t, map[string]string{"vol-aaaaa": "dm-0"}, "dm-0")
+	vdp := newVolumeDevicePlugin("vol-aaaaa", nil, opts...)
+	os.MkdirAll(filepath.Join(vdp.sysBlockDir, "dm-0", "slaves", "sda"), 0755)
+	if devices := allocateDevices(t, vdp, "vol-aaaaa"); len(devices) != 1 {
+		t.Errorf("Expected only the volume symlink, got %v", devices)
+	}
+}
+
+func TestAllocateNVMe(t *testing.T) {
+	opts := fakeDevices(t, map[string]string{"vol-aaaaa": "nvme1n1", "vol-bbbbb": "vdb"})
+	vdp := newVolumeDevicePlugin("vol-aaaaa", nil, opts...)
+	devices := allocateDevices(t, vdp, "vol-aaaaa", "vol-bbbbb")
+	expected := []string{"virtio-vol-aaaaa", "nvme1", "virtio-vol-bbbbb"}
+	if !slices.Equal(devices, expected) {
+		t.Errorf("Expected %v, got %v", expected, devices)
+	}
+}
+
+func TestAllocateDeviceAnnotations(t *testing.T) {
+	dir := t.TempDir()
+	device := filepath.Join(dir, "loop0")
+	err := unix.Mknod(device, unix.S_IFBLK|0600, int(unix.Mkdev(7, 0)))
+	if errors.Is(err, unix.EPERM) {
+		t.Skip("Creating device nodes needs CAP_MKNOD")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("loop0", filepath.Join(dir, "virtio-vol-aaaaa")); err != nil {
+		t.Fatal(err)
+	}
+	vdp := newVolumeDevicePlugin("vol-aaaaa", nil, withIDDevicePath(func(id string) (string, error) {
+		return volwatch.DevicePathIn(dir, id)
+	}))
+	resp, err := vdp.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"vol-aaaaa", "vol-bbbbb"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotations := resp.ContainerResponses[0].Annotations
+	if annotations["volumes.brightbox.com/major"] != "7," || annotations["volumes.brightbox.com/minor"] != "0," {
+		t.Errorf("Unexpected annotations %v", annotations)
+	}
+	if size, err := volwatch.BlockDeviceSize(device); err == nil {
+		if expected := strconv.FormatInt(size, 10) + ","; annotations["volumes.brightbox.com/size-bytes"] != expected {
+			t.Errorf("Expected size-bytes %q, got %v", expected, annotations)
+		}
+	}
+}
+
+func TestAllocateFilesystemAnnotation(t *testing.T) {
+	opts := fakeDevices(t, map[string]string{"vol-aaaaa": "vda", "vol-bbbbb": "vdb"})
+	vdp := newVolumeDevicePlugin("vol-aaaaa", nil, opts...)
+	if err := os.WriteFile(vdp.devicePath("vol-bbbbb"), []byte("XFSB"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := vdp.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"vol-aaaaa", "vol-bbbbb"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filesystems := resp.ContainerResponses[0].Annotations["volumes.brightbox.com/filesystem"]; filesystems != "raw,xfs" {
+		t.Errorf("Expected raw,xfs, got %q", filesystems)
+	}
+}
+
+func TestAllocateAppArmorProfile(t *testing.T) {
+	opts := fakeDevices(t, map[string]string{"vol-aaaaa": "vda"})
+	for _, profile := range []string{"", "localhost/block-devices"} {
+		vdp := newVolumeDevicePlugin("vol-aaaaa", nil, append(opts, WithAppArmorProfile(profile))...)
+		resp, err := vdp.Allocate(context.Background(), &pluginapi.AllocateRequest{
+			ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+				{DevicesIDs: []string{"vol-aaaaa"}},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		annotation, ok := resp.ContainerResponses[0].Annotations[appArmorAnnotation]
+		if profile == "" && ok {
+			t.Errorf("Expected no AppArmor annotation without a profile, got %q", annotation)
+		} else if profile != "" && annotation != profile {
+			t.Errorf("Expected AppArmor annotation %q, got %q", profile, annotation)
+		}
+	}
+}
+
+func TestAllocateSELinuxLabel(t *testing.T) {
+	opts := fakeDevices(t, map[string]string{"vol-aaaaa": "vda", "vol-bbbbb": "nvme1n1"})
+	label := "system_u:object_r:fixed_disk_device_t:s0:c1,c2"
+	for _, withLabel := range []bool{false, true} {
+		pluginOpts := opts
+		if withLabel {
+			pluginOpts = append(slices.Clone(opts), WithSELinuxLabel(label))
+		}
+		vdp := newVolumeDevicePlugin("vol-aaaaa", nil, pluginOpts...)
+		resp, err := vdp.Allocate(context.Background(), &pluginapi.AllocateRequest{
+			ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+				{DevicesIDs: []string{"vol-aaaaa", "vol-bbbbb"}},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		container := resp.ContainerResponses[0]
+		for _, device := range container.Devices {
+			annotation, ok := container.Annotations[selinuxAnnotationPrefix+filepath.Base(device.HostPath)]
+			if !withLabel && ok {
+				t.Errorf("Expected no SELinux annotation for %s without a label, got %q", device.HostPath, annotation)
+			} else if withLabel && annotation != label {
+				t.Errorf("Expected SELinux annotation %q for %s, got %q", label, device.HostPath, annotation)
+			}
+		}
+		if withLabel && len(container.Devices) != 3 {
+			t.Errorf("Expected both volumes and the NVMe controller, got %v", container.Devices)
+		}
+	}
+}
+
+func TestAllocateCloudAnnotations(t *testing.T) {
+	opts := fakeDevices(t, map[string]string{"vol-aaaaa": "vda", "vol-bbbbb": "vdb"})
+	cloud := &fakeCloudClient{volumes: map[string]VolumeMetadata{
+		"vol-aaaaa": {Description: "database", ServerID: "srv-abcde", Zone: "gb1s-a"},
+	}}
+	vdp := newVolumeDevicePlugin("vol-aaaaa", nil, append(opts, WithCloudClient(cloud))...)
+	resp, err := vdp.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"vol-aaaaa", "vol-bbbbb"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotations := resp.ContainerResponses[0].Annotations
+	for key, value := range map[string]string{
+		"volumes.brightbox.com/vol-aaaaa-description": "database",
+		"volumes.brightbox.com/vol-aaaaa-server":      "srv-abcde",
+		"volumes.brightbox.com/vol-aaaaa-zone":        "gb1s-a",
+	} {
+		if annotations[key] != value {
+			t.Errorf("Expected annotation %s to be %q, got %q", key, value, annotations[key])
+		}
+	}
+	for key := range annotations {
+		if strings.HasPrefix(key, "volumes.brightbox.com/vol-bbbbb-") {
+			t.Errorf("Expected no metadata annotations for a volume failing lookup, got %s", key)
+		}
+	}
+}
+
+func TestAllocateThinProvisioned(t *testing.T) {
+	opts := fakeDevices(t, map[string]string{"vol-aaaaa": "vda", "vol-bbbbb": "vdb"}, "vda", "vdb")
+	vdp := newVolumeDevicePlugin("vol-aaaaa", nil, opts...)
+	thick := newVolumeDevicePlugin("vol-bbbbb", nil, opts...)
+	sysBlock := vdp.sysBlockDir
+	for dev, discardMax := range map[string]string{"vda": "2147483136", "vdb": "0"} {
+		os.MkdirAll(filepath.Join(sysBlock, dev, "queue"), 0755)
+		if err := os.WriteFile(filepath.Join(sysBlock, dev, "queue", "discard_max_bytes"), []byte(discardMax+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := metrics.ThinProvisionedVolumes.Value()
+	for _, plugin := range []*volumeDevicePlugin{vdp, vdp, thick} {
+		if _, err := plugin.Allocate(context.Background(), &pluginapi.AllocateRequest{
+			ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+				{DevicesIDs: []string{plugin.volumeID}},
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if thin := metrics.ThinProvisionedVolumes.Value() - before; thin != 1 {
+		t.Errorf("Expected one thin provisioned volume counted, got %d", thin)
+	}
+	vdp.volLister = newTestLister(t)
+	vdp.Stop()
+	if thin := metrics.ThinProvisionedVolumes.Value() - before; thin != 0 {
+		t.Errorf("Expected the stopped volume to be uncounted, got %d", thin)
+	}
+}
+
+func TestAllocateTracing(t *testing.T) {
+	recorder := &tracing.Recorder{}
+	opts := fakeDevices(t, map[string]string{"vol-aaaaa": "vda"})
+	vdp := newVolumeDevicePlugin("vol-aaaaa", nil,
+		append(opts, WithTracer(tracing.NewProvider(recorder)))...)
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		"traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	))
+	if _, err := vdp.Allocate(ctx, &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"vol-aaaaa"}},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	spans := recorder.Ended()
+	if len(spans) != 1 || spans[0].Name != "Allocate" {
+		t.Fatalf("Expected an Allocate span, got %+v", spans)
+	}
+	span := spans[0]
+	if span.Context.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Expected the caller's trace to continue, got %s", span.Context.TraceID)
+	}
+	if span.Attribute("volume.id") != "vol-aaaaa" || span.Attribute("container.count") != int64(1) {
+		t.Errorf("Unexpected attributes %v", span.Attributes)
+	}
+	if path := span.Attribute("device.path"); path != vdp.devicePath("vol-aaaaa") {
+		t.Errorf("Unexpected device.path %v", path)
+	}
+}
+
+func TestAllocateTracingError(t *testing.T) {
+	recorder := &tracing.Recorder{}
+	vdp := newVolumeDevicePlugin("vol-aaaaa", nil, WithTracer(tracing.NewProvider(recorder)))
+	if _, err := allocatePermissions(t, vdp, "../vol-aaaaa"); err == nil {
+		t.Fatal("Expected invalid ID to be rejected")
+	}
+	spans := recorder.Ended()
+	if len(spans) != 1 || !errors.Is(spans[0].Err, volwatch.ErrInvalidVolumeID) {
+		t.Errorf("Expected the error to be recorded, got %+v", spans)
+	}
+}
+
+func TestAllocateDryRun(t *testing.T) {
+	opts := fakeDevices(t, nil)
+	vdp := newVolumeDevicePlugin("vol-aaaaa", nil, append(opts, WithDryRun(true), WithPreStartCheck(true))...)
+	if _, err := os.Lstat(vdp.devicePath("vol-aaaaa")); !os.IsNotExist(err) {
+		t.Fatalf("Expected missing symlink, got %v", err)
+	}
+	resp, err := vdp.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"vol-aaaaa"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.ContainerResponses) != 1 {
+		t.Fatalf("Expected one container response, got %d", len(resp.ContainerResponses))
+	}
+	container := resp.ContainerResponses[0]
+	if len(container.Devices) != 0 || len(container.Envs) != 0 || len(container.Annotations) != 0 {
+		t.Errorf("Expected an empty response, got %v", container)
+	}
+	if health := vdp.deviceHealth(); health != pluginapi.Healthy {
+		t.Errorf("Expected volume to be reported healthy, got %s", health)
+	}
+	if _, err := vdp.PreStartContainer(context.Background(), &pluginapi.PreStartContainerRequest{DevicesIDs: []string{"vol-aaaaa"}}); err != nil {
+		t.Errorf("Expected pre-start check to be skipped, got %v", err)
+	}
+}
+
+// unreadyDevice returns a device opener that reports ENXIO for the first
+// n attempts, and a count of the attempts made
+func unreadyDevice(n int) (func(string) error, *int) {
+	attempts := 0
+	return func(string) error {
+		attempts++
+		if attempts <= n {
+			return &os.PathError{Op: "open", Path: "/dev/vda", Err: syscall.ENXIO}
+		}
+		return nil
+	}, &attempts
+}
+
+func TestAllocateWaitsForDevice(t *testing.T) {
+	opts := fakeDevices(t, map[string]string{"vol-aaaaa": "vda"}, "vda")
+	opener, attempts := unreadyDevice(3)
+	vdp := newVolumeDevicePlugin("vol-aaaaa", nil, append(opts,
+		WithDeviceOpenWait(time.Second, time.Millisecond),
+		withDeviceOpener(opener),
+	)...)
+	if _, err := allocatePermissions(t, vdp, "vol-aaaaa"); err != nil {
+		t.Fatalf("Expected allocation once the device was ready, got %v", err)
+	}
+	if *attempts != 4 {
+		t.Errorf("Expected 4 attempts to open the device, got %d", *attempts)
+	}
+}
+
+func TestAllocateDeviceNeverReady(t *testing.T) {
+	opts := fakeDevices(t, map[string]string{"vol-aaaaa": "vda"})
+	opener, _ := unreadyDevice(math.MaxInt)
+	vdp := newVolumeDevicePlugin("vol-aaaaa", nil, append(opts,
+		WithDeviceOpenWait(20*time.Millisecond, time.Millisecond),
+		withDeviceOpener(opener),
+	)...)
+	_, err := allocatePermissions(t, vdp, "vol-aaaaa")
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("Expected DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestAllocateDeviceNotFound(t *testing.T) {
+	opts := fakeDevices(t, map[string]string{})
+	vdp := newVolumeDevicePlugin("vol-aaaaa", nil, append(opts,
+		WithDeviceOpenWait(time.Second, time.Millisecond),
+		withDeviceOpener(func(string) error { return nil }),
+	)...)
+	_, err := allocatePermissions(t, vdp, "vol-aaaaa")
+	if !errors.Is(err, volwatch.ErrDeviceNotFound) {
+		t.Fatalf("Expected ErrDeviceNotFound, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "volume vol-aaaaa not found at ") {
+		t.Errorf("Expected the missing path in the error, got %q", err)
+	}
+}
+
+func TestAllocateCircularSymlink(t *testing.T) {
+	opts := fakeDevices(t, map[string]string{})
+	vdp := newVolumeDevicePlugin("vol-aaaaa", nil, append(opts,
+		WithDeviceOpenWait(time.Second, time.Millisecond),
+		withDeviceOpener(func(string) error { return nil }),
+	)...)
+	symlink := vdp.devicePath("vol-aaaaa")
+	if err := os.Symlink(filepath.Base(symlink), symlink); err != nil {
+		t.Fatal(err)
+	}
+	_, err := allocatePermissions(t, vdp, "vol-aaaaa")
+	if !errors.Is(err, volwatch.ErrCircularSymlink) {
+		t.Fatalf("Expected ErrCircularSymlink, got %v", err)
+	}
+	if !strings.Contains(err.Error(), symlink) {
+		t.Errorf("Expected the symlink path in the error, got %q", err)
+	}
+}
+
+func TestAllocateBlockDeviceNotReady(t *testing.T) {
+	opts := fakeDevices(t, map[string]string{"vol-aaaaa": "vda"}, "vda")
+	vdp := newVolumeDevicePlugin("vol-aaaaa", nil, append(opts,
+		WithDeviceOpenWait(20*time.Millisecond, time.Millisecond),
+		withDeviceOpener(func(string) error { return nil }),
+	)...)
+	// Partition table still being scanned
+	if err := os.WriteFile(filepath.Join(vdp.sysBlockDir, "vda", "size"), []byte("0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := allocatePermissions(t, vdp, "vol-aaaaa")
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("Expected DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestAllocateBlockDeviceBecomesReady(t *testing.T) {
+	opts := fakeDevices(t, map[string]string{"vol-aaaaa": "vda"})
+	vdp := newVolumeDevicePlugin("vol-aaaaa", nil, append(opts,
+		WithDeviceOpenWait(5*time.Second, time.Millisecond),
+		withDeviceOpener(func(string) error { return nil }),
+	)...)
+	deviceDir := filepath.Join(vdp.sysBlockDir, "vda")
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		os.Mkdir(deviceDir, 0755)
+		os.WriteFile(filepath.Join(deviceDir, "size"), []byte("2048\n"), 0644)
+		os.WriteFile(filepath.Join(deviceDir, "stat"), nil, 0644)
+	}()
+	if _, err := allocatePermissions(t, vdp, "vol-aaaaa"); err != nil {
+		t.Errorf("Expected allocation once the block device was ready, got %v", err)
+	}
+}
+
+func TestAllocateDeviceOpenError(t *testing.T) {
+	opts := fakeDevices(t, map[string]string{"vol-aaaaa": "vda"})
+	attempts := 0
+	vdp := newVolumeDevicePlugin("vol-aaaaa", nil, append(opts,
+		WithDeviceOpenWait(time.Second, time.Millisecond),
+		withDeviceOpener(func(string) error {
+			attempts++
+			return os.ErrPermission
+		}),
+	)...)
+	if _, err := allocatePermissions(t, vdp, "vol-aaaaa"); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("Expected permission error, got %v", err)
+	}
+	if attempts != 1 {
+		t.Errorf("Expected no retries, got %d attempts", attempts)
+	}
+}
+
+func TestAllocateNoDeviceWait(t *testing.T) {
+	opts := fakeDevices(t, map[string]string{"vol-aaaaa": "vda"})
+	opener, attempts := unreadyDevice(math.MaxInt)
+	vdp := newVolumeDevicePlugin("vol-aaaaa", nil, append(opts, withDeviceOpener(opener))...)
+	if _, err := allocatePermissions(t, vdp, "vol-aaaaa"); err != nil {
+		t.Fatal(err)
+	}
+	if *attempts != 0 {
+		t.Errorf("Expected the device not to be opened, got %d attempts", *attempts)
+	}
+}
+
+func TestAllocateCDISpec(t *testing.T) {
+	opts := fakeDevices(t, map[string]string{"vol-aaaaa": "vda"})
+	cdiDir := t.TempDir()
+	vl := newTestLister(t, WithPluginOptions(append(opts, WithCDIOutputDir(cdiDir))...))
+	vdp := vl.NewPlugin("vol-aaaaa").(*volumeDevicePlugin)
+	if err := allocate(vdp, "vol-aaaaa"); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(cdiDir, "volumes.brightbox.com-volume-vol-aaaaa.json")
+	spec, err := cdi.ReadSpec(path)
+	if err != nil {
+		t.Fatalf("Expected a valid CDI spec, got %v", err)
+	}
+	if spec.Kind != "volumes.brightbox.com/volume" || len(spec.Devices) != 1 || spec.Devices[0].Name != "vol-aaaaa" {
+		t.Fatalf("Unexpected spec %+v", spec)
+	}
+	edits := spec.Devices[0].ContainerEdits
+	symlink := vdp.devicePath("vol-aaaaa")
+	if len(edits.DeviceNodes) != 1 ||
+		edits.DeviceNodes[0].Path != symlink ||
+		edits.DeviceNodes[0].HostPath != symlink ||
+		edits.DeviceNodes[0].Permissions != "rw" {
+		t.Errorf("Unexpected device nodes %+v", edits.DeviceNodes)
+	}
+	if !slices.Contains(edits.Env, "BRIGHTBOX_VOLUME_ID=vol-aaaaa") {
+		t.Errorf("Expected volume ID in environment, got %v", edits.Env)
+	}
+
+	vdp.Stop()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected CDI spec to be removed, got %v", err)
+	}
+}
+
+func TestAllocateNoCDISpecOnConflict(t *testing.T) {
+	opts := fakeDevices(t, map[string]string{"vol-aaaaa": "vda"})
+	cdiDir := t.TempDir()
+	tracker := NewAllocationTracker()
+	tracker.Claim("vol-aaaaa")
+	vdp := newVolumeDevicePlugin("vol-aaaaa", nil, append(opts,
+		WithCDIOutputDir(cdiDir),
+		WithAllocationTracker(tracker),
+	)...)
+	if err := allocate(vdp, "vol-aaaaa"); status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("Expected AlreadyExists, got %v", err)
+	}
+	if entries, _ := os.ReadDir(cdiDir); len(entries) != 0 {
+		t.Errorf("Expected no CDI spec, got %v", entries)
+	}
+}
+
+func TestResolveDeviceWithResolver(t *testing.T) {
+	vdp := newVolumeDevicePlugin("vol-aaaaa", nil,
+		withIDDevicePath(func(string) (string, error) {
+			t.Error("Expected the resolver to be used instead of the symlink")
+			return "", nil
+		}),
+		withDeviceResolver(func(id string) (string, error) {
+			return "/dev/" + id, nil
+		}),
+	)
+	if path, err := vdp.resolveDevice("vol-aaaaa"); err != nil || path != "/dev/vol-aaaaa" {
+		t.Errorf("Expected /dev/vol-aaaaa, got %q, %v", path, err)
+	}
+}
@@ -1,14 +1,18 @@
 package dpm
 
 import (
+	"fmt"
+	"io/fs"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
-	"github.com/fsnotify/fsnotify"
-	"github.com/golang/glog"
+	"github.com/brightbox/brightbox-volume-device-plugin/kubelet"
+	"github.com/brightbox/brightbox-volume-device-plugin/logging"
 
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
@@ -17,103 +21,315 @@ import (
 const (
 	startPluginServerRetries   = 3
 	startPluginServerRetryWait = 3 * time.Second
+
+	defaultPluginStartTimeout = 10 * time.Second
+
+	// defaultSocketPermissions leaves plugin sockets usable only by
+	// their owner, root in a deployed plugin
+	defaultSocketPermissions fs.FileMode = 0600
+
+	// insecureSocketDirPermissions are the socket directory mode bits
+	// beyond 0750 that draw a warning at startup
+	insecureSocketDirPermissions fs.FileMode = 0027
 )
 
-// Manager contains the main machinery of this framework. It uses user defined lister to monitor
+// Manager contains the main machinery of this framework. It uses user defined listers to monitor
 // available resources and start/stop plugins accordingly. It also handles system signals and
 // unexpected kubelet events.
 type Manager struct {
-	lister ListerInterface
+	listers        []ListerInterface
+	pluginMap      map[string]*devicePlugin
+	pluginMapMutex sync.Mutex
+	socketDir      string
+	socketMode     fs.FileMode
+	stopCh         chan struct{}
+	stopOnce       sync.Once
+	restartCh      chan struct{}
+
+	registrationTimeout time.Duration
+	pluginStartTimeout  time.Duration
+	pluginStopTimeout   time.Duration
+	negotiator          *VersionNegotiator
+}
+
+// ManagerOption configures a Manager at construction time
+type ManagerOption func(*Manager)
+
+// WithSocketDir replaces the directory holding the kubelet registration
+// socket and the plugin sockets, which defaults to
+// /var/lib/kubelet/device-plugins/
+func WithSocketDir(dir string) ManagerOption {
+	return func(dpm *Manager) {
+		dpm.socketDir = dir
+	}
+}
+
+// WithSocketPermissions sets the mode of each plugin socket, 0600 by
+// default so that only the plugin's user, and kubelet running as root,
+// may connect
+func WithSocketPermissions(mode fs.FileMode) ManagerOption {
+	return func(dpm *Manager) {
+		dpm.socketMode = mode.Perm()
+	}
+}
+
+// WithRegistrationTimeout limits how long each plugin waits for kubelet
+// to answer its registration request. A zero duration waits forever.
+func WithRegistrationTimeout(d time.Duration) ManagerOption {
+	return func(dpm *Manager) {
+		dpm.registrationTimeout = d
+	}
+}
+
+// WithPluginStartTimeout sets how long each plugin's gRPC server is given
+// to become ready before registering with kubelet, 10 seconds by default
+func WithPluginStartTimeout(d time.Duration) ManagerOption {
+	return func(dpm *Manager) {
+		if d > 0 {
+			dpm.pluginStartTimeout = d
+		}
+	}
+}
+
+// WithPluginStopTimeout stops plugins gracefully, letting open calls such
+// as ListAndWatch finish for up to d before their connections are
+// closed. A zero duration, the default, closes them immediately.
+func WithPluginStopTimeout(d time.Duration) ManagerOption {
+	return func(dpm *Manager) {
+		dpm.pluginStopTimeout = d
+	}
+}
+
+// WithAPIVersions sets the device plugin API versions plugins try in
+// turn when registering with kubelet, by default V1beta1 then V1alpha
+func WithAPIVersions(versions ...APIVersion) ManagerOption {
+	return func(dpm *Manager) {
+		dpm.negotiator = NewVersionNegotiator(versions...)
+	}
+}
+
+// WithListers adds listers for further resource namespaces, whose
+// plugins are run alongside those of the lister given to NewManager.
+// Each lister must have a distinct resource namespace.
+func WithListers(listers ...ListerInterface) ManagerOption {
+	return func(dpm *Manager) {
+		dpm.listers = append(dpm.listers, listers...)
+	}
 }
 
 // NewManager is the canonical way of initializing Manager. User must provide ListerInterface
 // implementation. Lister will provide information about handled resources, monitor their
 // availability and provide method to spawn plugins that will handle found resources.
-func NewManager(lister ListerInterface) *Manager {
-	return &Manager{
-		lister: lister,
+func NewManager(lister ListerInterface, opts ...ManagerOption) *Manager {
+	dpm := &Manager{
+		listers:    []ListerInterface{lister},
+		socketDir:  pluginapi.DevicePluginPath,
+		socketMode: defaultSocketPermissions,
+		stopCh:     make(chan struct{}),
+		restartCh:  make(chan struct{}, 1),
+
+		pluginStartTimeout: defaultPluginStartTimeout,
+		negotiator:         NewVersionNegotiator(),
+	}
+	for _, opt := range opts {
+		opt(dpm)
 	}
+	return dpm
 }
 
 // Run starts the Manager. It sets up the infrastructure and handles system signals, Kubelet socket
-// watch and monitoring of available resources as well as starting and stoping of plugins.
-func (dpm *Manager) Run() {
-	glog.V(3).Info("Starting device plugin manager")
+// watch and monitoring of available resources as well as starting and stoping of plugins. It
+// returns an error without starting any plugins if the socket directory cannot be watched.
+func (dpm *Manager) Run() error {
+	logging.V(3).Info("Starting device plugin manager")
+
+	if info, err := os.Stat(dpm.socketDir); err != nil {
+		return fmt.Errorf("device plugin socket directory: %w", err)
+	} else if !info.IsDir() {
+		return fmt.Errorf("device plugin socket directory %s is not a directory", dpm.socketDir)
+	} else if err := checkSocketDir(info); err != nil {
+		logging.Warn("Device plugin socket directory is not secure", "dir", dpm.socketDir, "err", err)
+	}
 
 	// First important signal channel is the os signal channel. We only care about (somewhat) small
 	// subset of available signals.
-	glog.V(3).Info("Registering for system signal notifications")
+	logging.V(3).Info("Registering for system signal notifications")
 	signalCh := make(chan os.Signal, 1)
 	signal.Notify(signalCh, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGINT)
 
-	// The other important channel is filesystem notification channel, responsible for watching
-	// device plugin directory.
-	glog.V(3).Info("Registering for notifications of filesystem changes in device plugin directory")
-	fsWatcher, _ := fsnotify.NewWatcher()
-	defer fsWatcher.Close()
-	fsWatcher.Add(pluginapi.DevicePluginPath)
-
-	// Create list of running plugins and start Discover method of given lister. This method is
-	// responsible of notifying manager about changes in available plugins.
-	var pluginMap = make(map[string]*devicePlugin)
-	glog.V(3).Info("Starting Discovery on new plugins")
-	pluginsCh := make(chan PluginNameListSync)
-	defer close(pluginsCh)
-	go dpm.lister.Discover(pluginsCh)
+	// The other important channel is the restart channel, triggered by watching the device
+	// plugin directory for kubelet recreating its socket.
+	logging.V(3).Info("Registering for notifications of kubelet restarts in device plugin directory")
+	kubeletSocket := filepath.Join(dpm.socketDir, filepath.Base(pluginapi.KubeletSocket))
+	kubeletWatcher, err := kubelet.NewKubeletWatcher(kubeletSocket, dpm.Restart)
+	if err != nil {
+		return fmt.Errorf("watching device plugin socket directory %s: %w", dpm.socketDir, err)
+	}
+	defer kubeletWatcher.Close()
+
+	// Create list of running plugins and start Discover method of given listers. This method is
+	// responsible of notifying manager about changes in available plugins. Lists from every
+	// lister are passed on to a single channel, tagged with the lister that sent them.
+	dpm.pluginMapMutex.Lock()
+	dpm.pluginMap = make(map[string]*devicePlugin)
+	pluginMap := dpm.pluginMap
+	dpm.pluginMapMutex.Unlock()
+	logging.V(3).Info("Starting Discovery on new plugins")
+	pluginsCh := make(chan listerPluginNameList)
+	forwardDone := make(chan struct{})
+	defer close(forwardDone)
+	for _, lister := range dpm.listers {
+		listerCh := make(chan PluginNameListSync)
+		defer close(listerCh)
+		go forwardPluginNameLists(lister, listerCh, pluginsCh, forwardDone)
+		go lister.Discover(listerCh)
+	}
 
 	// Finally start a loop that will handle messages from opened channels.
-	glog.V(3).Info("Handling incoming signals")
+	logging.V(3).Info("Handling incoming signals")
 HandleSignals:
 	for {
 		select {
 		case newPluginsList := <-pluginsCh:
-			glog.V(3).Infof("Received new list of plugins: %s", newPluginsList.Names)
-			dpm.handleNewPlugins(pluginMap, newPluginsList.Names)
+			logging.V(3).Info("Received new list of plugins",
+				"namespace", newPluginsList.lister.GetResourceNamespace(), "plugins", newPluginsList.Names)
+			dpm.handleNewPlugins(pluginMap, newPluginsList.lister, newPluginsList.Names)
 			if newPluginsList.Synced != nil {
 				newPluginsList.Synced.Done()
 			}
-		case event := <-fsWatcher.Events:
-			if event.Name == pluginapi.KubeletSocket {
-				glog.V(3).Infof("Received kubelet socket event: %s", event)
-				if event.Op&fsnotify.Create == fsnotify.Create {
-					dpm.startPluginServers(pluginMap)
-				}
-				// TODO: Kubelet doesn't really clean-up it's socket, so this is currently
-				// manual-testing thing. Could we solve Kubelet deaths better?
-				if event.Op&fsnotify.Remove == fsnotify.Remove {
-					dpm.stopPluginServers(pluginMap)
-				}
-			}
+		case <-dpm.restartCh:
+			// A new kubelet has removed the plugin sockets and knows nothing of the
+			// plugins, so serve each on a fresh socket and register it again.
+			logging.V(3).Info("Restarting plugin servers")
+			dpm.stopPluginServers(pluginMap)
+			dpm.startPluginServers(pluginMap)
 		case s := <-signalCh:
 			switch s {
 			case syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGINT:
-				glog.V(3).Infof("Received signal \"%v\", shutting down", s)
+				logging.V(3).Info("Received signal, shutting down", "signal", s)
 				dpm.stopPlugins(pluginMap)
 				break HandleSignals
 			}
+		case <-dpm.stopCh:
+			logging.V(3).Info("Manager stopped, shutting down")
+			dpm.stopPlugins(pluginMap)
+			break HandleSignals
 		}
 	}
+	return nil
+}
+
+// Stop makes Run stop all plugins, removing their sockets, and return
+// just as it does on receiving SIGTERM
+func (dpm *Manager) Stop() {
+	dpm.stopOnce.Do(func() {
+		close(dpm.stopCh)
+	})
 }
 
-func (dpm *Manager) handleNewPlugins(currentPluginsMap map[string]*devicePlugin, newPluginsList PluginNameList) {
+// Restart makes Run restart every plugin's gRPC server and register it
+// with kubelet again, as needed after kubelet restarts. It does not
+// block, and restarts requested before Run handles the first are
+// combined with it.
+func (dpm *Manager) Restart() {
+	select {
+	case dpm.restartCh <- struct{}{}:
+	default:
+	}
+}
+
+// RemoveSockets deletes any plugin sockets for the listers' resource
+// namespaces from the socket directory, such as those left behind by a
+// previous run that was killed. Other files are left alone. It should
+// not be called while plugins are running.
+func (dpm *Manager) RemoveSockets() error {
+	for _, lister := range dpm.listers {
+		pattern := filepath.Join(dpm.socketDir, lister.GetResourceNamespace()+"_*")
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return err
+		}
+		for _, name := range matches {
+			info, err := os.Lstat(name)
+			if err != nil || info.Mode()&os.ModeSocket == 0 {
+				continue
+			}
+			logging.Info("Removing stale plugin socket", "socket", name)
+			if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Plugins returns the resource names of the plugins the Manager is
+// currently running, e.g. "color.example.com/red". During shutdown these
+// are the plugins still to be stopped.
+func (dpm *Manager) Plugins() []string {
+	dpm.pluginMapMutex.Lock()
+	defer dpm.pluginMapMutex.Unlock()
+	names := make([]string, 0, len(dpm.pluginMap))
+	for name := range dpm.pluginMap {
+		names = append(names, name)
+	}
+	return names
+}
+
+// listerPluginNameList is a PluginNameListSync received from a lister
+type listerPluginNameList struct {
+	PluginNameListSync
+	lister ListerInterface
+}
+
+// forwardPluginNameLists passes each list the lister sends on from to
+// the shared channel to, until done is closed
+func forwardPluginNameLists(lister ListerInterface, from <-chan PluginNameListSync, to chan<- listerPluginNameList, done <-chan struct{}) {
+	for {
+		select {
+		case list, ok := <-from:
+			if !ok {
+				return
+			}
+			select {
+			case to <- listerPluginNameList{PluginNameListSync: list, lister: lister}:
+			case <-done:
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// handleNewPlugins starts plugins for the resources in newPluginsList
+// and stops the lister's plugins for resources no longer in it. Plugins
+// from other listers are left alone. currentPluginsMap is keyed by
+// resource name, so that last names need only be unique within a
+// namespace.
+func (dpm *Manager) handleNewPlugins(currentPluginsMap map[string]*devicePlugin, lister ListerInterface, newPluginsList PluginNameList) {
 	var wg sync.WaitGroup
-	var pluginMapMutex = &sync.Mutex{}
+	var pluginMapMutex = &dpm.pluginMapMutex
+	namespace := lister.GetResourceNamespace()
 
 	// This map is used for faster searches when removing old plugins
 	newPluginsSet := make(map[string]bool)
 
 	// Add new plugins
 	for _, newPluginLastName := range newPluginsList {
-		newPluginsSet[newPluginLastName] = true
+		newPluginsSet[namespace+"/"+newPluginLastName] = true
 		wg.Add(1)
 		go func(name string) {
-			if _, ok := currentPluginsMap[name]; !ok {
+			pluginMapMutex.Lock()
+			_, ok := currentPluginsMap[namespace+"/"+name]
+			pluginMapMutex.Unlock()
+			if !ok {
 				// add new plugin only if it doesn't already exist
-				glog.V(3).Infof("Adding a new plugin \"%s\"", name)
-				plugin := newDevicePlugin(dpm.lister.GetResourceNamespace(), name, dpm.lister.NewPlugin(name))
+				logging.V(3).Info("Adding a new plugin", "namespace", namespace, "plugin", name)
+				plugin := dpm.newDevicePlugin(namespace, name, lister.NewPlugin(name))
 				startPlugin(name, plugin)
 				pluginMapMutex.Lock()
-				currentPluginsMap[name] = plugin
+				currentPluginsMap[plugin.ResourceName] = plugin
 				pluginMapMutex.Unlock()
 			}
 			wg.Done()
@@ -122,31 +338,58 @@ func (dpm *Manager) handleNewPlugins(currentPluginsMap map[string]*devicePlugin,
 	wg.Wait()
 
 	// Remove old plugins
-	for pluginLastName, currentPlugin := range currentPluginsMap {
+	for resourceName, currentPlugin := range dpm.copyPlugins(currentPluginsMap) {
+		if !strings.HasPrefix(resourceName, namespace+"/") {
+			continue
+		}
 		wg.Add(1)
-		go func(name string, plugin *devicePlugin) {
-			if _, found := newPluginsSet[name]; !found {
-				glog.V(3).Infof("Remove unused plugin \"%s\"", name)
-				stopPlugin(name, plugin)
+		go func(resourceName string, plugin *devicePlugin) {
+			if _, found := newPluginsSet[resourceName]; !found {
+				logging.V(3).Info("Remove unused plugin", "namespace", namespace, "plugin", plugin.Name)
+				stopPlugin(plugin.Name, plugin)
 				pluginMapMutex.Lock()
-				delete(currentPluginsMap, name)
+				delete(currentPluginsMap, resourceName)
 				pluginMapMutex.Unlock()
 			}
 			wg.Done()
-		}(pluginLastName, currentPlugin)
+		}(resourceName, currentPlugin)
 	}
 	wg.Wait()
 }
 
+// newDevicePlugin creates a plugin with the Manager's socket directory
+// and timeouts
+func (dpm *Manager) newDevicePlugin(namespace string, name string, impl PluginInterface) *devicePlugin {
+	plugin := newDevicePlugin(dpm.socketDir, namespace, name, impl)
+	plugin.registrationTimeout = dpm.registrationTimeout
+	plugin.startTimeout = dpm.pluginStartTimeout
+	plugin.stopTimeout = dpm.pluginStopTimeout
+	plugin.negotiator = dpm.negotiator
+	plugin.socketMode = dpm.socketMode
+	return plugin
+}
+
+// checkSocketDir gives an error if the socket directory described by
+// info is not owned by root or is more open than 0750
+func checkSocketDir(info fs.FileInfo) error {
+	if mode := info.Mode().Perm(); mode&insecureSocketDirPermissions != 0 {
+		return fmt.Errorf("mode %04o is more open than 0750", mode)
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Uid != 0 {
+		return fmt.Errorf("owned by uid %d, not root", stat.Uid)
+	}
+	return nil
+}
+
 func (dpm *Manager) startPluginServers(pluginMap map[string]*devicePlugin) {
 	var wg sync.WaitGroup
 
-	for pluginLastName, currentPlugin := range pluginMap {
+	for _, currentPlugin := range pluginMap {
 		wg.Add(1)
-		go func(name string, plugin *devicePlugin) {
-			startPluginServer(name, plugin)
+		go func(plugin *devicePlugin) {
+			startPluginServer(plugin.Name, plugin)
 			wg.Done()
-		}(pluginLastName, currentPlugin)
+		}(currentPlugin)
 	}
 	wg.Wait()
 }
@@ -154,39 +397,51 @@ func (dpm *Manager) startPluginServers(pluginMap map[string]*devicePlugin) {
 func (dpm *Manager) stopPluginServers(pluginMap map[string]*devicePlugin) {
 	var wg sync.WaitGroup
 
-	for pluginLastName, currentPlugin := range pluginMap {
+	for _, currentPlugin := range pluginMap {
 		wg.Add(1)
-		go func(name string, plugin *devicePlugin) {
-			stopPluginServer(name, plugin)
+		go func(plugin *devicePlugin) {
+			stopPluginServer(plugin.Name, plugin)
 			wg.Done()
-		}(pluginLastName, currentPlugin)
+		}(currentPlugin)
 	}
 	wg.Wait()
 }
 
 func (dpm *Manager) stopPlugins(pluginMap map[string]*devicePlugin) {
 	var wg sync.WaitGroup
-	var pluginMapMutex = &sync.Mutex{}
+	var pluginMapMutex = &dpm.pluginMapMutex
 
-	for pluginLastName, currentPlugin := range pluginMap {
+	for resourceName, currentPlugin := range dpm.copyPlugins(pluginMap) {
 		wg.Add(1)
-		go func(name string, plugin *devicePlugin) {
-			stopPlugin(name, plugin)
+		go func(resourceName string, plugin *devicePlugin) {
+			stopPlugin(plugin.Name, plugin)
 			pluginMapMutex.Lock()
-			delete(pluginMap, name)
+			delete(pluginMap, resourceName)
 			pluginMapMutex.Unlock()
 			wg.Done()
-		}(pluginLastName, currentPlugin)
+		}(resourceName, currentPlugin)
 	}
 	wg.Wait()
 }
 
+// copyPlugins returns a copy of pluginMap that can be ranged over while
+// plugins are removed from the original
+func (dpm *Manager) copyPlugins(pluginMap map[string]*devicePlugin) map[string]*devicePlugin {
+	dpm.pluginMapMutex.Lock()
+	defer dpm.pluginMapMutex.Unlock()
+	result := make(map[string]*devicePlugin, len(pluginMap))
+	for name, plugin := range pluginMap {
+		result[name] = plugin
+	}
+	return result
+}
+
 func startPlugin(pluginLastName string, plugin *devicePlugin) {
 	var err error
 	if devicePluginImpl, ok := plugin.DevicePluginImpl.(PluginInterfaceStart); ok {
 		err = devicePluginImpl.Start()
 		if err != nil {
-			glog.Errorf("Failed to start plugin \"%s\": %s", pluginLastName, err)
+			logging.Error("Failed to start plugin", "plugin", pluginLastName, "err", err)
 		}
 	}
 	if err == nil {
@@ -199,7 +454,7 @@ func stopPlugin(pluginLastName string, plugin *devicePlugin) {
 	if devicePluginImpl, ok := plugin.DevicePluginImpl.(PluginInterfaceStop); ok {
 		err := devicePluginImpl.Stop()
 		if err != nil {
-			glog.Errorf("Failed to stop plugin \"%s\": %s", pluginLastName, err)
+			logging.Error("Failed to stop plugin", "plugin", pluginLastName, "err", err)
 		}
 	}
 }
@@ -210,11 +465,11 @@ func startPluginServer(pluginLastName string, plugin *devicePlugin) {
 		if err == nil {
 			return
 		} else if i == startPluginServerRetries {
-			glog.V(3).Infof("Failed to start plugin's \"%s\" server, within given %d tries: %s",
-				pluginLastName, startPluginServerRetries, err)
+			logging.V(3).Info("Failed to start plugin's server within given tries",
+				"plugin", pluginLastName, "tries", startPluginServerRetries, "err", err)
 		} else {
-			glog.Errorf("Failed to start plugin's \"%s\" server, atempt %d ouf of %d waiting %d before next try: %s",
-				pluginLastName, i, startPluginServerRetries, startPluginServerRetryWait, err)
+			logging.Error("Failed to start plugin's server, waiting before next try",
+				"plugin", pluginLastName, "attempt", i, "tries", startPluginServerRetries, "wait", startPluginServerRetryWait, "err", err)
 			time.Sleep(startPluginServerRetryWait)
 		}
 	}
@@ -223,13 +478,13 @@ func startPluginServer(pluginLastName string, plugin *devicePlugin) {
 func stopPluginServer(pluginLastName string, plugin *devicePlugin) {
 	err := plugin.StopServer()
 	if err != nil {
-		glog.Errorf("Failed to stop plugin's \"%s\" server: %s", pluginLastName, err)
+		logging.Error("Failed to stop plugin's server", "plugin", pluginLastName, "err", err)
 	}
 }
 
 func gracefulStopPluginServer(pluginLastName string, plugin *devicePlugin) {
 	err := plugin.GracefulStopServer()
 	if err != nil {
-		glog.Errorf("Failed to gracefully stop plugin's \"%s\" server: %s", pluginLastName, err)
+		logging.Error("Failed to gracefully stop plugin's server", "plugin", pluginLastName, "err", err)
 	}
 }
@@ -0,0 +1,436 @@
+package dpm
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+type fakeKubelet struct {
+	pluginapi.UnimplementedRegistrationServer
+	registered chan *pluginapi.RegisterRequest
+	server     *grpc.Server
+}
+
+func (k *fakeKubelet) Register(ctx context.Context, req *pluginapi.RegisterRequest) (*pluginapi.Empty, error) {
+	k.registered <- req
+	return &pluginapi.Empty{}, nil
+}
+
+func serveFakeKubelet(t *testing.T, dir string) *fakeKubelet {
+	sock, err := net.Listen("unix", filepath.Join(dir, "kubelet.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	kubelet := &fakeKubelet{registered: make(chan *pluginapi.RegisterRequest, 4), server: server}
+	pluginapi.RegisterRegistrationServer(server, kubelet)
+	go server.Serve(sock)
+	t.Cleanup(server.Stop)
+	return kubelet
+}
+
+type fakeLister struct {
+	namespace string
+	names     PluginNameList
+	synced    sync.WaitGroup
+}
+
+func (fl *fakeLister) GetResourceNamespace() string {
+	if fl.namespace == "" {
+		return "volumes.example.com"
+	}
+	return fl.namespace
+}
+
+func (fl *fakeLister) Discover(pluginListCh chan PluginNameListSync) {
+	pluginListCh <- PluginNameListSync{Names: fl.names, Synced: &fl.synced}
+}
+
+func (fl *fakeLister) NewPlugin(string) PluginInterface {
+	return &pluginapi.UnimplementedDevicePluginServer{}
+}
+
+func TestManagerSocketDir(t *testing.T) {
+	dir := t.TempDir()
+	kubelet := serveFakeKubelet(t, dir)
+	lister := &fakeLister{names: PluginNameList{"vol-12345"}}
+	lister.synced.Add(1)
+
+	manager := NewManager(lister, WithSocketDir(dir))
+	done := make(chan struct{})
+	go func() {
+		manager.Run()
+		close(done)
+	}()
+	lister.synced.Wait()
+
+	socket := filepath.Join(dir, "volumes.example.com_vol-12345")
+	if _, err := os.Stat(socket); err != nil {
+		t.Errorf("Expected plugin socket: %s", err)
+	}
+	select {
+	case req := <-kubelet.registered:
+		if req.Endpoint != "volumes.example.com_vol-12345" || req.ResourceName != "volumes.example.com/vol-12345" {
+			t.Errorf("Unexpected registration %+v", req)
+		}
+	default:
+		t.Error("Plugin did not register with kubelet")
+	}
+
+	manager.Stop()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Manager did not stop")
+	}
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("Expected plugin socket to be removed, got %v", err)
+	}
+}
+
+// staleSocket leaves a socket file at path with nothing listening on it,
+// as a killed plugin would
+func staleSocket(t *testing.T, path string) {
+	t.Helper()
+	sock, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock.(*net.UnixListener).SetUnlinkOnClose(false)
+	sock.Close()
+}
+
+func TestManagerRemoveSockets(t *testing.T) {
+	dir := t.TempDir()
+	stale := filepath.Join(dir, "volumes.example.com_vol-12345")
+	staleSocket(t, stale)
+	other := filepath.Join(dir, "other.example.com_vol-12345")
+	staleSocket(t, other)
+	file := filepath.Join(dir, "volumes.example.com_notes")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	manager := NewManager(&fakeLister{}, WithSocketDir(dir))
+	if err := manager.RemoveSockets(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(stale); !os.IsNotExist(err) {
+		t.Errorf("Expected stale socket to be removed, got %v", err)
+	}
+	for _, path := range []string{other, file} {
+		if _, err := os.Lstat(path); err != nil {
+			t.Errorf("Expected %s to be left alone, got %v", path, err)
+		}
+	}
+}
+
+func TestManagerStartsWithStaleSocket(t *testing.T) {
+	dir := t.TempDir()
+	kubelet := serveFakeKubelet(t, dir)
+	staleSocket(t, filepath.Join(dir, "volumes.example.com_vol-12345"))
+	lister := &fakeLister{names: PluginNameList{"vol-12345"}}
+	lister.synced.Add(1)
+
+	manager := NewManager(lister, WithSocketDir(dir))
+	if err := manager.RemoveSockets(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		manager.Run()
+		close(done)
+	}()
+	defer func() {
+		manager.Stop()
+		<-done
+	}()
+	lister.synced.Wait()
+
+	select {
+	case <-kubelet.registered:
+	default:
+		t.Error("Plugin did not register with kubelet")
+	}
+}
+
+func TestManagerMultipleListers(t *testing.T) {
+	dir := t.TempDir()
+	kubelet := serveFakeKubelet(t, dir)
+	volumes := &fakeLister{names: PluginNameList{"vol-12345"}}
+	volumes.synced.Add(1)
+	ssds := &fakeLister{namespace: "ssd.example.com", names: PluginNameList{"vol-12345", "ssd-12345"}}
+	ssds.synced.Add(1)
+
+	manager := NewManager(volumes, WithSocketDir(dir), WithListers(ssds))
+	staleSocket(t, filepath.Join(dir, "ssd.example.com_ssd-99999"))
+	if err := manager.RemoveSockets(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "ssd.example.com_ssd-99999")); !os.IsNotExist(err) {
+		t.Errorf("Expected stale socket in extra namespace to be removed, got %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		manager.Run()
+		close(done)
+	}()
+	volumes.synced.Wait()
+	ssds.synced.Wait()
+
+	expected := []string{"ssd.example.com/ssd-12345", "ssd.example.com/vol-12345", "volumes.example.com/vol-12345"}
+	plugins := manager.Plugins()
+	sort.Strings(plugins)
+	if len(plugins) != len(expected) {
+		t.Fatalf("Expected plugins %v, got %v", expected, plugins)
+	}
+	for i := range expected {
+		if plugins[i] != expected[i] {
+			t.Errorf("Expected plugins %v, got %v", expected, plugins)
+			break
+		}
+	}
+	registered := make([]string, 0, len(expected))
+	for range expected {
+		select {
+		case req := <-kubelet.registered:
+			registered = append(registered, req.ResourceName)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Only %v registered with kubelet", registered)
+		}
+	}
+	sort.Strings(registered)
+	for i := range expected {
+		if registered[i] != expected[i] {
+			t.Errorf("Expected registrations %v, got %v", expected, registered)
+			break
+		}
+	}
+	for _, name := range []string{"volumes.example.com_vol-12345", "ssd.example.com_vol-12345", "ssd.example.com_ssd-12345"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("Expected plugin socket: %s", err)
+		}
+	}
+
+	manager.Stop()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Manager did not stop")
+	}
+	if plugins := manager.Plugins(); len(plugins) != 0 {
+		t.Errorf("Expected all plugins stopped, got %v", plugins)
+	}
+}
+
+func TestManagerMissingSocketDir(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing")
+	manager := NewManager(&fakeLister{names: PluginNameList{"vol-12345"}}, WithSocketDir(missing))
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- manager.Run()
+	}()
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, os.ErrNotExist) || !strings.Contains(err.Error(), "socket directory") {
+			t.Errorf("Expected missing socket directory error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		manager.Stop()
+		t.Fatal("Manager started without a socket directory")
+	}
+}
+
+func TestManagerSocketDirNotDirectory(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	manager := NewManager(&fakeLister{}, WithSocketDir(file))
+	if err := manager.Run(); err == nil || !strings.Contains(err.Error(), "not a directory") {
+		t.Errorf("Expected not a directory error, got %v", err)
+	}
+}
+
+func TestManagerTimeoutOptions(t *testing.T) {
+	manager := NewManager(&fakeLister{},
+		WithSocketDir("/tmp"),
+		WithRegistrationTimeout(time.Second),
+		WithPluginStartTimeout(2*time.Second),
+		WithPluginStopTimeout(3*time.Second),
+	)
+	plugin := manager.newDevicePlugin("volumes.example.com", "vol-12345", &pluginapi.UnimplementedDevicePluginServer{})
+	if plugin.Socket != "/tmp/volumes.example.com_vol-12345" {
+		t.Errorf("Unexpected socket %s", plugin.Socket)
+	}
+	if plugin.registrationTimeout != time.Second || plugin.startTimeout != 2*time.Second || plugin.stopTimeout != 3*time.Second {
+		t.Errorf("Timeouts not passed to plugin: %+v", plugin)
+	}
+
+	defaults := NewManager(&fakeLister{}, WithPluginStartTimeout(0))
+	plugin = defaults.newDevicePlugin("volumes.example.com", "vol-12345", &pluginapi.UnimplementedDevicePluginServer{})
+	if plugin.registrationTimeout != 0 || plugin.startTimeout != defaultPluginStartTimeout || plugin.stopTimeout != 0 {
+		t.Errorf("Unexpected default timeouts: %+v", plugin)
+	}
+}
+
+// silentKubelet accepts registration requests but never answers them
+type silentKubelet struct {
+	pluginapi.UnimplementedRegistrationServer
+}
+
+func (k *silentKubelet) Register(ctx context.Context, req *pluginapi.RegisterRequest) (*pluginapi.Empty, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestPluginRegistrationTimeout(t *testing.T) {
+	dir := t.TempDir()
+	sock, err := net.Listen("unix", filepath.Join(dir, "kubelet.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	pluginapi.RegisterRegistrationServer(server, &silentKubelet{})
+	go server.Serve(sock)
+	defer server.Stop()
+
+	manager := NewManager(&fakeLister{},
+		WithSocketDir(dir),
+		WithRegistrationTimeout(100*time.Millisecond),
+		WithPluginStartTimeout(time.Millisecond),
+	)
+	plugin := manager.newDevicePlugin("volumes.example.com", "vol-12345", &pluginapi.UnimplementedDevicePluginServer{})
+	start := time.Now()
+	err = plugin.StartServer()
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("Expected registration to time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Registration took %s", elapsed)
+	}
+	if plugin.Running {
+		t.Error("Expected plugin server to be stopped after failed registration")
+	}
+}
+
+func TestManagerReregistersAfterKubeletRestart(t *testing.T) {
+	dir := t.TempDir()
+	kubelet := serveFakeKubelet(t, dir)
+	lister := &fakeLister{names: PluginNameList{"vol-12345"}}
+	lister.synced.Add(1)
+
+	manager := NewManager(lister, WithSocketDir(dir), WithPluginStartTimeout(time.Millisecond))
+	done := make(chan struct{})
+	go func() {
+		manager.Run()
+		close(done)
+	}()
+	defer func() {
+		manager.Stop()
+		<-done
+	}()
+	lister.synced.Wait()
+	select {
+	case <-kubelet.registered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Plugin did not register with kubelet")
+	}
+
+	// A restarting kubelet removes its socket and those of the plugins
+	kubelet.server.Stop()
+	socket := filepath.Join(dir, "volumes.example.com_vol-12345")
+	if err := os.Remove(socket); err != nil {
+		t.Fatal(err)
+	}
+	restarted := serveFakeKubelet(t, dir)
+	select {
+	case req := <-restarted.registered:
+		if req.ResourceName != "volumes.example.com/vol-12345" {
+			t.Errorf("Unexpected registration %+v", req)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Plugin did not register with the restarted kubelet")
+	}
+	if _, err := os.Stat(socket); err != nil {
+		t.Errorf("Expected plugin socket to be recreated: %s", err)
+	}
+}
+
+func TestManagerRestartBeforeRun(t *testing.T) {
+	manager := NewManager(&fakeLister{})
+	manager.Restart()
+	manager.Restart()
+	if len(manager.restartCh) != 1 {
+		t.Errorf("Expected restarts to be combined, got %d pending", len(manager.restartCh))
+	}
+}
+
+func TestPluginSocketPermissions(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		opts     []ManagerOption
+		expected os.FileMode
+	}{
+		{"default", nil, 0600},
+		{"custom", []ManagerOption{WithSocketPermissions(0660)}, 0660},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			serveFakeKubelet(t, dir)
+			manager := NewManager(&fakeLister{}, append(tt.opts, WithSocketDir(dir), WithPluginStartTimeout(time.Millisecond))...)
+			plugin := manager.newDevicePlugin("volumes.example.com", "vol-12345", &pluginapi.UnimplementedDevicePluginServer{})
+			if err := plugin.StartServer(); err != nil {
+				t.Fatal(err)
+			}
+			defer plugin.StopServer()
+			info, err := os.Stat(plugin.Socket)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Type() != os.ModeSocket || info.Mode().Perm() != tt.expected {
+				t.Errorf("Expected a socket with mode %04o, got %s", tt.expected, info.Mode())
+			}
+		})
+	}
+}
+
+func TestCheckSocketDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Chmod(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkSocketDir(info); err == nil || !strings.Contains(err.Error(), "0777") {
+		t.Errorf("Expected mode 0777 to be reported, got %v", err)
+	}
+	if err := os.Chmod(dir, 0750); err != nil {
+		t.Fatal(err)
+	}
+	if info, err = os.Stat(dir); err != nil {
+		t.Fatal(err)
+	}
+	err = checkSocketDir(info)
+	if os.Getuid() == 0 && err != nil {
+		t.Errorf("Expected a root owned 0750 directory to pass, got %v", err)
+	} else if os.Getuid() != 0 && (err == nil || !strings.Contains(err.Error(), "not root")) {
+		t.Errorf("Expected the owner to be reported, got %v", err)
+	}
+}
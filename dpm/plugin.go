@@ -1,16 +1,19 @@
 package dpm
 
 import (
+	"io/fs"
 	"net"
 	"os"
 	"path"
+	"path/filepath"
 	"sync"
 	"time"
 
-	"github.com/golang/glog"
+	"github.com/brightbox/brightbox-volume-device-plugin/logging"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 
+	v1alpha "k8s.io/kubelet/pkg/apis/deviceplugin/v1alpha"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
@@ -43,25 +46,38 @@ type devicePlugin struct {
 	ResourceName     string
 	Name             string
 	Socket           string
+	KubeletSocket    string
 	Server           *grpc.Server
 	Running          bool
 	Starting         *sync.Mutex
+	APIVersion       APIVersion
+
+	negotiator *VersionNegotiator
+
+	registrationTimeout time.Duration
+	startTimeout        time.Duration
+	stopTimeout         time.Duration
+	socketMode          fs.FileMode
 }
 
-func newDevicePlugin(resourceNamespace string, pluginName string, devicePluginImpl PluginInterface) *devicePlugin {
+func newDevicePlugin(socketDir string, resourceNamespace string, pluginName string, devicePluginImpl PluginInterface) *devicePlugin {
 	return &devicePlugin{
 		DevicePluginImpl: devicePluginImpl,
-		Socket:           pluginapi.DevicePluginPath + resourceNamespace + "_" + pluginName,
+		Socket:           filepath.Join(socketDir, resourceNamespace+"_"+pluginName),
+		KubeletSocket:    filepath.Join(socketDir, filepath.Base(pluginapi.KubeletSocket)),
 		ResourceName:     resourceNamespace + "/" + pluginName,
 		Name:             pluginName,
 		Starting:         &sync.Mutex{},
+		startTimeout:     defaultPluginStartTimeout,
+		socketMode:       defaultSocketPermissions,
+		negotiator:       NewVersionNegotiator(),
 	}
 }
 
 // StartServer starts the gRPC server and registers the device plugin to Kubelet. Calling
 // StartServer on started object is NOOP.
 func (dpi *devicePlugin) StartServer() error {
-	glog.V(3).Infof("%s: Starting plugin server", dpi.Name)
+	logging.V(3).Info("Starting plugin server", "plugin", dpi.Name)
 
 	// If Kubelet socket is created, we may try to start the same plugin concurrently. To avoid
 	// that, let's make plugins startup a critical section.
@@ -80,49 +96,54 @@ func (dpi *devicePlugin) StartServer() error {
 	}
 
 	dpi.Running = true
-	glog.V(3).Infof("%s: plugin server running", dpi.Name)
+	logging.V(3).Info("Plugin server running", "plugin", dpi.Name)
 
 	err = dpi.register()
 	if err != nil {
-		glog.V(3).Infof("%s: plugin server stopping due to error", dpi.Name)
+		logging.V(3).Info("Plugin server stopping due to error", "plugin", dpi.Name)
 		dpi.StopServer()
 		return err
 	}
 
-	glog.V(3).Infof("%s: Finished starting plugin server", dpi.Name)
-	glog.V(4).Infof("%p", dpi)
-	glog.V(4).Infof("%+v", *dpi)
+	logging.V(3).Info("Finished starting plugin server", "plugin", dpi.Name)
+	logging.V(4).Info("Plugin state", "state", dpi)
 	return nil
 }
 
 // serve starts the gRPC server of the device plugin.
 func (dpi *devicePlugin) serve() error {
-	glog.V(3).Infof("%s: Starting the DPI gRPC server", dpi.Name)
+	logging.V(3).Info("Starting the DPI gRPC server", "plugin", dpi.Name)
 
 	err := dpi.cleanup()
 	if err != nil {
-		glog.Errorf("%s: Failed to setup a DPI gRPC server: %s", dpi.Name, err)
+		logging.Error("Failed to setup a DPI gRPC server", "plugin", dpi.Name, "err", err)
 		return err
 	}
 
 	sock, err := net.Listen("unix", dpi.Socket)
 	if err != nil {
-		glog.Errorf("%s: Failed to setup a DPI gRPC server: %s", dpi.Name, err)
+		logging.Error("Failed to setup a DPI gRPC server", "plugin", dpi.Name, "err", err)
+		return err
+	}
+	if err := os.Chmod(dpi.Socket, dpi.socketMode); err != nil {
+		logging.Error("Failed to set DPI socket permissions", "plugin", dpi.Name, "err", err)
+		sock.Close()
 		return err
 	}
 
 	dpi.Server = grpc.NewServer([]grpc.ServerOption{}...)
 	pluginapi.RegisterDevicePluginServer(dpi.Server, dpi.DevicePluginImpl)
+	v1alpha.RegisterDevicePluginServer(dpi.Server, &v1alphaPlugin{dpi.DevicePluginImpl})
 
 	go dpi.Server.Serve(sock)
-	glog.V(3).Infof("%s: Serving requests...", dpi.Name)
+	logging.V(3).Info("Serving requests", "plugin", dpi.Name)
 	// Wait till grpc server is ready.
-	for i := 0; i < 10; i++ {
+	for deadline := time.Now().Add(dpi.startTimeout); time.Now().Before(deadline); {
 		services := dpi.Server.GetServiceInfo()
 		if len(services) > 1 {
 			break
 		}
-		time.Sleep(1 * time.Second)
+		time.Sleep(min(time.Second, time.Until(deadline)))
 	}
 
 	return nil
@@ -131,32 +152,31 @@ func (dpi *devicePlugin) serve() error {
 // register registers the device plugin (as gRPC client call) for the given ResourceName with
 // Kubelet DPI infrastructure.
 func (dpi *devicePlugin) register() error {
-	glog.V(3).Infof("%s: Registering the DPI with Kubelet", dpi.Name)
+	logging.V(3).Info("Registering the DPI with Kubelet", "plugin", dpi.Name)
 
-	conn, err := grpc.Dial(pluginapi.KubeletSocket, grpc.WithInsecure(),
+	conn, err := grpc.Dial(dpi.KubeletSocket, grpc.WithInsecure(),
 		grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
 			return net.DialTimeout("unix", addr, timeout)
 		}))
 	defer conn.Close()
 	if err != nil {
-		glog.Errorf("%s: Could not dial gRPC: %s", dpi.Name, err)
+		logging.Error("Could not dial gRPC", "plugin", dpi.Name, "err", err)
 		return err
 	}
-	client := pluginapi.NewRegistrationClient(conn)
-	glog.Infof("%s: Registration for endpoint %s", dpi.Name, path.Base(dpi.Socket))
-	reqt := &pluginapi.RegisterRequest{
-		Version:      pluginapi.Version,
-		Endpoint:     path.Base(dpi.Socket),
-		ResourceName: dpi.ResourceName,
+	logging.Info("Registration for endpoint", "plugin", dpi.Name, "endpoint", path.Base(dpi.Socket))
+	ctx := context.Background()
+	if dpi.registrationTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dpi.registrationTimeout)
+		defer cancel()
 	}
-
-	_, err = client.Register(context.Background(), reqt)
+	dpi.APIVersion, err = dpi.negotiator.Register(ctx, conn, path.Base(dpi.Socket), dpi.ResourceName)
 	if err != nil {
-		glog.Errorf("%s: Registration failed: %s", dpi.Name, err)
-		glog.Errorf("%s: Make sure that the DevicePlugins feature gate is enabled and kubelet running", dpi.Name)
+		logging.Error("Registration failed", "plugin", dpi.Name, "err", err)
+		logging.Error("Make sure that the DevicePlugins feature gate is enabled and kubelet running", "plugin", dpi.Name)
 		return err
 	}
-	glog.V(3).Infof("%s: Finished Registering the DPI with Kubelet", dpi.Name)
+	logging.V(3).Info("Finished Registering the DPI with Kubelet", "plugin", dpi.Name, "version", dpi.APIVersion)
 	return nil
 }
 
@@ -176,19 +196,34 @@ func (dpi *devicePlugin) GracefulStopServer() error {
 func (dpi *devicePlugin) stopServer(serverStopFunc func()) error {
 	// TODO: should this also be a critical section?
 	// how do we prevent multiple stops? or start/stop race condition?
-	glog.V(3).Infof("%s: Stopping plugin server", dpi.Name)
-	glog.V(4).Infof("%p", dpi)
-	glog.V(4).Infof("%+v", *dpi)
+	logging.V(3).Info("Stopping plugin server", "plugin", dpi.Name)
+	logging.V(4).Info("Plugin state", "state", dpi)
 
 	if !dpi.Running {
-		glog.V(3).Infof("%s: Tried to stop stopped DPI", dpi.Name)
+		logging.V(3).Info("Tried to stop stopped DPI", "plugin", dpi.Name)
 		return nil
 	}
 
-	glog.V(3).Infof("%s: Stopping the DPI gRPC server", dpi.Name)
-	dpi.Server.Stop()
+	logging.V(3).Info("Stopping the DPI gRPC server", "plugin", dpi.Name)
+	if dpi.stopTimeout > 0 {
+		// Give the server until the timeout to stop in the way asked,
+		// then close any connections still open
+		stopped := make(chan struct{})
+		go func() {
+			serverStopFunc()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(dpi.stopTimeout):
+			logging.Warn("Plugin server did not stop in time, closing connections", "plugin", dpi.Name, "timeout", dpi.stopTimeout)
+			dpi.Server.Stop()
+		}
+	} else {
+		dpi.Server.Stop()
+	}
 	dpi.Running = false
-	glog.V(3).Infof("%s: Finished Stopping plugin server", dpi.Name)
+	logging.V(3).Info("Finished Stopping plugin server", "plugin", dpi.Name)
 
 	return dpi.cleanup()
 }
@@ -196,7 +231,7 @@ func (dpi *devicePlugin) stopServer(serverStopFunc func()) error {
 // cleanup is a helper to remove DPI's socket.
 func (dpi *devicePlugin) cleanup() error {
 	if err := os.Remove(dpi.Socket); err != nil && !os.IsNotExist(err) {
-		glog.Errorf("%s: Could not clean up socket %s: %s", dpi.Name, dpi.Socket, err)
+		logging.Error("Could not clean up socket", "plugin", dpi.Name, "socket", dpi.Socket, "err", err)
 		return err
 	}
 
@@ -0,0 +1,152 @@
+package dpm
+
+import (
+	"fmt"
+
+	"github.com/brightbox/brightbox-volume-device-plugin/logging"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	v1alpha "k8s.io/kubelet/pkg/apis/deviceplugin/v1alpha"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// APIVersion is a version of the kubelet device plugin API, as sent in
+// registration requests
+type APIVersion string
+
+// The device plugin API versions a plugin can register with. Plugins
+// are always served in both versions; registration decides which one
+// kubelet uses.
+const (
+	V1beta1 APIVersion = pluginapi.Version
+	V1alpha APIVersion = v1alpha.Version
+)
+
+// registerFuncs holds the registration call for each supported version
+var registerFuncs = map[APIVersion]func(context.Context, *grpc.ClientConn, string, string) error{
+	V1beta1: func(ctx context.Context, conn *grpc.ClientConn, endpoint string, resourceName string) error {
+		_, err := pluginapi.NewRegistrationClient(conn).Register(ctx, &pluginapi.RegisterRequest{
+			Version:      pluginapi.Version,
+			Endpoint:     endpoint,
+			ResourceName: resourceName,
+		})
+		return err
+	},
+	V1alpha: func(ctx context.Context, conn *grpc.ClientConn, endpoint string, resourceName string) error {
+		_, err := v1alpha.NewRegistrationClient(conn).Register(ctx, &v1alpha.RegisterRequest{
+			Version:      v1alpha.Version,
+			Endpoint:     endpoint,
+			ResourceName: resourceName,
+		})
+		return err
+	},
+}
+
+// VersionNegotiator registers plugins with kubelet using the first API
+// version it supports
+type VersionNegotiator struct {
+	versions []APIVersion
+}
+
+// NewVersionNegotiator creates a VersionNegotiator trying each of
+// versions in order, or V1beta1 then V1alpha if none are given
+func NewVersionNegotiator(versions ...APIVersion) *VersionNegotiator {
+	if len(versions) == 0 {
+		versions = []APIVersion{V1beta1, V1alpha}
+	}
+	return &VersionNegotiator{versions: versions}
+}
+
+// Versions returns the API versions in the order they are tried
+func (vn *VersionNegotiator) Versions() []APIVersion {
+	return append([]APIVersion(nil), vn.versions...)
+}
+
+// Register registers the plugin listening on endpoint for resourceName
+// with the kubelet at the other end of conn, returning the API version
+// kubelet accepted. The next version is only tried if kubelet does not
+// implement the registration service of the previous one, as an older
+// kubelet does not; any other error is returned straight away.
+func (vn *VersionNegotiator) Register(ctx context.Context, conn *grpc.ClientConn, endpoint string, resourceName string) (APIVersion, error) {
+	var err error
+	for _, version := range vn.versions {
+		register, ok := registerFuncs[version]
+		if !ok {
+			return "", fmt.Errorf("unsupported device plugin API version %q", version)
+		}
+		err = register(ctx, conn, endpoint, resourceName)
+		if status.Code(err) != codes.Unimplemented {
+			return version, err
+		}
+		logging.V(3).Info("Kubelet does not support device plugin API version", "version", version, "err", err)
+	}
+	return "", status.Errorf(codes.Unimplemented, "kubelet supports none of device plugin API versions %v: %v", vn.versions, err)
+}
+
+// v1alphaPlugin adapts a PluginInterface, written against the v1beta1
+// API, to serve the v1alpha API
+type v1alphaPlugin struct {
+	plugin PluginInterface
+}
+
+var _ v1alpha.DevicePluginServer = (*v1alphaPlugin)(nil)
+
+// ListAndWatch passes on each device list sent by the plugin
+func (p *v1alphaPlugin) ListAndWatch(_ *v1alpha.Empty, srv v1alpha.DevicePlugin_ListAndWatchServer) error {
+	return p.plugin.ListAndWatch(&pluginapi.Empty{}, &v1alphaListAndWatchServer{srv})
+}
+
+// Allocate asks the plugin to allocate the devices to a single container
+func (p *v1alphaPlugin) Allocate(ctx context.Context, request *v1alpha.AllocateRequest) (*v1alpha.AllocateResponse, error) {
+	resp, err := p.plugin.Allocate(ctx, &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: request.DevicesIDs},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.ContainerResponses) != 1 {
+		return nil, status.Errorf(codes.Internal, "expected one container response, got %d", len(resp.ContainerResponses))
+	}
+	container := resp.ContainerResponses[0]
+	result := &v1alpha.AllocateResponse{
+		Envs:        container.Envs,
+		Annotations: container.Annotations,
+	}
+	for _, mount := range container.Mounts {
+		result.Mounts = append(result.Mounts, &v1alpha.Mount{
+			ContainerPath: mount.ContainerPath,
+			HostPath:      mount.HostPath,
+			ReadOnly:      mount.ReadOnly,
+		})
+	}
+	for _, device := range container.Devices {
+		result.Devices = append(result.Devices, &v1alpha.DeviceSpec{
+			ContainerPath: device.ContainerPath,
+			HostPath:      device.HostPath,
+			Permissions:   device.Permissions,
+		})
+	}
+	return result, nil
+}
+
+// v1alphaListAndWatchServer is a v1beta1 ListAndWatch stream sending to
+// a v1alpha one
+type v1alphaListAndWatchServer struct {
+	v1alpha.DevicePlugin_ListAndWatchServer
+}
+
+func (s *v1alphaListAndWatchServer) Send(resp *pluginapi.ListAndWatchResponse) error {
+	result := &v1alpha.ListAndWatchResponse{Devices: []*v1alpha.Device{}}
+	for _, device := range resp.Devices {
+		result.Devices = append(result.Devices, &v1alpha.Device{
+			ID:     device.ID,
+			Health: device.Health,
+		})
+	}
+	return s.DevicePlugin_ListAndWatchServer.Send(result)
+}
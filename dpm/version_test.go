@@ -0,0 +1,247 @@
+package dpm
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	v1alpha "k8s.io/kubelet/pkg/apis/deviceplugin/v1alpha"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// fakeAlphaKubelet is a kubelet from before v1beta1, accepting only
+// v1alpha registrations
+type fakeAlphaKubelet struct {
+	v1alpha.UnimplementedRegistrationServer
+	registered chan *v1alpha.RegisterRequest
+}
+
+func (k *fakeAlphaKubelet) Register(ctx context.Context, req *v1alpha.RegisterRequest) (*v1alpha.Empty, error) {
+	k.registered <- req
+	return &v1alpha.Empty{}, nil
+}
+
+// rejectingKubelet refuses every v1beta1 registration
+type rejectingKubelet struct {
+	pluginapi.UnimplementedRegistrationServer
+}
+
+func (k *rejectingKubelet) Register(ctx context.Context, req *pluginapi.RegisterRequest) (*pluginapi.Empty, error) {
+	return nil, status.Error(codes.InvalidArgument, "resource already registered")
+}
+
+// dialKubelet serves the registration services set up by register on a
+// socket in a temporary directory and returns a connection to it
+func dialKubelet(t *testing.T, register func(*grpc.Server)) *grpc.ClientConn {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "kubelet.sock")
+	sock, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	register(server)
+	go server.Serve(sock)
+	t.Cleanup(server.Stop)
+	conn, err := grpc.Dial("unix://"+path, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestVersionNegotiatorDefaults(t *testing.T) {
+	versions := NewVersionNegotiator().Versions()
+	if len(versions) != 2 || versions[0] != V1beta1 || versions[1] != V1alpha {
+		t.Errorf("Expected v1beta1 then v1alpha, got %v", versions)
+	}
+}
+
+func TestVersionNegotiatorSelection(t *testing.T) {
+	tests := []struct {
+		name     string
+		register func(*grpc.Server)
+		versions []APIVersion
+		expected APIVersion
+		code     codes.Code
+	}{
+		{
+			name: "v1beta1 kubelet",
+			register: func(s *grpc.Server) {
+				pluginapi.RegisterRegistrationServer(s, &fakeKubelet{registered: make(chan *pluginapi.RegisterRequest, 1)})
+			},
+			expected: V1beta1,
+		},
+		{
+			name: "v1alpha kubelet",
+			register: func(s *grpc.Server) {
+				v1alpha.RegisterRegistrationServer(s, &fakeAlphaKubelet{registered: make(chan *v1alpha.RegisterRequest, 1)})
+			},
+			expected: V1alpha,
+		},
+		{
+			name: "both versions prefers v1beta1",
+			register: func(s *grpc.Server) {
+				pluginapi.RegisterRegistrationServer(s, &fakeKubelet{registered: make(chan *pluginapi.RegisterRequest, 1)})
+				v1alpha.RegisterRegistrationServer(s, &fakeAlphaKubelet{registered: make(chan *v1alpha.RegisterRequest, 1)})
+			},
+			expected: V1beta1,
+		},
+		{
+			name: "order given",
+			register: func(s *grpc.Server) {
+				pluginapi.RegisterRegistrationServer(s, &fakeKubelet{registered: make(chan *pluginapi.RegisterRequest, 1)})
+				v1alpha.RegisterRegistrationServer(s, &fakeAlphaKubelet{registered: make(chan *v1alpha.RegisterRequest, 1)})
+			},
+			versions: []APIVersion{V1alpha, V1beta1},
+			expected: V1alpha,
+		},
+		{
+			name: "v1alpha kubelet without fallback",
+			register: func(s *grpc.Server) {
+				v1alpha.RegisterRegistrationServer(s, &fakeAlphaKubelet{registered: make(chan *v1alpha.RegisterRequest, 1)})
+			},
+			versions: []APIVersion{V1beta1},
+			code:     codes.Unimplemented,
+		},
+		{
+			name:     "no registration service",
+			register: func(*grpc.Server) {},
+			code:     codes.Unimplemented,
+		},
+		{
+			name: "rejection is not retried",
+			register: func(s *grpc.Server) {
+				pluginapi.RegisterRegistrationServer(s, &rejectingKubelet{})
+				v1alpha.RegisterRegistrationServer(s, &fakeAlphaKubelet{registered: make(chan *v1alpha.RegisterRequest, 1)})
+			},
+			expected: V1beta1,
+			code:     codes.InvalidArgument,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := dialKubelet(t, tt.register)
+			version, err := NewVersionNegotiator(tt.versions...).Register(context.Background(), conn, "volumes.example.com_vol-12345", "volumes.example.com/vol-12345")
+			if code := status.Code(err); code != tt.code {
+				t.Errorf("Expected %s, got %v", tt.code, err)
+			}
+			if version != tt.expected {
+				t.Errorf("Expected version %q, got %q", tt.expected, version)
+			}
+		})
+	}
+}
+
+func TestVersionNegotiatorUnknownVersion(t *testing.T) {
+	conn := dialKubelet(t, func(*grpc.Server) {})
+	if _, err := NewVersionNegotiator("v2").Register(context.Background(), conn, "endpoint", "volumes.example.com/vol-12345"); err == nil {
+		t.Error("Expected error for an unknown version")
+	}
+}
+
+// fakePlugin returns canned responses to Allocate and ListAndWatch
+type fakePlugin struct {
+	pluginapi.UnimplementedDevicePluginServer
+	request  *pluginapi.AllocateRequest
+	response *pluginapi.AllocateResponse
+	devices  []*pluginapi.Device
+}
+
+func (p *fakePlugin) Allocate(ctx context.Context, req *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
+	p.request = req
+	return p.response, nil
+}
+
+func (p *fakePlugin) ListAndWatch(_ *pluginapi.Empty, srv pluginapi.DevicePlugin_ListAndWatchServer) error {
+	return srv.Send(&pluginapi.ListAndWatchResponse{Devices: p.devices})
+}
+
+func TestV1alphaAllocate(t *testing.T) {
+	plugin := &fakePlugin{response: &pluginapi.AllocateResponse{
+		ContainerResponses: []*pluginapi.ContainerAllocateResponse{{
+			Envs:        map[string]string{"VOLUME": "vol-12345"},
+			Annotations: map[string]string{"volume": "vol-12345"},
+			Mounts:      []*pluginapi.Mount{{ContainerPath: "/mnt", HostPath: "/srv", ReadOnly: true}},
+			Devices:     []*pluginapi.DeviceSpec{{ContainerPath: "/dev/vdb", HostPath: "/dev/vdb", Permissions: "rw"}},
+		}},
+	}}
+	resp, err := (&v1alphaPlugin{plugin}).Allocate(context.Background(), &v1alpha.AllocateRequest{DevicesIDs: []string{"vol-12345"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plugin.request.ContainerRequests) != 1 || plugin.request.ContainerRequests[0].DevicesIDs[0] != "vol-12345" {
+		t.Errorf("Unexpected v1beta1 request %+v", plugin.request)
+	}
+	if resp.Envs["VOLUME"] != "vol-12345" || resp.Annotations["volume"] != "vol-12345" {
+		t.Errorf("Envs and annotations not passed on: %+v", resp)
+	}
+	if len(resp.Mounts) != 1 || *resp.Mounts[0] != (v1alpha.Mount{ContainerPath: "/mnt", HostPath: "/srv", ReadOnly: true}) {
+		t.Errorf("Unexpected mounts %v", resp.Mounts)
+	}
+	if len(resp.Devices) != 1 || *resp.Devices[0] != (v1alpha.DeviceSpec{ContainerPath: "/dev/vdb", HostPath: "/dev/vdb", Permissions: "rw"}) {
+		t.Errorf("Unexpected devices %v", resp.Devices)
+	}
+}
+
+// fakeAlphaStream records the responses sent on a v1alpha ListAndWatch
+// stream
+type fakeAlphaStream struct {
+	grpc.ServerStream
+	sent []*v1alpha.ListAndWatchResponse
+}
+
+func (s *fakeAlphaStream) Send(resp *v1alpha.ListAndWatchResponse) error {
+	s.sent = append(s.sent, resp)
+	return nil
+}
+
+func TestV1alphaListAndWatch(t *testing.T) {
+	plugin := &fakePlugin{devices: []*pluginapi.Device{
+		{ID: "vol-12345", Health: pluginapi.Healthy, Topology: &pluginapi.TopologyInfo{}},
+	}}
+	stream := &fakeAlphaStream{}
+	if err := (&v1alphaPlugin{plugin}).ListAndWatch(&v1alpha.Empty{}, stream); err != nil {
+		t.Fatal(err)
+	}
+	if len(stream.sent) != 1 || len(stream.sent[0].Devices) != 1 {
+		t.Fatalf("Unexpected responses %v", stream.sent)
+	}
+	if device := stream.sent[0].Devices[0]; device.ID != "vol-12345" || device.Health != v1alpha.Healthy {
+		t.Errorf("Unexpected device %v", device)
+	}
+}
+
+func TestPluginRegistersWithV1alphaKubelet(t *testing.T) {
+	dir := t.TempDir()
+	sock, err := net.Listen("unix", filepath.Join(dir, "kubelet.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kubelet := &fakeAlphaKubelet{registered: make(chan *v1alpha.RegisterRequest, 1)}
+	server := grpc.NewServer()
+	v1alpha.RegisterRegistrationServer(server, kubelet)
+	go server.Serve(sock)
+	defer server.Stop()
+
+	manager := NewManager(&fakeLister{}, WithSocketDir(dir), WithPluginStartTimeout(time.Millisecond))
+	plugin := manager.newDevicePlugin("volumes.example.com", "vol-12345", &pluginapi.UnimplementedDevicePluginServer{})
+	if err := plugin.StartServer(); err != nil {
+		t.Fatal(err)
+	}
+	defer plugin.StopServer()
+	if plugin.APIVersion != V1alpha {
+		t.Errorf("Expected v1alpha registration, got %q", plugin.APIVersion)
+	}
+	req := <-kubelet.registered
+	if req.Version != v1alpha.Version || req.ResourceName != "volumes.example.com/vol-12345" {
+		t.Errorf("Unexpected registration %+v", req)
+	}
+}
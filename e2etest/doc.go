@@ -0,0 +1,7 @@
+// Package e2etest runs the plugin binary against a temporary device
+// directory and talks to it as the kubelet would.
+//
+// The tests only build with the integration tag:
+//
+//	go test -tags integration ./e2etest
+package e2etest
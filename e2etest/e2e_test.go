@@ -0,0 +1,197 @@
+//go:build integration
+
+package e2etest
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// pluginBinary is the plugin built by TestMain
+var pluginBinary string
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "e2etest")
+	if err != nil {
+		panic(err)
+	}
+	pluginBinary = filepath.Join(dir, "brightbox-volume-device-plugin")
+	build := exec.Command("go", "build", "-o", pluginBinary, "..")
+	build.Stdout, build.Stderr = os.Stdout, os.Stderr
+	if err := build.Run(); err != nil {
+		os.RemoveAll(dir)
+		panic(err)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// fakeKubelet is the kubelet side of the device plugin registration
+// protocol, passing on each registration it receives
+type fakeKubelet struct {
+	pluginapi.UnimplementedRegistrationServer
+	registered chan *pluginapi.RegisterRequest
+}
+
+func (k *fakeKubelet) Register(ctx context.Context, req *pluginapi.RegisterRequest) (*pluginapi.Empty, error) {
+	k.registered <- req
+	return &pluginapi.Empty{}, nil
+}
+
+func serveFakeKubelet(t *testing.T, socketDir string) *fakeKubelet {
+	t.Helper()
+	sock, err := net.Listen("unix", filepath.Join(socketDir, filepath.Base(pluginapi.KubeletSocket)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kubelet := &fakeKubelet{registered: make(chan *pluginapi.RegisterRequest, 8)}
+	server := grpc.NewServer()
+	pluginapi.RegisterRegistrationServer(server, kubelet)
+	go server.Serve(sock)
+	t.Cleanup(server.Stop)
+	return kubelet
+}
+
+// startPlugin runs the plugin binary watching deviceDir and registering
+// through socketDir, stopping it with SIGTERM when the test ends
+func startPlugin(t *testing.T, deviceDir string, socketDir string) {
+	t.Helper()
+	config, err := json.Marshal(map[string]string{
+		"deviceDir": deviceDir,
+		"socketDir": socketDir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(configFile, config, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(pluginBinary, "-config", configFile, "-v", "3")
+	cmd.Env = append(os.Environ(), "NODE_NAME=")
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Signal(syscall.SIGTERM)
+		exited := make(chan error, 1)
+		go func() {
+			exited <- cmd.Wait()
+		}()
+		select {
+		case err := <-exited:
+			if err != nil {
+				t.Errorf("Expected clean exit, got %v", err)
+			}
+		case <-time.After(10 * time.Second):
+			cmd.Process.Kill()
+			t.Error("Plugin did not exit after SIGTERM")
+		}
+	})
+}
+
+func dialPlugin(t *testing.T, socketDir string, endpoint string) pluginapi.DevicePluginClient {
+	t.Helper()
+	conn, err := grpc.Dial(filepath.Join(socketDir, endpoint), grpc.WithInsecure(),
+		grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("unix", addr, timeout)
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pluginapi.NewDevicePluginClient(conn)
+}
+
+func TestListAndWatchAndAllocate(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping end-to-end test in short mode")
+	}
+	deviceDir := filepath.Join(t.TempDir(), "by-id")
+	if err := os.Mkdir(deviceDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	socketDir := t.TempDir()
+	kubelet := serveFakeKubelet(t, socketDir)
+	startPlugin(t, deviceDir, socketDir)
+
+	// Stand in for the block device the volume's symlink points at
+	target := filepath.Join(t.TempDir(), "vdb")
+	if err := os.WriteFile(target, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(deviceDir, "virtio-vol-e2e01")
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatal(err)
+	}
+
+	var registration *pluginapi.RegisterRequest
+	select {
+	case registration = <-kubelet.registered:
+	case <-time.After(30 * time.Second):
+		t.Fatal("Plugin did not register with kubelet")
+	}
+	if registration.ResourceName != "volumes.brightbox.com/vol-e2e01" {
+		t.Errorf("Unexpected resource name %q", registration.ResourceName)
+	}
+
+	client := dialPlugin(t, socketDir, registration.Endpoint)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	stream, err := client.ListAndWatch(ctx, &pluginapi.Empty{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Devices) != 1 ||
+		response.Devices[0].ID != "vol-e2e01" ||
+		response.Devices[0].Health != pluginapi.Healthy {
+		t.Errorf("Unexpected devices %v", response.Devices)
+	}
+
+	allocation, err := client.Allocate(ctx, &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"vol-e2e01"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allocation.ContainerResponses) != 1 {
+		t.Fatalf("Expected one container response, got %d", len(allocation.ContainerResponses))
+	}
+	devices := allocation.ContainerResponses[0].Devices
+	if len(devices) != 1 {
+		t.Fatalf("Expected one device, got %v", devices)
+	}
+	if devices[0].HostPath != link || devices[0].ContainerPath != link || devices[0].Permissions != "rw" {
+		t.Errorf("Unexpected device spec %v", devices[0])
+	}
+
+	if err := os.Remove(link); err != nil {
+		t.Fatal(err)
+	}
+	response, err = stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Devices) != 0 {
+		t.Errorf("Expected volume to be removed, got %v", response.Devices)
+	}
+}
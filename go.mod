@@ -1,20 +1,22 @@
 module github.com/brightbox/brightbox-volume-device-plugin
 
-go 1.18
+go 1.21
 
 require (
 	github.com/fsnotify/fsnotify v1.5.5-0.20220810151001-61a05ce2c490
-	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b
+	github.com/pilebones/go-udev v0.9.0
 	golang.org/x/exp v0.0.0-20220722155223-a9213eeb770e
 	golang.org/x/net v0.0.0-20220127200216-cd36cc0744dd
+	golang.org/x/sys v0.0.0-20220811171246-fbc7d0a398ab
+	golang.org/x/time v0.0.0-20220722155302-e5dcc9cfc0b9
 	google.golang.org/grpc v1.40.0
+	gopkg.in/yaml.v3 v3.0.1
 	k8s.io/kubelet v0.24.3
 )
 
 require (
 	github.com/gogo/protobuf v1.3.2 // indirect
 	github.com/golang/protobuf v1.5.2 // indirect
-	golang.org/x/sys v0.0.0-20220811171246-fbc7d0a398ab // indirect
 	golang.org/x/text v0.3.7 // indirect
 	google.golang.org/genproto v0.0.0-20220107163113-42d7afdf6368 // indirect
 	google.golang.org/protobuf v1.27.1 // indirect
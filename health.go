@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/brightbox/brightbox-volume-device-plugin/logging"
+)
+
+// HealthChecker reports whether a component is functioning
+type HealthChecker interface {
+	HealthCheck() error
+}
+
+// HealthCheckFunc adapts an ordinary function to a HealthChecker
+type HealthCheckFunc func() error
+
+// HealthCheck calls f
+func (f HealthCheckFunc) HealthCheck() error {
+	return f()
+}
+
+// healthHandler answers probes with 200 when the checker is healthy and
+// 503 otherwise
+func healthHandler(checker HealthChecker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := checker.HealthCheck(); err != nil {
+			logging.V(3).Info("Health check failed", "path", r.URL.Path, "err", err)
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok\n"))
+	})
+}
+
+// healthMux serves liveness probes on /livez, and on /healthz for
+// existing deployments, and readiness probes on /readyz
+func healthMux(live HealthChecker, ready HealthChecker) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", healthHandler(live))
+	mux.Handle("/livez", healthHandler(live))
+	mux.Handle("/readyz", healthHandler(ready))
+	return mux
+}
+
+// serveHealth runs the health endpoints on addr in the background
+func serveHealth(addr string, live HealthChecker, ready HealthChecker) {
+	mux := healthMux(live, ready)
+	go func() {
+		logging.V(3).Info("Serving health checks", "addr", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			logging.Error("Health check server failed", "err", err)
+		}
+	}()
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func probe(t *testing.T, live HealthChecker, ready HealthChecker, path string) int {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	healthMux(live, ready).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	return rec.Code
+}
+
+func TestHealthProbes(t *testing.T) {
+	healthy := HealthCheckFunc(func() error { return nil })
+	failing := HealthCheckFunc(func() error { return errors.New("failed") })
+	tests := []struct {
+		path     string
+		live     HealthChecker
+		ready    HealthChecker
+		expected int
+	}{
+		{"/livez", healthy, failing, http.StatusOK},
+		{"/livez", failing, healthy, http.StatusServiceUnavailable},
+		{"/healthz", healthy, failing, http.StatusOK},
+		{"/healthz", failing, healthy, http.StatusServiceUnavailable},
+		{"/readyz", failing, healthy, http.StatusOK},
+		{"/readyz", healthy, failing, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		if code := probe(t, tt.live, tt.ready, tt.path); code != tt.expected {
+			t.Errorf("%s: expected %d, got %d", tt.path, tt.expected, code)
+		}
+	}
+}
+
+func TestLivezWatcherCancelled(t *testing.T) {
+	vl := newTestLister(t)
+	watcher := vl.volWatcher.(interface {
+		HealthChecker
+		Cancel()
+	})
+	watcher.Cancel()
+	<-vl.Done()
+	if code := probe(t, watcher, HealthCheckFunc(vl.ReadyCheck), "/livez"); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected %d once the watcher is cancelled, got %d", http.StatusServiceUnavailable, code)
+	}
+}
+
+func TestReadyzAfterListAndWatch(t *testing.T) {
+	vl := newTestLister(t)
+	live := HealthCheckFunc(func() error { return nil })
+	if code := probe(t, live, HealthCheckFunc(vl.ReadyCheck), "/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected %d before any volumes are sent, got %d", http.StatusServiceUnavailable, code)
+	}
+	vdp := vl.NewPlugin("vol-aaaaa").(*volumeDevicePlugin)
+	vdp.Start()
+	defer vdp.Stop()
+	srv := &fakeListAndWatchServer{responses: make(chan *pluginapi.ListAndWatchResponse, 4)}
+	go vdp.ListAndWatch(&pluginapi.Empty{}, srv)
+	nextHealth(t, srv)
+	// Readiness is marked just after the send returns
+	deadline := time.Now().Add(5 * time.Second)
+	for probe(t, live, HealthCheckFunc(vl.ReadyCheck), "/readyz") != http.StatusOK {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected ready after the volume list was sent")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,86 @@
+// Package kubelet watches for kubelet restarts, which remove and
+// recreate its device plugin registration socket. Device plugins must
+// register again with each new kubelet to keep their resources
+// advertised.
+package kubelet
+
+import (
+	"path/filepath"
+	"sync"
+
+	"github.com/brightbox/brightbox-volume-device-plugin/logging"
+	"github.com/fsnotify/fsnotify"
+)
+
+// KubeletWatcher calls a restart function each time the kubelet socket
+// is created, as happens when kubelet starts
+type KubeletWatcher struct {
+	socketPath string
+	restart    func()
+	watcher    *fsnotify.Watcher
+	done       sync.WaitGroup
+	closeOnce  sync.Once
+}
+
+// NewKubeletWatcher watches the directory holding socketPath and calls
+// restart whenever socketPath is created there. The directory must
+// exist. restart is called from the watcher's goroutine, one call at a
+// time, and should not block for long.
+func NewKubeletWatcher(socketPath string, restart func()) (*KubeletWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := watcher.Add(filepath.Dir(socketPath)); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	kw := &KubeletWatcher{
+		socketPath: socketPath,
+		restart:    restart,
+		watcher:    watcher,
+	}
+	kw.done.Add(1)
+	go kw.run()
+	return kw, nil
+}
+
+// SocketPath returns the path of the kubelet socket being watched
+func (kw *KubeletWatcher) SocketPath() string {
+	return kw.socketPath
+}
+
+// Close stops the watch and waits for any restart in progress to return
+func (kw *KubeletWatcher) Close() error {
+	var err error
+	kw.closeOnce.Do(func() {
+		err = kw.watcher.Close()
+		kw.done.Wait()
+	})
+	return err
+}
+
+func (kw *KubeletWatcher) run() {
+	defer kw.done.Done()
+	for {
+		select {
+		case event, ok := <-kw.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Name != kw.socketPath {
+				continue
+			}
+			logging.V(3).Info("Received kubelet socket event", "event", event)
+			if event.Op&fsnotify.Create == fsnotify.Create {
+				logging.Info("Kubelet socket created, re-registering plugins", "socket", kw.socketPath)
+				kw.restart()
+			}
+		case err, ok := <-kw.watcher.Errors:
+			if !ok {
+				return
+			}
+			logging.Warn("Kubelet socket watch error", "socket", kw.socketPath, "err", err)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package kubelet
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeKubelet creates the socket at path as kubelet does on starting,
+// returning a function that removes it again as on stopping
+func fakeKubelet(t *testing.T, path string) func() {
+	t.Helper()
+	sock, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func() { sock.Close() }
+}
+
+func newTestWatcher(t *testing.T, socketPath string) <-chan struct{} {
+	t.Helper()
+	restarts := make(chan struct{}, 8)
+	kw, err := NewKubeletWatcher(socketPath, func() { restarts <- struct{}{} })
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { kw.Close() })
+	return restarts
+}
+
+func expectRestart(t *testing.T, restarts <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-restarts:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for restart")
+	}
+}
+
+func expectNoRestart(t *testing.T, restarts <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-restarts:
+		t.Fatal("Unexpected restart")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestKubeletRestart(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "kubelet.sock")
+	stop := fakeKubelet(t, socketPath)
+	restarts := newTestWatcher(t, socketPath)
+
+	stop()
+	expectNoRestart(t, restarts)
+	stop = fakeKubelet(t, socketPath)
+	defer stop()
+	expectRestart(t, restarts)
+}
+
+func TestKubeletRepeatedRestarts(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "kubelet.sock")
+	restarts := newTestWatcher(t, socketPath)
+	for i := 0; i < 3; i++ {
+		stop := fakeKubelet(t, socketPath)
+		expectRestart(t, restarts)
+		stop()
+	}
+}
+
+func TestKubeletOtherSocketsIgnored(t *testing.T) {
+	dir := t.TempDir()
+	restarts := newTestWatcher(t, filepath.Join(dir, "kubelet.sock"))
+	stop := fakeKubelet(t, filepath.Join(dir, "volumes.example.com_vol-12345"))
+	defer stop()
+	if err := os.WriteFile(filepath.Join(dir, "kubelet_internal_checkpoint"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	expectNoRestart(t, restarts)
+}
+
+func TestKubeletWatcherMissingDir(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "missing", "kubelet.sock")
+	if _, err := NewKubeletWatcher(socketPath, func() {}); err == nil {
+		t.Error("Expected error watching a missing directory")
+	}
+}
+
+func TestKubeletWatcherClose(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "kubelet.sock")
+	restarts := make(chan struct{}, 1)
+	kw, err := NewKubeletWatcher(socketPath, func() { restarts <- struct{}{} })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	kw.Close()
+	stop := fakeKubelet(t, socketPath)
+	defer stop()
+	expectNoRestart(t, restarts)
+}
@@ -1,41 +1,204 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/brightbox/brightbox-volume-device-plugin/dpm"
+	"github.com/brightbox/brightbox-volume-device-plugin/logging"
+	"github.com/brightbox/brightbox-volume-device-plugin/metrics"
 	"github.com/brightbox/brightbox-volume-device-plugin/volwatch"
-	"github.com/golang/glog"
 	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // Completion provides a volumes slice and a completion function that needs to
-// called when the subscriber plugin has finished with the volumes.
+// called when the subscriber plugin has finished with the volumes. Any error
+// encountered while processing the update is passed to the completion
+// function and reported on the lister's InformErrors channel.
+// AddedVolumes and RemovedVolumes list the volumes that changed since the
+// previous update.
 type Completion struct {
-	Volumes      []string
-	CompleteFunc func()
+	Volumes        []string
+	AddedVolumes   []string
+	RemovedVolumes []string
+	CompleteFunc   func(error)
+}
+
+// subscription is a subscriber's channel along with the predicate deciding
+// which volume lists it is sent
+type subscription struct {
+	channel chan<- Completion
+	filter  func([]string) bool
+}
+
+// ErrNotReady is returned by ReadyCheck until the lister's first volume
+// list has reached kubelet
+var ErrNotReady = errors.New("volumes not yet advertised to kubelet")
+
+func passAll([]string) bool {
+	return true
 }
 
 // VolumeLister is a proxy which takes events from the volumewatcher and posts
 // them to the plugin manager using the Lister interface
 type VolumeLister struct {
-	volWatcher *volwatch.VolumeWatcher
-	mapmutex   sync.RWMutex
-	eventmap   map[string]chan<- Completion
+	volWatcher volwatch.Watcher
+	eventmap   sync.Map // volume ID -> *subscription
+	subCount   int64
+	countmutex sync.Mutex   // guards subCount
+	mapmutex   sync.RWMutex // guards slowmap, deadLetters and lastEvent
+	slowmap    map[string]int
+	informErrs chan error
+	lastEvent  []string
+
+	subscriberTimeout time.Duration
+	maxTimeouts       int
+	pluginOpts        []PluginOption
+	namespace         string
+	allocations       Allocations
+	heartbeatInterval time.Duration
+	volumeFilter      func(string) bool
+
+	readyOnce sync.Once
+	ready     chan struct{}
+
+	maxVolumes     int64
+	allocatedCount int64 // atomic
+
+	deadLetterSize int
+	deadLetters    map[string][]Completion
+}
+
+// ListerOption configures a VolumeLister at construction time
+type ListerOption func(*VolumeLister)
+
+// WithSubscriberTimeout limits how long the lister waits for a subscriber
+// to accept an update. A subscriber that times out is skipped for that
+// update and reported by SlowSubscribers. A zero duration waits forever.
+func WithSubscriberTimeout(d time.Duration) ListerOption {
+	return func(vl *VolumeLister) {
+		vl.subscriberTimeout = d
+	}
+}
+
+// WithMaxSubscriberTimeouts unsubscribes a subscriber after n consecutive
+// timeouts. Zero leaves slow subscribers subscribed.
+func WithMaxSubscriberTimeouts(n int) ListerOption {
+	return func(vl *VolumeLister) {
+		vl.maxTimeouts = n
+	}
+}
+
+// WithPluginOptions supplies options applied to every plugin the lister
+// creates
+func WithPluginOptions(opts ...PluginOption) ListerOption {
+	return func(vl *VolumeLister) {
+		vl.pluginOpts = append(vl.pluginOpts, opts...)
+	}
+}
+
+// WithNamespace replaces the vendor namespace under which volume
+// resources are advertised
+func WithNamespace(ns string) ListerOption {
+	return func(vl *VolumeLister) {
+		vl.namespace = ns
+	}
+}
+
+// WithVolumeFilter hides the volumes for which filter returns false, so
+// they are neither advertised to the manager nor passed to subscribers.
+// A nil filter passes every volume.
+func WithVolumeFilter(filter func(string) bool) ListerOption {
+	return func(vl *VolumeLister) {
+		vl.volumeFilter = filter
+	}
+}
+
+// WithHeartbeatInterval sends every subscriber the current volume list
+// each interval d, removing any subscriber that fails to accept
+// maxMissedHeartbeats in a row within the interval. This clears out
+// subscribers that stopped reading without unsubscribing, which would
+// otherwise block updates. A zero interval disables the heartbeat.
+func WithHeartbeatInterval(d time.Duration) ListerOption {
+	return func(vl *VolumeLister) {
+		vl.heartbeatInterval = d
+	}
+}
+
+// WithMaxVolumes limits the lister's plugins to n volumes allocated at
+// once, rejecting further allocations with a ResourceExhausted error
+// until a plugin stops. Zero allows any number.
+func WithMaxVolumes(n int) ListerOption {
+	return func(vl *VolumeLister) {
+		vl.maxVolumes = int64(n)
+	}
+}
+
+// WithDeadLetterSize keeps the last n updates each subscriber failed to
+// accept within the subscriber timeout, for DrainDeadLetters. Zero keeps
+// none.
+func WithDeadLetterSize(n int) ListerOption {
+	return func(vl *VolumeLister) {
+		vl.deadLetterSize = n
+	}
+}
+
+// WithAllocations replaces the in-memory AllocationTracker shared by the
+// plugins, e.g. with a PersistentAllocationTracker
+func WithAllocations(allocations Allocations) ListerOption {
+	return func(vl *VolumeLister) {
+		vl.allocations = allocations
+	}
+}
+
+// WithAllowMultiAttach lets a volume be allocated to any number of pods
+// at once. By default the plugins share an AllocationTracker and reject
+// the allocation of a volume that is already allocated.
+func WithAllowMultiAttach(allow bool) ListerOption {
+	return func(vl *VolumeLister) {
+		if allow {
+			vl.allocations = nil
+		}
+	}
 }
 
 // NewLister creates a new volumeLister
-func NewLister(vw *volwatch.VolumeWatcher) *VolumeLister {
-	return &VolumeLister{
-		volWatcher: vw,
-		eventmap:   make(map[string]chan<- Completion),
+func NewLister(vw volwatch.Watcher, opts ...ListerOption) *VolumeLister {
+	vl := &VolumeLister{
+		volWatcher:  vw,
+		slowmap:     make(map[string]int),
+		deadLetters: make(map[string][]Completion),
+		informErrs:  make(chan error, informErrorBufferSize),
+		namespace:   resourceNamespace,
+		allocations: NewAllocationTracker(),
+		ready:       make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(vl)
 	}
+	if vl.heartbeatInterval > 0 {
+		go vl.watchdog()
+	}
+	return vl
+}
+
+// NewListerWithNamespace creates a new volumeLister advertising volumes
+// under the resource namespace ns rather than the built in one
+func NewListerWithNamespace(vw volwatch.Watcher, ns string, opts ...ListerOption) *VolumeLister {
+	return NewLister(vw, append([]ListerOption{WithNamespace(ns)}, opts...)...)
 }
 
 // GetResourceNamespace must return namespace (vendor ID) of implemented Lister. e.g. for
 // resources in format "color.example.com/<color>" that would be "color.example.com".
 func (vl *VolumeLister) GetResourceNamespace() string {
-	return resourceNamespace
+	return vl.namespace
 }
 
 // Discover notifies manager with a list of currently available resources in its namespace.
@@ -45,18 +208,21 @@ func (vl *VolumeLister) GetResourceNamespace() string {
 // dynamic, it could block and pass a new list each times resources changed. If blocking is
 // used, it should check whether the channel is closed, i.e. Discover should stop.
 func (vl *VolumeLister) Discover(pluginListCh chan dpm.PluginNameListSync) {
-	glog.V(3).Infof("Waiting for volume events\n")
+	logging.V(3).Info("Waiting for volume events")
 	for {
 		select {
 		case <-vl.Done():
-			glog.V(3).Infof("Exiting Discover: %s\n", vl.volWatcher.Err())
+			logging.V(3).Info("Exiting Discover", "reason", vl.volWatcher.Err())
 			return
-		case event, ok := <-vl.volWatcher.Events():
-			if ok {
-				glog.V(3).Infoln("Received watch event")
-				glog.V(3).Infof("Volumes are %v\n", event.Volumes())
-				vl.informSubscribers(event.Volumes())
-				glog.V(3).Infoln("Notifying manager")
+		case err := <-vl.volWatcher.Errors():
+			logging.Warn("Volume watcher error", "err", err)
+		case event, ok := <-vl.volWatcher.DeltaEvents():
+			if ok && !vl.applyVolumeFilter(&event) {
+				logging.V(4).Info("Ignoring filtered volume", "eventType", event.Type.String(), "volumeID", event.VolumeID)
+			} else if ok {
+				logging.V(3).Info("Received watch event", "eventType", event.Type.String(), "volumeID", event.VolumeID, "volumes", event.Volumes())
+				vl.informSubscribers(event)
+				logging.V(3).Info("Notifying manager")
 				var wg sync.WaitGroup
 				wg.Add(1)
 				pluginListCh <- dpm.PluginNameListSync{
@@ -64,9 +230,14 @@ func (vl *VolumeLister) Discover(pluginListCh chan dpm.PluginNameListSync) {
 					Synced: &wg,
 				}
 				wg.Wait()
-				glog.V(3).Infoln("Manager synced, listening for watch events")
+				if len(event.Volumes()) == 0 {
+					// No plugins will call ListAndWatch, so kubelet
+					// already has the whole list
+					vl.markReady()
+				}
+				logging.V(3).Info("Manager synced, listening for watch events")
 			} else {
-				glog.V(3).Infoln("Unexpected fault on Watch Event channel")
+				logging.V(3).Info("Unexpected fault on Watch Event channel")
 			}
 		}
 	}
@@ -76,31 +247,179 @@ func (vl *VolumeLister) Discover(pluginListCh chan dpm.PluginNameListSync) {
 // e.g. for resource name "color.example.com/red" that would be "red". It must return valid
 // implementation of a PluginInterface.
 func (vl *VolumeLister) NewPlugin(kind string) dpm.PluginInterface {
-	glog.V(3).Infof("Creating device plugin %s", kind)
+	logging.V(3).Info("Creating device plugin", "volumeID", kind)
 
-	return &volumeDevicePlugin{
-		kind,
-		make(chan Completion),
-		vl,
-	}
+	opts := append(slices.Clone(vl.pluginOpts), WithAllocationTracker(vl.allocations))
+	return newVolumeDevicePlugin(kind, vl, opts...)
 }
 
 // Subscribe adds a channel to the subscription list for volume events
 func (vl *VolumeLister) Subscribe(index string, channel chan<- Completion) {
-	glog.V(4).Infof("Adding channel subscription for %s", index)
-	vl.mapmutex.Lock()
-	defer vl.mapmutex.Unlock()
-	vl.eventmap[index] = channel
-	glog.V(4).Infof("Added")
+	vl.SubscribeFiltered(index, channel, passAll)
+}
+
+// SubscribeFiltered adds a channel to the subscription list for volume
+// events. The channel is only sent volume lists for which filter returns
+// true.
+// If the lister has already seen a volume list, it is replayed to the new
+// subscriber in the background so it starts from the current state
+// rather than waiting for the next change.
+func (vl *VolumeLister) SubscribeFiltered(index string, channel chan<- Completion, filter func([]string) bool) {
+	logging.V(4).Info("Adding channel subscription", "volumeID", index)
+	if filter == nil {
+		filter = passAll
+	}
+	sub := &subscription{channel, filter}
+	if _, loaded := vl.eventmap.Swap(index, sub); !loaded {
+		vl.updateSubscriberCount(1)
+	}
+	vl.mapmutex.RLock()
+	lastEvent := vl.lastEvent
+	vl.mapmutex.RUnlock()
+	if lastEvent != nil {
+		go vl.replay(index, sub, lastEvent)
+	}
+	logging.V(4).Info("Added")
+}
+
+// SubscribeWithContext adds a channel to the subscription list for volume
+// events, and removes it again when ctx is done
+func (vl *VolumeLister) SubscribeWithContext(ctx context.Context, index string, channel chan<- Completion) {
+	vl.Subscribe(index, channel)
+	go func() {
+		select {
+		case <-ctx.Done():
+			logging.V(4).Info("Subscription context done", "volumeID", index)
+			vl.unsubscribeChannel(index, channel)
+		case <-vl.Done():
+		}
+	}()
 }
 
 // Unsubscribe removes a channel from the subscription list for volume events
 func (vl *VolumeLister) Unsubscribe(index string) {
-	glog.V(4).Infof("Removing channel subscription for %s", index)
+	logging.V(4).Info("Removing channel subscription", "volumeID", index)
+	if _, loaded := vl.eventmap.LoadAndDelete(index); loaded {
+		vl.updateSubscriberCount(-1)
+	}
+	vl.mapmutex.Lock()
+	delete(vl.slowmap, index)
+	vl.mapmutex.Unlock()
+	logging.V(4).Info("Removed")
+}
+
+// ListVolumes returns the volumes available right now, without waiting
+// for the next watch event
+func (vl *VolumeLister) ListVolumes() ([]string, error) {
+	volumes, err := vl.volWatcher.ListVolumes()
+	if err != nil || vl.volumeFilter == nil {
+		return volumes, err
+	}
+	return vl.filterVolumes(volumes), nil
+}
+
+// InformErrors returns a buffered channel of errors reported by
+// subscribers through their completion functions. Errors that arrive
+// while the buffer is full are logged and dropped.
+func (vl *VolumeLister) InformErrors() <-chan error {
+	return vl.informErrs
+}
+
+// SlowSubscribers returns the indexes of subscribers whose most recent
+// update timed out
+func (vl *VolumeLister) SlowSubscribers() []string {
+	vl.mapmutex.RLock()
+	defer vl.mapmutex.RUnlock()
+	result := maps.Keys(vl.slowmap)
+	slices.Sort(result)
+	return result
+}
+
+// StaleVolumes returns the IDs of volumes that were present in the last
+// scan but had broken symlinks
+func (vl *VolumeLister) StaleVolumes() []string {
+	return vl.volWatcher.StaleVolumes()
+}
+
+// DeadLetters returns the updates each subscriber, by volume ID, failed
+// to accept, oldest first, leaving them in place. Their CompleteFuncs are
+// nil.
+func (vl *VolumeLister) DeadLetters() map[string][]Completion {
+	vl.mapmutex.RLock()
+	defer vl.mapmutex.RUnlock()
+	result := make(map[string][]Completion, len(vl.deadLetters))
+	for index, letters := range vl.deadLetters {
+		result[index] = slices.Clone(letters)
+	}
+	return result
+}
+
+// DrainDeadLetters removes and returns the updates the subscriber for
+// subscriberID failed to accept, oldest first. Their CompleteFuncs are
+// nil.
+func (vl *VolumeLister) DrainDeadLetters(subscriberID string) []Completion {
 	vl.mapmutex.Lock()
 	defer vl.mapmutex.Unlock()
-	delete(vl.eventmap, index)
-	glog.V(4).Infof("Removed")
+	letters := vl.deadLetters[subscriberID]
+	delete(vl.deadLetters, subscriberID)
+	return letters
+}
+
+// unsubscribeChannel removes the subscription for index only if it is
+// still using channel, so a later resubscription is left in place
+func (vl *VolumeLister) unsubscribeChannel(index string, channel chan<- Completion) {
+	sub, ok := vl.lookup(index)
+	if !ok || sub.channel != channel {
+		return
+	}
+	if vl.eventmap.CompareAndDelete(index, sub) {
+		vl.updateSubscriberCount(-1)
+		vl.mapmutex.Lock()
+		delete(vl.slowmap, index)
+		vl.mapmutex.Unlock()
+		logging.V(4).Info("Removed subscription", "volumeID", index)
+	}
+}
+
+// ReadyCheck returns nil once the volumes from the first watch event
+// have been advertised to kubelet, either by a plugin's first
+// ListAndWatch response or by the manager syncing an empty list, and
+// ErrNotReady before then
+func (vl *VolumeLister) ReadyCheck() error {
+	select {
+	case <-vl.ready:
+		return nil
+	default:
+		return ErrNotReady
+	}
+}
+
+// markReady records that kubelet has been sent a volume list
+func (vl *VolumeLister) markReady() {
+	vl.readyOnce.Do(func() {
+		logging.V(3).Info("Volumes advertised to kubelet, ready", "namespace", vl.namespace)
+		close(vl.ready)
+	})
+}
+
+// reserveVolume counts another allocated volume, returning a
+// ResourceExhausted error if that would exceed the maximum
+func (vl *VolumeLister) reserveVolume(volumeID string) error {
+	for {
+		current := atomic.LoadInt64(&vl.allocatedCount)
+		if vl.maxVolumes > 0 && current >= vl.maxVolumes {
+			return status.Errorf(codes.ResourceExhausted,
+				"volume %s: %d of at most %d volumes already allocated", volumeID, current, vl.maxVolumes)
+		}
+		if atomic.CompareAndSwapInt64(&vl.allocatedCount, current, current+1) {
+			return nil
+		}
+	}
+}
+
+// releaseVolume uncounts an allocated volume
+func (vl *VolumeLister) releaseVolume() {
+	atomic.AddInt64(&vl.allocatedCount, -1)
 }
 
 // Done returns a channel that is closed when the watcher has been cancelled
@@ -115,26 +434,318 @@ func (vl *VolumeLister) Err() error {
 
 // Implementation
 
-func (vl *VolumeLister) informSubscribers(files []string) {
-	glog.V(4).Infoln("Obtaining channels")
-	vl.mapmutex.RLock()
-	channels := maps.Values(vl.eventmap)
-	vl.mapmutex.RUnlock()
-	glog.V(4).Infoln("Informing Subscribers")
+// informSubscribers compares the event's volume list with the previous
+// one and passes the update on to the subscribers for the volumes that
+// were added or removed. Other subscribers are not sent the update.
+func (vl *VolumeLister) informSubscribers(event volwatch.DeltaEvent) {
+	vl.mapmutex.Lock()
+	// With nobody to tell, only the last volume list needs keeping, for
+	// replay to later subscribers. This is the usual case at startup.
+	// Subscribers read it under mapmutex once counted, so none can miss
+	// both this update and its replay.
+	if vl.subscriberCount() == 0 {
+		vl.lastEvent = event.Volumes()
+		vl.mapmutex.Unlock()
+		return
+	}
+	added, removed := diffVolumeLists(vl.lastEvent, event.Volumes())
+	vl.lastEvent = event.Volumes()
+	vl.mapmutex.Unlock()
+	switch {
+	case event.Type == volwatch.Create && !slices.Contains(added, event.VolumeID):
+		added = append(added, event.VolumeID)
+	case event.Type == volwatch.Remove && !slices.Contains(removed, event.VolumeID):
+		removed = append(removed, event.VolumeID)
+	}
+	changed := append(append([]string{}, removed...), added...)
+	for _, id := range changed {
+		vl.informSubscriber(id, Completion{
+			Volumes:        event.Volumes(),
+			AddedVolumes:   added,
+			RemovedVolumes: removed,
+		})
+	}
+}
+
+// applyVolumeFilter removes the volumes hidden by the volume filter from
+// the event's snapshot, returning false if the changed volume is itself
+// hidden and the event can be ignored
+func (vl *VolumeLister) applyVolumeFilter(event *volwatch.DeltaEvent) bool {
+	if vl.volumeFilter == nil {
+		return true
+	}
+	event.Snapshot = vl.filterVolumes(event.Snapshot)
+	return vl.volumeFilter(event.VolumeID)
+}
+
+// filterVolumes returns the volumes passed by the volume filter
+func (vl *VolumeLister) filterVolumes(volumes []string) []string {
+	result := make([]string, 0, len(volumes))
+	for _, vol := range volumes {
+		if vl.volumeFilter(vol) {
+			result = append(result, vol)
+		}
+	}
+	return result
+}
+
+// diffVolumeLists returns the volumes in current but not previous, and
+// those in previous but not current
+func diffVolumeLists(previous []string, current []string) (added []string, removed []string) {
+	for _, vol := range current {
+		if !slices.Contains(previous, vol) {
+			added = append(added, vol)
+		}
+	}
+	for _, vol := range previous {
+		if !slices.Contains(current, vol) {
+			removed = append(removed, vol)
+		}
+	}
+	return added, removed
+}
+
+// informSubscriber passes the update on to the subscriber for index, if
+// there is one, and waits for it to complete. The wait is abandoned if
+// the watcher is cancelled first.
+func (vl *VolumeLister) informSubscriber(index string, update Completion) {
+	logging.V(4).Info("Obtaining channel", "volumeID", index)
+	sub, ok := vl.lookup(index)
+	if !ok {
+		logging.V(4).Info("No subscriber", "volumeID", index)
+		return
+	}
+	if !sub.filter(update.Volumes) {
+		logging.V(4).Info("Update filtered out by subscriber", "volumeID", index)
+		return
+	}
+	logging.V(4).Info("Informing Subscriber")
+	select {
+	case <-vl.volWatcher.Done():
+		logging.V(4).Info("Watcher is done, shouldn't get here")
+		return
+	default:
+	}
+	completed := make(chan struct{})
+	var once sync.Once
+	update.CompleteFunc = func(err error) {
+		if err != nil {
+			vl.postInformError(fmt.Errorf("subscriber %s: %w", index, err))
+		}
+		once.Do(func() { close(completed) })
+	}
+	if !vl.send(index, sub.channel, update) {
+		return
+	}
+	logging.V(4).Info("Waiting for Subscriber to complete update")
+	select {
+	case <-completed:
+	case <-vl.volWatcher.Done():
+		logging.V(4).Info("Watcher is done, abandoning wait for subscriber", "volumeID", index)
+	}
+}
+
+// replay sends the cached volume list to a new subscriber. It gives up
+// when the watcher is done or after the subscriber timeout, if one is
+// set, without counting the subscriber as slow.
+func (vl *VolumeLister) replay(index string, sub *subscription, volumes []string) {
+	if !sub.filter(volumes) {
+		logging.V(4).Info("Replay filtered out by subscriber", "volumeID", index)
+		return
+	}
+	var timeout <-chan time.Time
+	if vl.subscriberTimeout > 0 {
+		timer := time.NewTimer(vl.subscriberTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	complete := func(err error) {
+		if err != nil {
+			vl.postInformError(fmt.Errorf("subscriber %s: %w", index, err))
+		}
+	}
+	logging.V(4).Info("Replaying last volume list", "volumeID", index)
+	select {
+	case sub.channel <- Completion{Volumes: volumes, CompleteFunc: complete}:
+	case <-vl.Done():
+	case <-timeout:
+		logging.V(4).Info("Subscriber did not accept replay in time", "volumeID", index)
+	}
+}
+
+// watchdog sends a heartbeat to every subscriber each heartbeat interval
+// and unsubscribes those that miss too many in a row. Heartbeats carry
+// the last volume list, so none are sent before the first event.
+func (vl *VolumeLister) watchdog() {
+	ticker := time.NewTicker(vl.heartbeatInterval)
+	defer ticker.Stop()
+	missed := make(map[*subscription]int)
+	for {
+		select {
+		case <-vl.Done():
+			return
+		case <-ticker.C:
+			vl.mapmutex.RLock()
+			volumes := vl.lastEvent
+			vl.mapmutex.RUnlock()
+			if volumes == nil {
+				continue
+			}
+			stillMissing := make(map[*subscription]int)
+			for index, sub := range vl.heartbeat(volumes) {
+				count := missed[sub] + 1
+				logging.V(4).Info("Subscriber missed heartbeat", "volumeID", index, "missed", count)
+				if count >= maxMissedHeartbeats {
+					logging.Warn("Subscriber stopped reading, unsubscribing", "volumeID", index)
+					vl.unsubscribeChannel(index, sub.channel)
+					continue
+				}
+				stillMissing[sub] = count
+			}
+			missed = stillMissing
+		}
+	}
+}
+
+// heartbeat sends volumes to every subscriber in parallel and returns the
+// subscriptions, by index, that did not accept it within the heartbeat
+// interval
+func (vl *VolumeLister) heartbeat(volumes []string) map[string]*subscription {
+	var mutex sync.Mutex
 	var wg sync.WaitGroup
-	for _, channel := range channels {
+	result := make(map[string]*subscription)
+	vl.eventmap.Range(func(key, value any) bool {
+		index, sub := key.(string), value.(*subscription)
+		// A subscriber for a missing volume has already been told it
+		// was removed, and would take the heartbeat as another removal
+		if !slices.Contains(volumes, index) || !sub.filter(volumes) {
+			return true
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			timer := time.NewTimer(vl.heartbeatInterval)
+			defer timer.Stop()
+			heartbeat := Completion{Volumes: volumes, CompleteFunc: func(error) {}}
+			select {
+			case sub.channel <- heartbeat:
+			case <-vl.Done():
+			case <-timer.C:
+				mutex.Lock()
+				result[index] = sub
+				mutex.Unlock()
+			}
+		}()
+		return true
+	})
+	wg.Wait()
+	return result
+}
+
+// postInformError adds the error to the inform errors channel without
+// blocking
+func (vl *VolumeLister) postInformError(err error) {
+	logging.Warn("Subscriber update failed", "err", err)
+	select {
+	case vl.informErrs <- err:
+	default:
+		logging.Warn("Inform error channel full, dropping error", "err", err)
+	}
+}
+
+// send posts the completion to the subscriber, giving up after the
+// subscriber timeout if one is set or when the watcher is cancelled.
+// Returns false if the completion was not sent.
+func (vl *VolumeLister) send(index string, channel chan<- Completion, completion Completion) bool {
+	if vl.subscriberTimeout <= 0 {
 		select {
+		case channel <- completion:
+			return true
 		case <-vl.volWatcher.Done():
-			glog.V(4).Infoln("Watcher is done, shouldn't get here")
-		default:
-			wg.Add(1)
-			channel <- Completion{files, wg.Done}
+			logging.V(4).Info("Watcher is done, abandoning update", "volumeID", index)
+			return false
 		}
 	}
-	glog.V(4).Infoln("Waiting for Subscribers to complete updates")
-	wg.Wait()
+	timer := time.NewTimer(vl.subscriberTimeout)
+	defer timer.Stop()
+	select {
+	case channel <- completion:
+		vl.recordSend(index, true)
+		return true
+	case <-vl.volWatcher.Done():
+		logging.V(4).Info("Watcher is done, abandoning update", "volumeID", index)
+		return false
+	case <-timer.C:
+		logging.Warn("Subscriber did not accept update in time", "volumeID", index, "timeout", vl.subscriberTimeout)
+		vl.recordDeadLetter(index, completion)
+		vl.recordSend(index, false)
+		return false
+	}
+}
+
+// recordDeadLetter keeps an update the subscriber for index failed to
+// accept, dropping the oldest beyond the dead letter size
+func (vl *VolumeLister) recordDeadLetter(index string, completion Completion) {
+	if vl.deadLetterSize <= 0 {
+		return
+	}
+	completion.CompleteFunc = nil
+	vl.mapmutex.Lock()
+	defer vl.mapmutex.Unlock()
+	letters := append(vl.deadLetters[index], completion)
+	if excess := len(letters) - vl.deadLetterSize; excess > 0 {
+		letters = slices.Delete(letters, 0, excess)
+	}
+	vl.deadLetters[index] = letters
+}
+
+// recordSend tracks consecutive timeouts for a subscriber, removing the
+// subscription once the limit is reached
+func (vl *VolumeLister) recordSend(index string, accepted bool) {
+	vl.mapmutex.Lock()
+	defer vl.mapmutex.Unlock()
+	if accepted {
+		delete(vl.slowmap, index)
+		return
+	}
+	vl.slowmap[index]++
+	if vl.maxTimeouts > 0 && vl.slowmap[index] >= vl.maxTimeouts {
+		logging.Warn("Subscriber timed out repeatedly, unsubscribing", "volumeID", index, "timeouts", vl.slowmap[index])
+		if _, loaded := vl.eventmap.LoadAndDelete(index); loaded {
+			vl.updateSubscriberCount(-1)
+		}
+		delete(vl.slowmap, index)
+	}
+}
+
+// lookup returns the subscription for index, if there is one
+func (vl *VolumeLister) lookup(index string) (*subscription, bool) {
+	value, ok := vl.eventmap.Load(index)
+	if !ok {
+		return nil, false
+	}
+	return value.(*subscription), true
+}
+
+// updateSubscriberCount adjusts and publishes the number of subscriptions.
+// The two happen under a lock so that concurrent updates cannot publish
+// their counts out of order and leave the gauge stale.
+// subscriberCount returns the number of subscriptions
+func (vl *VolumeLister) subscriberCount() int64 {
+	vl.countmutex.Lock()
+	defer vl.countmutex.Unlock()
+	return vl.subCount
+}
+
+func (vl *VolumeLister) updateSubscriberCount(delta int64) {
+	vl.countmutex.Lock()
+	defer vl.countmutex.Unlock()
+	vl.subCount += delta
+	metrics.ActiveSubscribers.Set(int(vl.subCount))
 }
 
 const (
-	resourceNamespace = "volumes.brightbox.com"
+	resourceNamespace     = "volumes.brightbox.com"
+	informErrorBufferSize = 8
+	maxMissedHeartbeats   = 2
 )
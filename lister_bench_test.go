@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/brightbox/brightbox-volume-device-plugin/volwatch"
+	volwatchtesting "github.com/brightbox/brightbox-volume-device-plugin/volwatch/testing"
+)
+
+var subscriberCounts = []int{1, 10, 50, 100, 200, 500}
+
+func rejectAll([]string) bool {
+	return false
+}
+
+// benchmarkInformSubscribers times informSubscribers with subscribers
+// for each of the given number of volumes, all of which are added or
+// removed by every event. Each subscriber drains its channel in its own
+// goroutine. The filter for the subscriber at position i is chosen by
+// filterFor.
+func benchmarkInformSubscribers(b *testing.B, subscribers int, filterFor func(i int) func([]string) bool) {
+	watcher := volwatchtesting.NewFakeWatcher(true)
+	defer watcher.Cancel()
+	vl := NewLister(watcher)
+	volumes := make([]string, subscribers)
+	for i := range volumes {
+		volumes[i] = fmt.Sprintf("vol-%05d", i)
+		ch := make(chan Completion)
+		go func() {
+			for {
+				select {
+				case completion := <-ch:
+					completion.CompleteFunc(nil)
+				case <-vl.Done():
+					return
+				}
+			}
+		}()
+		vl.SubscribeFiltered(volumes[i], ch, filterFor(i))
+	}
+	events := []volwatch.DeltaEvent{
+		{Type: volwatch.Create, VolumeID: volumes[0], Snapshot: volumes},
+		{Type: volwatch.Remove, VolumeID: volumes[0], Snapshot: []string{}},
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		vl.informSubscribers(events[n%len(events)])
+	}
+	b.StopTimer()
+	if seconds := b.Elapsed().Seconds(); seconds > 0 {
+		b.ReportMetric(float64(b.N)/seconds, "events/s")
+	}
+	b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*subscribers), "ns/subscriber")
+}
+
+func BenchmarkInformSubscribers(b *testing.B) {
+	for _, subscribers := range subscriberCounts {
+		b.Run(fmt.Sprintf("%d", subscribers), func(b *testing.B) {
+			benchmarkInformSubscribers(b, subscribers, func(int) func([]string) bool {
+				return passAll
+			})
+		})
+	}
+}
+
+// BenchmarkInformSubscribersWithFilter has nine in every ten subscribers
+// filter out every update, for comparison with BenchmarkInformSubscribers
+func BenchmarkInformSubscribersWithFilter(b *testing.B) {
+	for _, subscribers := range subscriberCounts {
+		b.Run(fmt.Sprintf("%d", subscribers), func(b *testing.B) {
+			benchmarkInformSubscribers(b, subscribers, func(i int) func([]string) bool {
+				if i%10 == 0 {
+					return passAll
+				}
+				return rejectAll
+			})
+		})
+	}
+}
+
+// BenchmarkInformNoSubscribers should report no allocations. Run with
+// -benchtime=1000000x for a fixed number of calls.
+func BenchmarkInformNoSubscribers(b *testing.B) {
+	watcher := volwatchtesting.NewFakeWatcher(true)
+	defer watcher.Cancel()
+	vl := NewLister(watcher)
+	volumes := []string{"vol-aaaaa", "vol-bbbbb"}
+	events := []volwatch.DeltaEvent{
+		{Type: volwatch.Create, VolumeID: volumes[0], Snapshot: volumes},
+		{Type: volwatch.Remove, VolumeID: volumes[0], Snapshot: volumes[1:]},
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		vl.informSubscribers(events[n%len(events)])
+	}
+}
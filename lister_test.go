@@ -0,0 +1,959 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/brightbox/brightbox-volume-device-plugin/dpm"
+	"github.com/brightbox/brightbox-volume-device-plugin/metrics"
+	"github.com/brightbox/brightbox-volume-device-plugin/volwatch"
+	volwatchtesting "github.com/brightbox/brightbox-volume-device-plugin/volwatch/testing"
+	"golang.org/x/exp/slices"
+)
+
+func newTestLister(t *testing.T, opts ...ListerOption) *VolumeLister {
+	t.Helper()
+	watcher := volwatch.NewWatchDir(
+		filepath.Join(t.TempDir(), "by-id"),
+		volwatch.WithDeltaEvents(),
+	)
+	t.Cleanup(watcher.Cancel)
+	return NewLister(watcher, opts...)
+}
+
+func isSubscribed(vl *VolumeLister, index string) bool {
+	_, ok := vl.lookup(index)
+	return ok
+}
+
+func TestSubscriberTimeout(t *testing.T) {
+	vl := newTestLister(t,
+		WithSubscriberTimeout(20*time.Millisecond),
+		WithMaxSubscriberTimeouts(2),
+	)
+	vl.Subscribe("vol-aaaaa", make(chan Completion))
+	event := volwatch.DeltaEvent{Type: volwatch.Remove, VolumeID: "vol-aaaaa"}
+	vl.informSubscribers(event)
+	slow := vl.SlowSubscribers()
+	if len(slow) != 1 || slow[0] != "vol-aaaaa" {
+		t.Errorf("Expected slow subscriber vol-aaaaa, got %v", slow)
+	}
+	if !isSubscribed(vl, "vol-aaaaa") {
+		t.Error("Subscriber removed after a single timeout")
+	}
+	vl.informSubscribers(event)
+	if isSubscribed(vl, "vol-aaaaa") {
+		t.Error("Subscriber not removed after repeated timeouts")
+	}
+	if slow := vl.SlowSubscribers(); len(slow) != 0 {
+		t.Errorf("Expected no slow subscribers, got %v", slow)
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+	vl := newTestLister(t,
+		WithSubscriberTimeout(10*time.Millisecond),
+		WithDeadLetterSize(2),
+	)
+	vl.Subscribe("vol-aaaaa", make(chan Completion))
+	for _, volumes := range [][]string{{"vol-aaaaa"}, {"vol-aaaaa", "vol-bbbbb"}, {"vol-aaaaa", "vol-ccccc"}} {
+		vl.informSubscribers(volwatch.DeltaEvent{Type: volwatch.Create, VolumeID: "vol-aaaaa", Snapshot: volumes})
+	}
+	if letters := vl.DeadLetters(); len(letters["vol-aaaaa"]) != 2 {
+		t.Errorf("Expected 2 dead letters, got %v", letters)
+	}
+	letters := vl.DrainDeadLetters("vol-aaaaa")
+	if len(letters) != 2 {
+		t.Fatalf("Expected the last 2 updates, got %v", letters)
+	}
+	if !slices.Equal(letters[0].Volumes, []string{"vol-aaaaa", "vol-bbbbb"}) || !slices.Equal(letters[1].Volumes, []string{"vol-aaaaa", "vol-ccccc"}) {
+		t.Errorf("Expected the latest updates oldest first, got %v, %v", letters[0].Volumes, letters[1].Volumes)
+	}
+	if letters[0].CompleteFunc != nil {
+		t.Error("Expected dead letters without a CompleteFunc")
+	}
+	if letters := vl.DrainDeadLetters("vol-aaaaa"); len(letters) != 0 {
+		t.Errorf("Expected dead letters to be drained, got %v", letters)
+	}
+}
+
+func TestDeadLettersDisabled(t *testing.T) {
+	vl := newTestLister(t, WithSubscriberTimeout(10*time.Millisecond))
+	vl.Subscribe("vol-aaaaa", make(chan Completion))
+	vl.informSubscribers(volwatch.DeltaEvent{Type: volwatch.Create, VolumeID: "vol-aaaaa", Snapshot: []string{"vol-aaaaa"}})
+	if letters := vl.DrainDeadLetters("vol-aaaaa"); len(letters) != 0 {
+		t.Errorf("Expected no dead letters by default, got %v", letters)
+	}
+}
+
+func TestSubscriberDelayedAccept(t *testing.T) {
+	vl := newTestLister(t, WithSubscriberTimeout(time.Second))
+	ch := make(chan Completion)
+	vl.Subscribe("vol-aaaaa", ch)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		completion := <-ch
+		completion.CompleteFunc(nil)
+	}()
+	vl.informSubscribers(volwatch.DeltaEvent{Type: volwatch.Remove, VolumeID: "vol-aaaaa"})
+	if slow := vl.SlowSubscribers(); len(slow) != 0 {
+		t.Errorf("Expected no slow subscribers, got %v", slow)
+	}
+}
+
+func TestSubscribeWithContext(t *testing.T) {
+	vl := newTestLister(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	vl.SubscribeWithContext(ctx, "vol-aaaaa", make(chan Completion))
+	if !isSubscribed(vl, "vol-aaaaa") {
+		t.Fatal("Subscription not added")
+	}
+	cancel()
+	deadline := time.Now().Add(time.Second)
+	for isSubscribed(vl, "vol-aaaaa") {
+		if time.Now().After(deadline) {
+			t.Fatal("Subscription not removed after context cancelled")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSubscribeWithContextResubscribe(t *testing.T) {
+	vl := newTestLister(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	vl.SubscribeWithContext(ctx, "vol-aaaaa", make(chan Completion))
+	replacement := make(chan Completion)
+	vl.Subscribe("vol-aaaaa", replacement)
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+	if sub, _ := vl.lookup("vol-aaaaa"); sub == nil || sub.channel != replacement {
+		t.Error("Resubscription removed by expired context")
+	}
+}
+
+func TestInformErrors(t *testing.T) {
+	vl := newTestLister(t)
+	failing := make(chan Completion)
+	working := make(chan Completion)
+	vl.Subscribe("vol-aaaaa", failing)
+	vl.Subscribe("vol-bbbbb", working)
+	received := make(chan []string, 1)
+	go func() {
+		completion := <-failing
+		completion.CompleteFunc(errors.New("device path missing"))
+	}()
+	go func() {
+		completion := <-working
+		received <- completion.Volumes
+		completion.CompleteFunc(nil)
+	}()
+	vl.informSubscribers(volwatch.DeltaEvent{Type: volwatch.Remove, VolumeID: "vol-aaaaa"})
+	vl.informSubscribers(volwatch.DeltaEvent{
+		Type:     volwatch.Create,
+		VolumeID: "vol-bbbbb",
+		Snapshot: []string{"vol-bbbbb"},
+	})
+	select {
+	case err := <-vl.InformErrors():
+		if err == nil || !strings.Contains(err.Error(), "vol-aaaaa") {
+			t.Errorf("Expected error from vol-aaaaa, got %v", err)
+		}
+	default:
+		t.Fatal("Expected subscriber error on InformErrors")
+	}
+	select {
+	case err := <-vl.InformErrors():
+		t.Errorf("Expected a single error, got %v", err)
+	default:
+	}
+	if volumes := <-received; len(volumes) != 1 || volumes[0] != "vol-bbbbb" {
+		t.Errorf("Expected working subscriber to receive [vol-bbbbb], got %v", volumes)
+	}
+}
+
+func TestListVolumes(t *testing.T) {
+	vl := newTestLister(t)
+	watchDir := vl.volWatcher.(*volwatch.VolumeWatcher).WatchDir()
+	os.Mkdir(watchDir, 0755)
+	for _, name := range []string{"virtio-vol-aaaaa", "virtio-vol-bbbbb", "ata-QEMU_HARDDISK"} {
+		if err := os.WriteFile(filepath.Join(watchDir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	volumes, err := vl.ListVolumes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(volumes) != 2 || volumes[0] != "vol-aaaaa" || volumes[1] != "vol-bbbbb" {
+		t.Errorf("Expected [vol-aaaaa vol-bbbbb], got %v", volumes)
+	}
+}
+
+func missing(index string) func([]string) bool {
+	return func(volumes []string) bool {
+		return !slices.Contains(volumes, index)
+	}
+}
+
+func TestSubscribeFiltered(t *testing.T) {
+	vl := newTestLister(t, WithSubscriberTimeout(20*time.Millisecond))
+	ch := make(chan Completion, 1)
+	vl.SubscribeFiltered("vol-aaaaa", ch, missing("vol-aaaaa"))
+	vl.informSubscribers(volwatch.DeltaEvent{
+		Type:     volwatch.Create,
+		VolumeID: "vol-aaaaa",
+		Snapshot: []string{"vol-aaaaa"},
+	})
+	if len(ch) != 0 {
+		t.Error("Filtered update was sent to subscriber")
+	}
+	go func() {
+		completion := <-ch
+		completion.CompleteFunc(nil)
+	}()
+	vl.informSubscribers(volwatch.DeltaEvent{Type: volwatch.Remove, VolumeID: "vol-aaaaa"})
+	if slow := vl.SlowSubscribers(); len(slow) != 0 {
+		t.Errorf("Expected unfiltered update to be accepted, got slow %v", slow)
+	}
+}
+
+func benchmarkInform(b *testing.B, filtered bool) {
+	vl := NewLister(volwatch.NewWatchDir(filepath.Join(b.TempDir(), "by-id")))
+	defer vl.volWatcher.Cancel()
+	volumes := make([]string, 200)
+	var sends int64
+	for i := range volumes {
+		volumes[i] = fmt.Sprintf("vol-%05d", i)
+		ch := make(chan Completion)
+		go func() {
+			for completion := range ch {
+				atomic.AddInt64(&sends, 1)
+				completion.CompleteFunc(nil)
+			}
+		}()
+		defer close(ch)
+		if filtered {
+			vl.SubscribeFiltered(volumes[i], ch, missing(volumes[i]))
+		} else {
+			vl.Subscribe(volumes[i], ch)
+		}
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for _, vol := range volumes {
+			vl.informSubscribers(volwatch.DeltaEvent{Type: volwatch.Create, VolumeID: vol, Snapshot: volumes})
+		}
+	}
+	b.ReportMetric(float64(atomic.LoadInt64(&sends))/float64(b.N), "sends/op")
+}
+
+func BenchmarkInformUnfiltered(b *testing.B) {
+	benchmarkInform(b, false)
+}
+
+func BenchmarkInformFiltered(b *testing.B) {
+	benchmarkInform(b, true)
+}
+
+func TestInformOnlyChangedSubscribers(t *testing.T) {
+	vl := newTestLister(t)
+	volumes := make([]string, 100)
+	var sends int64
+	updates := make(chan Completion, 1)
+	for i := range volumes {
+		volumes[i] = fmt.Sprintf("vol-%05d", i)
+		ch := make(chan Completion)
+		go func() {
+			for completion := range ch {
+				atomic.AddInt64(&sends, 1)
+				updates <- completion
+				completion.CompleteFunc(nil)
+			}
+		}()
+		defer close(ch)
+		vl.Subscribe(volumes[i], ch)
+	}
+	vl.lastEvent = volumes
+	remaining := slices.Delete(slices.Clone(volumes), 42, 43)
+	vl.informSubscribers(volwatch.DeltaEvent{Type: volwatch.Remove, VolumeID: "vol-00042", Snapshot: remaining})
+	if sends := atomic.LoadInt64(&sends); sends != 1 {
+		t.Fatalf("Expected 1 subscriber to be notified, got %d", sends)
+	}
+	update := <-updates
+	if len(update.RemovedVolumes) != 1 || update.RemovedVolumes[0] != "vol-00042" {
+		t.Errorf("Expected RemovedVolumes [vol-00042], got %v", update.RemovedVolumes)
+	}
+	if len(update.AddedVolumes) != 0 || len(update.Volumes) != 99 {
+		t.Errorf("Unexpected update %v added, %d volumes", update.AddedVolumes, len(update.Volumes))
+	}
+}
+
+func TestDiffVolumeLists(t *testing.T) {
+	added, removed := diffVolumeLists(
+		[]string{"vol-aaaaa", "vol-bbbbb"},
+		[]string{"vol-bbbbb", "vol-ccccc"},
+	)
+	if len(added) != 1 || added[0] != "vol-ccccc" {
+		t.Errorf("Expected added [vol-ccccc], got %v", added)
+	}
+	if len(removed) != 1 || removed[0] != "vol-aaaaa" {
+		t.Errorf("Expected removed [vol-aaaaa], got %v", removed)
+	}
+}
+
+func TestSubscribeReplaysLastEvent(t *testing.T) {
+	vl := newTestLister(t)
+	watchDir := vl.volWatcher.(*volwatch.VolumeWatcher).WatchDir()
+	os.Mkdir(watchDir, 0755)
+	pluginListCh := make(chan dpm.PluginNameListSync)
+	go vl.Discover(pluginListCh)
+	for _, name := range []string{"virtio-vol-aaaaa", "virtio-vol-bbbbb"} {
+		if err := os.WriteFile(filepath.Join(watchDir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for synced := false; !synced; {
+		select {
+		case list := <-pluginListCh:
+			list.Synced.Done()
+			synced = len(list.Names) == 2
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for Discover")
+		}
+	}
+
+	ch := make(chan Completion)
+	vl.Subscribe("vol-bbbbb", ch)
+	select {
+	case completion := <-ch:
+		if len(completion.Volumes) != 2 || !slices.Contains(completion.Volumes, "vol-bbbbb") {
+			t.Errorf("Expected cached volume list, got %v", completion.Volumes)
+		}
+		completion.CompleteFunc(nil)
+	case <-time.After(time.Second):
+		t.Fatal("New subscriber was not sent the cached volume list")
+	}
+}
+
+// TestAtomicEventDelivery creates volumes as fast as it can while a
+// subscriber checks each list it is sent holds every volume of the one
+// before, so no list read part way through enumeration is posted. Lists
+// may grow by more than one volume at a time, as creations arriving
+// together are read in one go. Run with -race.
+func TestAtomicEventDelivery(t *testing.T) {
+	const count = 50
+	vl := newTestLister(t, WithSubscriberTimeout(5*time.Second))
+	watchDir := vl.volWatcher.(*volwatch.VolumeWatcher).WatchDir()
+	os.Mkdir(watchDir, 0755)
+	pluginListCh := make(chan dpm.PluginNameListSync)
+	go vl.Discover(pluginListCh)
+	go func() {
+		for {
+			select {
+			case update := <-pluginListCh:
+				update.Synced.Done()
+			case <-vl.Done():
+				return
+			}
+		}
+	}()
+	// Subscribers only hear of changes to their own volume, so listen
+	// for all of them on one channel
+	ch := make(chan Completion)
+	for i := 0; i < count; i++ {
+		vl.Subscribe(fmt.Sprintf("vol-%05d", i), ch)
+	}
+
+	go func() {
+		for i := 0; i < count; i++ {
+			name := fmt.Sprintf("virtio-vol-%05d", i)
+			if err := os.WriteFile(filepath.Join(watchDir, name), nil, 0644); err != nil {
+				t.Error(err)
+				return
+			}
+			time.Sleep(time.Microsecond)
+		}
+	}()
+
+	var previous []string
+	timeout := time.After(10 * time.Second)
+	for len(previous) < count {
+		select {
+		case completion := <-ch:
+			completion.CompleteFunc(nil)
+			for _, volume := range previous {
+				if !slices.Contains(completion.Volumes, volume) {
+					t.Fatalf("Saw %v after %v", completion.Volumes, previous)
+				}
+			}
+			previous = completion.Volumes
+		case <-timeout:
+			t.Fatalf("Timed out with %d of %d volumes seen", len(previous), count)
+		}
+	}
+}
+
+// TestInformSubscribersCancelled checks a notification in progress is
+// abandoned when the watcher is cancelled, whether the subscriber has yet
+// to accept the update or has accepted it and not completed
+func TestInformSubscribersCancelled(t *testing.T) {
+	for _, accept := range []bool{false, true} {
+		watcher := volwatchtesting.NewFakeWatcher(true)
+		vl := NewLister(watcher)
+		ch := make(chan Completion, 1)
+		if accept {
+			// Buffered, so the update is accepted but never completed
+			vl.Subscribe("vol-aaaaa", ch)
+		} else {
+			vl.Subscribe("vol-aaaaa", make(chan Completion))
+		}
+		returned := make(chan struct{})
+		go func() {
+			defer close(returned)
+			vl.informSubscribers(volwatch.DeltaEvent{
+				Type:     volwatch.Create,
+				VolumeID: "vol-aaaaa",
+				Snapshot: []string{"vol-aaaaa"},
+			})
+		}()
+		if accept {
+			<-ch
+		}
+		watcher.Cancel()
+		select {
+		case <-returned:
+		case <-time.After(time.Second):
+			t.Fatalf("informSubscribers did not return after cancel (accepted %v)", accept)
+		}
+	}
+}
+
+// mutexSubscriptions is the RWMutex guarded map the lister used before
+// moving to sync.Map, kept for comparison in BenchmarkSubscriberLookup
+type mutexSubscriptions struct {
+	mutex sync.RWMutex
+	subs  map[string]*subscription
+}
+
+func (ms *mutexSubscriptions) store(index string, sub *subscription) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.subs[index] = sub
+}
+
+func (ms *mutexSubscriptions) load(index string) (*subscription, bool) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	sub, ok := ms.subs[index]
+	return sub, ok
+}
+
+// benchmarkLookup looks up subscribers from parallel goroutines while
+// every hundredth operation resubscribes, as plugins restarting would
+func benchmarkLookup(b *testing.B, subscribers int, store func(string, *subscription), load func(string) (*subscription, bool)) {
+	indexes := make([]string, subscribers)
+	for i := range indexes {
+		indexes[i] = fmt.Sprintf("vol-%05d", i)
+		store(indexes[i], &subscription{filter: passAll})
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			index := indexes[i%subscribers]
+			if i%100 == 0 {
+				store(index, &subscription{filter: passAll})
+			} else if _, ok := load(index); !ok {
+				b.Errorf("Subscriber %s missing", index)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkSubscriberLookup(b *testing.B) {
+	for _, subscribers := range []int{10, 100, 500} {
+		b.Run(fmt.Sprintf("RWMutex-%d", subscribers), func(b *testing.B) {
+			ms := &mutexSubscriptions{subs: make(map[string]*subscription)}
+			benchmarkLookup(b, subscribers, ms.store, ms.load)
+		})
+		b.Run(fmt.Sprintf("SyncMap-%d", subscribers), func(b *testing.B) {
+			vl := &VolumeLister{}
+			store := func(index string, sub *subscription) {
+				vl.eventmap.Store(index, sub)
+			}
+			benchmarkLookup(b, subscribers, store, vl.lookup)
+		})
+	}
+}
+
+func TestHeartbeatRemovesAbandonedSubscriber(t *testing.T) {
+	vl := newTestLister(t, WithHeartbeatInterval(10*time.Millisecond))
+	abandoned := make(chan Completion)
+	live := make(chan Completion)
+	vl.Subscribe("vol-aaaaa", abandoned)
+	vl.Subscribe("vol-bbbbb", live)
+	go func() {
+		for {
+			select {
+			case completion := <-live:
+				completion.CompleteFunc(nil)
+			case <-vl.Done():
+				return
+			}
+		}
+	}()
+	vl.mapmutex.Lock()
+	vl.lastEvent = []string{"vol-aaaaa", "vol-bbbbb"}
+	vl.mapmutex.Unlock()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for isSubscribed(vl, "vol-aaaaa") {
+		if time.Now().After(deadline) {
+			t.Fatal("Abandoned subscriber was not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !isSubscribed(vl, "vol-bbbbb") {
+		t.Error("Live subscriber was removed")
+	}
+}
+
+// newFakeLister creates a lister reading delta events from a fake
+// watcher, with Discover running and passing volume lists to the
+// returned channel
+func newFakeLister(t *testing.T, opts ...ListerOption) (*VolumeLister, *volwatchtesting.FakeWatcher, <-chan []string) {
+	t.Helper()
+	watcher := volwatchtesting.NewFakeWatcher(true)
+	t.Cleanup(watcher.Cancel)
+	vl := NewLister(watcher, opts...)
+	pluginListCh := make(chan dpm.PluginNameListSync)
+	names := make(chan []string)
+	go vl.Discover(pluginListCh)
+	go func() {
+		for {
+			select {
+			case update := <-pluginListCh:
+				select {
+				case names <- update.Names:
+				case <-vl.Done():
+				}
+				update.Synced.Done()
+			case <-vl.Done():
+				return
+			}
+		}
+	}()
+	return vl, watcher, names
+}
+
+func nextNames(t *testing.T, names <-chan []string) []string {
+	t.Helper()
+	select {
+	case result := <-names:
+		return result
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the manager to be notified")
+		return nil
+	}
+}
+
+// recordCompletions subscribes to index and sends each completion it
+// receives to the returned channel, completing it with err
+func recordCompletions(vl *VolumeLister, index string, err error) <-chan Completion {
+	channel := make(chan Completion)
+	result := make(chan Completion, 8)
+	vl.Subscribe(index, channel)
+	go func() {
+		for {
+			select {
+			case completion := <-channel:
+				result <- completion
+				completion.CompleteFunc(err)
+			case <-vl.Done():
+				return
+			}
+		}
+	}()
+	return result
+}
+
+func nextCompletion(t *testing.T, completions <-chan Completion) Completion {
+	t.Helper()
+	select {
+	case completion := <-completions:
+		return completion
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for an update")
+		return Completion{}
+	}
+}
+
+func TestDiscoverNotifiesManager(t *testing.T) {
+	_, watcher, names := newFakeLister(t)
+	go watcher.SendEvent([]string{"vol-aaaaa", "vol-bbbbb"})
+	for i := 0; i < 2; i++ {
+		if got := nextNames(t, names); !slices.Equal(got, []string{"vol-aaaaa", "vol-bbbbb"}) {
+			t.Errorf("Expected both volumes, got %v", got)
+		}
+	}
+	go watcher.SendEvent([]string{"vol-bbbbb"})
+	if got := nextNames(t, names); !slices.Equal(got, []string{"vol-bbbbb"}) {
+		t.Errorf("Expected vol-bbbbb, got %v", got)
+	}
+}
+
+func TestDiscoverSurvivesWatcherErrors(t *testing.T) {
+	_, watcher, names := newFakeLister(t)
+	watcher.SendError(errors.New("transient failure"))
+	go watcher.SendEvent([]string{"vol-aaaaa"})
+	if got := nextNames(t, names); !slices.Equal(got, []string{"vol-aaaaa"}) {
+		t.Errorf("Expected vol-aaaaa, got %v", got)
+	}
+}
+
+func TestDiscoverExitsWhenWatcherCancelled(t *testing.T) {
+	watcher := volwatchtesting.NewFakeWatcher(true)
+	vl := NewLister(watcher)
+	exited := make(chan struct{})
+	go func() {
+		vl.Discover(make(chan dpm.PluginNameListSync))
+		close(exited)
+	}()
+	watcher.FakeCancel()
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		t.Fatal("Discover did not exit after the watcher was cancelled")
+	}
+	if !errors.Is(vl.Err(), context.Canceled) {
+		t.Errorf("Expected Canceled, got %v", vl.Err())
+	}
+}
+
+func TestReadyAfterEmptyVolumeList(t *testing.T) {
+	vl, watcher, names := newFakeLister(t)
+	if err := vl.ReadyCheck(); !errors.Is(err, ErrNotReady) {
+		t.Errorf("Expected ErrNotReady before discovery, got %v", err)
+	}
+	go watcher.SendEvent([]string{"vol-aaaaa"})
+	nextNames(t, names)
+	if err := vl.ReadyCheck(); !errors.Is(err, ErrNotReady) {
+		t.Errorf("Expected ErrNotReady until a plugin sends its volume, got %v", err)
+	}
+	go watcher.SendEvent([]string{})
+	nextNames(t, names)
+	deadline := time.Now().Add(time.Second)
+	for vl.ReadyCheck() != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected ready once the manager synced an empty volume list")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestInformSubscribersAdded(t *testing.T) {
+	vl, watcher, names := newFakeLister(t)
+	aaaaa := recordCompletions(vl, "vol-aaaaa", nil)
+	go watcher.SendEvent([]string{"vol-aaaaa"})
+	completion := nextCompletion(t, aaaaa)
+	if !slices.Equal(completion.Volumes, []string{"vol-aaaaa"}) ||
+		!slices.Equal(completion.AddedVolumes, []string{"vol-aaaaa"}) ||
+		len(completion.RemovedVolumes) != 0 {
+		t.Errorf("Unexpected update %+v", completion)
+	}
+	nextNames(t, names)
+}
+
+func TestInformSubscribersRemoved(t *testing.T) {
+	vl, watcher, names := newFakeLister(t)
+	go watcher.SendEvent([]string{"vol-aaaaa", "vol-bbbbb"})
+	nextNames(t, names)
+	nextNames(t, names)
+	aaaaa := recordCompletions(vl, "vol-aaaaa", nil)
+	// Subscribing replays the current list
+	nextCompletion(t, aaaaa)
+	bbbbb := recordCompletions(vl, "vol-bbbbb", nil)
+	nextCompletion(t, bbbbb)
+
+	go watcher.SendEvent([]string{"vol-bbbbb"})
+	completion := nextCompletion(t, aaaaa)
+	if slices.Contains(completion.Volumes, "vol-aaaaa") ||
+		!slices.Equal(completion.RemovedVolumes, []string{"vol-aaaaa"}) {
+		t.Errorf("Unexpected update %+v", completion)
+	}
+	nextNames(t, names)
+	select {
+	case completion := <-bbbbb:
+		t.Errorf("Unchanged volume informed of %+v", completion)
+	default:
+	}
+}
+
+func TestInformSubscribersReportsErrors(t *testing.T) {
+	vl, watcher, names := newFakeLister(t)
+	recordCompletions(vl, "vol-aaaaa", errors.New("device missing"))
+	go watcher.SendEvent([]string{"vol-aaaaa"})
+	nextNames(t, names)
+	select {
+	case err := <-vl.InformErrors():
+		if !strings.Contains(err.Error(), "vol-aaaaa") {
+			t.Errorf("Expected error naming the subscriber, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Subscriber error not reported")
+	}
+}
+
+func TestInformSubscribersAfterCancel(t *testing.T) {
+	watcher := volwatchtesting.NewFakeWatcher(true)
+	vl := NewLister(watcher)
+	vl.Subscribe("vol-aaaaa", make(chan Completion))
+	watcher.FakeCancel()
+	done := make(chan struct{})
+	go func() {
+		vl.informSubscribers(volwatch.DeltaEvent{Type: volwatch.Create, VolumeID: "vol-aaaaa", Snapshot: []string{"vol-aaaaa"}})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("informSubscribers blocked after the watcher was cancelled")
+	}
+}
+
+func TestStaleVolumesFromWatcher(t *testing.T) {
+	watcher := volwatchtesting.NewFakeWatcher(true)
+	defer watcher.Cancel()
+	vl := NewLister(watcher)
+	watcher.SetStaleVolumes([]string{"vol-ccccc"})
+	if got := vl.StaleVolumes(); !slices.Equal(got, []string{"vol-ccccc"}) {
+		t.Errorf("Expected vol-ccccc, got %v", got)
+	}
+}
+
+// TestConcurrentSubscribeUnsubscribe churns subscriptions while updates
+// are being sent. It is most useful run with the race detector:
+//
+//	go test -race -run TestConcurrentSubscribeUnsubscribe
+func TestConcurrentSubscribeUnsubscribe(t *testing.T) {
+	const subscribers = 50
+	watcher := volwatchtesting.NewFakeWatcher(true)
+	t.Cleanup(watcher.Cancel)
+	vl := NewLister(watcher)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	var volumes []string
+	for i := 0; i < subscribers; i++ {
+		index := fmt.Sprintf("vol-%05d", i)
+		volumes = append(volumes, index)
+		channel := make(chan Completion)
+		go func() {
+			for {
+				select {
+				case completion := <-channel:
+					completion.CompleteFunc(nil)
+				case <-vl.Done():
+					return
+				}
+			}
+		}()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Churn at least once, however late the goroutine starts
+			for {
+				vl.Subscribe(index, channel)
+				vl.Unsubscribe(index)
+				vl.Subscribe(index, channel)
+				select {
+				case <-stop:
+					return
+				default:
+				}
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			eventType, snapshot := volwatch.Create, volumes
+			if i%2 == 1 {
+				eventType, snapshot = volwatch.Remove, []string{}
+			}
+			vl.informSubscribers(volwatch.DeltaEvent{Type: eventType, VolumeID: volumes[0], Snapshot: snapshot})
+		}
+	}()
+	time.Sleep(2 * time.Second)
+	close(stop)
+	wg.Wait()
+
+	var count int64
+	vl.eventmap.Range(func(any, any) bool {
+		count++
+		return true
+	})
+	if count != subscribers {
+		t.Errorf("Expected %d subscriptions, got %d", subscribers, count)
+	}
+	if vl.subCount != count {
+		t.Errorf("Subscriber count %d does not match %d subscriptions", vl.subCount, count)
+	}
+	if got := metrics.ActiveSubscribers.Value(); got != count {
+		t.Errorf("Published subscriber count %d does not match %d subscriptions", got, count)
+	}
+}
+
+// discoverNames runs Discover on vl until it reports want, failing the
+// test if it reports anything else first
+func discoverNames(t *testing.T, vl *VolumeLister, want []string) {
+	t.Helper()
+	pluginListCh := make(chan dpm.PluginNameListSync)
+	go vl.Discover(pluginListCh)
+	for {
+		select {
+		case list := <-pluginListCh:
+			list.Synced.Done()
+			if slices.Equal([]string(list.Names), want) {
+				return
+			}
+			for _, name := range list.Names {
+				if !slices.Contains(want, name) {
+					t.Fatalf("Unexpected volume %s in %s", name, vl.GetResourceNamespace())
+				}
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for %v in %s", want, vl.GetResourceNamespace())
+		}
+	}
+}
+
+func TestExtraNamespacesDiscoverIndependently(t *testing.T) {
+	watchDir := t.TempDir()
+	newNamespaceLister := func(ns string, pattern string) *VolumeLister {
+		watcher := volwatch.NewWatchDir(watchDir,
+			volwatch.WithDeltaEvents(),
+			volwatch.WithVolumeRegex(regexp.MustCompile(pattern)),
+		)
+		t.Cleanup(watcher.Cancel)
+		return NewListerWithNamespace(watcher, ns)
+	}
+	volumes := newNamespaceLister("volumes.example.com", `vol-.....$`)
+	ssds := newNamespaceLister("ssd.example.com", `ssd-.....$`)
+	for _, name := range []string{"virtio-vol-aaaaa", "virtio-ssd-bbbbb", "virtio-ssd-ccccc"} {
+		if err := os.WriteFile(filepath.Join(watchDir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	discoverNames(t, volumes, []string{"vol-aaaaa"})
+	discoverNames(t, ssds, []string{"ssd-bbbbb", "ssd-ccccc"})
+	if volumes.GetResourceNamespace() == ssds.GetResourceNamespace() {
+		t.Errorf("Expected distinct namespaces, both are %s", volumes.GetResourceNamespace())
+	}
+	if err := volumes.allocations.Claim("vol-aaaaa"); err != nil {
+		t.Fatal(err)
+	}
+	if ssds.allocations.Allocated("vol-aaaaa") {
+		t.Error("Allocation in one namespace leaked into the other")
+	}
+}
+
+func TestListerOptions(t *testing.T) {
+	watcher := volwatchtesting.NewFakeWatcher(true)
+	defer watcher.Cancel()
+	vl := NewLister(watcher,
+		WithSubscriberTimeout(time.Second),
+		WithMaxSubscriberTimeouts(3),
+		WithHeartbeatInterval(time.Minute),
+		WithNamespace("volumes.example.com"),
+		WithVolumeFilter(func(string) bool { return true }),
+	)
+	if vl.subscriberTimeout != time.Second || vl.maxTimeouts != 3 {
+		t.Errorf("Subscriber timeout options not applied: %s, %d", vl.subscriberTimeout, vl.maxTimeouts)
+	}
+	if vl.heartbeatInterval != time.Minute {
+		t.Errorf("Expected heartbeat interval of a minute, got %s", vl.heartbeatInterval)
+	}
+	if ns := vl.GetResourceNamespace(); ns != "volumes.example.com" {
+		t.Errorf("Expected namespace volumes.example.com, got %s", ns)
+	}
+	if vl.volumeFilter == nil {
+		t.Error("Volume filter not applied")
+	}
+}
+
+func TestListerDefaults(t *testing.T) {
+	watcher := volwatchtesting.NewFakeWatcher(true)
+	defer watcher.Cancel()
+	vl := NewLister(watcher)
+	if vl.subscriberTimeout != 0 || vl.heartbeatInterval != 0 || vl.volumeFilter != nil {
+		t.Errorf("Unexpected defaults: timeout %s, heartbeat %s", vl.subscriberTimeout, vl.heartbeatInterval)
+	}
+	if ns := vl.GetResourceNamespace(); ns != resourceNamespace {
+		t.Errorf("Expected namespace %s, got %s", resourceNamespace, ns)
+	}
+}
+
+func TestVolumeFilter(t *testing.T) {
+	vl, watcher, names := newFakeLister(t, WithVolumeFilter(func(id string) bool {
+		return id != "vol-bbbbb"
+	}))
+	completions := recordCompletions(vl, "vol-ccccc", nil)
+	go watcher.SendEvent([]string{"vol-aaaaa", "vol-bbbbb"})
+	if got := nextNames(t, names); !slices.Equal(got, []string{"vol-aaaaa"}) {
+		t.Errorf("Expected only vol-aaaaa, got %v", got)
+	}
+	go watcher.SendEvent([]string{"vol-aaaaa", "vol-bbbbb", "vol-ccccc"})
+	if got := nextNames(t, names); !slices.Equal(got, []string{"vol-aaaaa", "vol-ccccc"}) {
+		t.Errorf("Expected vol-aaaaa and vol-ccccc, got %v", got)
+	}
+	if completion := nextCompletion(t, completions); !slices.Equal(completion.Volumes, []string{"vol-aaaaa", "vol-ccccc"}) {
+		t.Errorf("Expected subscriber to see the filtered list, got %v", completion.Volumes)
+	}
+	volumes, err := vl.ListVolumes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(volumes, []string{"vol-aaaaa", "vol-ccccc"}) {
+		t.Errorf("Expected ListVolumes to be filtered, got %v", volumes)
+	}
+}
+
+func TestInformNoSubscribersAllocs(t *testing.T) {
+	vl := newTestLister(t)
+	event := volwatch.DeltaEvent{Type: volwatch.Create, VolumeID: "vol-aaaaa", Snapshot: []string{"vol-aaaaa"}}
+	if allocs := testing.AllocsPerRun(1000, func() { vl.informSubscribers(event) }); allocs != 0 {
+		t.Errorf("Expected no allocations without subscribers, got %v", allocs)
+	}
+}
+
+func TestInformNoSubscribersReplayed(t *testing.T) {
+	vl := newTestLister(t)
+	vl.informSubscribers(volwatch.DeltaEvent{Type: volwatch.Create, VolumeID: "vol-aaaaa", Snapshot: []string{"vol-aaaaa"}})
+	ch := make(chan Completion, 1)
+	vl.Subscribe("vol-aaaaa", ch)
+	select {
+	case completion := <-ch:
+		if !slices.Equal(completion.Volumes, []string{"vol-aaaaa"}) {
+			t.Errorf("Expected [vol-aaaaa] replayed, got %v", completion.Volumes)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the last volume list to be replayed to a new subscriber")
+	}
+}
@@ -0,0 +1,100 @@
+// Package logging holds the structured logger shared by the plugin's
+// packages.
+//
+// Verbosity follows glog: V(0) is ordinary information and V(4) the most
+// detailed debugging. Level n maps to slog.Level(-n), so V(4) is
+// slog.LevelDebug.
+//
+// Until SetLogger is called log output is discarded, which keeps test
+// output quiet.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync/atomic"
+)
+
+var logger atomic.Pointer[slog.Logger]
+
+func init() {
+	logger.Store(slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+// Logger returns the current logger
+func Logger() *slog.Logger {
+	return logger.Load()
+}
+
+// SetLogger replaces the logger used by every package
+func SetLogger(l *slog.Logger) {
+	logger.Store(l)
+}
+
+// MaxVerbosity is the most detailed glog verbosity level in use
+const MaxVerbosity = 4
+
+// New creates a logger writing to w in the given format, either "text"
+// or "json", that records messages up to glog verbosity level v
+func New(w io.Writer, format string, v int) (*slog.Logger, error) {
+	return NewWithLevel(w, format, Level(v))
+}
+
+// NewWithLevel is New with the level given by a slog.Leveler, such as a
+// slog.LevelVar that can be changed while the logger is in use
+func NewWithLevel(w io.Writer, format string, level slog.Leveler) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q: must be text or json", format)
+	}
+}
+
+// Level maps a glog verbosity level to a slog level
+func Level(v int) slog.Level {
+	return slog.Level(-v)
+}
+
+// Verbosity maps a slog level back to a glog verbosity level
+func Verbosity(l slog.Level) int {
+	return int(-l)
+}
+
+// Verbose logs at a glog verbosity level
+type Verbose int
+
+// V returns a Verbose for glog verbosity level v
+func V(v int) Verbose {
+	return Verbose(v)
+}
+
+// Info logs msg if the verbosity level is enabled
+func (v Verbose) Info(msg string, args ...any) {
+	Logger().Log(context.Background(), Level(int(v)), msg, args...)
+}
+
+// Enabled reports whether the verbosity level is being recorded
+func (v Verbose) Enabled() bool {
+	return Logger().Enabled(context.Background(), Level(int(v)))
+}
+
+// Info logs msg at verbosity level 0
+func Info(msg string, args ...any) {
+	Logger().Info(msg, args...)
+}
+
+// Warn logs msg as a warning
+func Warn(msg string, args ...any) {
+	Logger().Warn(msg, args...)
+}
+
+// Error logs msg as an error
+func Error(msg string, args ...any) {
+	Logger().Error(msg, args...)
+}
@@ -0,0 +1,74 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestVerbosity(t *testing.T) {
+	var b bytes.Buffer
+	logger, err := New(&b, "text", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := Logger()
+	SetLogger(logger)
+	defer SetLogger(old)
+
+	V(3).Info("shown")
+	V(4).Info("hidden")
+	if !strings.Contains(b.String(), "msg=shown") {
+		t.Errorf("Expected level 3 message, got %q", b.String())
+	}
+	if strings.Contains(b.String(), "hidden") {
+		t.Errorf("Level 4 message logged at verbosity 3: %q", b.String())
+	}
+	if V(4).Enabled() {
+		t.Error("Expected level 4 to be disabled")
+	}
+}
+
+func TestJSONFormat(t *testing.T) {
+	var b bytes.Buffer
+	logger, err := New(&b, "json", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Warn("volume missing", "volume", "vol-12345")
+	var record map[string]any
+	if err := json.Unmarshal(b.Bytes(), &record); err != nil {
+		t.Fatalf("Expected JSON record, got %q: %s", b.String(), err)
+	}
+	if record["level"] != "WARN" || record["volume"] != "vol-12345" {
+		t.Errorf("Unexpected record %v", record)
+	}
+}
+
+func TestUnknownFormat(t *testing.T) {
+	if _, err := New(&bytes.Buffer{}, "xml", 0); err == nil {
+		t.Error("Expected error for unknown format")
+	}
+}
+
+func TestNewWithLevelVar(t *testing.T) {
+	var b bytes.Buffer
+	var level slog.LevelVar
+	logger, err := NewWithLevel(&b, "text", &level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if logger.Enabled(context.Background(), Level(1)) {
+		t.Error("Expected level 1 to be disabled at verbosity 0")
+	}
+	level.Set(Level(MaxVerbosity))
+	if !logger.Enabled(context.Background(), Level(MaxVerbosity)) {
+		t.Error("Expected the most detailed level to be enabled after raising verbosity")
+	}
+	if v := Verbosity(level.Level()); v != MaxVerbosity {
+		t.Errorf("Expected verbosity %d, got %d", MaxVerbosity, v)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"github.com/brightbox/brightbox-volume-device-plugin/logging"
+)
+
+// logLevel is the level of the logger installed by setupLogging, which
+// SIGHUP and /debug/loglevel change while the plugin runs
+var logLevel slog.LevelVar
+
+// nextVerbosity gives the glog verbosity level after v, wrapping back to
+// 0 after logging.MaxVerbosity
+func nextVerbosity(v int) int {
+	if v >= logging.MaxVerbosity || v < 0 {
+		return 0
+	}
+	return v + 1
+}
+
+// watchSighup raises the verbosity of level by one each time the process
+// receives SIGHUP, until the returned function is called
+func watchSighup(level *slog.LevelVar) func() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-signals:
+				v := nextVerbosity(logging.Verbosity(level.Level()))
+				level.Set(logging.Level(v))
+				logging.Info("Log verbosity changed by SIGHUP", "verbosity", v)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
+// logLevelHandler reports the glog verbosity level of level on GET, and
+// sets it from the form value level on POST
+func logLevelHandler(level *slog.LevelVar) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			v, err := strconv.Atoi(r.FormValue("level"))
+			if err != nil || v < 0 || v > logging.MaxVerbosity {
+				http.Error(w, fmt.Sprintf("level must be between 0 and %d", logging.MaxVerbosity), http.StatusBadRequest)
+				return
+			}
+			level.Set(logging.Level(v))
+			logging.Info("Log verbosity changed by request", "verbosity", v)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "%d\n", logging.Verbosity(level.Level()))
+	})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/brightbox/brightbox-volume-device-plugin/logging"
+)
+
+func TestNextVerbosity(t *testing.T) {
+	for v, expected := range []int{1, 2, 3, 4, 0} {
+		if next := nextVerbosity(v); next != expected {
+			t.Errorf("Expected %d after %d, got %d", expected, v, next)
+		}
+	}
+}
+
+func TestSighupRaisesVerbosity(t *testing.T) {
+	var level slog.LevelVar
+	level.Set(logging.Level(logging.MaxVerbosity))
+	stop := watchSighup(&level)
+	defer stop()
+	for _, expected := range []int{0, 1} {
+		if err := syscall.Kill(syscall.Getpid(), syscall.SIGHUP); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(time.Second)
+		for logging.Verbosity(level.Level()) != expected {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected verbosity %d after SIGHUP, got %d", expected, logging.Verbosity(level.Level()))
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func TestPprofServerLogLevel(t *testing.T) {
+	var level slog.LevelVar
+	level.Set(logging.Level(2))
+	ps, err := newPprofServer("127.0.0.1:0", nil, nil, &level, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Shutdown()
+	endpoint := "http://" + ps.Addr().String() + "/debug/loglevel"
+	resp, err := http.Get(endpoint)
+	if body := readBody(t, resp, err); body != "2\n" {
+		t.Errorf("Expected level 2, got %q", body)
+	}
+	resp, err = http.PostForm(endpoint, url.Values{"level": {"4"}})
+	if body := readBody(t, resp, err); body != "4\n" {
+		t.Errorf("Expected level 4 after POST, got %q", body)
+	}
+	if v := logging.Verbosity(level.Level()); v != 4 {
+		t.Errorf("Expected the logger's verbosity to be 4, got %d", v)
+	}
+	for _, bad := range []string{"5", "-1", "loud"} {
+		resp, err := http.PostForm(endpoint, url.Values{"level": {bad}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected 400 for level %q, got %s", bad, resp.Status)
+		}
+	}
+	req, _ := http.NewRequest(http.MethodDelete, endpoint, nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for DELETE, got %s", resp.Status)
+	}
+}
+
+// readBody returns the body of a successful response
+func readBody(t *testing.T, resp *http.Response, err error) string {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return string(body)
+}
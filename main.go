@@ -1,24 +1,379 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"regexp"
+	"syscall"
+	"time"
 
+	"github.com/brightbox/brightbox-volume-device-plugin/buildinfo"
 	"github.com/brightbox/brightbox-volume-device-plugin/dpm"
+	"github.com/brightbox/brightbox-volume-device-plugin/logging"
+	"github.com/brightbox/brightbox-volume-device-plugin/metrics"
+	"github.com/brightbox/brightbox-volume-device-plugin/tracing"
 	"github.com/brightbox/brightbox-volume-device-plugin/volwatch"
+	"golang.org/x/time/rate"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
+var (
+	healthAddr             = flag.String("health-addr", "", "address on which to serve /healthz, e.g. :8080 (disabled if empty)")
+	preStartCheck          = flag.Bool("prestart-check", false, "verify devices can be opened before each container start")
+	defaultPermissionsFlag = flag.String("default-permissions", defaultPermissions, "device permissions granted to containers: rw, ro or mrw")
+	injectEnv              = flag.Bool("inject-env", true, "add BRIGHTBOX_VOLUME_* environment variables to containers using volumes")
+	healthCheckInterval    = flag.Duration("health-check-interval", 0, "how often to check each volume's block device is present (disabled if zero)")
+	cloudHealthInterval    = flag.Duration("cloud-health-interval", time.Minute, "how often to check each volume's status in the Brightbox API, when configured (disabled if zero)")
+	apiRateLimit           = flag.Float64("api-rate-limit", 2, "Brightbox API calls allowed per second across all volumes")
+	apiRateBurst           = flag.Int("api-rate-burst", 5, "Brightbox API calls allowed at once before -api-rate-limit applies")
+	apiCacheSize           = flag.Int("api-cache-size", defaultCloudCacheSize, "Brightbox API volume lookups to cache before dropping the least recently used")
+	statsInterval          = flag.Duration("stats-interval", 30*time.Second, "how often to read each volume's block device I/O statistics into the metrics (disabled if zero)")
+	keepaliveInterval      = flag.Duration("keepalive-interval", 0, "how often each volume plugin resends its device list to kubelet to detect a stalled connection (disabled if zero)")
+	shutdownTimeout        = flag.Duration("shutdown-timeout", 30*time.Second, "how long to wait for plugins to stop after SIGTERM or SIGINT")
+	nodeName               = flag.String("node-name", os.Getenv("NODE_NAME"), "name of the node the plugin is running on, used to read node annotations and labels")
+	metricsAddr            = flag.String("metrics-addr", "", "address on which to serve Prometheus /metrics, e.g. :9090 (disabled if empty)")
+	reconcileInterval      = flag.Duration("reconcile-interval", 0, "how often to rescan the device directory for missed changes (disabled if zero)")
+	scsiRescan             = flag.Bool("scsi-rescan", false, "ask the kernel to rescan each new volume's device if it is a SCSI device")
+	devicePathCacheTTL     = flag.Duration("device-path-cache-ttl", 0, "how long to remember the device node each volume's symlink resolves to (disabled if zero)")
+	multipath              = flag.Bool("multipath", false, "also expose the underlying paths of volumes attached via multipath")
+	allowMultiAttach       = flag.Bool("allow-multi-attach", false, "allow a volume to be allocated to more than one pod at a time")
+	maxVolumes             = flag.Int("max-volumes", 0, "how many volumes of each resource namespace may be allocated at once (unlimited if zero)")
+	subscriberTimeout      = flag.Duration("subscriber-timeout", 0, "how long to wait for a volume plugin to accept an update before skipping it (forever if zero)")
+	deadLetterSize         = flag.Int("dead-letter-size", 0, "how many updates each volume plugin failed to accept are kept for /debug/dead-letters (none if zero)")
+	heartbeatInterval      = flag.Duration("heartbeat-interval", 0, "how often to check each volume plugin is still reading updates (disabled if zero)")
+	otelEndpoint           = flag.String("otel-endpoint", "", "OTLP/HTTP collector to send traces to, e.g. otel-collector:4318 (disabled if empty)")
+	pprofAddr              = flag.String("pprof-addr", "", "address on which to serve /debug/pprof/, /debug/watches, /debug/dead-letters and /api/refresh-volume/, e.g. localhost:6060 (disabled if empty)")
+	udevEvents             = flag.Bool("udev-events", false, "listen for kernel block device uevents instead of watching the device directory with inotify")
+	appArmorProfile        = flag.String("apparmor-profile", "", "AppArmor profile for containers given volumes, e.g. localhost/block-devices or runtime/default (left to the runtime if empty)")
+	selinuxLabel           = flag.String("selinux-label", "", "SELinux label each device given to a container is relabelled with, e.g. system_u:object_r:fixed_disk_device_t:s0 (left alone if empty)")
+	deviceDir              = flag.String("device-dir", volwatch.DefaultDeviceDir, "directory in which udev links volumes by ID")
+	socketDir              = flag.String("socket-dir", pluginapi.DevicePluginPath, "directory holding the kubelet registration socket and plugin sockets")
+	logFormat              = flag.String("log-format", "text", "log output format: text or json")
+	verbosity              = flag.Int("v", 0, "log verbosity, from 0 (informational) to 4 (debug)")
+	dryRun                 = flag.Bool("dry-run", false, "log the devices each allocation would supply without supplying them; for testing only, NOT suitable for production")
+	deviceOpenTimeout      = flag.Duration("device-open-timeout", 10*time.Second, "how long Allocate waits for a volume's block device to finish initialising (disabled if zero)")
+	deviceOpenInterval     = flag.Duration("device-open-interval", 500*time.Millisecond, "how often Allocate retries opening a block device that is still initialising")
+	allocationStateFile    = flag.String("allocation-state-file", "", "file in which to record allocated volumes so they survive a restart (disabled if empty)")
+	cdiOutputDir           = flag.String("cdi-output-dir", "", "directory in which to write a CDI spec for each allocated volume, e.g. /var/run/cdi (disabled if empty)")
+	registrationTimeout    = flag.Duration("registration-timeout", 0, "how long each plugin waits for kubelet to accept its registration (forever if zero)")
+	pluginStartTimeout     = flag.Duration("plugin-start-timeout", 10*time.Second, "how long each plugin's gRPC server is given to become ready before registering")
+	pluginStopTimeout      = flag.Duration("plugin-stop-timeout", 5*time.Second, "how long a stopping plugin's open calls are given to finish before their connections are closed (closed immediately if zero)")
+	showVersion            = flag.Bool("version", false, "print the build version and exit")
+	configFile             = flag.String("config", "", "YAML or JSON configuration file, overriding the flag defaults")
+	extraNamespaces        extraNamespaceList
+)
+
+func init() {
+	flag.Var(&extraNamespaces, "extra-namespaces", "further volume classes to advertise, as comma separated NAMESPACE:WATCHDIR:REGEX entries, e.g. ssd.brightbox.com::ssd-.....$ (WATCHDIR defaults to the device directory)")
+}
+
 func main() {
 	flag.Parse()
+	if *showVersion {
+		fmt.Print(buildinfo.Get())
+		return
+	}
+	setupLogging(*verbosity)
+	if *dryRun {
+		logging.Warn("Running in dry-run mode: containers will not be given any devices")
+	}
 
-	// Kubernetes plugin uses the kubernetes library, which uses glog, which logs to the filesystem by default,
-	// while we need all logs to go to stderr
-	// See also: https://github.com/coredns/coredns/pull/1598
-	flag.Set("logtostderr", "true")
+	if _, ok := validPermissions[*defaultPermissionsFlag]; !ok {
+		fatal("Invalid -default-permissions: must be one of rw, ro or mrw", "permissions", *defaultPermissionsFlag)
+	}
+	if *appArmorProfile != "" {
+		if err := ValidateAppArmorProfile(*appArmorProfile); err != nil {
+			fatal("Invalid -apparmor-profile", "err", err)
+		}
+	}
+	if *selinuxLabel != "" {
+		if err := ValidateSELinuxLabel(*selinuxLabel); err != nil {
+			fatal("Invalid -selinux-label", "err", err)
+		}
+	}
+	if *apiCacheSize < 1 {
+		fatal("Invalid -api-cache-size: must be positive", "size", *apiCacheSize)
+	}
+	if *apiRateLimit <= 0 || *apiRateBurst < 1 {
+		fatal("Invalid -api-rate-limit or -api-rate-burst: must be positive", "limit", *apiRateLimit, "burst", *apiRateBurst)
+	}
+
+	config := defaultConfig()
+	if *configFile != "" {
+		var err error
+		config, err = loadConfig(*configFile, config)
+		if err != nil {
+			fatal("Failed to load configuration", "err", err)
+		}
+		if err := ValidateConfig(config); err != nil {
+			fatal("Invalid configuration", "file", *configFile, "err", err)
+		}
+		if config.LogLevel > 0 {
+			setupLogging(config.LogLevel)
+		}
+	}
+	if err := ValidateResourceNamespace(config.ResourceNamespace); err != nil {
+		fatal("Invalid resource namespace", "err", err)
+	}
+	if err := ValidateExtraNamespaces(config); err != nil {
+		fatal("Invalid extra namespaces", "err", err)
+	}
+	volRe, err := regexp.Compile(config.VolumeRegex)
+	if err != nil {
+		fatal("Invalid volume regex", "regex", config.VolumeRegex, "err", err)
+	}
+	drainTimeout := time.Duration(config.ShutdownTimeoutSec) * time.Second
 
 	// manager := dpm.NewManager(volumeLister{})
 	// manager.Run()
-	watcher := volwatch.NewWatcher()
-	lister := NewLister(watcher)
-	manager := dpm.NewManager(lister)
-	manager.Run()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	stopSighup := watchSighup(&logLevel)
+	defer stopSighup()
+
+	newWatcher := func(dir string, re *regexp.Regexp) *volwatch.VolumeWatcher {
+		watchOpts := []volwatch.Option{
+			volwatch.WithDeltaEvents(),
+			volwatch.WithValidateSymlinks(true),
+			volwatch.WithVolumeRegex(re),
+			volwatch.WithDebounceDuration(time.Duration(config.DebounceMs) * time.Millisecond),
+			volwatch.WithReconcileInterval(*reconcileInterval),
+			volwatch.WithCacheTTL(*devicePathCacheTTL),
+			volwatch.WithSCSIRescan(*scsiRescan),
+		}
+		if *udevEvents {
+			watchOpts = append(watchOpts, volwatch.WithBackend(volwatch.NewUdevBackend()))
+		}
+		return volwatch.NewWatchDirWithContext(ctx, dir, watchOpts...)
+	}
+	watcher := newWatcher(config.DeviceDir, volRe)
+	var metricsServer *metrics.MetricsServer
+	if *metricsAddr != "" {
+		metricsServer, err = metrics.NewMetricsServer(*metricsAddr, metrics.DefaultRegistry)
+		if err != nil {
+			fatal("Failed to serve metrics", "addr", *metricsAddr, "err", err)
+		}
+	}
+	pluginOpts := []PluginOption{
+		WithPreStartCheck(*preStartCheck),
+		WithDefaultPermissions(*defaultPermissionsFlag),
+		WithInjectEnv(*injectEnv),
+		WithHealthCheckInterval(*healthCheckInterval),
+		WithStatsInterval(*statsInterval),
+		WithKeepaliveInterval(*keepaliveInterval),
+		WithMultipathSupport(*multipath),
+		WithDryRun(*dryRun),
+		WithDeviceOpenWait(*deviceOpenTimeout, *deviceOpenInterval),
+		WithCDIOutputDir(*cdiOutputDir),
+		WithAppArmorProfile(*appArmorProfile),
+		WithSELinuxLabel(*selinuxLabel),
+	}
+	var exporter *tracing.OTLPExporter
+	if *otelEndpoint != "" {
+		exporter, err = tracing.NewOTLPExporter(*otelEndpoint)
+		if err != nil {
+			fatal("Failed to set up tracing", "endpoint", *otelEndpoint, "err", err)
+		}
+		pluginOpts = append(pluginOpts, WithTracer(tracing.NewProvider(exporter)))
+	}
+	if *nodeName != "" {
+		client, err := newInClusterNodeClient(*nodeName)
+		if err != nil {
+			logging.Warn("Node annotations unavailable", "err", err)
+		} else {
+			pluginOpts = append(pluginOpts,
+				WithAnnotationStore(client),
+				WithPodAnnotationStore(client),
+				WithNodeTopology(client),
+			)
+		}
+	}
+	var refresher VolumeRefresher
+	if api, err := newAPIClientFromEnv(); err == nil {
+		// One limiter is shared by every plugin's lookups. Health checks
+		// want the current status, not a cached one.
+		cloud := newRateLimitedCloudClient(api, rate.Limit(*apiRateLimit), *apiRateBurst)
+		cache := newCachingCloudClient(cloud, cloudCacheTTL, *apiCacheSize)
+		refresher = cache
+		pluginOpts = append(pluginOpts,
+			WithCloudClient(cache),
+			WithCloudHealthChecker(cloud, *cloudHealthInterval),
+		)
+	} else {
+		logging.V(2).Info("Volume metadata unavailable", "err", err)
+	}
+	listerOpts := []ListerOption{
+		WithPluginOptions(pluginOpts...),
+		WithHeartbeatInterval(*heartbeatInterval),
+		WithMaxVolumes(*maxVolumes),
+		WithSubscriberTimeout(*subscriberTimeout),
+		WithDeadLetterSize(*deadLetterSize),
+	}
+	// Each lister finds volumes with its own pattern in its own directory.
+	// The extra listers keep their allocations in memory only.
+	var extraWatchers []*volwatch.VolumeWatcher
+	var extraListers []dpm.ListerInterface
+	var volumeListers []*VolumeLister
+	for _, extra := range config.ExtraNamespaces {
+		dir := extra.WatchDir
+		if dir == "" {
+			dir = config.DeviceDir
+		}
+		re := regexp.MustCompile(extra.VolumeRegex)
+		extraWatcher := newWatcher(dir, re)
+		extraWatchers = append(extraWatchers, extraWatcher)
+		extraOpts := append([]ListerOption{}, listerOpts...)
+		extraOpts = append(extraOpts,
+			WithPluginOptions(volumePathOptions(extraWatcher, re)...),
+			WithAllowMultiAttach(*allowMultiAttach),
+		)
+		extraLister := NewListerWithNamespace(extraWatcher, extra.Namespace, extraOpts...)
+		extraListers = append(extraListers, extraLister)
+		volumeListers = append(volumeListers, extraLister)
+		logging.Info("Serving extra namespace", "namespace", extra.Namespace, "dir", dir, "regex", re)
+	}
+	listerOpts = append(listerOpts, WithPluginOptions(volumePathOptions(watcher, volRe)...))
+	var allocationState *PersistentAllocationTracker
+	if *allocationStateFile != "" {
+		allocationState, err = NewPersistentAllocationTracker(*allocationStateFile)
+		if err != nil {
+			fatal("Failed to load allocation state", "path", *allocationStateFile, "err", err)
+		}
+		listerOpts = append(listerOpts, WithAllocations(allocationState))
+	}
+	listerOpts = append(listerOpts, WithAllowMultiAttach(*allowMultiAttach))
+	lister := NewListerWithNamespace(watcher, config.ResourceNamespace, listerOpts...)
+	volumeListers = append(volumeListers, lister)
+	var profiler *pprofServer
+	if *pprofAddr != "" {
+		watched := []WatchedPathLister{watcher}
+		for _, extraWatcher := range extraWatchers {
+			watched = append(watched, extraWatcher)
+		}
+		var reporters []DeadLetterReporter
+		for _, vl := range volumeListers {
+			reporters = append(reporters, vl)
+		}
+		profiler, err = newPprofServer(*pprofAddr, watched, reporters, &logLevel, refresher)
+		if err != nil {
+			fatal("Failed to serve pprof", "addr", *pprofAddr, "err", err)
+		}
+	}
+	if config.HealthAddr != "" {
+		// Live while every watcher runs, ready once every lister's
+		// volumes have reached kubelet
+		live := HealthCheckFunc(func() error {
+			for _, w := range append([]*volwatch.VolumeWatcher{watcher}, extraWatchers...) {
+				if err := w.HealthCheck(); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		ready := HealthCheckFunc(func() error {
+			for _, vl := range volumeListers {
+				if err := vl.ReadyCheck(); err != nil {
+					return fmt.Errorf("%s: %w", vl.GetResourceNamespace(), err)
+				}
+			}
+			return nil
+		})
+		serveHealth(config.HealthAddr, live, ready)
+	}
+	manager := dpm.NewManager(lister,
+		dpm.WithSocketDir(config.SocketDir),
+		dpm.WithRegistrationTimeout(*registrationTimeout),
+		dpm.WithPluginStartTimeout(*pluginStartTimeout),
+		dpm.WithPluginStopTimeout(*pluginStopTimeout),
+		dpm.WithListers(extraListers...),
+	)
+	if err := manager.RemoveSockets(); err != nil {
+		logging.Warn("Unable to remove stale plugin sockets", "err", err)
+	}
+	done := make(chan struct{})
+	var runErr error
+	go func() {
+		runErr = manager.Run()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		if runErr != nil {
+			fatal("Unable to start device plugin manager", "err", runErr)
+		}
+		return
+	case <-ctx.Done():
+		logging.Info("Shutting down, waiting for plugins to stop", "timeout", drainTimeout)
+		if allocationState != nil {
+			// Keep the allocations for the next run
+			allocationState.Close()
+		}
+		watcher.Cancel()
+		for _, extraWatcher := range extraWatchers {
+			extraWatcher.Cancel()
+		}
+		manager.Stop()
+	}
+	select {
+	case <-done:
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+		defer cancel()
+		if metricsServer != nil {
+			if err := metricsServer.Shutdown(shutdownCtx); err != nil {
+				logging.Warn("Metrics server shutdown failed", "err", err)
+			}
+		}
+		if exporter != nil {
+			if err := exporter.Shutdown(shutdownCtx); err != nil {
+				logging.Warn("Trace exporter shutdown failed", "err", err)
+			}
+		}
+		if profiler != nil {
+			if err := profiler.Shutdown(); err != nil {
+				logging.Warn("pprof server shutdown failed", "err", err)
+			}
+		}
+		logging.Info("Shutdown complete")
+	case <-time.After(drainTimeout):
+		// Don't leave sockets behind for plugins that failed to stop
+		if err := manager.RemoveSockets(); err != nil {
+			logging.Warn("Unable to remove plugin sockets", "err", err)
+		}
+		fatal("Shutdown timed out with plugins still running", "plugins", manager.Plugins())
+	}
+}
+
+// volumePathOptions gives the plugin options for volumes found by
+// watcher with the pattern re
+func volumePathOptions(watcher *volwatch.VolumeWatcher, re *regexp.Regexp) []PluginOption {
+	return []PluginOption{
+		withIDDevicePath(watcher.IDDevicePath),
+		withDeviceResolver(watcher.ResolveDevicePath),
+		WithVolumeIDRegex(re),
+	}
+}
+
+// setupLogging installs a logger writing to stderr in the -log-format
+// format at glog verbosity v, which may later be changed through
+// logLevel
+func setupLogging(v int) {
+	logLevel.Set(logging.Level(v))
+	logger, err := logging.NewWithLevel(os.Stderr, *logFormat, &logLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -log-format: %s\n", err)
+		os.Exit(2)
+	}
+	logging.SetLogger(logger)
+	slog.SetDefault(logger)
+}
+
+// fatal logs msg as an error and exits
+func fatal(msg string, args ...any) {
+	logging.Error(msg, args...)
+	os.Exit(1)
 }
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestShutdownOnSigterm(t *testing.T) {
+	if os.Getenv("BRIGHTBOX_PLUGIN_MAIN") == "1" {
+		main()
+		return
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestShutdownOnSigterm$", "-shutdown-timeout=5s", "-socket-dir="+t.TempDir())
+	cmd.Env = append(os.Environ(), "BRIGHTBOX_PLUGIN_MAIN=1", "NODE_NAME=")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Errorf("Expected clean exit, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("Plugin did not exit after SIGTERM")
+	}
+}
+
+func TestVersionFlag(t *testing.T) {
+	if os.Getenv("BRIGHTBOX_PLUGIN_MAIN") == "1" {
+		main()
+		return
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestVersionFlag$", "-version")
+	cmd.Env = append(os.Environ(), "BRIGHTBOX_PLUGIN_MAIN=1")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("Expected clean exit, got %v", err)
+	}
+	for _, field := range []string{"version: ", "commit: ", "build date: ", "go version: go"} {
+		if !strings.Contains(string(out), field) {
+			t.Errorf("Expected %q in output %q", field, out)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+// Package metrics exposes the plugin's counters and gauges over HTTP in
+// the Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/brightbox/brightbox-volume-device-plugin/buildinfo"
+)
+
+// Counter is a monotonically increasing value
+type Counter struct {
+	value uint64
+}
+
+// Inc adds one to the counter
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+// Set replaces the count, for mirroring a total kept elsewhere such as
+// the kernel's block device statistics
+func (c *Counter) Set(v uint64) {
+	atomic.StoreUint64(&c.value, v)
+}
+
+// Value returns the current count
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	value int64
+}
+
+// Set replaces the gauge value
+func (g *Gauge) Set(v int) {
+	atomic.StoreInt64(&g.value, int64(v))
+}
+
+// Add adds delta, which may be negative, to the gauge value
+func (g *Gauge) Add(delta int) {
+	atomic.AddInt64(&g.value, int64(delta))
+}
+
+// Value returns the current gauge value
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.value)
+}
+
+// CounterVec is a set of counters distinguished by the value of a
+// single label
+type CounterVec struct {
+	label    string
+	mutex    sync.Mutex
+	counters map[string]*Counter
+}
+
+// WithLabelValue returns the counter for the label value, creating it if
+// necessary
+func (cv *CounterVec) WithLabelValue(value string) *Counter {
+	cv.mutex.Lock()
+	defer cv.mutex.Unlock()
+	c, ok := cv.counters[value]
+	if !ok {
+		c = new(Counter)
+		cv.counters[value] = c
+	}
+	return c
+}
+
+// Delete removes the counter for the label value, so it is no longer
+// served
+func (cv *CounterVec) Delete(value string) {
+	cv.mutex.Lock()
+	defer cv.mutex.Unlock()
+	delete(cv.counters, value)
+}
+
+// metric is a named, documented value in the registry
+type metric struct {
+	name  string
+	help  string
+	kind  string
+	write func(w io.Writer, name string)
+}
+
+// Registry holds the metrics served by a MetricsServer
+type Registry struct {
+	mutex   sync.Mutex
+	metrics map[string]metric
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]metric)}
+}
+
+// NewCounter adds a counter to the registry
+func (r *Registry) NewCounter(name string, help string) *Counter {
+	c := new(Counter)
+	r.register(metric{name, help, "counter", func(w io.Writer, name string) {
+		fmt.Fprintf(w, "%s %d\n", name, c.Value())
+	}})
+	return c
+}
+
+// NewGauge adds a gauge to the registry
+func (r *Registry) NewGauge(name string, help string) *Gauge {
+	g := new(Gauge)
+	r.register(metric{name, help, "gauge", func(w io.Writer, name string) {
+		fmt.Fprintf(w, "%s %d\n", name, g.Value())
+	}})
+	return g
+}
+
+// NewCounterVec adds a labelled set of counters to the registry. The
+// label values in values are reported as zero until first incremented.
+func (r *Registry) NewCounterVec(name string, help string, label string, values ...string) *CounterVec {
+	cv := &CounterVec{label: label, counters: make(map[string]*Counter)}
+	for _, value := range values {
+		cv.WithLabelValue(value)
+	}
+	r.register(metric{name, help, "counter", func(w io.Writer, name string) {
+		cv.mutex.Lock()
+		defer cv.mutex.Unlock()
+		keys := make([]string, 0, len(cv.counters))
+		for key := range cv.counters {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(w, "%s{%s=%q} %d\n", name, cv.label, key, cv.counters[key].Value())
+		}
+	}})
+	return cv
+}
+
+// NewInfo adds a gauge that is always 1, with labels describing the
+// process. labels are name, value pairs.
+func (r *Registry) NewInfo(name string, help string, labels ...string) {
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	sample := fmt.Sprintf("%s{%s} 1\n", name, strings.Join(pairs, ","))
+	r.register(metric{name, help, "gauge", func(w io.Writer, _ string) {
+		io.WriteString(w, sample)
+	}})
+}
+
+// Write writes every metric in the registry in the Prometheus text
+// format, ordered by name
+func (r *Registry) Write(w io.Writer) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		m := r.metrics[name]
+		fmt.Fprintf(w, "# HELP %s %s\n", name, escapeHelp(m.help))
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, m.kind)
+		m.write(w, name)
+	}
+}
+
+func (r *Registry) register(m metric) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.metrics[m.name]; ok {
+		panic("metrics: duplicate registration of " + m.name)
+	}
+	r.metrics[m.name] = m
+}
+
+func escapeHelp(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
+
+// DefaultRegistry holds the plugin's metrics
+var DefaultRegistry = NewRegistry()
+
+// Plugin metrics
+var (
+	VolumeEvents = DefaultRegistry.NewCounterVec(
+		"brightbox_volume_events_total",
+		"Volume create and remove events seen by the watcher.",
+		"type", "create", "remove",
+	)
+	ActiveVolumes = DefaultRegistry.NewGauge(
+		"brightbox_active_volumes",
+		"Volumes present in the device directory at the last scan.",
+	)
+	ActiveSubscribers = DefaultRegistry.NewGauge(
+		"brightbox_active_subscribers",
+		"Device plugins subscribed to volume updates.",
+	)
+	ThinProvisionedVolumes = DefaultRegistry.NewGauge(
+		"brightbox_thin_provisioned_volumes",
+		"Allocated volumes whose block devices are thin provisioned.",
+	)
+	AllocateRequests = DefaultRegistry.NewCounter(
+		"brightbox_allocate_requests_total",
+		"Allocate calls received from the kubelet.",
+	)
+	AllocateErrors = DefaultRegistry.NewCounter(
+		"brightbox_allocate_errors_total",
+		"Allocate calls that returned an error.",
+	)
+	WatcherReconnects = DefaultRegistry.NewCounter(
+		"brightbox_watcher_reconnects_total",
+		"Times the watcher restored its watch after the device directory was removed.",
+	)
+	WatcherTransientErrors = DefaultRegistry.NewCounter(
+		"brightbox_watcher_transient_errors_total",
+		"Transient notifier errors the watcher recovered from.",
+	)
+	VolumeReadBytes = DefaultRegistry.NewCounterVec(
+		"brightbox_volume_read_bytes_total",
+		"Bytes read from each volume's block device.",
+		"volume_id",
+	)
+	VolumeWriteBytes = DefaultRegistry.NewCounterVec(
+		"brightbox_volume_write_bytes_total",
+		"Bytes written to each volume's block device.",
+		"volume_id",
+	)
+)
+
+func init() {
+	info := buildinfo.Get()
+	DefaultRegistry.NewInfo(
+		"brightbox_device_plugin_build_info",
+		"Build information for the running plugin. Always 1.",
+		"version", info.Version,
+		"commit", info.Commit,
+		"goversion", info.GoVersion,
+	)
+}
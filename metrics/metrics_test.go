@@ -0,0 +1,113 @@
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func scrape(t *testing.T, url string) map[string]string {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status %s", resp.Status)
+	}
+	samples := make(map[string]string)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") || line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			t.Fatalf("Malformed sample line %q", line)
+		}
+		samples[fields[0]] = fields[1]
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return samples
+}
+
+func TestMetricsServer(t *testing.T) {
+	registry := NewRegistry()
+	events := registry.NewCounterVec("test_events_total", "Events.", "type", "create", "remove")
+	active := registry.NewGauge("test_active", "Active.")
+	requests := registry.NewCounter("test_requests_total", "Requests.")
+	registry.NewInfo("test_build_info", "Build.", "version", "v1.0.0", "commit", "abc123")
+
+	events.WithLabelValue("create").Inc()
+	events.WithLabelValue("create").Inc()
+	events.WithLabelValue("stale").Inc()
+	events.Delete("stale")
+	active.Set(2)
+	active.Add(2)
+	active.Add(-1)
+	requests.Set(41)
+	requests.Inc()
+
+	ms, err := NewMetricsServer("127.0.0.1:0", registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ms.Shutdown(context.Background())
+
+	samples := scrape(t, "http://"+ms.Addr().String()+"/metrics")
+	expected := map[string]string{
+		`test_events_total{type="create"}`:                  "2",
+		`test_events_total{type="remove"}`:                  "0",
+		"test_active":                                       "3",
+		"test_requests_total":                               "42",
+		`test_build_info{version="v1.0.0",commit="abc123"}`: "1",
+	}
+	for name, value := range expected {
+		if samples[name] != value {
+			t.Errorf("Expected %s to be %s, got %q", name, value, samples[name])
+		}
+	}
+	if _, ok := samples[`test_events_total{type="stale"}`]; ok {
+		t.Error("Expected deleted label value not to be served")
+	}
+}
+
+func TestMetricsServerShutdown(t *testing.T) {
+	ms, err := NewMetricsServer("127.0.0.1:0", NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "http://" + ms.Addr().String() + "/metrics"
+	if err := ms.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := http.Get(url); err == nil {
+		t.Error("Expected request to fail after shutdown")
+	}
+}
+
+func TestDefaultRegistry(t *testing.T) {
+	var b strings.Builder
+	DefaultRegistry.Write(&b)
+	for _, name := range []string{
+		"brightbox_volume_events_total",
+		"brightbox_active_volumes",
+		"brightbox_active_subscribers",
+		"brightbox_allocate_requests_total",
+		"brightbox_allocate_errors_total",
+		"brightbox_watcher_reconnects_total",
+		"brightbox_watcher_transient_errors_total",
+		"brightbox_thin_provisioned_volumes",
+		"brightbox_volume_read_bytes_total",
+		"brightbox_volume_write_bytes_total",
+	} {
+		if !strings.Contains(b.String(), "# TYPE "+name+" ") {
+			t.Errorf("Missing %s from default registry", name)
+		}
+	}
+}
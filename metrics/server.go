@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/brightbox/brightbox-volume-device-plugin/logging"
+)
+
+// MetricsServer serves a registry on /metrics
+//
+// Create a MetricsServer by calling the NewMetricsServer function
+type MetricsServer struct {
+	server   *http.Server
+	listener net.Listener
+}
+
+// NewMetricsServer listens on addr and serves the registry in the
+// background until Shutdown is called
+func NewMetricsServer(addr string, registry *Registry) (*MetricsServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler(registry))
+	ms := &MetricsServer{
+		server:   &http.Server{Handler: mux},
+		listener: listener,
+	}
+	go func() {
+		logging.V(3).Info("Serving metrics", "addr", listener.Addr())
+		if err := ms.server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			logging.Error("Metrics server failed", "err", err)
+		}
+	}()
+	return ms, nil
+}
+
+// Addr returns the address the server is listening on
+func (ms *MetricsServer) Addr() net.Addr {
+	return ms.listener.Addr()
+}
+
+// Shutdown stops the server, waiting for in flight scrapes to finish
+// until ctx is done
+func (ms *MetricsServer) Shutdown(ctx context.Context) error {
+	return ms.server.Shutdown(ctx)
+}
+
+// Handler returns an http.Handler that writes the registry in the
+// Prometheus text format
+func Handler(registry *Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		registry.Write(w)
+	})
+}
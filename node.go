@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brightbox/brightbox-volume-device-plugin/logging"
+	"golang.org/x/exp/slices"
+)
+
+// AnnotationStore supplies the annotations of the node running the plugin
+type AnnotationStore interface {
+	Annotations() (map[string]string, error)
+}
+
+// PodAnnotationStore supplies the annotations of the pod on the node
+// requesting a resource
+type PodAnnotationStore interface {
+	PodAnnotations(resourceName string) (map[string]string, error)
+}
+
+// NodeTopology supplies the topology of the node running the plugin
+type NodeTopology interface {
+	Zone() (string, error)
+}
+
+// ErrNotInCluster is returned when the in-cluster API server environment
+// is unavailable
+var ErrNotInCluster = errors.New("unable to load in-cluster configuration")
+
+// nodeMetadata holds the parts of a Kubernetes Node object the plugin uses
+type nodeMetadata struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+// podList holds the parts of a Kubernetes PodList the plugin uses
+type podList struct {
+	Items []struct {
+		Metadata nodeMetadata `json:"metadata"`
+		Spec     struct {
+			Containers     []podContainer `json:"containers"`
+			InitContainers []podContainer `json:"initContainers"`
+		} `json:"spec"`
+		Status struct {
+			Phase string `json:"phase"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+// podContainer holds the resources of a container in a pod
+type podContainer struct {
+	Resources struct {
+		Limits   map[string]string `json:"limits"`
+		Requests map[string]string `json:"requests"`
+	} `json:"resources"`
+}
+
+// requests reports whether the container asks for the resource
+func (c podContainer) requests(resourceName string) bool {
+	_, limited := c.Resources.Limits[resourceName]
+	_, requested := c.Resources.Requests[resourceName]
+	return limited || requested
+}
+
+// nodeClient fetches the metadata of a single Node from the Kubernetes API
+// server, caching the result for a short period
+type nodeClient struct {
+	nodeURL string
+	podsURL string
+	token   string
+	client  *http.Client
+	ttl     time.Duration
+
+	mutex   sync.Mutex
+	cached  *nodeMetadata
+	fetched time.Time
+}
+
+// newNodeClient creates a client for the named node on the given API server
+func newNodeClient(apiServer string, nodeName string, token string, client *http.Client) *nodeClient {
+	return &nodeClient{
+		nodeURL: strings.TrimSuffix(apiServer, "/") + "/api/v1/nodes/" + url.PathEscape(nodeName),
+		podsURL: strings.TrimSuffix(apiServer, "/") + "/api/v1/pods?" +
+			url.Values{"fieldSelector": {"spec.nodeName=" + nodeName}}.Encode(),
+		token:  token,
+		client: client,
+		ttl:    nodeCacheTTL,
+	}
+}
+
+// newInClusterNodeClient creates a node client using the service account
+// credentials mounted into the pod
+func newInClusterNodeClient(nodeName string) (*nodeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, ErrNotInCluster
+	}
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrNotInCluster, err)
+	}
+	caData, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrNotInCluster, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caData) {
+		return nil, fmt.Errorf("%w: no certificates in ca.crt", ErrNotInCluster)
+	}
+	client := &http.Client{
+		Timeout: nodeRequestTimeout,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		},
+	}
+	apiServer := "https://" + net.JoinHostPort(host, port)
+	return newNodeClient(apiServer, nodeName, strings.TrimSpace(string(token)), client), nil
+}
+
+// Annotations returns the annotations of the node
+func (nc *nodeClient) Annotations() (map[string]string, error) {
+	metadata, err := nc.metadata()
+	if err != nil {
+		return nil, err
+	}
+	return metadata.Annotations, nil
+}
+
+// Labels returns the labels of the node
+func (nc *nodeClient) Labels() (map[string]string, error) {
+	metadata, err := nc.metadata()
+	if err != nil {
+		return nil, err
+	}
+	return metadata.Labels, nil
+}
+
+// Zone returns the node's topology.kubernetes.io/zone label
+func (nc *nodeClient) Zone() (string, error) {
+	labels, err := nc.Labels()
+	if err != nil {
+		return "", err
+	}
+	zone, ok := labels[zoneLabel]
+	if !ok {
+		return "", fmt.Errorf("node has no %s label", zoneLabel)
+	}
+	return zone, nil
+}
+
+// PodAnnotations returns the annotations of the pod on the node whose
+// containers ask for the resource, preferring one still pending as
+// kubelet only allocates devices while admitting a pod. Pods are not
+// cached, as the pod being allocated has only just been scheduled. Nil
+// is returned if no pod asks for the resource.
+func (nc *nodeClient) PodAnnotations(resourceName string) (map[string]string, error) {
+	var pods podList
+	if err := nc.get(nc.podsURL, &pods); err != nil {
+		return nil, fmt.Errorf("listing pods: %w", err)
+	}
+	var found map[string]string
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == "Succeeded" || pod.Status.Phase == "Failed" {
+			continue
+		}
+		containers := append(slices.Clone(pod.Spec.InitContainers), pod.Spec.Containers...)
+		if slices.IndexFunc(containers, func(c podContainer) bool { return c.requests(resourceName) }) < 0 {
+			continue
+		}
+		if pod.Status.Phase == "Pending" {
+			return pod.Metadata.Annotations, nil
+		}
+		if found == nil {
+			found = pod.Metadata.Annotations
+		}
+	}
+	return found, nil
+}
+
+func (nc *nodeClient) metadata() (*nodeMetadata, error) {
+	nc.mutex.Lock()
+	defer nc.mutex.Unlock()
+	if nc.cached != nil && time.Since(nc.fetched) < nc.ttl {
+		return nc.cached, nil
+	}
+	logging.V(4).Info("Fetching node metadata", "url", nc.nodeURL)
+	var node struct {
+		Metadata nodeMetadata `json:"metadata"`
+	}
+	if err := nc.get(nc.nodeURL, &node); err != nil {
+		return nil, fmt.Errorf("fetching node: %w", err)
+	}
+	nc.cached = &node.Metadata
+	nc.fetched = time.Now()
+	return nc.cached, nil
+}
+
+// get decodes the JSON object at target into result
+func (nc *nodeClient) get(target string, result any) error {
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	if nc.token != "" {
+		req.Header.Set("Authorization", "Bearer "+nc.token)
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := nc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("decoding response: %w", err)
+	}
+	return nil
+}
+
+const (
+	zoneLabel          = "topology.kubernetes.io/zone"
+	serviceAccountDir  = "/var/run/secrets/kubernetes.io/serviceaccount"
+	nodeCacheTTL       = 30 * time.Second
+	nodeRequestTimeout = 10 * time.Second
+)
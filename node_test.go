@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNodeClientAnnotations(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/api/v1/nodes/srv-abcde" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"metadata":{"name":"srv-abcde","annotations":{"volumes.brightbox.com/vol-aaaaa-permissions":"ro"}}}`))
+	}))
+	defer server.Close()
+	client := newNodeClient(server.URL, "srv-abcde", "secret", server.Client())
+	annotations, err := client.Annotations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if annotations["volumes.brightbox.com/vol-aaaaa-permissions"] != "ro" {
+		t.Errorf("Unexpected annotations %v", annotations)
+	}
+	client.Annotations()
+	if requests != 1 {
+		t.Errorf("Expected cached metadata, got %d requests", requests)
+	}
+}
+
+func TestNodeClientError(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	client := newNodeClient(server.URL, "srv-abcde", "", server.Client())
+	if _, err := client.Annotations(); err == nil {
+		t.Error("Expected error for missing node")
+	}
+}
+
+func TestNodeClientZone(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"metadata":{"labels":{"topology.kubernetes.io/zone":"gb1s-a"}}}`))
+	}))
+	defer server.Close()
+	var topology NodeTopology = newNodeClient(server.URL, "srv-abcde", "", server.Client())
+	zone, err := topology.Zone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if zone != "gb1s-a" {
+		t.Errorf("Expected zone gb1s-a, got %q", zone)
+	}
+}
+
+func TestNodeClientPodAnnotations(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/pods" || r.URL.Query().Get("fieldSelector") != "spec.nodeName=srv-abcde" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"items":[
+			{"metadata":{"annotations":{"pod":"finished"}},"status":{"phase":"Succeeded"},
+			 "spec":{"containers":[{"resources":{"limits":{"volumes.brightbox.com/vol-aaaaa":"1"}}}]}},
+			{"metadata":{"annotations":{"pod":"other"}},"status":{"phase":"Pending"},
+			 "spec":{"containers":[{"resources":{"limits":{"volumes.brightbox.com/vol-bbbbb":"1"}}}]}},
+			{"metadata":{"annotations":{"pod":"running"}},"status":{"phase":"Running"},
+			 "spec":{"containers":[{"resources":{"limits":{"volumes.brightbox.com/vol-aaaaa":"1"}}}]}},
+			{"metadata":{"annotations":{"pod":"pending"}},"status":{"phase":"Pending"},
+			 "spec":{"initContainers":[{"resources":{"requests":{"volumes.brightbox.com/vol-aaaaa":"1"}}}]}}
+		]}`))
+	}))
+	defer server.Close()
+	var store PodAnnotationStore = newNodeClient(server.URL, "srv-abcde", "", server.Client())
+	tests := map[string]string{
+		"volumes.brightbox.com/vol-aaaaa": "pending",
+		"volumes.brightbox.com/vol-bbbbb": "other",
+		"volumes.brightbox.com/vol-ccccc": "",
+	}
+	for resourceName, expected := range tests {
+		annotations, err := store.PodAnnotations(resourceName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if annotations["pod"] != expected {
+			t.Errorf("%s: expected pod %q, got %v", resourceName, expected, annotations)
+		}
+	}
+}
+
+func TestNodeClientPodAnnotationsError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+	client := newNodeClient(server.URL, "srv-abcde", "", server.Client())
+	if _, err := client.PodAnnotations("volumes.brightbox.com/vol-aaaaa"); err == nil {
+		t.Error("Expected error when pods cannot be listed")
+	}
+}
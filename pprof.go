@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/brightbox/brightbox-volume-device-plugin/logging"
+)
+
+// pprofShutdownTimeout bounds how long in flight profiles are given to
+// finish at shutdown
+const pprofShutdownTimeout = 5 * time.Second
+
+// refreshVolumePath is followed by the ID of the volume to refresh
+const refreshVolumePath = "/api/refresh-volume/"
+
+// WatchedPathLister reports the filesystem paths it is watching
+type WatchedPathLister interface {
+	WatchedPaths() []string
+}
+
+// DeadLetterReporter reports the updates its subscribers failed to
+// accept, by subscriber
+type DeadLetterReporter interface {
+	GetResourceNamespace() string
+	DeadLetters() map[string][]Completion
+}
+
+// VolumeRefresher refetches a volume's cached cloud metadata
+type VolumeRefresher interface {
+	RefreshVolume(ctx context.Context, id string) error
+}
+
+// pprofServer serves the net/http/pprof handlers under /debug/pprof/,
+// along with the paths being watched for volumes under /debug/watches,
+// undelivered subscriber updates under /debug/dead-letters, the log
+// verbosity under /debug/loglevel and forced refreshes of cloud metadata
+// under /api/refresh-volume/
+type pprofServer struct {
+	server   *http.Server
+	listener net.Listener
+}
+
+// newPprofServer listens on addr and serves the debugging endpoints in
+// the background until Shutdown is called. /debug/loglevel is only served
+// if level is not nil, and /api/refresh-volume/ if refresher is not nil.
+func newPprofServer(addr string, watchers []WatchedPathLister, listers []DeadLetterReporter, level *slog.LevelVar, refresher VolumeRefresher) (*pprofServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/watches", watchesHandler(watchers))
+	mux.Handle("/debug/dead-letters", deadLettersHandler(listers))
+	if level != nil {
+		mux.Handle("/debug/loglevel", logLevelHandler(level))
+	}
+	if refresher != nil {
+		mux.Handle(refreshVolumePath, refreshVolumeHandler(refresher))
+	}
+	ps := &pprofServer{
+		server:   &http.Server{Handler: mux},
+		listener: listener,
+	}
+	go func() {
+		logging.V(3).Info("Serving pprof", "addr", listener.Addr())
+		if err := ps.server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			logging.Error("pprof server failed", "err", err)
+		}
+	}()
+	return ps, nil
+}
+
+// watchesHandler lists the paths watched by all the watchers, one per
+// line
+func watchesHandler(watchers []WatchedPathLister) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var paths []string
+		for _, watcher := range watchers {
+			paths = append(paths, watcher.WatchedPaths()...)
+		}
+		sort.Strings(paths)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, path := range paths {
+			w.Write([]byte(path + "\n"))
+		}
+	})
+}
+
+// refreshVolumeHandler refetches the cloud metadata of the volume named
+// in a POST to /api/refresh-volume/{id}
+func refreshVolumeHandler(refresher VolumeRefresher) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id := strings.TrimPrefix(r.URL.Path, refreshVolumePath)
+		if id == "" || strings.Contains(id, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		if err := refresher.RefreshVolume(r.Context(), id); err != nil {
+			logging.Warn("Unable to refresh volume metadata", "volumeID", id, "err", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		logging.V(2).Info("Refreshed volume metadata", "volumeID", id)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok\n"))
+	})
+}
+
+// deadLetter is the JSON form of an undelivered update
+type deadLetter struct {
+	Volumes        []string `json:"volumes"`
+	AddedVolumes   []string `json:"addedVolumes,omitempty"`
+	RemovedVolumes []string `json:"removedVolumes,omitempty"`
+}
+
+// deadLetterSummary lists the updates a subscriber failed to accept
+type deadLetterSummary struct {
+	Namespace  string       `json:"namespace"`
+	Subscriber string       `json:"subscriber"`
+	Pending    []deadLetter `json:"pending"`
+}
+
+// deadLettersHandler summarises the undelivered updates of all the
+// listers as JSON, ordered by namespace and subscriber
+func deadLettersHandler(listers []DeadLetterReporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		summaries := []deadLetterSummary{}
+		for _, lister := range listers {
+			for subscriber, letters := range lister.DeadLetters() {
+				summary := deadLetterSummary{
+					Namespace:  lister.GetResourceNamespace(),
+					Subscriber: subscriber,
+				}
+				for _, letter := range letters {
+					summary.Pending = append(summary.Pending, deadLetter{
+						Volumes:        letter.Volumes,
+						AddedVolumes:   letter.AddedVolumes,
+						RemovedVolumes: letter.RemovedVolumes,
+					})
+				}
+				summaries = append(summaries, summary)
+			}
+		}
+		sort.Slice(summaries, func(i, j int) bool {
+			if summaries[i].Namespace != summaries[j].Namespace {
+				return summaries[i].Namespace < summaries[j].Namespace
+			}
+			return summaries[i].Subscriber < summaries[j].Subscriber
+		})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(summaries)
+	})
+}
+
+// Addr returns the address the server is listening on
+func (ps *pprofServer) Addr() net.Addr {
+	return ps.listener.Addr()
+}
+
+// Shutdown stops the server, waiting up to pprofShutdownTimeout for in
+// flight requests to finish
+func (ps *pprofServer) Shutdown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), pprofShutdownTimeout)
+	defer cancel()
+	return ps.server.Shutdown(ctx)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestPprofServer(t *testing.T) {
+	ps, err := newPprofServer("127.0.0.1:0", nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get("http://" + ps.Addr().String() + "/debug/pprof/cmdline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200, got %s", resp.Status)
+	}
+	if err := ps.Shutdown(); err != nil {
+		t.Errorf("Shutdown failed: %s", err)
+	}
+	if _, err := http.Get("http://" + ps.Addr().String() + "/debug/pprof/cmdline"); err == nil {
+		t.Error("Expected server to be stopped")
+	}
+}
+
+// fakeWatchedPaths is a WatchedPathLister with a fixed list of paths
+type fakeWatchedPaths []string
+
+func (f fakeWatchedPaths) WatchedPaths() []string {
+	return f
+}
+
+func TestPprofServerWatches(t *testing.T) {
+	ps, err := newPprofServer("127.0.0.1:0", []WatchedPathLister{
+		fakeWatchedPaths{"/dev/disk/by-id", "/dev/disk"},
+		fakeWatchedPaths{"/dev/disk/by-path"},
+	}, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Shutdown()
+	resp, err := http.Get("http://" + ps.Addr().String() + "/debug/watches")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "/dev/disk\n/dev/disk/by-id\n/dev/disk/by-path\n"; string(body) != expected {
+		t.Errorf("Expected %q, got %q", expected, body)
+	}
+}
+
+// fakeDeadLetters is a DeadLetterReporter with fixed dead letters
+type fakeDeadLetters struct {
+	namespace string
+	letters   map[string][]Completion
+}
+
+func (f fakeDeadLetters) GetResourceNamespace() string {
+	return f.namespace
+}
+
+func (f fakeDeadLetters) DeadLetters() map[string][]Completion {
+	return f.letters
+}
+
+func TestPprofServerDeadLetters(t *testing.T) {
+	ps, err := newPprofServer("127.0.0.1:0", nil, []DeadLetterReporter{
+		fakeDeadLetters{"volumes.example.com", map[string][]Completion{
+			"vol-bbbbb": {{Volumes: []string{"vol-bbbbb"}, AddedVolumes: []string{"vol-bbbbb"}}},
+			"vol-aaaaa": {{Volumes: []string{}, RemovedVolumes: []string{"vol-aaaaa"}}},
+		}},
+		fakeDeadLetters{"extra.example.com", map[string][]Completion{
+			"img-ccccc": {{Volumes: []string{"img-ccccc"}}, {Volumes: []string{"img-ccccc", "img-ddddd"}}},
+		}},
+	}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Shutdown()
+	resp, err := http.Get("http://" + ps.Addr().String() + "/debug/dead-letters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var summaries []deadLetterSummary
+	if err := json.NewDecoder(resp.Body).Decode(&summaries); err != nil {
+		t.Fatal(err)
+	}
+	if len(summaries) != 3 {
+		t.Fatalf("Expected 3 summaries, got %+v", summaries)
+	}
+	for i, expected := range []string{"extra.example.com/img-ccccc", "volumes.example.com/vol-aaaaa", "volumes.example.com/vol-bbbbb"} {
+		if got := summaries[i].Namespace + "/" + summaries[i].Subscriber; got != expected {
+			t.Errorf("Expected %s at %d, got %s", expected, i, got)
+		}
+	}
+	if pending := summaries[0].Pending; len(pending) != 2 || len(pending[1].Volumes) != 2 {
+		t.Errorf("Unexpected pending updates %+v", pending)
+	}
+	if pending := summaries[1].Pending; len(pending) != 1 || pending[0].RemovedVolumes[0] != "vol-aaaaa" {
+		t.Errorf("Unexpected pending updates %+v", pending)
+	}
+}
+
+func TestPprofServerNoDeadLetters(t *testing.T) {
+	ps, err := newPprofServer("127.0.0.1:0", nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Shutdown()
+	resp, err := http.Get("http://" + ps.Addr().String() + "/debug/dead-letters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "[]\n" {
+		t.Errorf("Expected an empty list, got %q", body)
+	}
+}
+
+// fakeRefresher is a VolumeRefresher recording the volumes refreshed
+type fakeRefresher struct {
+	refreshed []string
+}
+
+func (f *fakeRefresher) RefreshVolume(ctx context.Context, id string) error {
+	if id == "vol-zzzzz" {
+		return errors.New("volume not found")
+	}
+	f.refreshed = append(f.refreshed, id)
+	return nil
+}
+
+func TestPprofServerRefreshVolume(t *testing.T) {
+	refresher := &fakeRefresher{}
+	ps, err := newPprofServer("127.0.0.1:0", nil, nil, nil, refresher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Shutdown()
+	base := "http://" + ps.Addr().String() + "/api/refresh-volume/"
+	for _, tc := range []struct {
+		method string
+		id     string
+		status int
+	}{
+		{http.MethodPost, "vol-aaaaa", http.StatusOK},
+		{http.MethodGet, "vol-aaaaa", http.StatusMethodNotAllowed},
+		{http.MethodPost, "", http.StatusNotFound},
+		{http.MethodPost, "vol-aaaaa/extra", http.StatusNotFound},
+		{http.MethodPost, "vol-zzzzz", http.StatusBadGateway},
+	} {
+		req, _ := http.NewRequest(tc.method, base+tc.id, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s %q: expected status %d, got %s", tc.method, tc.id, tc.status, resp.Status)
+		}
+	}
+	if len(refresher.refreshed) != 1 || refresher.refreshed[0] != "vol-aaaaa" {
+		t.Errorf("Expected vol-aaaaa to be refreshed once, got %v", refresher.refreshed)
+	}
+}
+
+func TestPprofServerWithoutRefresher(t *testing.T) {
+	ps, err := newPprofServer("127.0.0.1:0", nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Shutdown()
+	resp, err := http.Post("http://"+ps.Addr().String()+"/api/refresh-volume/vol-aaaaa", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 without a refresher, got %s", resp.Status)
+	}
+}
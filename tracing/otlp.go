@@ -0,0 +1,267 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/brightbox/brightbox-volume-device-plugin/logging"
+)
+
+// ServiceName identifies the plugin's spans to the collector
+const ServiceName = "brightbox-volume-device-plugin"
+
+const (
+	exportInterval  = 5 * time.Second
+	exportBatchSize = 256
+	exportQueueSize = 2048
+	exportTimeout   = 10 * time.Second
+)
+
+// OTLPExporter is a SpanProcessor that sends finished spans in batches
+// to an OTLP/HTTP collector. Spans are queued without blocking and
+// dropped if the queue is full or the collector cannot be reached.
+//
+// Create an OTLPExporter by calling the NewOTLPExporter function
+type OTLPExporter struct {
+	url      string
+	client   *http.Client
+	spans    chan SpanData
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// NewOTLPExporter sends spans to endpoint, either a host:port, which is
+// given the default /v1/traces path over http, or a full URL
+func NewOTLPExporter(endpoint string) (*OTLPExporter, error) {
+	target, err := otlpURL(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	e := &OTLPExporter{
+		url:    target,
+		client: &http.Client{Timeout: exportTimeout},
+		spans:  make(chan SpanData, exportQueueSize),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go e.run()
+	return e, nil
+}
+
+// otlpURL turns the endpoint into the URL spans are posted to
+func otlpURL(endpoint string) (string, error) {
+	if endpoint == "" {
+		return "", fmt.Errorf("empty OTLP endpoint")
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		u, err = url.Parse("http://" + endpoint)
+	}
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("invalid OTLP endpoint %q", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	return u.String(), nil
+}
+
+// OnEnd queues the span for export
+func (e *OTLPExporter) OnEnd(span SpanData) {
+	select {
+	case e.spans <- span:
+	default:
+		logging.Warn("Trace export queue full, dropping span", "span", span.Name)
+	}
+}
+
+// Shutdown exports any queued spans and stops the exporter, giving up
+// when ctx is done
+func (e *OTLPExporter) Shutdown(ctx context.Context) error {
+	e.stopOnce.Do(func() { close(e.stop) })
+	select {
+	case <-e.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run batches queued spans, exporting them every export interval or
+// when a batch fills
+func (e *OTLPExporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+	var batch []SpanData
+	for {
+		select {
+		case span := <-e.spans:
+			batch = append(batch, span)
+			if len(batch) >= exportBatchSize {
+				e.export(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			e.export(batch)
+			batch = nil
+		case <-e.stop:
+			for {
+				select {
+				case span := <-e.spans:
+					batch = append(batch, span)
+				default:
+					e.export(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+// export posts the batch to the collector, logging any failure
+func (e *OTLPExporter) export(batch []SpanData) {
+	if len(batch) == 0 {
+		return
+	}
+	body, err := json.Marshal(newOTLPRequest(batch))
+	if err != nil {
+		logging.Error("Unable to encode spans", "err", err)
+		return
+	}
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logging.Warn("Unable to export spans", "url", e.url, "spans", len(batch), "err", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		logging.Warn("Collector rejected spans", "url", e.url, "spans", len(batch), "status", resp.Status)
+		return
+	}
+	logging.V(4).Info("Exported spans", "spans", len(batch))
+}
+
+// The OTLP JSON encoding of ExportTraceServiceRequest. IDs are hex and
+// 64 bit integers are strings.
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+const (
+	otlpSpanKindServer  = 2
+	otlpStatusCodeError = 2
+)
+
+// newOTLPRequest groups the spans by scope under the plugin's resource
+func newOTLPRequest(batch []SpanData) otlpRequest {
+	var scopes []otlpScopeSpans
+	index := make(map[string]int)
+	for _, span := range batch {
+		i, ok := index[span.Scope]
+		if !ok {
+			i = len(scopes)
+			index[span.Scope] = i
+			scopes = append(scopes, otlpScopeSpans{Scope: otlpScope{Name: span.Scope}})
+		}
+		scopes[i].Spans = append(scopes[i].Spans, newOTLPSpan(span))
+	}
+	return otlpRequest{
+		ResourceSpans: []otlpResourceSpans{
+			{
+				Resource: otlpResource{
+					Attributes: []otlpKeyValue{newOTLPKeyValue(String("service.name", ServiceName))},
+				},
+				ScopeSpans: scopes,
+			},
+		},
+	}
+}
+
+func newOTLPSpan(span SpanData) otlpSpan {
+	result := otlpSpan{
+		TraceID:           span.Context.TraceID.String(),
+		SpanID:            span.Context.SpanID.String(),
+		Name:              span.Name,
+		Kind:              otlpSpanKindServer,
+		StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+	}
+	if span.Parent != (SpanID{}) {
+		result.ParentSpanID = span.Parent.String()
+	}
+	for _, attr := range span.Attributes {
+		result.Attributes = append(result.Attributes, newOTLPKeyValue(attr))
+	}
+	if span.Err != nil {
+		result.Status = otlpStatus{Code: otlpStatusCodeError, Message: span.Err.Error()}
+	}
+	return result
+}
+
+func newOTLPKeyValue(attr Attribute) otlpKeyValue {
+	var value otlpAnyValue
+	switch v := attr.Value.(type) {
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		value.IntValue = &s
+	default:
+		s := fmt.Sprint(v)
+		value.StringValue = &s
+	}
+	return otlpKeyValue{Key: attr.Key, Value: value}
+}
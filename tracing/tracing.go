@@ -0,0 +1,273 @@
+// Package tracing records spans for the plugin's RPC handlers and exports
+// them to an OpenTelemetry collector with OTLP over HTTP, using the JSON
+// encoding.
+//
+// The API mirrors the parts of OpenTelemetry's tracing API the plugin
+// needs: a TracerProvider hands out Tracers, which start Spans carrying
+// attributes. Finished spans are passed to the provider's SpanProcessors.
+// Trace context arriving in a W3C traceparent header is continued.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TracerProvider creates named Tracers
+type TracerProvider interface {
+	Tracer(name string) Tracer
+}
+
+// Tracer starts spans
+type Tracer interface {
+	// Start begins a span that is a child of any span in ctx, returning
+	// a context holding the new span
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is an operation being traced. End must be called when the
+// operation finishes.
+type Span interface {
+	SetAttributes(attrs ...Attribute)
+	RecordError(err error)
+	End()
+}
+
+// Attribute is a key/value pair recorded on a span. Values are strings
+// or int64s.
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+// String returns a string Attribute
+func String(key, value string) Attribute {
+	return Attribute{key, value}
+}
+
+// Int returns an integer Attribute
+func Int(key string, value int) Attribute {
+	return Attribute{key, int64(value)}
+}
+
+// TraceID identifies a trace
+type TraceID [16]byte
+
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// SpanID identifies a span within a trace
+type SpanID [8]byte
+
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// SpanContext identifies a span across process boundaries
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+}
+
+// IsValid reports whether both IDs are set
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+type spanContextKey struct{}
+
+// SpanContextFromContext returns the context of the span in ctx, which
+// is invalid if there is none
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	sc, _ := ctx.Value(spanContextKey{}).(SpanContext)
+	return sc
+}
+
+func contextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// ContextWithRemoteParent parses a W3C traceparent header, e.g.
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", and returns
+// a context in which new spans continue that trace. An invalid header
+// is returned as an error along with ctx unchanged.
+func ContextWithRemoteParent(ctx context.Context, traceparent string) (context.Context, error) {
+	fields := strings.Split(traceparent, "-")
+	if len(fields) < 4 || fields[0] == "ff" || len(fields[0]) != 2 {
+		return ctx, fmt.Errorf("invalid traceparent %q", traceparent)
+	}
+	var sc SpanContext
+	if err := decodeID(sc.TraceID[:], fields[1]); err != nil {
+		return ctx, fmt.Errorf("invalid traceparent %q: %w", traceparent, err)
+	}
+	if err := decodeID(sc.SpanID[:], fields[2]); err != nil {
+		return ctx, fmt.Errorf("invalid traceparent %q: %w", traceparent, err)
+	}
+	if !sc.IsValid() {
+		return ctx, fmt.Errorf("invalid traceparent %q: zero ID", traceparent)
+	}
+	return contextWithSpanContext(ctx, sc), nil
+}
+
+// decodeID decodes hex exactly filling id
+func decodeID(id []byte, s string) error {
+	if hex.DecodedLen(len(s)) != len(id) {
+		return fmt.Errorf("ID %q is the wrong length", s)
+	}
+	_, err := hex.Decode(id, []byte(s))
+	return err
+}
+
+// NoopTracerProvider returns a TracerProvider whose spans record nothing
+func NoopTracerProvider() TracerProvider {
+	return noopProvider{}
+}
+
+type noopProvider struct{}
+
+func (noopProvider) Tracer(string) Tracer {
+	return noopTracer{}
+}
+
+type noopTracer struct{}
+
+func (noopTracer) Start(ctx context.Context, _ string) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttributes(...Attribute) {}
+func (noopSpan) RecordError(error)          {}
+func (noopSpan) End()                       {}
+
+// SpanData describes a finished span
+type SpanData struct {
+	Scope      string
+	Name       string
+	Context    SpanContext
+	Parent     SpanID
+	Start      time.Time
+	End        time.Time
+	Attributes []Attribute
+	Err        error
+}
+
+// Attribute returns the value of the named attribute, or nil if the span
+// does not have it
+func (sd SpanData) Attribute(key string) any {
+	for _, attr := range sd.Attributes {
+		if attr.Key == key {
+			return attr.Value
+		}
+	}
+	return nil
+}
+
+// SpanProcessor is passed each span as it ends
+type SpanProcessor interface {
+	OnEnd(span SpanData)
+}
+
+// Provider is a TracerProvider that records spans and passes them to
+// its processors when they end
+type Provider struct {
+	processors []SpanProcessor
+}
+
+// NewProvider creates a Provider sending finished spans to processors
+func NewProvider(processors ...SpanProcessor) *Provider {
+	return &Provider{processors: processors}
+}
+
+// Tracer returns a Tracer whose spans are reported under the scope name
+func (p *Provider) Tracer(name string) Tracer {
+	return &tracer{provider: p, scope: name}
+}
+
+type tracer struct {
+	provider *Provider
+	scope    string
+}
+
+func (t *tracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	parent := SpanContextFromContext(ctx)
+	s := &span{
+		provider: t.provider,
+		data: SpanData{
+			Scope:  t.scope,
+			Name:   name,
+			Parent: parent.SpanID,
+			Start:  time.Now(),
+		},
+	}
+	if parent.IsValid() {
+		s.data.Context.TraceID = parent.TraceID
+	} else {
+		rand.Read(s.data.Context.TraceID[:])
+	}
+	rand.Read(s.data.Context.SpanID[:])
+	return contextWithSpanContext(ctx, s.data.Context), s
+}
+
+type span struct {
+	provider *Provider
+	mutex    sync.Mutex
+	data     SpanData
+	ended    bool
+}
+
+func (s *span) SetAttributes(attrs ...Attribute) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.data.Attributes = append(s.data.Attributes, attrs...)
+}
+
+func (s *span) RecordError(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.data.Err = err
+}
+
+// End finishes the span and passes it to the processors. Only the first
+// call has any effect.
+func (s *span) End() {
+	s.mutex.Lock()
+	if s.ended {
+		s.mutex.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	s.mutex.Unlock()
+	for _, processor := range s.provider.processors {
+		processor.OnEnd(data)
+	}
+}
+
+// Recorder is a SpanProcessor that keeps every finished span, for tests
+type Recorder struct {
+	mutex sync.Mutex
+	spans []SpanData
+}
+
+// OnEnd records the span
+func (r *Recorder) OnEnd(span SpanData) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.spans = append(r.spans, span)
+}
+
+// Ended returns the spans recorded so far, in the order they ended
+func (r *Recorder) Ended() []SpanData {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]SpanData(nil), r.spans...)
+}
@@ -0,0 +1,139 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestProviderRecordsSpans(t *testing.T) {
+	recorder := &Recorder{}
+	tracer := NewProvider(recorder).Tracer("test")
+	ctx, parent := tracer.Start(context.Background(), "parent")
+	_, child := tracer.Start(ctx, "child")
+	child.SetAttributes(String("volume.id", "vol-12345"), Int("container.count", 2))
+	child.RecordError(errors.New("failed"))
+	child.End()
+	child.End()
+	parent.End()
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans, got %d", len(spans))
+	}
+	c, p := spans[0], spans[1]
+	if c.Name != "child" || p.Name != "parent" || c.Scope != "test" {
+		t.Errorf("Unexpected spans %+v", spans)
+	}
+	if c.Context.TraceID != p.Context.TraceID || c.Parent != p.Context.SpanID {
+		t.Error("Child span not linked to parent")
+	}
+	if p.Parent != (SpanID{}) || !p.Context.IsValid() {
+		t.Errorf("Expected a valid root span, got %+v", p)
+	}
+	if c.Attribute("volume.id") != "vol-12345" || c.Attribute("container.count") != int64(2) {
+		t.Errorf("Unexpected attributes %v", c.Attributes)
+	}
+	if c.Err == nil || c.End.Before(c.Start) {
+		t.Errorf("Unexpected span %+v", c)
+	}
+}
+
+func TestContextWithRemoteParent(t *testing.T) {
+	ctx, err := ContextWithRemoteParent(context.Background(),
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := &Recorder{}
+	_, span := NewProvider(recorder).Tracer("test").Start(ctx, "remote child")
+	span.End()
+	got := recorder.Ended()[0]
+	if got.Context.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || got.Parent.String() != "00f067aa0ba902b7" {
+		t.Errorf("Trace not continued: %+v", got)
+	}
+
+	invalid := []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736",
+		"00-4bf92f3577b34da6-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-xyz92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	}
+	for _, header := range invalid {
+		if _, err := ContextWithRemoteParent(context.Background(), header); err == nil {
+			t.Errorf("Expected %q to be rejected", header)
+		}
+	}
+}
+
+func TestOTLPURL(t *testing.T) {
+	tests := map[string]string{
+		"collector:4318":                     "http://collector:4318/v1/traces",
+		"http://collector:4318/":             "http://collector:4318/v1/traces",
+		"https://collector.example.com/otlp": "https://collector.example.com/otlp",
+	}
+	for endpoint, expected := range tests {
+		if got, err := otlpURL(endpoint); err != nil || got != expected {
+			t.Errorf("otlpURL(%q) = %q, %v, want %q", endpoint, got, err, expected)
+		}
+	}
+	if _, err := otlpURL(""); err == nil {
+		t.Error("Expected error for empty endpoint")
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	requests := make(chan otlpRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Unexpected request %s %s", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		var req otlpRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		requests <- req
+	}))
+	defer server.Close()
+
+	exporter, err := NewOTLPExporter(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, span := NewProvider(exporter).Tracer("test").Start(context.Background(), "Allocate")
+	span.SetAttributes(String("volume.id", "vol-12345"), Int("container.count", 1))
+	span.RecordError(errors.New("failed"))
+	span.End()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := exporter.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var req otlpRequest
+	select {
+	case req = <-requests:
+	default:
+		t.Fatal("No spans exported")
+	}
+	resource := req.ResourceSpans[0]
+	if *resource.Resource.Attributes[0].Value.StringValue != ServiceName {
+		t.Errorf("Unexpected resource %+v", resource.Resource)
+	}
+	got := resource.ScopeSpans[0].Spans[0]
+	if got.Name != "Allocate" || len(got.TraceID) != 32 || len(got.SpanID) != 16 {
+		t.Errorf("Unexpected span %+v", got)
+	}
+	if got.Status.Code != otlpStatusCodeError || got.Status.Message != "failed" {
+		t.Errorf("Unexpected status %+v", got.Status)
+	}
+	if len(got.Attributes) != 2 || *got.Attributes[0].Value.StringValue != "vol-12345" || *got.Attributes[1].Value.IntValue != "1" {
+		t.Errorf("Unexpected attributes %+v", got.Attributes)
+	}
+}
@@ -0,0 +1,90 @@
+package volwatch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+
+	"github.com/brightbox/brightbox-volume-device-plugin/logging"
+	"github.com/pilebones/go-udev/netlink"
+)
+
+// Backend is an alternative source of volume change notifications to the
+// built in fsnotify watch of the device directory, selected with
+// WithBackend.
+//
+// Start runs until ctx is cancelled, sending an Event on events whenever
+// the volumes may have changed. It must stop sending once ctx is
+// cancelled, and returns nil when cancelled or an error if the source
+// fails. Whatever the Event holds, the watcher rescans the watch
+// directory to find the current volumes, so a Backend may send an empty
+// Event if it cannot tell which volumes changed.
+type Backend interface {
+	Start(ctx context.Context, events chan<- Event) error
+}
+
+// UdevBackend listens for kernel uevents on a netlink socket and signals
+// a change whenever a block device disk is added or removed. It can see
+// volumes arrive in containers where the device directory is a bind
+// mount that never raises inotify events.
+//
+// Kernel uevents are sent before udev has created the device directory
+// links, so pair this backend with WithDebounceDuration or
+// WithReconcileInterval to pick up the links once they appear.
+type UdevBackend struct{}
+
+// NewUdevBackend creates a Backend listening for kernel uevents
+func NewUdevBackend() *UdevBackend {
+	return &UdevBackend{}
+}
+
+// udevReadTimeout bounds each netlink read so that cancellation is
+// noticed
+const udevReadTimeout = 500 * time.Millisecond
+
+// Start implements Backend
+func (b *UdevBackend) Start(ctx context.Context, events chan<- Event) error {
+	conn := &netlink.UEventConn{}
+	if err := conn.Connect(netlink.KernelEvent); err != nil {
+		return fmt.Errorf("connecting to netlink uevent socket: %w", err)
+	}
+	defer conn.Close()
+	timeout := syscall.NsecToTimeval(udevReadTimeout.Nanoseconds())
+	if err := syscall.SetsockoptTimeval(conn.Fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &timeout); err != nil {
+		return fmt.Errorf("setting netlink read timeout: %w", err)
+	}
+	logging.V(4).Info("Listening for kernel uevents")
+	for ctx.Err() == nil {
+		msg, err := conn.ReadMsg()
+		switch {
+		case errors.Is(err, syscall.EAGAIN), errors.Is(err, syscall.EINTR):
+			continue
+		case err != nil:
+			return fmt.Errorf("reading netlink uevent: %w", err)
+		}
+		uevent, err := netlink.ParseUEvent(msg)
+		if err != nil {
+			logging.V(4).Info("Ignoring unparseable uevent", "err", err)
+			continue
+		}
+		if !isBlockDiskChange(uevent) {
+			continue
+		}
+		logging.V(4).Info("Block device uevent", "action", uevent.Action, "device", uevent.Env["DEVNAME"])
+		select {
+		case events <- Event{}:
+		case <-ctx.Done():
+		}
+	}
+	return nil
+}
+
+// isBlockDiskChange reports whether the uevent adds or removes a whole
+// block device, ignoring partitions
+func isBlockDiskChange(uevent *netlink.UEvent) bool {
+	return (uevent.Action == netlink.ADD || uevent.Action == netlink.REMOVE) &&
+		uevent.Env["SUBSYSTEM"] == "block" &&
+		uevent.Env["DEVTYPE"] == "disk"
+}
@@ -0,0 +1,107 @@
+package volwatch
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var volumeCounts = []int{1, 10, 100, 500}
+
+// awaitVolumes reads events until one lists want volumes
+func awaitVolumes(b *testing.B, watch *VolumeWatcher, want int) {
+	b.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event, ok := <-watch.Events():
+			if !ok {
+				b.Fatal("Events channel closed")
+			}
+			if len(event) == want {
+				return
+			}
+		case <-timeout:
+			b.Fatalf("Timed out waiting for %d volumes", want)
+		}
+	}
+}
+
+// benchmarkWatcherEventThroughput times a volume being added to and
+// removed from a directory already holding the given number of volume
+// symlinks, each change waiting for the watcher to report it. Bytes are
+// the volume IDs carried by each event.
+func benchmarkWatcherEventThroughput(b *testing.B, volumes int) {
+	watchDir := filepath.Join(b.TempDir(), "by-id")
+	if err := os.Mkdir(watchDir, 0755); err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < volumes; i++ {
+		if err := os.Symlink("../../vdb", filepath.Join(watchDir, fmt.Sprintf("virtio-vol-%05d", i))); err != nil {
+			b.Fatal(err)
+		}
+	}
+	watch := NewWatchDir(watchDir)
+	defer watch.Cancel()
+	awaitVolumes(b, watch, volumes)
+	extra := filepath.Join(watchDir, "virtio-vol-zzzzz")
+	b.ReportAllocs()
+	b.SetBytes(int64(volumes * len("vol-00000")))
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if n%2 == 0 {
+			if err := os.Symlink("../../vdc", extra); err != nil {
+				b.Fatal(err)
+			}
+			awaitVolumes(b, watch, volumes+1)
+		} else {
+			if err := os.Remove(extra); err != nil {
+				b.Fatal(err)
+			}
+			awaitVolumes(b, watch, volumes)
+		}
+	}
+	b.StopTimer()
+	if seconds := b.Elapsed().Seconds(); seconds > 0 {
+		b.ReportMetric(float64(b.N)/seconds, "events/s")
+	}
+}
+
+func BenchmarkWatcherEventThroughput(b *testing.B) {
+	for _, volumes := range volumeCounts {
+		b.Run(fmt.Sprintf("%d", volumes), func(b *testing.B) {
+			benchmarkWatcherEventThroughput(b, volumes)
+		})
+	}
+}
+
+// benchmarkEnumerateVolumes reads a list of 500 volumes each time,
+// releasing it afterwards if pooled, as happens when nothing has changed
+// since the last read. Run with -benchtime=10000x for a fixed number of
+// calls.
+func benchmarkEnumerateVolumes(b *testing.B, pooled bool) {
+	dirents := make([]os.DirEntry, 500)
+	for i := range dirents {
+		dirents[i] = fakeSymlink(fmt.Sprintf("virtio-vol-%05d", i))
+	}
+	o := defaultWatcherConfig()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		volumes, _ := enumerateVolumes("", dirents, o)
+		if pooled {
+			releaseVolumes(volumes)
+		}
+	}
+}
+
+func BenchmarkEnumerateVolumes(b *testing.B) {
+	b.Run("pooled", func(b *testing.B) {
+		benchmarkEnumerateVolumes(b, true)
+	})
+	b.Run("unpooled", func(b *testing.B) {
+		benchmarkEnumerateVolumes(b, false)
+	})
+}
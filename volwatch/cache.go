@@ -0,0 +1,53 @@
+package volwatch
+
+import (
+	"sync"
+	"time"
+)
+
+// DevicePathCache remembers the device node each volume's symlink
+// resolved to, for a limited time, so repeated lookups of the same volume
+// don't walk the links again. It is safe for concurrent use.
+//
+// Create a DevicePathCache by calling the NewDevicePathCache function
+type DevicePathCache struct {
+	ttl     time.Duration
+	entries sync.Map // volume ID -> cachedPath
+	now     func() time.Time
+}
+
+// cachedPath is a resolved device path and when it stops being valid
+type cachedPath struct {
+	path    string
+	expires time.Time
+}
+
+// NewDevicePathCache creates a cache whose entries last for ttl
+func NewDevicePathCache(ttl time.Duration) *DevicePathCache {
+	return &DevicePathCache{ttl: ttl, now: time.Now}
+}
+
+// Get returns the device path cached for id, if there is one that has
+// not yet expired
+func (c *DevicePathCache) Get(id string) (string, bool) {
+	value, ok := c.entries.Load(id)
+	if !ok {
+		return "", false
+	}
+	entry := value.(cachedPath)
+	if !c.now().Before(entry.expires) {
+		c.entries.CompareAndDelete(id, entry)
+		return "", false
+	}
+	return entry.path, true
+}
+
+// Put caches path as the device for id
+func (c *DevicePathCache) Put(id string, path string) {
+	c.entries.Store(id, cachedPath{path, c.now().Add(c.ttl)})
+}
+
+// Invalidate forgets the device path cached for id
+func (c *DevicePathCache) Invalidate(id string) {
+	c.entries.Delete(id)
+}
@@ -0,0 +1,80 @@
+package volwatch
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDevicePathCache(t *testing.T) {
+	now := time.Now()
+	cache := NewDevicePathCache(time.Minute)
+	cache.now = func() time.Time { return now }
+	if _, ok := cache.Get("vol-aaaaa"); ok {
+		t.Error("Expected a miss on an empty cache")
+	}
+	cache.Put("vol-aaaaa", "/dev/vdb")
+	if path, ok := cache.Get("vol-aaaaa"); !ok || path != "/dev/vdb" {
+		t.Errorf("Expected a hit on /dev/vdb, got %q, %v", path, ok)
+	}
+	now = now.Add(time.Minute)
+	if path, ok := cache.Get("vol-aaaaa"); ok {
+		t.Errorf("Expected the entry to expire, got %q", path)
+	}
+	cache.Put("vol-aaaaa", "/dev/vdc")
+	cache.Invalidate("vol-aaaaa")
+	if path, ok := cache.Get("vol-aaaaa"); ok {
+		t.Errorf("Expected the entry to be invalidated, got %q", path)
+	}
+}
+
+func TestResolveDevicePathCached(t *testing.T) {
+	baseDir := t.TempDir()
+	watchDir := filepath.Join(baseDir, "by-id")
+	os.Mkdir(watchDir, 0755)
+	device := filepath.Join(baseDir, "vdb")
+	touch(t, baseDir, "vdb")
+	link := filepath.Join(watchDir, "virtio-vol-aaaaa")
+	if err := os.Symlink("../vdb", link); err != nil {
+		t.Fatal(err)
+	}
+	watch := NewWatchDir(watchDir, WithCacheTTL(time.Hour))
+	defer watch.Cancel()
+	nextEvent(t, watch)
+	if path, err := watch.ResolveDevicePath("vol-aaaaa"); err != nil || path != device {
+		t.Fatalf("Expected %s, got %q, %v", device, path, err)
+	}
+	// The device going away is outside the watch, so the cache still
+	// answers
+	os.Remove(device)
+	if path, err := watch.ResolveDevicePath("vol-aaaaa"); err != nil || path != device {
+		t.Errorf("Expected cached %s, got %q, %v", device, path, err)
+	}
+	os.Remove(link)
+	nextEvent(t, watch)
+	if _, err := watch.ResolveDevicePath("vol-aaaaa"); !errors.Is(err, ErrDeviceNotFound) {
+		t.Errorf("Expected the removed volume to be uncached, got %v", err)
+	}
+}
+
+func TestResolveDevicePathUncached(t *testing.T) {
+	baseDir := t.TempDir()
+	watchDir := filepath.Join(baseDir, "by-id")
+	os.Mkdir(watchDir, 0755)
+	touch(t, baseDir, "vdb")
+	if err := os.Symlink("../vdb", filepath.Join(watchDir, "virtio-vol-aaaaa")); err != nil {
+		t.Fatal(err)
+	}
+	watch := NewWatchDir(watchDir)
+	defer watch.Cancel()
+	nextEvent(t, watch)
+	if _, err := watch.ResolveDevicePath("vol-aaaaa"); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(filepath.Join(baseDir, "vdb"))
+	if _, err := watch.ResolveDevicePath("vol-aaaaa"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected the missing device to be found missing, got %v", err)
+	}
+}
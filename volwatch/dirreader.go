@@ -0,0 +1,16 @@
+package volwatch
+
+import "os"
+
+// DirReader lists the entries of the watch directory, letting tests
+// substitute a fake for os.ReadDir with WithDirReader
+type DirReader interface {
+	ReadDir(path string) ([]os.DirEntry, error)
+}
+
+// osDirReader reads directories with os.ReadDir
+type osDirReader struct{}
+
+func (osDirReader) ReadDir(path string) ([]os.DirEntry, error) {
+	return os.ReadDir(path)
+}
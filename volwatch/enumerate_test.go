@@ -0,0 +1,150 @@
+package volwatch
+
+import (
+	"io/fs"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+// fakeDirEntry is an in-memory os.DirEntry, which also serves as its own
+// fs.FileInfo
+type fakeDirEntry struct {
+	name string
+	mode fs.FileMode
+}
+
+var _ os.DirEntry = fakeDirEntry{}
+var _ fs.FileInfo = fakeDirEntry{}
+
+func fakeFile(name string) fakeDirEntry    { return fakeDirEntry{name, 0} }
+func fakeDir(name string) fakeDirEntry     { return fakeDirEntry{name, fs.ModeDir} }
+func fakeSymlink(name string) fakeDirEntry { return fakeDirEntry{name, fs.ModeSymlink} }
+
+func (e fakeDirEntry) Name() string               { return e.name }
+func (e fakeDirEntry) IsDir() bool                { return e.mode.IsDir() }
+func (e fakeDirEntry) Type() fs.FileMode          { return e.mode.Type() }
+func (e fakeDirEntry) Info() (fs.FileInfo, error) { return e, nil }
+func (e fakeDirEntry) Size() int64                { return 0 }
+func (e fakeDirEntry) Mode() fs.FileMode          { return e.mode }
+func (e fakeDirEntry) ModTime() time.Time         { return time.Time{} }
+func (e fakeDirEntry) Sys() any                   { return nil }
+
+func TestEnumerateVolumes(t *testing.T) {
+	tests := []struct {
+		name     string
+		volRe    *regexp.Regexp
+		dirents  []os.DirEntry
+		expected []string
+	}{
+		{
+			name:     "empty directory",
+			expected: []string{},
+		},
+		{
+			name: "no matching names",
+			dirents: []os.DirEntry{
+				fakeFile("ata-QEMU_HARDDISK"),
+				fakeFile("virtio-vol"),
+				fakeFile("nvme-eui.0025385b71b0ba52"),
+			},
+			expected: []string{},
+		},
+		{
+			name: "name lengths",
+			dirents: []os.DirEntry{
+				fakeFile("virtio-vol-aaaa"),
+				fakeFile("virtio-vol-bbbbb"),
+				fakeFile("virtio-vol-cccccc"),
+				fakeFile("vol-ddddd"),
+				fakeFile("a-very-long-prefix-on-the-device-name-vol-eeeee"),
+			},
+			expected: []string{"vol-bbbbb", "vol-ddddd", "vol-eeeee"},
+		},
+		{
+			name: "subdirectories skipped",
+			dirents: []os.DirEntry{
+				fakeDir("virtio-vol-aaaaa"),
+				fakeFile("virtio-vol-bbbbb"),
+				fakeDir("by-path"),
+				fakeFile("virtio-vol-ccccc"),
+			},
+			expected: []string{"vol-bbbbb", "vol-ccccc"},
+		},
+		{
+			name: "symlinks",
+			dirents: []os.DirEntry{
+				fakeSymlink("virtio-vol-aaaaa"),
+				fakeSymlink("ata-QEMU_HARDDISK"),
+				fakeFile("virtio-vol-bbbbb"),
+			},
+			expected: []string{"vol-aaaaa", "vol-bbbbb"},
+		},
+		{
+			name: "partitions not matched by default",
+			dirents: []os.DirEntry{
+				fakeFile("virtio-vol-aaaaa"),
+				fakeFile("virtio-vol-aaaaa-part1"),
+			},
+			expected: []string{"vol-aaaaa"},
+		},
+		{
+			name:  "regex anchored at start",
+			volRe: regexp.MustCompile(`^vol-.....`),
+			dirents: []os.DirEntry{
+				fakeFile("vol-aaaaa-part1"),
+				fakeFile("virtio-vol-bbbbb"),
+			},
+			expected: []string{"vol-aaaaa"},
+		},
+		{
+			name:  "regex anchored at both ends",
+			volRe: regexp.MustCompile(`^virtio-(vol-.....)$`),
+			dirents: []os.DirEntry{
+				fakeFile("virtio-vol-aaaaa"),
+				fakeFile("virtio-vol-aaaaa-part1"),
+				fakeFile("scsi-virtio-vol-bbbbb"),
+			},
+			expected: []string{"virtio-vol-aaaaa"},
+		},
+		{
+			name:  "unanchored regex",
+			volRe: regexp.MustCompile(`vol-.....`),
+			dirents: []os.DirEntry{
+				fakeFile("virtio-vol-aaaaa-part1"),
+				fakeFile("virtio-vol-bbbbbbb"),
+			},
+			expected: []string{"vol-aaaaa", "vol-bbbbb"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := buildWatcherConfig([]Option{WithVolumeRegex(tt.volRe)})
+			result, stale := enumerateVolumes(t.TempDir(), tt.dirents, o)
+			if !slices.Equal([]string(result), tt.expected) {
+				t.Errorf("Expected %v, got %v", tt.expected, result)
+			}
+			if len(stale) != 0 {
+				t.Errorf("Expected no stale volumes, got %v", stale)
+			}
+		})
+	}
+}
+
+func TestPooledVolumes(t *testing.T) {
+	volumes := pooledVolumes(4)
+	if len(volumes) != 0 || cap(volumes) < 4 {
+		t.Fatalf("Expected an empty list with room for 4, got %d/%d", len(volumes), cap(volumes))
+	}
+	volumes = append(volumes, "vol-aaaaa", "vol-bbbbb")
+	releaseVolumes(volumes)
+	if reused := pooledVolumes(2); len(reused) != 0 || cap(reused) < 2 {
+		t.Errorf("Expected an empty list with room for 2, got %d/%d", len(reused), cap(reused))
+	}
+	if larger := pooledVolumes(64); cap(larger) < 64 {
+		t.Errorf("Expected room for 64, got %d", cap(larger))
+	}
+}
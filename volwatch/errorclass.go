@@ -0,0 +1,42 @@
+package volwatch
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// ErrorClass says whether a watch error can be ridden out
+type ErrorClass int
+
+const (
+	// Fatal errors stop the watch
+	Fatal ErrorClass = iota
+	// Transient errors are expected to clear up by themselves, so the
+	// watch carries on after rescanning the watch directory
+	Transient
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case Fatal:
+		return "Fatal"
+	case Transient:
+		return "Transient"
+	default:
+		return fmt.Sprintf("ErrorClass(%d)", int(c))
+	}
+}
+
+// ClassifyError sorts an error reported by the filesystem notifier into
+// Transient interruptions, such as EINTR and EAGAIN, and Fatal errors.
+// Anything not known to be transient is fatal.
+func ClassifyError(err error) ErrorClass {
+	switch {
+	case errors.Is(err, syscall.EINTR),
+		errors.Is(err, syscall.EAGAIN):
+		return Transient
+	default:
+		return Fatal
+	}
+}
@@ -0,0 +1,107 @@
+package volwatch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"syscall"
+)
+
+// RawFilesystem is returned by DetectFilesystem for devices without a
+// recognised filesystem signature
+const RawFilesystem = "raw"
+
+// DetectFilesystem identifies the filesystem on the device at devicePath
+// from its signature, using the names given by blkid (e.g. "ext4",
+// "xfs", "crypto_LUKS"), or returns RawFilesystem if none is found.
+// The device is opened read only and without blocking.
+func DetectFilesystem(devicePath string) (string, error) {
+	device, err := os.OpenFile(devicePath, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return "", err
+	}
+	defer device.Close()
+	buf := make([]byte, probeSize)
+	n, err := device.ReadAt(buf, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	return detectFilesystem(buf[:n]), nil
+}
+
+// probeSize covers every signature checked, the furthest being the
+// btrfs superblock at 64 KiB
+const probeSize = btrfsMagicOffset + 8
+
+const (
+	ext4SuperblockOffset = 1024
+	btrfsMagicOffset     = 0x10040
+	iso9660MagicOffset   = 0x8001
+	swapMagicOffset      = 4096 - 10
+)
+
+// ext superblock feature flags that distinguish ext3 and ext4
+const (
+	extCompatHasJournal = 0x4
+	extIncompatExtents  = 0x40
+	extIncompat64Bit    = 0x80
+	extIncompatFlexBG   = 0x200
+)
+
+// signature is a fixed magic value at an offset from the start of the
+// device
+type signature struct {
+	name   string
+	offset int
+	magic  string
+}
+
+var signatures = []signature{
+	{"xfs", 0, "XFSB"},
+	{"crypto_LUKS", 0, "LUKS\xba\xbe"},
+	{"squashfs", 0, "hsqs"},
+	{"LVM2_member", 512 + 24, "LVM2 001"},
+	{"vfat", 82, "FAT32   "},
+	{"vfat", 54, "FAT16   "},
+	{"vfat", 54, "FAT12   "},
+	{"swap", swapMagicOffset, "SWAPSPACE2"},
+	{"swap", swapMagicOffset, "SWAP-SPACE"},
+	{"iso9660", iso9660MagicOffset, "CD001"},
+	{"btrfs", btrfsMagicOffset, "_BHRfS_M"},
+}
+
+// detectFilesystem identifies the filesystem from the start of a device.
+// buf may be shorter than probeSize if the device is small.
+func detectFilesystem(buf []byte) string {
+	if name, ok := detectExt(buf); ok {
+		return name
+	}
+	for _, sig := range signatures {
+		end := sig.offset + len(sig.magic)
+		if end <= len(buf) && bytes.Equal(buf[sig.offset:end], []byte(sig.magic)) {
+			return sig.name
+		}
+	}
+	return RawFilesystem
+}
+
+// detectExt recognises the ext2/3/4 superblock, telling the versions
+// apart by their feature flags in the same way as blkid
+func detectExt(buf []byte) (string, bool) {
+	sb := ext4SuperblockOffset
+	if len(buf) < sb+0x64 || binary.LittleEndian.Uint16(buf[sb+0x38:]) != 0xef53 {
+		return "", false
+	}
+	compat := binary.LittleEndian.Uint32(buf[sb+0x5c:])
+	incompat := binary.LittleEndian.Uint32(buf[sb+0x60:])
+	switch {
+	case incompat&(extIncompatExtents|extIncompat64Bit|extIncompatFlexBG) != 0:
+		return "ext4", true
+	case compat&extCompatHasJournal != 0:
+		return "ext3", true
+	default:
+		return "ext2", true
+	}
+}
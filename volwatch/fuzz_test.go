@@ -0,0 +1,74 @@
+package volwatch
+
+// The fuzz targets run over their seed corpus, including the inputs in
+// testdata/fuzz, as part of the normal test suite. To fuzz with
+// generated inputs, name a single target, e.g.
+//
+//	go test ./volwatch -run '^$' -fuzz FuzzEnumerateVolumes -fuzztime 1m
+//
+// Failing inputs are written to testdata/fuzz and should be committed
+// once fixed so they are rerun as regression tests.
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func FuzzEnumerateVolumes(f *testing.F) {
+	for _, seed := range []string{
+		"",
+		"virtio-vol-aaaaa",
+		"virtio-vol-aaaaa/ata-QEMU_HARDDISK/virtio-vol-bbbbb",
+		"vol-\x00\x00\x00\x00\x00",
+		"virtio-vol-aaaaa-part1",
+		strings.Repeat("vol-", 1000) + "aaaaa",
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// Directory entry names cannot contain a path separator, so
+		// use it to split the input into several entries
+		var dirents []os.DirEntry
+		for _, name := range bytes.Split(data, []byte("/")) {
+			dirents = append(dirents, fakeFile(string(name)))
+		}
+		result, stale := enumerateVolumes("", dirents, defaultWatcherConfig())
+		if len(result) > len(dirents) {
+			t.Errorf("Got %d volumes from %d entries", len(result), len(dirents))
+		}
+		for _, vol := range result {
+			if !volRe.MatchString(vol) {
+				t.Errorf("Volume %q does not match %s", vol, volRe)
+			}
+		}
+		if len(stale) != 0 {
+			t.Errorf("Expected no stale volumes, got %q", stale)
+		}
+	})
+}
+
+func FuzzValidateVolumeID(f *testing.F) {
+	for _, seed := range []string{
+		"",
+		"vol-12345",
+		"vol-1/../../sda",
+		"vol-\x00\x00\x00\x00\x00",
+		"virtio-vol-12345",
+		strings.Repeat("a", 1000) + "vol-12345",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, id string) {
+		if ValidateVolumeID(id) != nil {
+			return
+		}
+		if !volRe.MatchString(id) {
+			t.Errorf("Valid ID %q does not match %s", id, volRe)
+		}
+		if strings.ContainsAny(id, `/\`) || strings.Contains(id, "..") {
+			t.Errorf("Valid ID %q could escape the device directory", id)
+		}
+	})
+}
@@ -0,0 +1,59 @@
+package volwatch
+
+import "github.com/fsnotify/fsnotify"
+
+// WatchBackend is the filesystem notification API used by VolumeWatcher,
+// letting tests substitute a fake for fsnotify with WithWatchBackend.
+// Backends that can also list their watches should provide a
+// WatchList() []string method, which WatchedPaths reports.
+type WatchBackend interface {
+	AddWatch(path string) error
+	RemoveWatch(path string) error
+	Events() <-chan fsnotify.Event
+	Errors() <-chan error
+	Close() error
+}
+
+// watchLister is implemented by WatchBackends that can list the paths
+// they are watching
+type watchLister interface {
+	WatchList() []string
+}
+
+// fsnotifyBackend adapts an fsnotify Watcher to the WatchBackend
+// interface
+type fsnotifyBackend struct {
+	watcher *fsnotify.Watcher
+}
+
+func newFsnotifyBackend() (WatchBackend, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	return &fsnotifyBackend{watcher}, nil
+}
+
+func (b *fsnotifyBackend) AddWatch(path string) error {
+	return b.watcher.Add(path)
+}
+
+func (b *fsnotifyBackend) RemoveWatch(path string) error {
+	return b.watcher.Remove(path)
+}
+
+func (b *fsnotifyBackend) Close() error {
+	return b.watcher.Close()
+}
+
+func (b *fsnotifyBackend) WatchList() []string {
+	return b.watcher.WatchList()
+}
+
+func (b *fsnotifyBackend) Events() <-chan fsnotify.Event {
+	return b.watcher.Events
+}
+
+func (b *fsnotifyBackend) Errors() <-chan error {
+	return b.watcher.Errors
+}
@@ -0,0 +1,275 @@
+package volwatch
+
+import (
+	"regexp"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Option configures a VolumeWatcher at construction time
+type Option func(*watcherConfig)
+
+// watcherConfig holds the settings of a VolumeWatcher, built from the
+// defaults and the Options given to its constructor
+type watcherConfig struct {
+	volRe    *regexp.Regexp
+	debounce time.Duration
+	deltas   bool
+
+	limiter     *rate.Limiter
+	eventBuffer int
+
+	reconnectMin time.Duration
+	reconnectMax time.Duration
+
+	maxRestarts        int
+	maxTransientErrors int
+	backend            Backend
+	notifier           WatchBackend
+	newNotifier        func() (WatchBackend, error)
+	dirReader          DirReader
+
+	pollInterval      time.Duration
+	reconcileInterval time.Duration
+
+	validateSymlinks bool
+	followSymlinks   bool
+
+	cacheTTL time.Duration
+
+	scsiRescan  bool
+	sysBlockDir string
+}
+
+// defaultWatcherConfig gives the settings of a watcher created without
+// any options: the default volume regex, full snapshots on the Events
+// channel with no debounce, rate limit or buffering, and an fsnotify
+// watch of the directory
+func defaultWatcherConfig() watcherConfig {
+	return watcherConfig{
+		volRe:              volRe,
+		reconnectMin:       defaultReconnectMin,
+		reconnectMax:       defaultReconnectMax,
+		maxTransientErrors: defaultMaxTransientErrors,
+		newNotifier:        newFsnotifyBackend,
+		dirReader:          osDirReader{},
+		sysBlockDir:        DefaultSysBlockDir,
+	}
+}
+
+const (
+	defaultReconnectMin       = 500 * time.Millisecond
+	defaultReconnectMax       = 30 * time.Second
+	defaultMaxTransientErrors = 5
+)
+
+func buildWatcherConfig(opts []Option) watcherConfig {
+	o := defaultWatcherConfig()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// DefaultVolumeRegex returns the pattern used to recognise Brightbox
+// volume IDs within the device directory
+func DefaultVolumeRegex() *regexp.Regexp {
+	return volRe
+}
+
+// WithVolumeRegex replaces the pattern used to extract volume IDs from
+// device directory entries.
+// The regex is applied with FindString, so the whole of the leftmost
+// match becomes the volume ID. Anchor the pattern (e.g. with `$`) to
+// avoid matching part of a longer name.
+func WithVolumeRegex(re *regexp.Regexp) Option {
+	return func(o *watcherConfig) {
+		if re != nil {
+			o.volRe = re
+		}
+	}
+}
+
+// WithDebounceDuration delays notification of volume changes until no
+// further filesystem events have arrived for the duration d, collapsing
+// a burst of changes into a single event. A zero duration notifies
+// immediately.
+func WithDebounceDuration(d time.Duration) Option {
+	return func(o *watcherConfig) {
+		o.debounce = d
+	}
+}
+
+// WithDeltaEvents switches the watcher from posting full snapshots on
+// the Events channel to posting individual Create and Remove changes on
+// the DeltaEvents channel.
+func WithDeltaEvents() Option {
+	return func(o *watcherConfig) {
+		o.deltas = true
+	}
+}
+
+// WithReconnectBackoff sets the bounds of the exponential backoff used
+// while waiting for a removed base directory to reappear. The delay
+// starts at min and doubles on each attempt up to max.
+func WithReconnectBackoff(min, max time.Duration) Option {
+	return func(o *watcherConfig) {
+		if min > 0 {
+			o.reconnectMin = min
+		}
+		if max < o.reconnectMin {
+			max = o.reconnectMin
+		}
+		o.reconnectMax = max
+	}
+}
+
+// WithRateLimit gates notifications triggered by volume changes through
+// the supplied limiter. A change arriving when the limiter has no tokens
+// is deferred until one becomes available, and further changes in the
+// meantime are collapsed into that single deferred notification.
+func WithRateLimit(r *rate.Limiter) Option {
+	return func(o *watcherConfig) {
+		o.limiter = r
+	}
+}
+
+// WithEventBuffer sets the depth of the events channels so that bursts
+// can be absorbed without blocking the watcher. The default is
+// unbuffered.
+func WithEventBuffer(n int) Option {
+	return func(o *watcherConfig) {
+		if n >= 0 {
+			o.eventBuffer = n
+		}
+	}
+}
+
+// WithRestartOnPanic restarts the watch loop after a panic, up to max
+// times in a row without a notification being delivered in between.
+// Once the limit is reached the watcher cancels itself. Without this
+// option the watcher cancels on the first panic.
+func WithRestartOnPanic(max int) Option {
+	return func(o *watcherConfig) {
+		if max >= 0 {
+			o.maxRestarts = max
+		}
+	}
+}
+
+// WithMaxTransientErrors sets how many Transient notifier errors, as
+// sorted by ClassifyError, the watcher rides out before treating the next
+// as Fatal. The count starts again each time the notifier delivers an
+// event. Zero makes every error fatal. The default is 5.
+func WithMaxTransientErrors(n int) Option {
+	return func(o *watcherConfig) {
+		if n >= 0 {
+			o.maxTransientErrors = n
+		}
+	}
+}
+
+// WithValidateSymlinks skips volumes whose device symlink points at a
+// missing target, such as those left behind by a detached volume.
+// Skipped volumes are reported by StaleVolumes.
+func WithValidateSymlinks(validate bool) Option {
+	return func(o *watcherConfig) {
+		o.validateSymlinks = validate
+	}
+}
+
+// WithFollowSymlinks also watches the directory the watch directory
+// resolves to, for when the device directory is itself a managed
+// symlink. Not needed when the device directory is a real directory.
+func WithFollowSymlinks(follow bool) Option {
+	return func(o *watcherConfig) {
+		o.followSymlinks = follow
+	}
+}
+
+// WithPollingFallback reads the watch directory every interval when
+// filesystem notifications are unavailable, for instance because the
+// inotify limits have been reached, instead of cancelling the watcher.
+// Only changes to the volume list are posted while polling. Each tick
+// also retries notifications, and the watcher switches back to them as
+// soon as they work again. A zero interval disables the fallback.
+func WithPollingFallback(interval time.Duration) Option {
+	return func(o *watcherConfig) {
+		o.pollInterval = interval
+	}
+}
+
+// WithReconcileInterval rescans the watch directory every d on top of
+// filesystem notifications, as a safety net for any events the kernel
+// dropped. Only changes to the volume list are posted. A zero duration
+// disables the scan.
+func WithReconcileInterval(d time.Duration) Option {
+	return func(o *watcherConfig) {
+		o.reconcileInterval = d
+	}
+}
+
+// WithBackend replaces the fsnotify watch of the device directory with
+// another source of volume change notifications, such as a UdevBackend.
+// The directory is still read to find the current volumes each time the
+// backend signals a change.
+func WithBackend(b Backend) Option {
+	return func(o *watcherConfig) {
+		o.backend = b
+	}
+}
+
+// WithDirReader replaces os.ReadDir for reading the watch directory,
+// e.g. with a FakeDirReader from the testing package
+func WithDirReader(r DirReader) Option {
+	return func(o *watcherConfig) {
+		if r != nil {
+			o.dirReader = r
+		}
+	}
+}
+
+// WithCacheTTL makes ResolveDevicePath remember each volume's device for
+// d, or until the watcher sees the volume removed. A zero duration
+// disables the cache.
+func WithCacheTTL(d time.Duration) Option {
+	return func(o *watcherConfig) {
+		o.cacheTTL = d
+	}
+}
+
+// WithSCSIRescan makes the watcher ask the kernel to rescan the device of
+// each new volume that is a SCSI device, before reporting the volume, in
+// case the device appeared before all its properties were read.
+func WithSCSIRescan(enabled bool) Option {
+	return func(o *watcherConfig) {
+		o.scsiRescan = enabled
+	}
+}
+
+// withSysBlockDir substitutes the sysfs block directory used to find SCSI
+// devices to rescan
+func withSysBlockDir(dir string) Option {
+	return func(o *watcherConfig) {
+		o.sysBlockDir = dir
+	}
+}
+
+// withNotifierFactory substitutes the function creating the filesystem
+// notifier
+func withNotifierFactory(fn func() (WatchBackend, error)) Option {
+	return func(o *watcherConfig) {
+		o.newNotifier = fn
+	}
+}
+
+// WithWatchBackend replaces the fsnotify watch with b, e.g. a
+// FakeBackend from the testing package. Unlike WithBackend, the watcher
+// still watches the device directory and its parent through b and reacts
+// to the filesystem events b reports.
+func WithWatchBackend(b WatchBackend) Option {
+	return func(o *watcherConfig) {
+		o.notifier = b
+	}
+}
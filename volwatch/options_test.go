@@ -0,0 +1,99 @@
+package volwatch
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// sameConfig reports whether a and b have the same settings. The notifier
+// factories are functions and are not compared.
+func sameConfig(a, b watcherConfig) bool {
+	return a.volRe.String() == b.volRe.String() &&
+		a.debounce == b.debounce &&
+		a.deltas == b.deltas &&
+		a.limiter == b.limiter &&
+		a.eventBuffer == b.eventBuffer &&
+		a.reconnectMin == b.reconnectMin &&
+		a.reconnectMax == b.reconnectMax &&
+		a.maxRestarts == b.maxRestarts &&
+		a.maxTransientErrors == b.maxTransientErrors &&
+		a.backend == b.backend &&
+		a.notifier == b.notifier &&
+		a.dirReader == b.dirReader &&
+		a.pollInterval == b.pollInterval &&
+		a.reconcileInterval == b.reconcileInterval &&
+		a.cacheTTL == b.cacheTTL &&
+		a.validateSymlinks == b.validateSymlinks &&
+		a.followSymlinks == b.followSymlinks &&
+		a.scsiRescan == b.scsiRescan &&
+		a.sysBlockDir == b.sysBlockDir
+}
+
+func TestDefaultWatcherConfig(t *testing.T) {
+	o := defaultWatcherConfig()
+	if o.volRe != DefaultVolumeRegex() {
+		t.Errorf("Expected the default volume regex, got %s", o.volRe)
+	}
+	if o.deltas || o.debounce != 0 || o.limiter != nil || o.eventBuffer != 0 {
+		t.Errorf("Expected unbuffered snapshots without debounce or rate limit, got %+v", o)
+	}
+	if o.reconnectMin != defaultReconnectMin || o.reconnectMax != defaultReconnectMax {
+		t.Errorf("Expected default reconnect backoff, got %s to %s", o.reconnectMin, o.reconnectMax)
+	}
+	if o.backend != nil || o.notifier != nil || o.newNotifier == nil {
+		t.Error("Expected an fsnotify watch by default")
+	}
+	if _, ok := o.dirReader.(osDirReader); !ok {
+		t.Errorf("Expected os.ReadDir by default, got %T", o.dirReader)
+	}
+	if !sameConfig(buildWatcherConfig(nil), o) {
+		t.Errorf("Expected no options to give the defaults, got %+v", buildWatcherConfig(nil))
+	}
+}
+
+func TestNewWatchDirDefaults(t *testing.T) {
+	watchDir := filepath.Join(t.TempDir(), "by-id")
+	watcher := NewWatchDir(watchDir)
+	defer watcher.Cancel()
+	if !sameConfig(watcher.opts, defaultWatcherConfig()) {
+		t.Errorf("Expected default settings, got %+v", watcher.opts)
+	}
+	if watcher.WatchDir() != watchDir {
+		t.Errorf("Expected to watch %s, got %s", watchDir, watcher.WatchDir())
+	}
+	if watcher.cache != nil {
+		t.Error("Expected no device path cache by default")
+	}
+}
+
+func TestNewWatchDirOptions(t *testing.T) {
+	watcher := NewWatchDir(filepath.Join(t.TempDir(), "by-id"),
+		WithDeltaEvents(),
+		WithDebounceDuration(time.Second),
+		WithEventBuffer(4),
+		WithReconnectBackoff(time.Second, time.Minute),
+	)
+	defer watcher.Cancel()
+	o := watcher.opts
+	if !o.deltas || o.debounce != time.Second || o.eventBuffer != 4 || o.reconnectMin != time.Second || o.reconnectMax != time.Minute {
+		t.Errorf("Options not applied: %+v", o)
+	}
+	if cap(watcher.deltas) != 4 {
+		t.Errorf("Expected delta channel buffer of 4, got %d", cap(watcher.deltas))
+	}
+}
+
+func TestNewWatcherWithoutOptions(t *testing.T) {
+	watcher := NewWatcher()
+	if watcher == nil {
+		t.Skip("File watching unavailable")
+	}
+	defer watcher.Cancel()
+	if watcher.WatchDir() != DefaultDeviceDir {
+		t.Errorf("Expected to watch %s, got %s", DefaultDeviceDir, watcher.WatchDir())
+	}
+	if !sameConfig(watcher.opts, defaultWatcherConfig()) {
+		t.Errorf("Expected default settings, got %+v", watcher.opts)
+	}
+}
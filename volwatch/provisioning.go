@@ -0,0 +1,53 @@
+package volwatch
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// thinProvisioningModes are the SCSI disk provisioning modes in which
+// the device can be told to release unused blocks
+var thinProvisioningModes = map[string]bool{
+	"unmap":        true,
+	"writesame_16": true,
+	"writesame_10": true,
+}
+
+// DetectThinProvisioning reports whether the block device at devpath is
+// thin provisioned, so its backing store may hold fewer blocks than its
+// size suggests and can run out of space before the device fills.
+// SCSI disks report their provisioning mode directly. Other devices,
+// such as virtio disks, are taken to be thin provisioned if they accept
+// discard requests.
+func DetectThinProvisioning(devpath string) (bool, error) {
+	return DetectThinProvisioningIn(DefaultSysBlockDir, devpath)
+}
+
+// DetectThinProvisioningIn is DetectThinProvisioning for the sysfs block
+// directory sysBlockDir
+func DetectThinProvisioningIn(sysBlockDir string, devpath string) (bool, error) {
+	deviceDir := filepath.Join(sysBlockDir, filepath.Base(devpath))
+	modes, err := filepath.Glob(filepath.Join(deviceDir, "device", "scsi_disk", "*", "provisioning_mode"))
+	if err != nil {
+		return false, err
+	}
+	if len(modes) > 0 {
+		mode, err := os.ReadFile(modes[0])
+		if err != nil {
+			return false, err
+		}
+		return thinProvisioningModes[strings.TrimSpace(string(mode))], nil
+	}
+	contents, err := os.ReadFile(filepath.Join(deviceDir, "queue", "discard_max_bytes"))
+	if err != nil {
+		return false, err
+	}
+	discardMax, err := strconv.ParseUint(strings.TrimSpace(string(contents)), 10, 64)
+	if err != nil {
+		return false, fmt.Errorf("reading discard limit of %s: %w", deviceDir, err)
+	}
+	return discardMax > 0, nil
+}
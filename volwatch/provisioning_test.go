@@ -0,0 +1,50 @@
+package volwatch
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeSysBlockFile writes contents to the file name under the sysfs
+// directory of dev in sysBlockDir
+func fakeSysBlockFile(t *testing.T, sysBlockDir string, dev string, name string, contents string) {
+	t.Helper()
+	path := filepath.Join(sysBlockDir, dev, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDetectThinProvisioning(t *testing.T) {
+	sysBlock := t.TempDir()
+	fakeSysBlockFile(t, sysBlock, "vdb", "queue/discard_max_bytes", "2147483136\n")
+	fakeSysBlockFile(t, sysBlock, "vdc", "queue/discard_max_bytes", "0\n")
+	fakeSysBlockFile(t, sysBlock, "sda", "device/scsi_disk/0:0:0:0/provisioning_mode", "unmap\n")
+	fakeSysBlockFile(t, sysBlock, "sda", "queue/discard_max_bytes", "0\n")
+	fakeSysBlockFile(t, sysBlock, "sdb", "device/scsi_disk/0:0:1:0/provisioning_mode", "full\n")
+	fakeSysBlockFile(t, sysBlock, "sdb", "queue/discard_max_bytes", "4096\n")
+	for dev, expected := range map[string]bool{"vdb": true, "vdc": false, "sda": true, "sdb": false} {
+		thin, err := DetectThinProvisioningIn(sysBlock, "/dev/"+dev)
+		if err != nil {
+			t.Errorf("%s: %s", dev, err)
+		} else if thin != expected {
+			t.Errorf("Expected %s thin provisioned %v, got %v", dev, expected, thin)
+		}
+	}
+}
+
+func TestDetectThinProvisioningErrors(t *testing.T) {
+	sysBlock := t.TempDir()
+	if _, err := DetectThinProvisioningIn(sysBlock, "/dev/vdb"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected a missing device to be reported, got %v", err)
+	}
+	fakeSysBlockFile(t, sysBlock, "vdc", "queue/discard_max_bytes", "lots\n")
+	if _, err := DetectThinProvisioningIn(sysBlock, "/dev/vdc"); err == nil {
+		t.Error("Expected an unreadable discard limit to be reported")
+	}
+}
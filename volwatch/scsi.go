@@ -0,0 +1,36 @@
+package volwatch
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// RescanSCSIDevice asks the kernel to rescan the block device at devpath
+// if it is a SCSI device, so properties such as its size and
+// provisioning mode are read again. It reports whether the device was
+// SCSI and so rescanned.
+func RescanSCSIDevice(devpath string) (bool, error) {
+	return RescanSCSIDeviceIn(DefaultSysBlockDir, devpath)
+}
+
+// RescanSCSIDeviceIn is RescanSCSIDevice for the sysfs block directory
+// sysBlockDir
+func RescanSCSIDeviceIn(sysBlockDir string, devpath string) (bool, error) {
+	deviceDir := filepath.Join(sysBlockDir, filepath.Base(devpath), "device")
+	// Only SCSI devices report a peripheral device type
+	if _, err := os.Stat(filepath.Join(deviceDir, "type")); errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	rescan, err := os.OpenFile(filepath.Join(deviceDir, "rescan"), os.O_WRONLY, 0)
+	if err != nil {
+		return true, err
+	}
+	if _, err := rescan.WriteString("1"); err != nil {
+		rescan.Close()
+		return true, err
+	}
+	return true, rescan.Close()
+}
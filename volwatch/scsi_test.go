@@ -0,0 +1,90 @@
+package volwatch
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRescanSCSIDevice(t *testing.T) {
+	sysBlock := t.TempDir()
+	fakeSysBlockFile(t, sysBlock, "sda", "device/type", "0\n")
+	fakeSysBlockFile(t, sysBlock, "sda", "device/rescan", "")
+	fakeSysBlockFile(t, sysBlock, "sdb", "device/type", "0\n")
+	fakeSysBlockFile(t, sysBlock, "vdb", "device/vendor", "0x1af4\n")
+	rescanned, err := RescanSCSIDeviceIn(sysBlock, "/dev/sda")
+	if err != nil || !rescanned {
+		t.Fatalf("Expected sda to be rescanned, got %t, %v", rescanned, err)
+	}
+	if contents, _ := os.ReadFile(filepath.Join(sysBlock, "sda", "device", "rescan")); string(contents) != "1" {
+		t.Errorf("Expected 1 written to rescan, got %q", contents)
+	}
+	if rescanned, err := RescanSCSIDeviceIn(sysBlock, "/dev/vdb"); err != nil || rescanned {
+		t.Errorf("Expected a virtio device to be left alone, got %t, %v", rescanned, err)
+	}
+	if _, err := RescanSCSIDeviceIn(sysBlock, "/dev/sdb"); err == nil {
+		t.Error("Expected a SCSI device without a rescan file to be reported")
+	}
+	if _, err := os.Stat(filepath.Join(sysBlock, "sdb", "device", "rescan")); err == nil {
+		t.Error("Expected no rescan file to be created")
+	}
+}
+
+func TestWatchSCSIRescan(t *testing.T) {
+	baseDir := t.TempDir()
+	watchDir := filepath.Join(baseDir, "by-id")
+	sysBlock := filepath.Join(baseDir, "sys", "block")
+	os.Mkdir(watchDir, 0755)
+	for _, dev := range []string{"sda", "sdb"} {
+		touch(t, baseDir, dev)
+		fakeSysBlockFile(t, sysBlock, dev, "device/type", "0\n")
+		fakeSysBlockFile(t, sysBlock, dev, "device/rescan", "")
+	}
+	if err := os.Symlink("../sda", filepath.Join(watchDir, "virtio-vol-aaaaa")); err != nil {
+		t.Fatal(err)
+	}
+	watch := NewWatchDir(watchDir, WithSCSIRescan(true), withSysBlockDir(sysBlock))
+	defer watch.Cancel()
+	awaitEvent(t, watch, "vol-aaaaa")
+	rescans := func(dev string) string {
+		contents, err := os.ReadFile(filepath.Join(sysBlock, dev, "device", "rescan"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(contents)
+	}
+	if rescans("sda") != "1" {
+		t.Errorf("Expected sda to be rescanned, got %q", rescans("sda"))
+	}
+	// Only new volumes are rescanned
+	os.WriteFile(filepath.Join(sysBlock, "sda", "device", "rescan"), nil, 0644)
+	if err := os.Symlink("../sdb", filepath.Join(watchDir, "virtio-vol-bbbbb")); err != nil {
+		t.Fatal(err)
+	}
+	awaitEvent(t, watch, "vol-aaaaa", "vol-bbbbb")
+	if rescans("sdb") != "1" {
+		t.Errorf("Expected sdb to be rescanned, got %q", rescans("sdb"))
+	}
+	if rescans("sda") != "" {
+		t.Errorf("Expected sda not to be rescanned again, got %q", rescans("sda"))
+	}
+}
+
+func TestWatchWithoutSCSIRescan(t *testing.T) {
+	baseDir := t.TempDir()
+	watchDir := filepath.Join(baseDir, "by-id")
+	sysBlock := filepath.Join(baseDir, "sys", "block")
+	os.Mkdir(watchDir, 0755)
+	touch(t, baseDir, "sda")
+	fakeSysBlockFile(t, sysBlock, "sda", "device/type", "0\n")
+	fakeSysBlockFile(t, sysBlock, "sda", "device/rescan", "")
+	if err := os.Symlink("../sda", filepath.Join(watchDir, "virtio-vol-aaaaa")); err != nil {
+		t.Fatal(err)
+	}
+	watch := NewWatchDir(watchDir, withSysBlockDir(sysBlock))
+	defer watch.Cancel()
+	awaitEvent(t, watch, "vol-aaaaa")
+	if contents, _ := os.ReadFile(filepath.Join(sysBlock, "sda", "device", "rescan")); len(contents) != 0 {
+		t.Errorf("Expected no rescan by default, got %q", contents)
+	}
+}
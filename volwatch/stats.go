@@ -0,0 +1,57 @@
+package volwatch
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// sectorSize is the unit of the sector counts in a block device's stat
+// file, whatever the device's own sector size
+const sectorSize = 512
+
+// BlockDeviceStats holds the I/O a block device has completed since it
+// appeared, as counted by the kernel
+type BlockDeviceStats struct {
+	ReadIOs    uint64
+	WriteIOs   uint64
+	ReadBytes  uint64
+	WriteBytes uint64
+}
+
+// CollectStats reads the I/O statistics of the block device devname,
+// e.g. vdb, from sysfs
+func CollectStats(devname string) (BlockDeviceStats, error) {
+	return CollectStatsIn(DefaultSysBlockDir, devname)
+}
+
+// CollectStatsIn is CollectStats for the sysfs block directory
+// sysBlockDir
+func CollectStatsIn(sysBlockDir string, devname string) (BlockDeviceStats, error) {
+	path := filepath.Join(sysBlockDir, filepath.Base(devname), "stat")
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return BlockDeviceStats{}, err
+	}
+	// Fields are read I/Os, merges, sectors and ticks, then the same for
+	// writes, followed by others that vary between kernel versions
+	fields := strings.Fields(string(contents))
+	if len(fields) < 7 {
+		return BlockDeviceStats{}, fmt.Errorf("reading %s: expected at least 7 fields, got %d", path, len(fields))
+	}
+	var values [7]uint64
+	for _, i := range []int{0, 2, 4, 6} {
+		values[i], err = strconv.ParseUint(fields[i], 10, 64)
+		if err != nil {
+			return BlockDeviceStats{}, fmt.Errorf("reading %s: %w", path, err)
+		}
+	}
+	return BlockDeviceStats{
+		ReadIOs:    values[0],
+		ReadBytes:  values[2] * sectorSize,
+		WriteIOs:   values[4],
+		WriteBytes: values[6] * sectorSize,
+	}, nil
+}
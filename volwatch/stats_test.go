@@ -0,0 +1,36 @@
+package volwatch
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestCollectStats(t *testing.T) {
+	sysBlock := t.TempDir()
+	fakeSysBlockFile(t, sysBlock, "vdb", "stat",
+		"    1200       30    96000      450      800       10    64000      900        0     1100     1350        0        0        0        0\n")
+	stats, err := CollectStatsIn(sysBlock, "/dev/vdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := BlockDeviceStats{ReadIOs: 1200, WriteIOs: 800, ReadBytes: 96000 * 512, WriteBytes: 64000 * 512}
+	if stats != expected {
+		t.Errorf("Expected %+v, got %+v", expected, stats)
+	}
+}
+
+func TestCollectStatsErrors(t *testing.T) {
+	sysBlock := t.TempDir()
+	if _, err := CollectStatsIn(sysBlock, "vdb"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected a missing device to be reported, got %v", err)
+	}
+	fakeSysBlockFile(t, sysBlock, "vdc", "stat", "1 2 3\n")
+	if _, err := CollectStatsIn(sysBlock, "vdc"); err == nil {
+		t.Error("Expected a short stat file to be reported")
+	}
+	fakeSysBlockFile(t, sysBlock, "vdd", "stat", "1 0 x 0 1 0 8\n")
+	if _, err := CollectStatsIn(sysBlock, "vdd"); err == nil {
+		t.Error("Expected a malformed stat file to be reported")
+	}
+}
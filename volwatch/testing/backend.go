@@ -0,0 +1,135 @@
+package testing
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/brightbox/brightbox-volume-device-plugin/volwatch"
+	"github.com/fsnotify/fsnotify"
+	"golang.org/x/exp/slices"
+)
+
+// FakeBackend is a volwatch.WatchBackend whose filesystem events and
+// errors are supplied by the test through SendEvent and SendError, for
+// use with volwatch.WithWatchBackend. The watcher still reads the watch
+// directory itself.
+//
+// Create a FakeBackend by calling the NewFakeBackend function
+type FakeBackend struct {
+	events    chan fsnotify.Event
+	errors    chan error
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mutex    sync.Mutex
+	watches  []string
+	addError map[string]error
+}
+
+var _ volwatch.WatchBackend = (*FakeBackend)(nil)
+
+// NewFakeBackend creates a FakeBackend watching nothing
+func NewFakeBackend() *FakeBackend {
+	return &FakeBackend{
+		events:   make(chan fsnotify.Event),
+		errors:   make(chan error),
+		closed:   make(chan struct{}),
+		addError: make(map[string]error),
+	}
+}
+
+// SendEvent posts event, blocking until the watcher reads it. Returns
+// false if the backend is closed first.
+func (b *FakeBackend) SendEvent(event fsnotify.Event) bool {
+	select {
+	case b.events <- event:
+		return true
+	case <-b.closed:
+		return false
+	}
+}
+
+// SendError posts err, blocking until the watcher reads it. Returns
+// false if the backend is closed first.
+func (b *FakeBackend) SendError(err error) bool {
+	select {
+	case b.errors <- err:
+		return true
+	case <-b.closed:
+		return false
+	}
+}
+
+// FailAddWatch makes AddWatch return err for path, e.g. to simulate a
+// missing directory. A nil err lets path be watched again.
+func (b *FakeBackend) FailAddWatch(path string, err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err == nil {
+		delete(b.addError, path)
+	} else {
+		b.addError[path] = err
+	}
+}
+
+// AddWatch starts watching path, unless FailAddWatch has been called
+// for it
+func (b *FakeBackend) AddWatch(path string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err := b.addError[path]; err != nil {
+		return err
+	}
+	if !slices.Contains(b.watches, path) {
+		b.watches = append(b.watches, path)
+	}
+	return nil
+}
+
+// RemoveWatch stops watching path
+func (b *FakeBackend) RemoveWatch(path string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	i := slices.Index(b.watches, path)
+	if i < 0 {
+		return fmt.Errorf("can't remove non-existent watch: %s", path)
+	}
+	b.watches = slices.Delete(b.watches, i, i+1)
+	return nil
+}
+
+// WatchList returns the paths being watched, sorted
+func (b *FakeBackend) WatchList() []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	result := slices.Clone(b.watches)
+	sort.Strings(result)
+	return result
+}
+
+// Events returns the channel events are posted to by SendEvent
+func (b *FakeBackend) Events() <-chan fsnotify.Event {
+	return b.events
+}
+
+// Errors returns the channel errors are posted to by SendError
+func (b *FakeBackend) Errors() <-chan error {
+	return b.errors
+}
+
+// Close stops the backend. Events and errors not yet sent are dropped.
+func (b *FakeBackend) Close() error {
+	b.closeOnce.Do(func() { close(b.closed) })
+	return nil
+}
+
+// Closed reports whether Close has been called
+func (b *FakeBackend) Closed() bool {
+	select {
+	case <-b.closed:
+		return true
+	default:
+		return false
+	}
+}
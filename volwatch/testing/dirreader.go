@@ -0,0 +1,98 @@
+package testing
+
+import (
+	"io/fs"
+	"os"
+	"sync"
+
+	"github.com/brightbox/brightbox-volume-device-plugin/volwatch"
+	"golang.org/x/exp/slices"
+)
+
+// FakeDirReader is a volwatch.DirReader returning the entries or errors
+// set by the test, for use with volwatch.WithDirReader. Reading a
+// directory with neither gives an error wrapping fs.ErrNotExist.
+//
+// Create a FakeDirReader by calling the NewFakeDirReader function
+type FakeDirReader struct {
+	mutex   sync.Mutex
+	entries map[string][]os.DirEntry
+	errors  map[string]error
+	reads   int
+}
+
+var _ volwatch.DirReader = (*FakeDirReader)(nil)
+
+// NewFakeDirReader creates a FakeDirReader with no directories
+func NewFakeDirReader() *FakeDirReader {
+	return &FakeDirReader{
+		entries: make(map[string][]os.DirEntry),
+		errors:  make(map[string]error),
+	}
+}
+
+// SetEntries makes dir exist, holding a symlink for each of names, and
+// clears any error set for it
+func (r *FakeDirReader) SetEntries(dir string, names ...string) {
+	entries := make([]os.DirEntry, len(names))
+	for i, name := range names {
+		entries[i] = fakeDirEntry{name: name, mode: fs.ModeSymlink}
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.entries[dir] = entries
+	delete(r.errors, dir)
+}
+
+// SetError makes reading dir fail with err. A nil err clears it.
+func (r *FakeDirReader) SetError(dir string, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err == nil {
+		delete(r.errors, dir)
+	} else {
+		r.errors[dir] = err
+	}
+}
+
+// Remove makes dir missing again
+func (r *FakeDirReader) Remove(dir string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.entries, dir)
+	delete(r.errors, dir)
+}
+
+// Reads returns the number of times ReadDir has been called
+func (r *FakeDirReader) Reads() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.reads
+}
+
+// ReadDir returns the entries or error set for dir
+func (r *FakeDirReader) ReadDir(dir string) ([]os.DirEntry, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.reads++
+	if err := r.errors[dir]; err != nil {
+		return nil, &fs.PathError{Op: "open", Path: dir, Err: err}
+	}
+	entries, ok := r.entries[dir]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: dir, Err: fs.ErrNotExist}
+	}
+	return slices.Clone(entries), nil
+}
+
+// fakeDirEntry is a directory entry with a name and type and nothing
+// else
+type fakeDirEntry struct {
+	name string
+	mode fs.FileMode
+}
+
+func (e fakeDirEntry) Name() string               { return e.name }
+func (e fakeDirEntry) IsDir() bool                { return e.mode.IsDir() }
+func (e fakeDirEntry) Type() fs.FileMode          { return e.mode.Type() }
+func (e fakeDirEntry) Info() (fs.FileInfo, error) { return nil, fs.ErrNotExist }
@@ -0,0 +1,142 @@
+// Package testing provides a fake volwatch.Watcher, letting tests drive
+// the consumers of volume events without a device directory, and a fake
+// volwatch.WatchBackend and volwatch.DirReader, letting tests drive a
+// VolumeWatcher without a real filesystem.
+package testing
+
+import (
+	"context"
+	"sync"
+
+	"github.com/brightbox/brightbox-volume-device-plugin/volwatch"
+	"golang.org/x/exp/slices"
+)
+
+// FakeWatcher is a volwatch.Watcher whose events are supplied by the
+// test through SendEvent
+//
+// Create a FakeWatcher by calling the NewFakeWatcher function
+type FakeWatcher struct {
+	events chan volwatch.Event
+	deltas chan volwatch.DeltaEvent
+	errors chan error
+	ctx    context.Context
+	cancel context.CancelFunc
+	delta  bool
+
+	mutex   sync.Mutex
+	volumes []string
+	stale   []string
+}
+
+var _ volwatch.Watcher = (*FakeWatcher)(nil)
+
+// NewFakeWatcher creates a FakeWatcher with no volumes. If deltas is set
+// each change is posted to the DeltaEvents channel, as by a watcher
+// created WithDeltaEvents, otherwise volume lists are posted to the
+// Events channel.
+func NewFakeWatcher(deltas bool) *FakeWatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &FakeWatcher{
+		events:  make(chan volwatch.Event),
+		deltas:  make(chan volwatch.DeltaEvent),
+		errors:  make(chan error, errorBufferSize),
+		ctx:     ctx,
+		cancel:  cancel,
+		delta:   deltas,
+		volumes: []string{},
+	}
+}
+
+// SendEvent makes volumes the current volume list and posts the event,
+// or the changes from the previous list, blocking until each is read or
+// the watcher is cancelled
+func (fw *FakeWatcher) SendEvent(volumes []string) {
+	volumes = slices.Clone(volumes)
+	fw.mutex.Lock()
+	previous := fw.volumes
+	fw.volumes = volumes
+	fw.mutex.Unlock()
+	if !fw.delta {
+		select {
+		case fw.events <- volwatch.Event(volumes):
+		case <-fw.ctx.Done():
+		}
+		return
+	}
+	for _, delta := range volwatch.DiffVolumes(previous, volumes) {
+		select {
+		case fw.deltas <- delta:
+		case <-fw.ctx.Done():
+			return
+		}
+	}
+}
+
+// SendError posts err to the Errors channel, dropping it if the buffer
+// is full
+func (fw *FakeWatcher) SendError(err error) {
+	select {
+	case fw.errors <- err:
+	default:
+	}
+}
+
+// SetStaleVolumes sets the volumes returned by StaleVolumes
+func (fw *FakeWatcher) SetStaleVolumes(stale []string) {
+	fw.mutex.Lock()
+	defer fw.mutex.Unlock()
+	fw.stale = slices.Clone(stale)
+}
+
+// FakeCancel stops the watcher as if it had failed or been shut down,
+// closing the Done channel
+func (fw *FakeWatcher) FakeCancel() {
+	fw.cancel()
+}
+
+// Events returns the channel volume lists are posted to
+func (fw *FakeWatcher) Events() <-chan volwatch.Event {
+	return fw.events
+}
+
+// DeltaEvents returns the channel individual volume changes are posted to
+func (fw *FakeWatcher) DeltaEvents() <-chan volwatch.DeltaEvent {
+	return fw.deltas
+}
+
+// Errors returns the channel errors are posted to by SendError
+func (fw *FakeWatcher) Errors() <-chan error {
+	return fw.errors
+}
+
+// ListVolumes returns the volume list last passed to SendEvent
+func (fw *FakeWatcher) ListVolumes() ([]string, error) {
+	fw.mutex.Lock()
+	defer fw.mutex.Unlock()
+	return slices.Clone(fw.volumes), nil
+}
+
+// StaleVolumes returns the volumes last passed to SetStaleVolumes
+func (fw *FakeWatcher) StaleVolumes() []string {
+	fw.mutex.Lock()
+	defer fw.mutex.Unlock()
+	return slices.Clone(fw.stale)
+}
+
+// Done returns a channel that is closed when the watcher has been cancelled
+func (fw *FakeWatcher) Done() <-chan struct{} {
+	return fw.ctx.Done()
+}
+
+// Cancel stops the watcher
+func (fw *FakeWatcher) Cancel() {
+	fw.cancel()
+}
+
+// Err returns a Cancelled error when the watcher has been stopped
+func (fw *FakeWatcher) Err() error {
+	return fw.ctx.Err()
+}
+
+const errorBufferSize = 8
@@ -0,0 +1,198 @@
+package volwatch_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/brightbox/brightbox-volume-device-plugin/volwatch"
+	volwatchtesting "github.com/brightbox/brightbox-volume-device-plugin/volwatch/testing"
+	"github.com/fsnotify/fsnotify"
+	"golang.org/x/exp/slices"
+)
+
+// newFakeBackendWatcher watches a temporary device directory through a
+// FakeBackend, returning once the initial volume list has been read
+func newFakeBackendWatcher(t *testing.T, opts ...volwatch.Option) (*volwatch.VolumeWatcher, *volwatchtesting.FakeBackend) {
+	t.Helper()
+	watchDir := filepath.Join(t.TempDir(), "by-id")
+	if err := os.Mkdir(watchDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	backend := volwatchtesting.NewFakeBackend()
+	watch := volwatch.NewWatchDir(watchDir, append(opts, volwatch.WithWatchBackend(backend))...)
+	t.Cleanup(watch.Cancel)
+	nextVolumes(t, watch)
+	return watch, backend
+}
+
+func nextVolumes(t *testing.T, watch *volwatch.VolumeWatcher) []string {
+	t.Helper()
+	select {
+	case event := <-watch.Events():
+		return event.Volumes()
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for event")
+	}
+	return nil
+}
+
+// createVolume adds a volume symlink to the watch directory and reports
+// its creation through the backend
+func createVolume(t *testing.T, watch *volwatch.VolumeWatcher, backend *volwatchtesting.FakeBackend, id string) {
+	t.Helper()
+	path := filepath.Join(watch.WatchDir(), "virtio-"+id)
+	if err := os.Symlink("../../vdb", path); err != nil {
+		t.Fatal(err)
+	}
+	backend.SendEvent(fsnotify.Event{Name: path, Op: fsnotify.Create})
+}
+
+func TestFakeBackendEvents(t *testing.T) {
+	watch, backend := newFakeBackendWatcher(t)
+	createVolume(t, watch, backend, "vol-aaaaa")
+	if volumes := nextVolumes(t, watch); !slices.Equal(volumes, []string{"vol-aaaaa"}) {
+		t.Errorf("Expected [vol-aaaaa], got %v", volumes)
+	}
+}
+
+func TestFakeBackendWatchedPaths(t *testing.T) {
+	watch, _ := newFakeBackendWatcher(t)
+	expected := []string{filepath.Dir(watch.WatchDir()), watch.WatchDir()}
+	if paths := watch.WatchedPaths(); !slices.Equal(paths, expected) {
+		t.Errorf("Expected %v, got %v", expected, paths)
+	}
+	if err := watch.HealthCheck(); err != nil {
+		t.Errorf("Expected healthy watcher, got %v", err)
+	}
+}
+
+func TestFakeBackendClosedOnCancel(t *testing.T) {
+	watch, backend := newFakeBackendWatcher(t)
+	watch.Cancel()
+	if !backend.Closed() {
+		t.Error("Expected the backend to be closed")
+	}
+}
+
+func TestFakeBackendReconnect(t *testing.T) {
+	watch, backend := newFakeBackendWatcher(t,
+		volwatch.WithReconnectBackoff(time.Millisecond, 10*time.Millisecond),
+	)
+	baseDir := filepath.Dir(watch.WatchDir())
+	backend.FailAddWatch(baseDir, os.ErrNotExist)
+	backend.RemoveWatch(baseDir)
+	backend.SendEvent(fsnotify.Event{Name: baseDir, Op: fsnotify.Remove})
+	for watch.State() != volwatch.Reconnecting {
+		time.Sleep(time.Millisecond)
+	}
+	// The next retry restores the watch
+	backend.FailAddWatch(baseDir, nil)
+	nextVolumes(t, watch)
+	if state := watch.State(); state != volwatch.Watching {
+		t.Errorf("Expected Watching, got %s", state)
+	}
+}
+
+func TestWatchTransientErrorRecovers(t *testing.T) {
+	watch, backend := newFakeBackendWatcher(t, volwatch.WithMaxTransientErrors(2))
+	for i := 0; i < 2; i++ {
+		backend.SendError(syscall.EINTR)
+		if err := <-watch.Errors(); !errors.Is(err, syscall.EINTR) {
+			t.Errorf("Expected EINTR to be reported, got %v", err)
+		}
+	}
+	// An event resets the count
+	createVolume(t, watch, backend, "vol-abcde")
+	if volumes := nextVolumes(t, watch); !slices.Equal(volumes, []string{"vol-abcde"}) {
+		t.Errorf("Expected [vol-abcde], got %v", volumes)
+	}
+	backend.SendError(syscall.EAGAIN)
+	<-watch.Errors()
+	if watch.Err() != nil {
+		t.Errorf("Expected watcher to keep running, got %s", watch.Err())
+	}
+}
+
+func TestWatchTransientErrorLimit(t *testing.T) {
+	watch, backend := newFakeBackendWatcher(t, volwatch.WithMaxTransientErrors(2))
+	for i := 0; i < 3; i++ {
+		backend.SendError(syscall.EINTR)
+	}
+	select {
+	case <-watch.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Expected watcher to cancel after too many transient errors")
+	}
+}
+
+func TestWatchFatalErrorCancels(t *testing.T) {
+	watch, backend := newFakeBackendWatcher(t)
+	backend.SendError(syscall.EBADF)
+	select {
+	case <-watch.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Expected watcher to cancel on a fatal error")
+	}
+}
+
+// newFakeWatcher watches a device directory that exists only in a
+// FakeBackend and FakeDirReader
+func newFakeWatcher(t *testing.T, reader *volwatchtesting.FakeDirReader) (*volwatch.VolumeWatcher, *volwatchtesting.FakeBackend) {
+	t.Helper()
+	backend := volwatchtesting.NewFakeBackend()
+	watch := volwatch.NewWatchDir(fakeWatchDir,
+		volwatch.WithWatchBackend(backend),
+		volwatch.WithDirReader(reader),
+	)
+	t.Cleanup(watch.Cancel)
+	return watch, backend
+}
+
+const fakeWatchDir = "/fake/disk/by-id"
+
+func TestFakeDirReader(t *testing.T) {
+	reader := volwatchtesting.NewFakeDirReader()
+	reader.SetEntries(fakeWatchDir, "virtio-vol-aaaaa", "wwn-0x5000c500", "virtio-vol-bbbbb")
+	watch, _ := newFakeWatcher(t, reader)
+	if volumes := nextVolumes(t, watch); !slices.Equal(volumes, []string{"vol-aaaaa", "vol-bbbbb"}) {
+		t.Errorf("Expected [vol-aaaaa vol-bbbbb], got %v", volumes)
+	}
+	if volumes, err := watch.Snapshot(); err != nil || !slices.Equal(volumes, []string{"vol-aaaaa", "vol-bbbbb"}) {
+		t.Errorf("Expected snapshot [vol-aaaaa vol-bbbbb], got %v, %v", volumes, err)
+	}
+}
+
+func TestFakeDirReaderNotExist(t *testing.T) {
+	reader := volwatchtesting.NewFakeDirReader()
+	watch, backend := newFakeWatcher(t, reader)
+	// The missing directory is read and skipped without an event
+	for reader.Reads() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	reader.SetEntries(fakeWatchDir, "virtio-vol-aaaaa")
+	backend.SendEvent(fsnotify.Event{Name: fakeWatchDir + "/virtio-vol-aaaaa", Op: fsnotify.Create})
+	if volumes := nextVolumes(t, watch); !slices.Equal(volumes, []string{"vol-aaaaa"}) {
+		t.Errorf("Expected [vol-aaaaa] as the first event, got %v", volumes)
+	}
+	if err := watch.Err(); err != nil {
+		t.Errorf("Expected watcher to keep running, got %v", err)
+	}
+}
+
+func TestFakeDirReaderError(t *testing.T) {
+	reader := volwatchtesting.NewFakeDirReader()
+	reader.SetError(fakeWatchDir, syscall.EACCES)
+	watch, _ := newFakeWatcher(t, reader)
+	select {
+	case <-watch.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Expected watcher to cancel on a read error")
+	}
+	if err := <-watch.Errors(); !errors.Is(err, syscall.EACCES) {
+		t.Errorf("Expected EACCES, got %v", err)
+	}
+}
@@ -8,18 +8,74 @@ import (
 	"path"
 	"path/filepath"
 	"regexp"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
 
+	"github.com/brightbox/brightbox-volume-device-plugin/logging"
+	"github.com/brightbox/brightbox-volume-device-plugin/metrics"
 	"github.com/fsnotify/fsnotify"
-	"github.com/golang/glog"
+	"golang.org/x/exp/slices"
+	"golang.org/x/sys/unix"
 )
 
+// EventType identifies the kind of change described by a DeltaEvent
+type EventType int
+
 const (
 	// Create is a volume creation event
-	Create = iota
+	Create EventType = iota
 	// Remove is a volume deletion event
 	Remove
 )
 
+func (t EventType) String() string {
+	switch t {
+	case Create:
+		return "Create"
+	case Remove:
+		return "Remove"
+	default:
+		return fmt.Sprintf("EventType(%d)", int(t))
+	}
+}
+
+// State is the stage of its lifecycle a VolumeWatcher has reached
+type State int32
+
+const (
+	// Initializing is the state of a watcher that has not yet set up its
+	// watches
+	Initializing State = iota
+	// Watching is the state of a watcher reporting volume changes
+	Watching
+	// Reconnecting is the state of a watcher waiting for the parent of
+	// its watch directory to reappear
+	Reconnecting
+	// Cancelled is the state of a watcher that has stopped for good
+	Cancelled
+)
+
+func (s State) String() string {
+	switch s {
+	case Initializing:
+		return "Initializing"
+	case Watching:
+		return "Watching"
+	case Reconnecting:
+		return "Reconnecting"
+	case Cancelled:
+		return "Cancelled"
+	default:
+		return fmt.Sprintf("State(%d)", int(s))
+	}
+}
+
 // Event is returned by the events channel
 type Event []string
 
@@ -28,20 +84,336 @@ func (e Event) Volumes() []string {
 	return []string(e)
 }
 
+// DeltaEvent is returned by the delta events channel. It describes a
+// single volume appearing or disappearing, along with the full list of
+// volumes present after the change.
+type DeltaEvent struct {
+	Type     EventType
+	VolumeID string
+	Snapshot []string
+}
+
+// Volumes extracts the list of volumes present after the change
+func (e DeltaEvent) Volumes() []string {
+	return e.Snapshot
+}
+
+// ErrInvalidVolumeID is returned by ValidateVolumeID for IDs that are not
+// safe to use as a device directory entry
+var ErrInvalidVolumeID = errors.New("invalid volume ID")
+
+// ErrNotBlockDevice is returned by BlockDeviceSize for paths that are not
+// block devices
+var ErrNotBlockDevice = errors.New("not a block device")
+
+// ErrWatcherUnhealthy is returned by HealthCheck when the watcher has
+// stopped or is no longer watching any directories
+var ErrWatcherUnhealthy = errors.New("volume watcher unhealthy")
+
+// ErrBlockDeviceNotReady is returned by WaitForBlockDeviceReady for
+// devices the kernel has yet to finish setting up
+var ErrBlockDeviceNotReady = errors.New("block device not ready")
+
+// ErrCircularSymlink is returned by CheckSymlinkDepth for symlinks that
+// point at themselves or are chained too deeply
+var ErrCircularSymlink = errors.New("circular symlink")
+
+// ErrDeviceNotFound is returned by IDDevicePath when there is no device
+// symlink for the volume. It wraps os.ErrNotExist.
+var ErrDeviceNotFound = fmt.Errorf("device %w", os.ErrNotExist)
+
+// Watcher is the behaviour of a VolumeWatcher its consumers rely on,
+// allowing a fake to be substituted in tests
+type Watcher interface {
+	Events() <-chan Event
+	DeltaEvents() <-chan DeltaEvent
+	Errors() <-chan error
+	ListVolumes() ([]string, error)
+	StaleVolumes() []string
+	Done() <-chan struct{}
+	Cancel()
+	Err() error
+}
+
+var _ Watcher = (*VolumeWatcher)(nil)
+
 // VolumeWatcher watches the disk area for new volumes
 // and posts them to the Events channel
 //
 // Create a VolumeWatcher by calling the NewWatcher function
 type VolumeWatcher struct {
-	events chan Event
-	ctx    context.Context
-	cancel context.CancelFunc
-	watch  *fsnotify.Watcher
+	dir      string
+	events   chan Event
+	deltas   chan DeltaEvent
+	errors   chan error
+	previous []string
+	ctx      context.Context
+	cancel   context.CancelFunc
+	stopped  chan struct{}
+	panics   int64
+	progress bool
+	// transientErrors counts Transient notifier errors since the
+	// notifier last delivered an event
+	transientErrors int
+	opts            watcherConfig
+	resolved        string
+	polling         atomic.Bool
+
+	state        atomic.Int32
+	stateChanges chan State
+
+	// watch is only replaced by the run goroutine, which may read it
+	// without holding watchMutex
+	watchMutex sync.Mutex
+	watch      WatchBackend
+
+	staleMutex sync.Mutex
+	stale      []string
+
+	// cache is nil unless the watcher was created WithCacheTTL
+	cache *DevicePathCache
+}
+
+// DefaultDeviceDir is the directory watched by NewWatcher, where udev
+// links disks by ID
+const DefaultDeviceDir = "/dev/disk/by-id"
+
+// DefaultMaxSymlinkDepth is the number of links ResolveDevicePath will
+// follow from a device symlink before giving up
+const DefaultMaxSymlinkDepth = 10
+
+// DefaultSysBlockDir is where the kernel lists block devices in sysfs
+const DefaultSysBlockDir = "/sys/block"
+
+// ValidateVolumeID checks id is a whole volume ID matching the default
+// volume pattern and cannot escape the device directory when passed to
+// IDDevicePath
+func ValidateVolumeID(id string) error {
+	return ValidateVolumeIDMatching(id, volRe)
+}
+
+// ValidateVolumeIDMatching is ValidateVolumeID for volumes found with
+// the pattern re in place of the default
+func ValidateVolumeIDMatching(id string, re *regexp.Regexp) error {
+	switch {
+	case id == "":
+		return fmt.Errorf("%w: empty", ErrInvalidVolumeID)
+	case len(id) > maxVolumeIDLength:
+		return fmt.Errorf("%w: longer than %d characters", ErrInvalidVolumeID, maxVolumeIDLength)
+	case strings.ContainsAny(id, `/\`), strings.Contains(id, ".."):
+		return fmt.Errorf("%w: %q contains a path separator or parent reference", ErrInvalidVolumeID, id)
+	case re.FindString(id) != id:
+		return fmt.Errorf("%w: %q does not match %s", ErrInvalidVolumeID, id, re)
+	}
+	return nil
 }
 
-// IDDevicePath gives the full path to the target in the deviceDir
-func IDDevicePath(target string) string {
-	return filepath.Join(deviceDir, "virtio-"+target)
+// CanonicalDevicePath gives the clean absolute path of target in dir, so
+// that it matches the names fsnotify reports. Gives an error wrapping
+// ErrInvalidVolumeID if target would resolve to somewhere other than an
+// entry under dir.
+func CanonicalDevicePath(dir string, target string) (string, error) {
+	base, err := filepath.Abs(filepath.Clean(dir))
+	if err != nil {
+		return "", err
+	}
+	path, err := filepath.Abs(filepath.Join(base, target))
+	if err != nil {
+		return "", err
+	}
+	if rel, err := filepath.Rel(base, path); err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%w: %q is not under %s", ErrInvalidVolumeID, target, base)
+	}
+	return path, nil
+}
+
+// IDDevicePath gives the full path to the target in DefaultDeviceDir.
+// The path is returned along with an error wrapping ErrDeviceNotFound if
+// there is nothing there.
+func IDDevicePath(target string) (string, error) {
+	return DevicePathIn(DefaultDeviceDir, target)
+}
+
+// IDDevicePath is the package IDDevicePath for the directory being
+// watched
+func (vw *VolumeWatcher) IDDevicePath(target string) (string, error) {
+	return DevicePathIn(vw.dir, target)
+}
+
+// ResolveDevicePath follows the device symlink for the volume target in
+// the directory being watched to the device node behind it. Gives an
+// error wrapping ErrDeviceNotFound if there is no symlink and
+// ErrCircularSymlink if the links loop. If the watcher was created
+// WithCacheTTL, the result is remembered until the cache entry expires
+// or the watcher sees the volume removed.
+func (vw *VolumeWatcher) ResolveDevicePath(target string) (string, error) {
+	if vw.cache != nil {
+		if path, ok := vw.cache.Get(target); ok {
+			return path, nil
+		}
+	}
+	symlink, err := vw.IDDevicePath(target)
+	if err != nil {
+		return "", err
+	}
+	path, err := ResolveSymlink(symlink, DefaultMaxSymlinkDepth)
+	if err != nil {
+		return "", fmt.Errorf("volume %s: %w", target, err)
+	}
+	if vw.cache != nil {
+		vw.cache.Put(target, path)
+	}
+	return path, nil
+}
+
+// DevicePathIn is IDDevicePath for the device directory dir
+func DevicePathIn(dir string, target string) (string, error) {
+	path, err := CanonicalDevicePath(dir, "virtio-"+target)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Lstat(path); errors.Is(err, os.ErrNotExist) {
+		return path, fmt.Errorf("volume %s not found at %s: %w", target, path, ErrDeviceNotFound)
+	} else if err != nil {
+		return path, fmt.Errorf("volume %s: %w", target, err)
+	}
+	return path, nil
+}
+
+// ResolveSymlink is filepath.EvalSymlinks, except that it first checks
+// with CheckSymlinkDepth that there are no more than maxDepth links to
+// follow
+func ResolveSymlink(path string, maxDepth int) (string, error) {
+	if err := CheckSymlinkDepth(path, maxDepth); err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(path)
+}
+
+// CheckSymlinkDepth follows the chain of symlinks starting at path,
+// giving an error wrapping ErrCircularSymlink if a link points at itself
+// or there are more than maxDepth links in the chain
+func CheckSymlinkDepth(path string, maxDepth int) error {
+	current := filepath.Clean(path)
+	for depth := 0; ; depth++ {
+		info, err := os.Lstat(current)
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+		if depth >= maxDepth {
+			return fmt.Errorf("%w: %s has more than %d levels of links", ErrCircularSymlink, path, maxDepth)
+		}
+		target, err := os.Readlink(current)
+		if err != nil {
+			return err
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(current), target)
+		}
+		if target == current {
+			return fmt.Errorf("%w: %s links to itself", ErrCircularSymlink, current)
+		}
+		current = target
+	}
+}
+
+// IsNVMe reports whether path names an NVMe namespace block device,
+// such as /dev/nvme0n1. Partitions are not included.
+func IsNVMe(path string) bool {
+	return nvmeRe.MatchString(filepath.Base(path))
+}
+
+// DeviceMajorMinor returns the major and minor numbers of the device
+// node at path, following symlinks
+func DeviceMajorMinor(path string) (major, minor uint32, err error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || info.Mode()&os.ModeDevice == 0 {
+		return 0, 0, fmt.Errorf("%s is not a device node", path)
+	}
+	rdev := uint64(stat.Rdev)
+	return unix.Major(rdev), unix.Minor(rdev), nil
+}
+
+// BlockDeviceSize returns the size in bytes of the block device at path,
+// following symlinks. Other kinds of file give an error wrapping
+// ErrNotBlockDevice.
+func BlockDeviceSize(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	if info.Mode()&os.ModeDevice == 0 || info.Mode()&os.ModeCharDevice != 0 {
+		return 0, fmt.Errorf("%w: %s", ErrNotBlockDevice, path)
+	}
+	device, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer device.Close()
+	var size uint64
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, device.Fd(), unix.BLKGETSIZE64, uintptr(unsafe.Pointer(&size)))
+	if errno != 0 {
+		return 0, fmt.Errorf("reading size of %s: %w", path, errno)
+	}
+	return int64(size), nil
+}
+
+// WaitForBlockDeviceReady waits up to timeout for the kernel to finish
+// setting up the block device node devpath, i.e. for the device's stat
+// file to appear in DefaultSysBlockDir and its size to be nonzero. The
+// device node may be created before its partition table has been
+// scanned. Gives an error wrapping ErrBlockDeviceNotReady on timeout.
+func WaitForBlockDeviceReady(devpath string, timeout time.Duration) error {
+	return WaitForBlockDeviceReadyIn(DefaultSysBlockDir, devpath, timeout)
+}
+
+// WaitForBlockDeviceReadyIn is WaitForBlockDeviceReady for the sysfs
+// block directory sysBlockDir
+func WaitForBlockDeviceReadyIn(sysBlockDir string, devpath string, timeout time.Duration) error {
+	deviceDir := filepath.Join(sysBlockDir, filepath.Base(devpath))
+	deadline := time.Now().Add(timeout)
+	for {
+		err := blockDeviceReady(deviceDir)
+		if !errors.Is(err, ErrBlockDeviceNotReady) || !time.Now().Before(deadline) {
+			return err
+		}
+		time.Sleep(blockDeviceReadyInterval)
+	}
+}
+
+// blockDeviceReady checks the sysfs directory of a block device for a
+// stat file and a nonzero size
+func blockDeviceReady(deviceDir string) error {
+	if _, err := os.Stat(filepath.Join(deviceDir, "stat")); errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: no %s", ErrBlockDeviceNotReady, filepath.Join(deviceDir, "stat"))
+	} else if err != nil {
+		return err
+	}
+	contents, err := os.ReadFile(filepath.Join(deviceDir, "size"))
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: no %s", ErrBlockDeviceNotReady, filepath.Join(deviceDir, "size"))
+	} else if err != nil {
+		return err
+	}
+	text := strings.TrimSpace(string(contents))
+	if text == "" {
+		return fmt.Errorf("%w: %s has no size", ErrBlockDeviceNotReady, deviceDir)
+	}
+	size, err := strconv.ParseUint(text, 10, 64)
+	if err != nil {
+		return fmt.Errorf("reading size of %s: %w", deviceDir, err)
+	}
+	if size == 0 {
+		return fmt.Errorf("%w: %s has zero size", ErrBlockDeviceNotReady, deviceDir)
+	}
+	return nil
 }
 
 // NewWatcher creates a new volume watcher.
@@ -49,43 +421,187 @@ func IDDevicePath(target string) string {
 // watches for volumes being created and removed.
 // The watcher can be cancelled by calling the returned context cancellation
 // function
-func NewWatcher() *VolumeWatcher {
-	return NewWatchDir(deviceDir)
+func NewWatcher(opts ...Option) *VolumeWatcher {
+	return NewWatcherWithContext(context.Background(), opts...)
+}
+
+// NewWatcherWithContext creates a new volume watcher whose lifetime is
+// bound to the supplied parent context.
+// Cancelling the parent stops the watcher just as calling Cancel does.
+func NewWatcherWithContext(ctx context.Context, opts ...Option) *VolumeWatcher {
+	return NewWatchDirWithContext(ctx, DefaultDeviceDir, opts...)
 }
 
 // NewWatchDir creates a new volume watcher on an arbitrary directory
-func NewWatchDir(dir string) *VolumeWatcher {
-	glog.V(4).Infof("Creating new watcher")
+func NewWatchDir(dir string, opts ...Option) *VolumeWatcher {
+	return NewWatchDirWithContext(context.Background(), dir, opts...)
+}
 
-	watch, err := fsnotify.NewWatcher()
-	if err != nil {
-		glog.Warningf("Unable to create file Watcher")
-		return nil
+// NewWatchDirWithContext creates a new volume watcher on an arbitrary
+// directory, deriving its context from the supplied parent context
+func NewWatchDirWithContext(ctx context.Context, dir string, opts ...Option) *VolumeWatcher {
+	logging.V(4).Info("Creating new watcher", "watchDir", dir)
+
+	o := buildWatcherConfig(opts)
+	watch := o.notifier
+	if watch == nil && o.backend == nil {
+		var err error
+		watch, err = o.newNotifier()
+		if err != nil && o.pollInterval <= 0 {
+			logging.Warn("Unable to create file watcher", "err", err)
+			return nil
+		} else if err != nil {
+			logging.Warn("Unable to create file watcher, falling back to polling", "err", err)
+			watch = nil
+		}
 	}
-	watchCtx, watchCancel := context.WithCancel(context.Background())
+	watchCtx, watchCancel := context.WithCancel(ctx)
 	watcher := &VolumeWatcher{
-		events: make(chan Event),
-		ctx:    watchCtx,
-		cancel: watchCancel,
-		watch:  watch,
+		dir:     dir,
+		errors:  make(chan error, errorBufferSize),
+		ctx:     watchCtx,
+		cancel:  watchCancel,
+		stopped: make(chan struct{}),
+		watch:   watch,
+		opts:    o,
+
+		stateChanges: make(chan State, stateBufferSize),
 	}
+	if o.cacheTTL > 0 {
+		watcher.cache = NewDevicePathCache(o.cacheTTL)
+	}
+	watcher.events = make(chan Event, watcher.opts.eventBuffer)
+	watcher.deltas = make(chan DeltaEvent, watcher.opts.eventBuffer)
 	go watcher.run(dir)
 	return watcher
 }
 
-// Events returns the main events channel
+// WatchDir returns the directory being watched for volumes
+func (vw *VolumeWatcher) WatchDir() string {
+	return vw.dir
+}
+
+// ListVolumes returns the volumes currently present. It is equivalent to
+// Snapshot.
+func (vw *VolumeWatcher) ListVolumes() ([]string, error) {
+	return vw.Snapshot()
+}
+
+// Snapshot reads the watch directory directly and returns the volumes
+// currently present, filtered exactly as they are for events. It does not
+// wait for, or disturb, event delivery and may be called at any time,
+// including before the first event has been sent. A missing watch
+// directory yields an empty list.
+func (vw *VolumeWatcher) Snapshot() ([]string, error) {
+	files, err := vw.opts.dirReader.ReadDir(vw.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	volumes, _ := enumerateVolumes(vw.dir, files, vw.opts)
+	return volumes.Volumes(), nil
+}
+
+// Events returns the main events channel.
+// Nothing is posted here if the watcher was created WithDeltaEvents.
 func (vw *VolumeWatcher) Events() <-chan Event {
 	return vw.events
 }
 
+// DeltaEvents returns the channel of individual volume changes.
+// Changes are only posted here if the watcher was created
+// WithDeltaEvents.
+func (vw *VolumeWatcher) DeltaEvents() <-chan DeltaEvent {
+	return vw.deltas
+}
+
+// Errors returns a buffered channel of errors encountered by the watcher.
+// An error that causes the watcher to cancel is posted here before the
+// Done channel is closed, so it can always be read once Done fires.
+// Errors that arrive while the buffer is full are logged and dropped.
+func (vw *VolumeWatcher) Errors() <-chan error {
+	return vw.errors
+}
+
+// HealthCheck returns nil if the watcher is running and has active
+// watches, and an error wrapping ErrWatcherUnhealthy otherwise
+func (vw *VolumeWatcher) HealthCheck() error {
+	if err := vw.ctx.Err(); err != nil {
+		return fmt.Errorf("%w: %s", ErrWatcherUnhealthy, err)
+	}
+	if vw.Polling() || vw.opts.backend != nil {
+		return nil
+	}
+	if _, ok := vw.watchLister(); !ok {
+		return nil
+	}
+	if len(vw.WatchedPaths()) == 0 {
+		return fmt.Errorf("%w: no active watches", ErrWatcherUnhealthy)
+	}
+	return nil
+}
+
+// WatchedPaths returns the paths fsnotify is currently watching, for
+// debugging. It is empty while polling, when using a Backend, or when
+// the WatchBackend cannot list its watches.
+func (vw *VolumeWatcher) WatchedPaths() []string {
+	if lister, ok := vw.watchLister(); ok {
+		return lister.WatchList()
+	}
+	return nil
+}
+
+// watchLister returns the current WatchBackend if it can list its watches
+func (vw *VolumeWatcher) watchLister() (watchLister, bool) {
+	vw.watchMutex.Lock()
+	defer vw.watchMutex.Unlock()
+	lister, ok := vw.watch.(watchLister)
+	return lister, ok
+}
+
+// StaleVolumes returns the IDs of volumes skipped in the last scan
+// because their symlinks were broken. Always empty unless the watcher
+// was created WithValidateSymlinks.
+func (vw *VolumeWatcher) StaleVolumes() []string {
+	vw.staleMutex.Lock()
+	defer vw.staleMutex.Unlock()
+	return slices.Clone(vw.stale)
+}
+
+// Polling reports whether the watcher has fallen back to polling the
+// watch directory because filesystem notifications are unavailable
+func (vw *VolumeWatcher) Polling() bool {
+	return vw.polling.Load()
+}
+
+// State returns the watcher's current state
+func (vw *VolumeWatcher) State() State {
+	return State(vw.state.Load())
+}
+
+// StateChanges returns a buffered channel of the states the watcher moves
+// into, closed once it is Cancelled. Changes that arrive while the buffer
+// is full are logged and dropped.
+func (vw *VolumeWatcher) StateChanges() <-chan State {
+	return vw.stateChanges
+}
+
+// PanicCount returns the number of times the watch loop has panicked
+func (vw *VolumeWatcher) PanicCount() int64 {
+	return atomic.LoadInt64(&vw.panics)
+}
+
 // Done returns a channel that is closed when the watcher has been cancelled
 func (vw *VolumeWatcher) Done() <-chan struct{} {
 	return vw.ctx.Done()
 }
 
-// Cancel signals to the watcher that it should stop watching and close down
+// Cancel signals to the watcher that it should stop watching and close
+// down, and waits for its goroutines to exit
 func (vw *VolumeWatcher) Cancel() {
 	vw.cancel()
+	<-vw.stopped
 }
 
 // Err returns a Cancelled error when the watcher has been stopped
@@ -95,51 +611,202 @@ func (vw *VolumeWatcher) Err() error {
 
 // Implementation
 
-const deviceDir = "/dev/disk/by-id"
 const bufferSize = 3
+const errorBufferSize = 8
+const stateBufferSize = 8
+const blockDeviceReadyInterval = 50 * time.Millisecond
+const maxVolumeIDLength = 64
 
 var volRe = regexp.MustCompile(`vol-.....$`)
+var nvmeRe = regexp.MustCompile(`^nvme[0-9]+n[0-9]+$`)
 
-// run sets up the watcher and reports events
+// run supervises the watch loop, restarting it after a panic if
+// configured to do so, and polling while the notifier is
+// unavailable
 // Runs until cancelled via the supplied context
 func (vw *VolumeWatcher) run(watchDir string) {
+	defer close(vw.stopped)
+	defer close(vw.stateChanges)
+	defer vw.setState(Cancelled)
+	defer vw.setNotifier(nil)
+	if vw.opts.backend != nil {
+		vw.setState(Watching)
+		vw.watchBackend(watchDir)
+		return
+	}
+	for vw.ctx.Err() == nil {
+		if vw.watch == nil && !vw.poll(watchDir) {
+			return
+		}
+		if !vw.superviseWatch(watchDir) {
+			return
+		}
+	}
+}
+
+// superviseWatch runs the watch loop until it returns, restarting it after
+// a panic if configured to do so. Returns false if the restart limit was
+// reached.
+func (vw *VolumeWatcher) superviseWatch(watchDir string) bool {
+	restarts := 0
+	for !vw.watchSafely(watchDir) {
+		if vw.progress {
+			restarts = 0
+			vw.progress = false
+		}
+		if restarts >= vw.opts.maxRestarts {
+			vw.warnAndCancel(
+				"Volume watch panicked",
+				fmt.Errorf("%d restarts without progress", restarts),
+			)
+			return false
+		}
+		restarts++
+		logging.Warn("Restarting volume watch", "restart", restarts, "max", vw.opts.maxRestarts)
+	}
+	return true
+}
+
+// poll reads the watch directory every poll interval, retrying the
+// notifier on each tick. Returns true once the notifier is
+// available again, or false if the watcher is cancelled.
+func (vw *VolumeWatcher) poll(watchDir string) bool {
+	logging.Warn("Polling watch directory", "watchDir", watchDir, "interval", vw.opts.pollInterval)
+	vw.setState(Watching)
+	vw.polling.Store(true)
+	defer vw.polling.Store(false)
+	vw.readAndNotifyChanges(watchDir)
+	ticker := time.NewTicker(vw.opts.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-vw.ctx.Done():
+			logging.V(4).Info("Directory poller cancelled")
+			return false
+		case <-ticker.C:
+			watch, err := vw.opts.newNotifier()
+			if err == nil {
+				logging.Info("File watcher available again - stopping polling")
+				vw.setNotifier(watch)
+				return true
+			}
+			logging.V(4).Info("File watcher still unavailable", "err", err)
+			vw.readAndNotifyChanges(watchDir)
+		}
+	}
+}
+
+// setNotifier replaces the notifier, closing the old one
+func (vw *VolumeWatcher) setNotifier(watch WatchBackend) {
+	vw.watchMutex.Lock()
+	old := vw.watch
+	vw.watch = watch
+	vw.watchMutex.Unlock()
+	if old != nil && old != watch {
+		old.Close()
+	}
+}
+
+// notifierFailed deals with the notifier failing. With a
+// polling fallback the notifier is dropped and true is returned, telling
+// the watch loop to return so run can start polling. Otherwise the
+// watcher is cancelled.
+func (vw *VolumeWatcher) notifierFailed(message string, err error) bool {
+	if vw.opts.pollInterval <= 0 {
+		vw.warnAndCancel(message, err)
+		return false
+	}
+	logging.Warn(message, "err", err)
+	vw.postError(fmt.Errorf("%s: %w", message, err))
+	vw.setNotifier(nil)
+	return true
+}
+
+// watchSafely runs the watch loop, recovering from any panic.
+// Returns false if the loop panicked.
+func (vw *VolumeWatcher) watchSafely(watchDir string) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			atomic.AddInt64(&vw.panics, 1)
+			logging.Error("Volume watch panicked", "panic", r, "stack", string(debug.Stack()))
+			ok = false
+		}
+	}()
+	vw.watchLoop(watchDir)
+	return true
+}
+
+// watchLoop sets up the watcher and reports events
+func (vw *VolumeWatcher) watchLoop(watchDir string) {
 	baseDir := path.Dir(watchDir)
-	defer vw.watch.Close()
-	if err := vw.watch.Add(baseDir); err != nil {
-		vw.warnAndCancel(
+	debounce := newDebouncer(vw.opts.debounce)
+	defer debounce.stop()
+	throttle := newDebouncer(0)
+	defer throttle.stop()
+	reconcile, stopReconcile := vw.reconcileTicker()
+	defer stopReconcile()
+	limitedNotify := func() {
+		vw.limitedNotify(watchDir, throttle)
+	}
+	if err := vw.watch.AddWatch(baseDir); err != nil {
+		vw.notifierFailed(
 			fmt.Sprintf("Failed to add %s to watcher", baseDir),
 			err,
 		)
 		return
 	}
-	if err := vw.watch.Add(watchDir); err == nil {
+	vw.setState(Watching)
+	if err := vw.addWatchDir(watchDir); err == nil {
 		vw.readAndNotify(watchDir)
 	} else {
-		glog.Infoln("Watch Directory is missing - awaiting create")
+		logging.Info("Watch Directory is missing - awaiting create", "watchDir", watchDir)
 	}
 	for {
 		select {
-		case err := <-vw.watch.Errors:
-			vw.warnAndCancel("Unexpected volume watch errors", err)
+		case err := <-vw.watch.Errors():
+			if vw.transientError(err) {
+				vw.readAndNotifyChanges(watchDir)
+			} else if vw.notifierFailed("Unexpected volume watch errors", err) {
+				return
+			}
 		case <-vw.ctx.Done():
-			glog.V(4).Infoln("Directory scanner cancelled")
+			logging.V(4).Info("Directory scanner cancelled")
 			return
-		case event, ok := <-vw.watch.Events:
+		case <-debounce.C():
+			logging.V(4).Info("Debounce period expired")
+			debounce.fired()
+			limitedNotify()
+		case <-throttle.C():
+			logging.V(4).Info("Rate limit delay expired")
+			throttle.fired()
+			vw.readAndNotifyChanges(watchDir)
+		case <-reconcile:
+			logging.V(4).Info("Reconciliation scan")
+			vw.readAndNotifyChanges(watchDir)
+		case event, ok := <-vw.watch.Events():
+			if ok {
+				vw.transientErrors = 0
+			}
 			switch {
 			case !ok:
-				vw.warnAndCancel(
+				if vw.notifierFailed(
 					"Unexpected volume watch event error",
 					fmt.Errorf("watch event error"),
-				)
+				) {
+					return
+				}
 			case isDirRemove(event, watchDir):
-				glog.V(4).Infoln("Watch Directory removed", event)
+				logging.V(4).Info("Watch Directory removed", "watchDir", watchDir, "eventType", event.Op.String())
+				vw.watchDirRemoved(watchDir, event)
 			case isDirRemove(event, baseDir):
-				glog.V(4).Infoln("Base Directory removed", event)
-				glog.Warning("Cancelling watch")
-				vw.cancel()
+				logging.Warn("Base Directory removed - awaiting recreate", "dir", baseDir, "watchDir", watchDir, "eventType", event.Op.String())
+				if !vw.reconnect(baseDir, watchDir) {
+					logging.V(4).Info("Directory scanner cancelled during reconnect")
+					return
+				}
 			case isDirCreate(event, watchDir):
-				glog.V(4).Infoln("Watch Directory added")
-				if err := vw.watch.Add(watchDir); err == nil {
+				logging.V(4).Info("Watch Directory added")
+				if err := vw.addWatchDir(watchDir); err == nil {
 					vw.readAndNotify(watchDir)
 				} else {
 					vw.warnAndCancel(
@@ -147,30 +814,260 @@ func (vw *VolumeWatcher) run(watchDir string) {
 						err,
 					)
 				}
-			case isVolChange(event, watchDir):
-				glog.V(4).Infoln("Watch Directory changed", event)
-				vw.readAndNotify(watchDir)
+			case isVolChange(event, watchDir),
+				vw.resolved != "" && isVolChange(event, vw.resolved):
+				logging.V(4).Info("Watch Directory changed", "watchDir", watchDir, "eventType", event.Op.String(), "path", event.Name)
+				if debounce.enabled() {
+					debounce.reset()
+				} else {
+					limitedNotify()
+				}
 			default:
-				glog.V(4).Infoln("Ignored watch event: ", event)
+				logging.V(4).Info("Ignored watch event", "watchDir", watchDir, "eventType", event.Op.String(), "path", event.Name)
+			}
+		}
+	}
+}
+
+// watchBackend reports the volume changes signalled by the Backend
+// supplied with WithBackend, in place of the fsnotify watch loop
+func (vw *VolumeWatcher) watchBackend(watchDir string) {
+	ctx, cancel := context.WithCancel(vw.ctx)
+	events := make(chan Event)
+	stopped := make(chan error, 1)
+	backendDone := make(chan struct{})
+	go func() {
+		defer close(backendDone)
+		stopped <- vw.opts.backend.Start(ctx, events)
+	}()
+	defer func() {
+		cancel()
+		<-backendDone
+	}()
+	debounce := newDebouncer(vw.opts.debounce)
+	defer debounce.stop()
+	throttle := newDebouncer(0)
+	defer throttle.stop()
+	reconcile, stopReconcile := vw.reconcileTicker()
+	defer stopReconcile()
+	vw.readAndNotify(watchDir)
+	for {
+		select {
+		case <-vw.ctx.Done():
+			logging.V(4).Info("Backend watch cancelled")
+			return
+		case err := <-stopped:
+			if err == nil {
+				err = fmt.Errorf("backend stopped")
+			}
+			vw.warnAndCancel("Volume event backend failed", err)
+			return
+		case <-debounce.C():
+			logging.V(4).Info("Debounce period expired")
+			debounce.fired()
+			vw.limitedNotify(watchDir, throttle)
+		case <-throttle.C():
+			logging.V(4).Info("Rate limit delay expired")
+			throttle.fired()
+			vw.readAndNotifyChanges(watchDir)
+		case <-reconcile:
+			logging.V(4).Info("Reconciliation scan")
+			vw.readAndNotifyChanges(watchDir)
+		case event := <-events:
+			logging.V(4).Info("Backend signalled volume change", "watchDir", watchDir, "volumes", event.Volumes())
+			if debounce.enabled() {
+				debounce.reset()
+			} else {
+				vw.limitedNotify(watchDir, throttle)
 			}
 		}
 	}
 }
 
+// limitedNotify reads and notifies of any volume changes if the rate
+// limiter allows, otherwise schedules a single deferred notification on
+// throttle. Changes to entries that are not volumes, such as a temporary
+// file created and removed, leave the volume list as it was and are not
+// reported.
+func (vw *VolumeWatcher) limitedNotify(watchDir string, throttle *debouncer) {
+	if vw.opts.limiter == nil || vw.opts.limiter.Allow() {
+		vw.readAndNotifyChanges(watchDir)
+		return
+	}
+	if throttle.pending {
+		logging.V(4).Info("Rate limited - notification already pending")
+		return
+	}
+	reservation := vw.opts.limiter.Reserve()
+	if !reservation.OK() {
+		logging.Warn("Rate limiter will never allow a notification - dropping event")
+		return
+	}
+	logging.V(4).Info("Rate limited - delaying notification", "delay", reservation.Delay())
+	throttle.schedule(reservation.Delay())
+}
+
+// reconcileTicker returns the reconciliation scan channel, which is nil
+// when reconciliation is disabled, and a function to stop it
+func (vw *VolumeWatcher) reconcileTicker() (<-chan time.Time, func()) {
+	if vw.opts.reconcileInterval <= 0 {
+		return nil, func() {}
+	}
+	ticker := time.NewTicker(vw.opts.reconcileInterval)
+	return ticker.C, ticker.Stop
+}
+
+// addWatchDir adds watchDir to the watcher. When following symlinks and
+// watchDir resolves elsewhere, the resolved directory is watched too and
+// remembered so events reported against it are recognised.
+func (vw *VolumeWatcher) addWatchDir(watchDir string) error {
+	if err := vw.watch.AddWatch(watchDir); err != nil {
+		return err
+	}
+	vw.resolved = ""
+	if !vw.opts.followSymlinks {
+		return nil
+	}
+	resolved, err := filepath.EvalSymlinks(watchDir)
+	if err != nil {
+		logging.Warn("Unable to resolve watch directory", "watchDir", watchDir, "err", err)
+		return nil
+	}
+	if resolved != watchDir {
+		logging.V(4).Info("Watch directory is a symlink", "watchDir", watchDir, "target", resolved)
+		if err := vw.watch.AddWatch(resolved); err != nil {
+			return err
+		}
+		vw.resolved = resolved
+	}
+	return nil
+}
+
+// reconnect waits for baseDir to reappear and re-establishes the watch
+// chain, backing off exponentially between attempts. Returns false if the
+// watcher is cancelled before the chain is restored.
+func (vw *VolumeWatcher) reconnect(baseDir string, watchDir string) bool {
+	vw.setState(Reconnecting)
+	parentDir := path.Dir(baseDir)
+	parentWatched := false
+	defer func() {
+		if parentWatched {
+			vw.watch.RemoveWatch(parentDir)
+		}
+	}()
+	backoff := vw.opts.reconnectMin
+	for {
+		if !parentWatched {
+			if err := vw.watch.AddWatch(parentDir); err == nil {
+				parentWatched = true
+			} else {
+				logging.V(4).Info("Unable to watch directory", "dir", parentDir, "err", err)
+			}
+		}
+		if err := vw.watch.AddWatch(baseDir); err == nil {
+			logging.Info("Base Directory recreated - watch restored")
+			metrics.WatcherReconnects.Inc()
+			vw.setState(Watching)
+			if err := vw.addWatchDir(watchDir); err == nil {
+				vw.readAndNotify(watchDir)
+			} else {
+				logging.Info("Watch Directory is missing - awaiting create", "watchDir", watchDir)
+			}
+			return true
+		}
+		logging.V(4).Info("Base Directory still missing", "retry", backoff)
+		timer := time.NewTimer(backoff)
+	Wait:
+		for {
+			select {
+			case <-vw.ctx.Done():
+				timer.Stop()
+				return false
+			case <-timer.C:
+				break Wait
+			case err := <-vw.watch.Errors():
+				logging.V(4).Info("Watch error during reconnect", "err", err)
+				vw.postError(err)
+			case event := <-vw.watch.Events():
+				if isDirCreate(event, baseDir) {
+					logging.V(4).Info("Base Directory created", "watchDir", watchDir, "eventType", event.Op.String(), "path", event.Name)
+					timer.Stop()
+					break Wait
+				}
+			}
+		}
+		backoff *= 2
+		if backoff > vw.opts.reconnectMax {
+			backoff = vw.opts.reconnectMax
+		}
+	}
+}
+
+// transientError reports whether err is Transient and within the limit
+// set by WithMaxTransientErrors, counting it if so
+func (vw *VolumeWatcher) transientError(err error) bool {
+	if ClassifyError(err) != Transient || vw.transientErrors >= vw.opts.maxTransientErrors {
+		return false
+	}
+	vw.transientErrors++
+	metrics.WatcherTransientErrors.Inc()
+	logging.Warn("Transient volume watch error - rescanning", "err", err, "count", vw.transientErrors, "max", vw.opts.maxTransientErrors)
+	vw.postError(fmt.Errorf("transient volume watch error: %w", err))
+	return true
+}
+
 func (vw *VolumeWatcher) warnAndCancel(message string, err error) {
-	glog.Warningf("%s: %s", message, err)
-	glog.Warning("Cancelling watch")
+	logging.Warn(message, "err", err)
+	vw.postError(fmt.Errorf("%s: %w", message, err))
+	logging.Warn("Cancelling watch")
 	vw.cancel()
 }
 
+// setState moves the watcher into state, publishing the change without
+// blocking
+func (vw *VolumeWatcher) setState(state State) {
+	if State(vw.state.Swap(int32(state))) == state {
+		return
+	}
+	logging.V(4).Info("Watcher state changed", "state", state)
+	select {
+	case vw.stateChanges <- state:
+	default:
+		logging.Warn("State change channel full, dropping change", "state", state)
+	}
+}
+
+// postError adds the error to the errors channel without blocking
+func (vw *VolumeWatcher) postError(err error) {
+	select {
+	case vw.errors <- err:
+	default:
+		logging.Warn("Error channel full, dropping error", "err", err)
+	}
+}
+
 func (vw *VolumeWatcher) readAndNotify(watchDir string) {
-	files, err := os.ReadDir(watchDir)
+	vw.read(watchDir, false)
+}
+
+// readAndNotifyChanges is readAndNotify, except nothing is posted if the
+// volume list is the same as last time
+func (vw *VolumeWatcher) readAndNotifyChanges(watchDir string) {
+	vw.read(watchDir, true)
+}
+
+func (vw *VolumeWatcher) read(watchDir string, changesOnly bool) {
+	files, err := vw.opts.dirReader.ReadDir(watchDir)
 	if err == nil {
-		glog.V(4).Infof("Enumerating volumes at %s\n", watchDir)
-		glog.V(4).Infoln("Adding event to lister queue")
-		vw.events <- enumerateVolumes(files)
+		logging.V(4).Info("Enumerating volumes", "watchDir", watchDir)
+		volumes, stale := enumerateVolumes(watchDir, files, vw.opts)
+		vw.setStale(stale)
+		if !vw.post(volumes, changesOnly) {
+			releaseVolumes(volumes)
+		}
+		vw.progress = true
 	} else if errors.Is(err, os.ErrNotExist) {
-		glog.V(4).Infoln("Watch Directory removed during event")
+		logging.V(4).Info("Watch Directory removed during event")
 	} else {
 		vw.warnAndCancel(
 			fmt.Sprintf("Failed to read %s", watchDir),
@@ -179,9 +1076,123 @@ func (vw *VolumeWatcher) readAndNotify(watchDir string) {
 	}
 }
 
+// post sends the volume list to the events channel, or as deltas if
+// enabled. If changesOnly is set, nothing is sent when the list is the
+// same as last time. It reports whether the list was kept, either by a
+// receiver or as the previous list; one that wasn't may be reused.
+func (vw *VolumeWatcher) post(volumes Event, changesOnly bool) bool {
+	if changesOnly && vw.previous != nil && slices.Equal(vw.previous, volumes.Volumes()) {
+		logging.V(4).Info("No volume changes")
+		return false
+	}
+	vw.invalidateRemoved(volumes.Volumes())
+	if vw.opts.scsiRescan {
+		vw.rescanCreated(volumes.Volumes())
+	}
+	if vw.opts.deltas {
+		vw.notifyDeltas(volumes.Volumes())
+	} else {
+		logging.V(4).Info("Adding event to lister queue")
+		vw.previous = volumes.Volumes()
+		select {
+		case vw.events <- volumes:
+		case <-vw.ctx.Done():
+		}
+	}
+	return true
+}
+
+// watchDirRemoved reports that no volumes remain once the watch
+// directory has gone. A directory renamed away is treated as removed:
+// inotify keeps watching it under its new name, so the watch is dropped
+// here and added again when a directory is created or renamed in its
+// place.
+func (vw *VolumeWatcher) watchDirRemoved(watchDir string, event fsnotify.Event) {
+	if event.Has(fsnotify.Rename) {
+		if err := vw.watch.RemoveWatch(watchDir); err != nil {
+			logging.V(4).Info("Watch Directory already unwatched", "watchDir", watchDir, "err", err)
+		}
+	}
+	vw.setStale(nil)
+	vw.post(Event{}, true)
+}
+
+// invalidateRemoved drops the cached devices of the volumes that were in
+// the previous list but are missing from volumes
+func (vw *VolumeWatcher) invalidateRemoved(volumes []string) {
+	if vw.cache == nil {
+		return
+	}
+	for _, vol := range vw.previous {
+		if !slices.Contains(volumes, vol) {
+			vw.cache.Invalidate(vol)
+		}
+	}
+}
+
+// rescanCreated rescans the SCSI devices of the volumes in volumes that
+// were not in the previous list. Failures are logged and otherwise
+// ignored: the volume is still reported.
+func (vw *VolumeWatcher) rescanCreated(volumes []string) {
+	for _, vol := range volumes {
+		if slices.Contains(vw.previous, vol) {
+			continue
+		}
+		devpath, err := vw.ResolveDevicePath(vol)
+		if err != nil {
+			logging.V(4).Info("Unable to find device to rescan", "volumeID", vol, "err", err)
+			continue
+		}
+		rescanned, err := RescanSCSIDeviceIn(vw.opts.sysBlockDir, devpath)
+		if err != nil {
+			logging.Warn("Unable to rescan SCSI device", "volumeID", vol, "device", devpath, "err", err)
+		} else if rescanned {
+			logging.V(3).Info("Rescanned SCSI device", "volumeID", vol, "device", devpath)
+		}
+	}
+}
+
+func (vw *VolumeWatcher) setStale(stale []string) {
+	vw.staleMutex.Lock()
+	defer vw.staleMutex.Unlock()
+	vw.stale = stale
+}
+
+func (vw *VolumeWatcher) notifyDeltas(volumes []string) {
+	deltas := DiffVolumes(vw.previous, volumes)
+	vw.previous = volumes
+	logging.V(4).Info("Adding delta events to lister queue", "watchDir", vw.dir, "count", len(deltas))
+	for _, delta := range deltas {
+		logging.V(3).Info("Volume changed", "watchDir", vw.dir, "eventType", delta.Type.String(), "volumeID", delta.VolumeID)
+		metrics.VolumeEvents.WithLabelValue(strings.ToLower(delta.Type.String())).Inc()
+		select {
+		case vw.deltas <- delta:
+		case <-vw.ctx.Done():
+			return
+		}
+	}
+}
+
+// DiffVolumes compares two volume lists and returns the removals followed
+// by the creations needed to get from previous to current.
+func DiffVolumes(previous []string, current []string) []DeltaEvent {
+	var result []DeltaEvent
+	for _, vol := range previous {
+		if !slices.Contains(current, vol) {
+			result = append(result, DeltaEvent{Remove, vol, current})
+		}
+	}
+	for _, vol := range current {
+		if !slices.Contains(previous, vol) {
+			result = append(result, DeltaEvent{Create, vol, current})
+		}
+	}
+	return result
+}
+
 func isDirRemove(event fsnotify.Event, targetDir string) bool {
-	return event.Has(fsnotify.Remove) &&
-		event.Name == targetDir
+	return (event.Has(fsnotify.Remove) ||
+		event.Has(fsnotify.Rename)) && event.Name == targetDir
 }
 
 func isDirCreate(event fsnotify.Event, targetDir string) bool {
@@ -191,18 +1202,114 @@ func isDirCreate(event fsnotify.Event, targetDir string) bool {
 
 func isVolChange(event fsnotify.Event, targetDir string) bool {
 	return (event.Has(fsnotify.Create) ||
-		event.Has(fsnotify.Remove)) && path.Dir(event.Name) == targetDir
+		event.Has(fsnotify.Remove) ||
+		event.Has(fsnotify.Rename)) && path.Dir(event.Name) == targetDir
 }
 
-func enumerateVolumes(dirents []os.DirEntry) Event {
-	result := make([]string, 0, len(dirents))
+// enumerateVolumes extracts the volume IDs from the directory entries.
+// If symlink validation is enabled, volumes whose links point at a
+// missing target are returned separately as stale.
+func enumerateVolumes(watchDir string, dirents []os.DirEntry, o watcherConfig) (Event, []string) {
+	result := pooledVolumes(len(dirents))
+	var stale []string
 	for _, ent := range dirents {
 		if ent.IsDir() {
 			continue
 		}
-		if m := volRe.FindString(ent.Name()); m != "" {
-			result = append(result, m)
+		m := o.volRe.FindString(ent.Name())
+		if m == "" {
+			continue
+		}
+		if o.validateSymlinks && isDangling(filepath.Join(watchDir, ent.Name())) {
+			logging.V(4).Info("Skipping broken symlink", "name", ent.Name())
+			stale = append(stale, m)
+			continue
 		}
+		result = append(result, m)
+	}
+	metrics.ActiveVolumes.Set(len(result))
+	return Event(result), stale
+}
+
+// volumePool holds volume lists that were read but never handed out,
+// most often because nothing had changed since the last read
+var volumePool sync.Pool
+
+// pooledVolumes returns an empty volume list with room for n entries,
+// reusing a released one if it is big enough
+func pooledVolumes(n int) []string {
+	if p, ok := volumePool.Get().(*[]string); ok && cap(*p) >= n {
+		return (*p)[:0]
+	}
+	return make([]string, 0, n)
+}
+
+// releaseVolumes returns a volume list to the pool. Nothing else may
+// hold the list: one that has been sent on a channel or stored must
+// never be released.
+func releaseVolumes(volumes Event) {
+	s := []string(volumes[:0])
+	volumePool.Put(&s)
+}
+
+// isDangling reports whether name is a symlink whose target is missing
+func isDangling(name string) bool {
+	if _, err := os.Lstat(name); err != nil {
+		return false
+	}
+	_, err := os.Stat(name)
+	return errors.Is(err, os.ErrNotExist)
+}
+
+// debouncer collapses a burst of triggers into a single timer expiry.
+// A zero duration disables debouncing.
+type debouncer struct {
+	duration time.Duration
+	timer    *time.Timer
+	pending  bool
+}
+
+func newDebouncer(d time.Duration) *debouncer {
+	return &debouncer{duration: d}
+}
+
+func (d *debouncer) enabled() bool {
+	return d.duration > 0
+}
+
+// C returns the expiry channel, or nil when nothing is pending so that
+// the select case never fires
+func (d *debouncer) C() <-chan time.Time {
+	if !d.pending {
+		return nil
+	}
+	return d.timer.C
+}
+
+// reset (re)starts the debounce period
+func (d *debouncer) reset() {
+	d.schedule(d.duration)
+}
+
+// schedule (re)starts the timer with an arbitrary delay
+func (d *debouncer) schedule(delay time.Duration) {
+	if d.timer == nil {
+		d.timer = time.NewTimer(delay)
+	} else {
+		d.stop()
+		d.timer.Reset(delay)
+	}
+	d.pending = true
+}
+
+// fired records that the expiry has been received
+func (d *debouncer) fired() {
+	d.pending = false
+}
+
+func (d *debouncer) stop() {
+	if d.timer != nil && !d.timer.Stop() && d.pending {
+		<-d.timer.C
 	}
-	return Event(result)
+	d.pending = false
 }
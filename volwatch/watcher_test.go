@@ -1,9 +1,30 @@
 package volwatch
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
+
+	"github.com/brightbox/brightbox-volume-device-plugin/logging"
+	"github.com/fsnotify/fsnotify"
+	"github.com/pilebones/go-udev/netlink"
+	"golang.org/x/exp/slices"
+	"golang.org/x/sys/unix"
+	"golang.org/x/time/rate"
 )
 
 func TestWatchCancel(t *testing.T) {
@@ -34,3 +55,1337 @@ func TestWatchCreate(t *testing.T) {
 		}
 	}
 }
+
+func TestWatchParentCancel(t *testing.T) {
+	baseDir := t.TempDir()
+	watchDir := filepath.Join(baseDir, "by-id")
+	ctx, cancel := context.WithCancel(context.Background())
+	watch := NewWatchDirWithContext(ctx, watchDir)
+	cancel()
+	select {
+	case <-watch.Done():
+	case <-time.After(time.Second):
+		t.Error("Watch failed to follow parent cancellation")
+	}
+	if !errors.Is(watch.Err(), context.Canceled) {
+		t.Errorf("Expected Canceled error, got %v", watch.Err())
+	}
+}
+
+func TestWatchDefaultRegex(t *testing.T) {
+	baseDir := t.TempDir()
+	watchDir := filepath.Join(baseDir, "by-id")
+	os.Mkdir(watchDir, 0755)
+	touch(t, watchDir, "virtio-vol-abcde")
+	touch(t, watchDir, "virtio-cinder-abcde")
+	watch := NewWatchDir(watchDir)
+	defer watch.Cancel()
+	event := nextEvent(t, watch)
+	if len(event) != 1 || event[0] != "vol-abcde" {
+		t.Errorf("Expected [vol-abcde], got %v", event)
+	}
+}
+
+func TestWatchCustomRegex(t *testing.T) {
+	baseDir := t.TempDir()
+	watchDir := filepath.Join(baseDir, "by-id")
+	os.Mkdir(watchDir, 0755)
+	touch(t, watchDir, "virtio-vol-abcde")
+	touch(t, watchDir, "virtio-cinder-abcdefgh")
+	watch := NewWatchDir(
+		watchDir,
+		WithVolumeRegex(regexp.MustCompile(`cinder-[a-z]+$`)),
+	)
+	defer watch.Cancel()
+	event := nextEvent(t, watch)
+	if len(event) != 1 || event[0] != "cinder-abcdefgh" {
+		t.Errorf("Expected [cinder-abcdefgh], got %v", event)
+	}
+}
+
+func touch(t *testing.T, dir string, name string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func nextEvent(t *testing.T, watch *VolumeWatcher) Event {
+	t.Helper()
+	select {
+	case event, ok := <-watch.Events():
+		if !ok {
+			t.Fatal("Events channel closed")
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for event")
+	}
+	return nil
+}
+
+// awaitEvent skips events until one lists exactly the expected volumes
+func awaitEvent(t *testing.T, watch *VolumeWatcher, expected ...string) {
+	t.Helper()
+	for {
+		if event := nextEvent(t, watch); slices.Equal(event.Volumes(), expected) {
+			return
+		}
+	}
+}
+
+func TestWatchRename(t *testing.T) {
+	baseDir := t.TempDir()
+	watchDir := filepath.Join(baseDir, "by-id")
+	os.Mkdir(watchDir, 0755)
+	touch(t, baseDir, "vda")
+	os.Symlink("../vda", filepath.Join(watchDir, "virtio-vol-aaaaa"))
+	watch := NewWatchDir(watchDir)
+	defer watch.Cancel()
+	awaitEvent(t, watch, "vol-aaaaa")
+	// Replace the symlink, as udev does atomically
+	if err := os.Rename(filepath.Join(watchDir, "virtio-vol-aaaaa"), filepath.Join(watchDir, "virtio-vol-bbbbb")); err != nil {
+		t.Fatal(err)
+	}
+	awaitEvent(t, watch, "vol-bbbbb")
+	// Moving a symlink out of the directory only signals a rename
+	if err := os.Rename(filepath.Join(watchDir, "virtio-vol-bbbbb"), filepath.Join(baseDir, "virtio-vol-bbbbb")); err != nil {
+		t.Fatal(err)
+	}
+	awaitEvent(t, watch)
+}
+
+func TestIsVolChangeRename(t *testing.T) {
+	event := fsnotify.Event{Name: "/dev/disk/by-id/virtio-vol-aaaaa", Op: fsnotify.Rename}
+	if !isVolChange(event, "/dev/disk/by-id") {
+		t.Error("Expected a rename in the watch directory to be a volume change")
+	}
+	if !isDirRemove(fsnotify.Event{Name: "/dev/disk/by-id", Op: fsnotify.Rename}, "/dev/disk/by-id") {
+		t.Error("Expected a rename of the watch directory to be a removal")
+	}
+}
+
+func TestWatchDirRename(t *testing.T) {
+	baseDir := t.TempDir()
+	watchDir := filepath.Join(baseDir, "by-id")
+	os.Mkdir(watchDir, 0755)
+	touch(t, watchDir, "virtio-vol-aaaaa")
+	watch := NewWatchDir(watchDir)
+	defer watch.Cancel()
+	awaitEvent(t, watch, "vol-aaaaa")
+	movedDir := filepath.Join(baseDir, "by-id.old")
+	if err := os.Rename(watchDir, movedDir); err != nil {
+		t.Fatal(err)
+	}
+	awaitEvent(t, watch)
+	// Changes in the renamed directory no longer count
+	touch(t, movedDir, "virtio-vol-ccccc")
+	newDir := filepath.Join(baseDir, "by-id.new")
+	os.Mkdir(newDir, 0755)
+	touch(t, newDir, "virtio-vol-bbbbb")
+	if err := os.Rename(newDir, watchDir); err != nil {
+		t.Fatal(err)
+	}
+	awaitEvent(t, watch, "vol-bbbbb")
+	touch(t, watchDir, "virtio-vol-ddddd")
+	awaitEvent(t, watch, "vol-bbbbb", "vol-ddddd")
+	select {
+	case <-watch.Done():
+		t.Error("Watch cancelled after watch directory rename")
+	default:
+	}
+}
+
+func TestWatchDebounce(t *testing.T) {
+	baseDir := t.TempDir()
+	watchDir := filepath.Join(baseDir, "by-id")
+	os.Mkdir(watchDir, 0755)
+	watch := NewWatchDir(watchDir, WithDebounceDuration(100*time.Millisecond))
+	defer watch.Cancel()
+	nextEvent(t, watch)
+	for _, name := range []string{"virtio-vol-aaaaa", "virtio-vol-bbbbb", "virtio-vol-ccccc"} {
+		touch(t, watchDir, name)
+	}
+	event := nextEvent(t, watch)
+	if len(event) != 3 {
+		t.Errorf("Expected 3 volumes, got %v", event)
+	}
+	select {
+	case event := <-watch.Events():
+		t.Errorf("Expected a single event, got another %v", event)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestWatchDeltaEvents(t *testing.T) {
+	baseDir := t.TempDir()
+	watchDir := filepath.Join(baseDir, "by-id")
+	os.Mkdir(watchDir, 0755)
+	touch(t, watchDir, "virtio-vol-aaaaa")
+	watch := NewWatchDir(watchDir, WithDeltaEvents())
+	defer watch.Cancel()
+	event := nextDeltaEvent(t, watch)
+	if event.Type != Create || event.VolumeID != "vol-aaaaa" {
+		t.Errorf("Expected Create vol-aaaaa, got %s %s", event.Type, event.VolumeID)
+	}
+	os.Remove(filepath.Join(watchDir, "virtio-vol-aaaaa"))
+	event = nextDeltaEvent(t, watch)
+	if event.Type != Remove || event.VolumeID != "vol-aaaaa" {
+		t.Errorf("Expected Remove vol-aaaaa, got %s %s", event.Type, event.VolumeID)
+	}
+	if len(event.Snapshot) != 0 {
+		t.Errorf("Expected empty snapshot, got %v", event.Snapshot)
+	}
+}
+
+func TestDiffVolumes(t *testing.T) {
+	deltas := DiffVolumes(
+		[]string{"vol-aaaaa", "vol-bbbbb"},
+		[]string{"vol-bbbbb", "vol-ccccc"},
+	)
+	if len(deltas) != 2 {
+		t.Fatalf("Expected 2 deltas, got %v", deltas)
+	}
+	if deltas[0].Type != Remove || deltas[0].VolumeID != "vol-aaaaa" {
+		t.Errorf("Expected Remove vol-aaaaa, got %s %s", deltas[0].Type, deltas[0].VolumeID)
+	}
+	if deltas[1].Type != Create || deltas[1].VolumeID != "vol-ccccc" {
+		t.Errorf("Expected Create vol-ccccc, got %s %s", deltas[1].Type, deltas[1].VolumeID)
+	}
+}
+
+func nextDeltaEvent(t *testing.T, watch *VolumeWatcher) DeltaEvent {
+	t.Helper()
+	select {
+	case event, ok := <-watch.DeltaEvents():
+		if !ok {
+			t.Fatal("DeltaEvents channel closed")
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for delta event")
+	}
+	return DeltaEvent{}
+}
+
+func TestWatchBaseDirRecreate(t *testing.T) {
+	baseDir := filepath.Join(t.TempDir(), "disk")
+	watchDir := filepath.Join(baseDir, "by-id")
+	os.MkdirAll(watchDir, 0755)
+	watch := NewWatchDir(
+		watchDir,
+		WithReconnectBackoff(10*time.Millisecond, 100*time.Millisecond),
+	)
+	defer watch.Cancel()
+	nextEvent(t, watch)
+	if err := os.RemoveAll(baseDir); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	os.MkdirAll(watchDir, 0755)
+	touch(t, watchDir, "virtio-vol-aaaaa")
+	for {
+		event := nextEvent(t, watch)
+		if len(event) == 1 && event[0] == "vol-aaaaa" {
+			break
+		}
+	}
+	select {
+	case <-watch.Done():
+		t.Error("Watch cancelled after base directory removal")
+	default:
+	}
+}
+
+func TestWatchCancelDuringReconnect(t *testing.T) {
+	baseDir := filepath.Join(t.TempDir(), "disk")
+	watchDir := filepath.Join(baseDir, "by-id")
+	os.MkdirAll(watchDir, 0755)
+	ctx, cancel := context.WithCancel(context.Background())
+	watch := NewWatchDirWithContext(ctx, watchDir)
+	nextEvent(t, watch)
+	os.RemoveAll(baseDir)
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case <-watch.Done():
+	case <-time.After(time.Second):
+		t.Error("Watch failed to cancel during reconnect")
+	}
+}
+
+// awaitStates reads state changes until the channel closes or the
+// expected number have arrived, and checks they match
+func awaitStates(t *testing.T, watch *VolumeWatcher, expected ...State) {
+	t.Helper()
+	var states []State
+	for len(states) < len(expected) {
+		select {
+		case state, ok := <-watch.StateChanges():
+			if !ok {
+				t.Fatalf("Expected states %v, got %v before close", expected, states)
+			}
+			states = append(states, state)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected states %v, timed out after %v", expected, states)
+		}
+	}
+	if !slices.Equal(states, expected) {
+		t.Errorf("Expected states %v, got %v", expected, states)
+	}
+}
+
+// drainEvents discards the watcher's events until it is done, so the
+// watch loop never blocks posting them
+func drainEvents(watch *VolumeWatcher) {
+	go func() {
+		for {
+			select {
+			case <-watch.Events():
+			case <-watch.Done():
+				return
+			}
+		}
+	}()
+}
+
+func TestWatchStates(t *testing.T) {
+	watchDir := filepath.Join(t.TempDir(), "by-id")
+	watch := NewWatchDir(watchDir)
+	awaitStates(t, watch, Watching)
+	if state := watch.State(); state != Watching {
+		t.Errorf("Expected Watching, got %s", state)
+	}
+	watch.Cancel()
+	awaitStates(t, watch, Cancelled)
+	if state := watch.State(); state != Cancelled {
+		t.Errorf("Expected Cancelled, got %s", state)
+	}
+	if _, ok := <-watch.StateChanges(); ok {
+		t.Error("Expected state changes to close once cancelled")
+	}
+}
+
+func TestWatchStatesFailedStart(t *testing.T) {
+	watch := NewWatchDir(filepath.Join(t.TempDir(), "missing", "by-id"))
+	awaitStates(t, watch, Cancelled)
+}
+
+func TestWatchStatesReconnect(t *testing.T) {
+	baseDir := filepath.Join(t.TempDir(), "disk")
+	watchDir := filepath.Join(baseDir, "by-id")
+	os.MkdirAll(watchDir, 0755)
+	watch := NewWatchDir(
+		watchDir,
+		WithReconnectBackoff(10*time.Millisecond, 100*time.Millisecond),
+	)
+	defer watch.Cancel()
+	drainEvents(watch)
+	awaitStates(t, watch, Watching)
+	os.RemoveAll(baseDir)
+	awaitStates(t, watch, Reconnecting)
+	if state := watch.State(); state != Reconnecting {
+		t.Errorf("Expected Reconnecting, got %s", state)
+	}
+	os.MkdirAll(watchDir, 0755)
+	awaitStates(t, watch, Watching)
+	watch.Cancel()
+	awaitStates(t, watch, Cancelled)
+}
+
+func TestWatchStatesCancelDuringReconnect(t *testing.T) {
+	baseDir := filepath.Join(t.TempDir(), "disk")
+	watchDir := filepath.Join(baseDir, "by-id")
+	os.MkdirAll(watchDir, 0755)
+	watch := NewWatchDir(watchDir)
+	drainEvents(watch)
+	awaitStates(t, watch, Watching)
+	os.RemoveAll(baseDir)
+	awaitStates(t, watch, Reconnecting)
+	watch.Cancel()
+	awaitStates(t, watch, Cancelled)
+}
+
+func TestStateString(t *testing.T) {
+	if s := Reconnecting.String(); s != "Reconnecting" {
+		t.Errorf("Expected Reconnecting, got %s", s)
+	}
+	if s := State(9).String(); s != "State(9)" {
+		t.Errorf("Expected State(9), got %s", s)
+	}
+}
+
+func TestWatchErrorBeforeDone(t *testing.T) {
+	watchDir := filepath.Join(t.TempDir(), "missing", "by-id")
+	watch := NewWatchDir(watchDir)
+	select {
+	case <-watch.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Watch failed to cancel on missing base directory")
+	}
+	select {
+	case err := <-watch.Errors():
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Expected not exist error, got %v", err)
+		}
+	default:
+		t.Error("Expected an error to be available once Done is closed")
+	}
+}
+
+func TestWatchRateLimit(t *testing.T) {
+	baseDir := t.TempDir()
+	watchDir := filepath.Join(baseDir, "by-id")
+	os.Mkdir(watchDir, 0755)
+	watch := NewWatchDir(
+		watchDir,
+		WithRateLimit(rate.NewLimiter(rate.Every(time.Second), 1)),
+		WithEventBuffer(10),
+	)
+	defer watch.Cancel()
+	nextEvent(t, watch)
+	for _, name := range []string{"virtio-vol-aaaaa", "virtio-vol-bbbbb", "virtio-vol-ccccc", "virtio-vol-ddddd"} {
+		touch(t, watchDir, name)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if len(watch.Events()) != 1 {
+		t.Errorf("Expected 1 notification within the limit, got %d", len(watch.Events()))
+	}
+	// The deferred notification is only sent if the first one missed
+	// some of the volumes
+	if event := nextEvent(t, watch); len(event) != 4 {
+		event = nextEvent(t, watch)
+		if len(event) != 4 {
+			t.Errorf("Expected deferred notification with 4 volumes, got %v", event)
+		}
+	}
+}
+
+func TestWatchIgnoresNonVolumeChanges(t *testing.T) {
+	baseDir := t.TempDir()
+	watchDir := filepath.Join(baseDir, "by-id")
+	os.Mkdir(watchDir, 0755)
+	touch(t, watchDir, "virtio-vol-aaaaa")
+	watch := NewWatchDir(watchDir)
+	defer watch.Cancel()
+	nextEvent(t, watch)
+	touch(t, watchDir, "wwn-0x5000c500")
+	if err := os.Remove(filepath.Join(watchDir, "wwn-0x5000c500")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-watch.Events():
+		t.Errorf("Expected no event for a non-volume file, got %v", event)
+	case <-time.After(200 * time.Millisecond):
+	}
+	touch(t, watchDir, "virtio-vol-bbbbb")
+	if event := nextEvent(t, watch); !slices.Equal(event.Volumes(), []string{"vol-aaaaa", "vol-bbbbb"}) {
+		t.Errorf("Expected [vol-aaaaa vol-bbbbb], got %v", event)
+	}
+}
+
+func TestWatchHealthCheck(t *testing.T) {
+	baseDir := t.TempDir()
+	watchDir := filepath.Join(baseDir, "by-id")
+	os.Mkdir(watchDir, 0755)
+	watch := NewWatchDir(watchDir)
+	nextEvent(t, watch)
+	if err := watch.HealthCheck(); err != nil {
+		t.Errorf("Expected healthy watcher, got %v", err)
+	}
+	watch.Cancel()
+	if err := watch.HealthCheck(); !errors.Is(err, ErrWatcherUnhealthy) {
+		t.Errorf("Expected ErrWatcherUnhealthy, got %v", err)
+	}
+}
+
+func TestWatcherIDDevicePath(t *testing.T) {
+	if path, _ := IDDevicePath("vol-aaaaa"); path != "/dev/disk/by-id/virtio-vol-aaaaa" {
+		t.Errorf("Expected default device path, got %s", path)
+	}
+	watch := NewWatchDir("/dev/brightbox")
+	watch.Cancel()
+	if path, _ := watch.IDDevicePath("vol-aaaaa"); path != "/dev/brightbox/virtio-vol-aaaaa" {
+		t.Errorf("Expected path in the watched directory, got %s", path)
+	}
+}
+
+func TestCanonicalDevicePath(t *testing.T) {
+	tests := []struct {
+		dir      string
+		target   string
+		expected string
+	}{
+		{"/dev/disk/by-id", "vol-12345", "/dev/disk/by-id/vol-12345"},
+		{"/dev/disk/by-id", "./vol-12345", "/dev/disk/by-id/vol-12345"},
+		{"/dev/disk/by-id", "vol-12345/", "/dev/disk/by-id/vol-12345"},
+		{"/dev/disk/by-id/", "vol-12345", "/dev/disk/by-id/vol-12345"},
+		{"/dev//disk/./by-id", "vol-12345", "/dev/disk/by-id/vol-12345"},
+		{"/dev/disk/by-id", "../by-id/vol-12345", "/dev/disk/by-id/vol-12345"},
+	}
+	for _, tt := range tests {
+		path, err := CanonicalDevicePath(tt.dir, tt.target)
+		if err != nil {
+			t.Errorf("%q in %q: %s", tt.target, tt.dir, err)
+		} else if path != tt.expected {
+			t.Errorf("%q in %q: expected %s, got %s", tt.target, tt.dir, tt.expected, path)
+		}
+	}
+}
+
+func TestCanonicalDevicePathTraversal(t *testing.T) {
+	for _, target := range []string{"../../etc/passwd", "..", ".", "", "vol-12345/../..", "/../../etc/passwd/../.."} {
+		if path, err := CanonicalDevicePath("/dev/disk/by-id", target); !errors.Is(err, ErrInvalidVolumeID) {
+			t.Errorf("%q: expected ErrInvalidVolumeID, got %q, %v", target, path, err)
+		}
+	}
+}
+
+func TestDevicePathInTraversal(t *testing.T) {
+	if _, err := DevicePathIn("/dev/disk/by-id", "../../../etc/passwd"); !errors.Is(err, ErrInvalidVolumeID) {
+		t.Errorf("Expected ErrInvalidVolumeID, got %v", err)
+	}
+}
+
+// symlinkChain creates links link0 -> link1 -> ... -> link<n-1> -> target
+// in dir and returns the path of the first
+func symlinkChain(t *testing.T, dir string, n int, target string) string {
+	t.Helper()
+	for i := n - 1; i >= 0; i-- {
+		if err := os.Symlink(target, filepath.Join(dir, fmt.Sprintf("link%d", i))); err != nil {
+			t.Fatal(err)
+		}
+		target = fmt.Sprintf("link%d", i)
+	}
+	return filepath.Join(dir, target)
+}
+
+func TestCheckSymlinkDepth(t *testing.T) {
+	dir := t.TempDir()
+	device := filepath.Join(dir, "vdb")
+	if err := os.WriteFile(device, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckSymlinkDepth(device, 10); err != nil {
+		t.Errorf("Expected a plain file to pass, got %v", err)
+	}
+	if err := CheckSymlinkDepth(symlinkChain(t, dir, 10, "vdb"), 10); err != nil {
+		t.Errorf("Expected a chain of 10 links to pass, got %v", err)
+	}
+}
+
+func TestCheckSymlinkDepthCircular(t *testing.T) {
+	dir := t.TempDir()
+	self := filepath.Join(dir, "self")
+	if err := os.Symlink("self", self); err != nil {
+		t.Fatal(err)
+	}
+	loop := filepath.Join(dir, "a")
+	if err := os.Symlink("b", loop); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(loop, filepath.Join(dir, "b")); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{self, loop} {
+		err := CheckSymlinkDepth(path, 10)
+		if !errors.Is(err, ErrCircularSymlink) {
+			t.Errorf("%s: expected ErrCircularSymlink, got %v", path, err)
+		} else if !strings.Contains(err.Error(), path) {
+			t.Errorf("%s: expected path in error, got %q", path, err)
+		}
+	}
+}
+
+func TestCheckSymlinkDepthTooDeep(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "vdb"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	path := symlinkChain(t, dir, 11, "vdb")
+	if err := CheckSymlinkDepth(path, 10); !errors.Is(err, ErrCircularSymlink) {
+		t.Errorf("Expected ErrCircularSymlink, got %v", err)
+	}
+}
+
+func TestDevicePathInFound(t *testing.T) {
+	dir := t.TempDir()
+	// The symlink need not resolve, only exist
+	if err := os.Symlink("../../vdb", filepath.Join(dir, "virtio-vol-aaaaa")); err != nil {
+		t.Fatal(err)
+	}
+	path, err := DevicePathIn(dir, "vol-aaaaa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := filepath.Join(dir, "virtio-vol-aaaaa"); path != expected {
+		t.Errorf("Expected %s, got %s", expected, path)
+	}
+}
+
+func TestDevicePathInNotFound(t *testing.T) {
+	dir := t.TempDir()
+	path, err := DevicePathIn(dir, "vol-aaaaa")
+	if expected := filepath.Join(dir, "virtio-vol-aaaaa"); path != expected {
+		t.Errorf("Expected %s, got %s", expected, path)
+	}
+	if !errors.Is(err, ErrDeviceNotFound) || !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected ErrDeviceNotFound, got %v", err)
+	}
+	if expected := "volume vol-aaaaa not found at " + path; !strings.HasPrefix(err.Error(), expected) {
+		t.Errorf("Expected message starting %q, got %q", expected, err)
+	}
+}
+
+func TestWatchedPaths(t *testing.T) {
+	baseDir := t.TempDir()
+	watchDir := filepath.Join(baseDir, "by-id")
+	os.Mkdir(watchDir, 0755)
+	watch := NewWatchDir(watchDir)
+	defer watch.Cancel()
+	nextEvent(t, watch)
+	paths := watch.WatchedPaths()
+	for _, expected := range []string{baseDir, watchDir} {
+		if !slices.Contains(paths, expected) {
+			t.Errorf("Expected %s to be watched, got %v", expected, paths)
+		}
+	}
+}
+
+// panicNotifier is a fake WatchBackend whose AddWatch panics a set number
+// of times
+type panicNotifier struct {
+	panicsLeft int32
+	events     chan fsnotify.Event
+	errors     chan error
+}
+
+func newPanicNotifier(panics int32) *panicNotifier {
+	return &panicNotifier{
+		panicsLeft: panics,
+		events:     make(chan fsnotify.Event),
+		errors:     make(chan error),
+	}
+}
+
+func (b *panicNotifier) AddWatch(name string) error {
+	if atomic.AddInt32(&b.panicsLeft, -1) >= 0 {
+		panic("fake notifier failure")
+	}
+	return nil
+}
+
+func (b *panicNotifier) RemoveWatch(name string) error { return nil }
+func (b *panicNotifier) Close() error                  { return nil }
+func (b *panicNotifier) WatchList() []string           { return nil }
+func (b *panicNotifier) Events() <-chan fsnotify.Event { return b.events }
+func (b *panicNotifier) Errors() <-chan error          { return b.errors }
+
+func TestWatchPanicCancels(t *testing.T) {
+	watchDir := filepath.Join(t.TempDir(), "by-id")
+	watch := NewWatchDir(watchDir, WithWatchBackend(newPanicNotifier(1)))
+	select {
+	case <-watch.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Watch failed to cancel after panic")
+	}
+	if watch.PanicCount() != 1 {
+		t.Errorf("Expected 1 panic, got %d", watch.PanicCount())
+	}
+}
+
+func TestWatchPanicRestart(t *testing.T) {
+	watchDir := filepath.Join(t.TempDir(), "by-id")
+	os.Mkdir(watchDir, 0755)
+	watch := NewWatchDir(
+		watchDir,
+		WithWatchBackend(newPanicNotifier(2)),
+		WithRestartOnPanic(2),
+	)
+	defer watch.Cancel()
+	nextEvent(t, watch)
+	if watch.PanicCount() != 2 {
+		t.Errorf("Expected 2 panics, got %d", watch.PanicCount())
+	}
+}
+
+func TestWatchPanicRestartLimit(t *testing.T) {
+	watchDir := filepath.Join(t.TempDir(), "by-id")
+	watch := NewWatchDir(
+		watchDir,
+		WithWatchBackend(newPanicNotifier(10)),
+		WithRestartOnPanic(2),
+	)
+	select {
+	case <-watch.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Watch failed to cancel after repeated panics")
+	}
+	if watch.PanicCount() != 3 {
+		t.Errorf("Expected 3 panics, got %d", watch.PanicCount())
+	}
+}
+
+func TestWatchValidateSymlinks(t *testing.T) {
+	baseDir := t.TempDir()
+	watchDir := filepath.Join(baseDir, "by-id")
+	os.Mkdir(watchDir, 0755)
+	touch(t, baseDir, "vda")
+	os.Symlink("../vda", filepath.Join(watchDir, "virtio-vol-aaaaa"))
+	os.Symlink("../vdb", filepath.Join(watchDir, "virtio-vol-bbbbb"))
+	watch := NewWatchDir(watchDir, WithValidateSymlinks(true))
+	defer watch.Cancel()
+	event := nextEvent(t, watch)
+	if len(event) != 1 || event[0] != "vol-aaaaa" {
+		t.Errorf("Expected [vol-aaaaa], got %v", event)
+	}
+	stale := watch.StaleVolumes()
+	if len(stale) != 1 || stale[0] != "vol-bbbbb" {
+		t.Errorf("Expected stale [vol-bbbbb], got %v", stale)
+	}
+}
+
+func TestWatchNoValidateSymlinks(t *testing.T) {
+	baseDir := t.TempDir()
+	watchDir := filepath.Join(baseDir, "by-id")
+	os.Mkdir(watchDir, 0755)
+	os.Symlink("../vdb", filepath.Join(watchDir, "virtio-vol-bbbbb"))
+	watch := NewWatchDir(watchDir)
+	defer watch.Cancel()
+	event := nextEvent(t, watch)
+	if len(event) != 1 || event[0] != "vol-bbbbb" {
+		t.Errorf("Expected [vol-bbbbb], got %v", event)
+	}
+	if stale := watch.StaleVolumes(); len(stale) != 0 {
+		t.Errorf("Expected no stale volumes, got %v", stale)
+	}
+}
+
+func TestValidateVolumeID(t *testing.T) {
+	for _, id := range []string{"vol-12345", "vol-abcde"} {
+		if err := ValidateVolumeID(id); err != nil {
+			t.Errorf("Expected %q to be valid, got %s", id, err)
+		}
+	}
+	invalid := []string{
+		"",
+		"../../etc/passwd",
+		"vol-1/../../sda",
+		`vol-1\2345`,
+		"vol-..345",
+		"vol-123",
+		"xvol-12345",
+		"virtio-vol-12345",
+		strings.Repeat("a", 1000) + "vol-12345",
+	}
+	for _, id := range invalid {
+		if err := ValidateVolumeID(id); !errors.Is(err, ErrInvalidVolumeID) {
+			t.Errorf("Expected %q to be rejected, got %v", id, err)
+		}
+	}
+}
+
+func TestIsNVMe(t *testing.T) {
+	for _, path := range []string{"/dev/nvme0n1", "/dev/nvme12n3", "nvme0n1"} {
+		if !IsNVMe(path) {
+			t.Errorf("Expected %q to be NVMe", path)
+		}
+	}
+	for _, path := range []string{"/dev/nvme0", "/dev/nvme0n1p1", "/dev/sda", "/dev/vdb", "/dev/dm-0"} {
+		if IsNVMe(path) {
+			t.Errorf("Expected %q not to be NVMe", path)
+		}
+	}
+}
+
+// mknod creates a block device node, skipping the test if that is not
+// permitted
+func mknod(t *testing.T, path string, major, minor uint32) {
+	t.Helper()
+	err := unix.Mknod(path, unix.S_IFBLK|0600, int(unix.Mkdev(major, minor)))
+	if errors.Is(err, unix.EPERM) {
+		t.Skip("Creating device nodes needs CAP_MKNOD")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeviceMajorMinor(t *testing.T) {
+	dir := t.TempDir()
+	device := filepath.Join(dir, "vdb")
+	mknod(t, device, 253, 16)
+	link := filepath.Join(dir, "virtio-vol-abcde")
+	if err := os.Symlink(device, link); err != nil {
+		t.Fatal(err)
+	}
+	major, minor, err := DeviceMajorMinor(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if major != 253 || minor != 16 {
+		t.Errorf("Expected 253:16, got %d:%d", major, minor)
+	}
+}
+
+func TestDeviceMajorMinorNotDevice(t *testing.T) {
+	if _, _, err := DeviceMajorMinor(t.TempDir()); err == nil {
+		t.Error("Expected error for a directory")
+	}
+	if _, _, err := DeviceMajorMinor(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("Expected error for a missing path")
+	}
+}
+
+// withMagic returns a probe sized buffer holding magic at offset
+func withMagic(offset int, magic string) []byte {
+	buf := make([]byte, probeSize)
+	copy(buf[offset:], magic)
+	return buf
+}
+
+// extSuperblock returns a buffer holding an ext superblock with the
+// given compatible and incompatible feature flags
+func extSuperblock(compat, incompat uint32) []byte {
+	buf := withMagic(1024+0x38, "\x53\xef")
+	binary.LittleEndian.PutUint32(buf[1024+0x5c:], compat)
+	binary.LittleEndian.PutUint32(buf[1024+0x60:], incompat)
+	return buf
+}
+
+func TestBlockDeviceSize(t *testing.T) {
+	loop := filepath.Join(t.TempDir(), "loop0")
+	mknod(t, loop, 7, 0)
+	size, err := BlockDeviceSize(loop)
+	if errors.Is(err, unix.ENXIO) || errors.Is(err, os.ErrNotExist) {
+		t.Skip("No loop device available")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	if size < 0 {
+		t.Errorf("Expected a size, got %d", size)
+	}
+}
+
+func TestBlockDeviceSizeNotBlockDevice(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/dev/null", file, t.TempDir()} {
+		if _, err := BlockDeviceSize(path); !errors.Is(err, ErrNotBlockDevice) {
+			t.Errorf("Expected ErrNotBlockDevice for %s, got %v", path, err)
+		}
+	}
+}
+
+// fakeSysBlock creates the sysfs directory of block device name in a
+// temporary /sys/block, with the given size unless it is empty
+func fakeSysBlock(t *testing.T, name string, size string) string {
+	t.Helper()
+	sysBlock := t.TempDir()
+	deviceDir := filepath.Join(sysBlock, name)
+	if err := os.Mkdir(deviceDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(deviceDir, "stat"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if size != "" {
+		if err := os.WriteFile(filepath.Join(deviceDir, "size"), []byte(size+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return sysBlock
+}
+
+func TestWaitForBlockDeviceReady(t *testing.T) {
+	sysBlock := fakeSysBlock(t, "vdb", "2048")
+	if err := WaitForBlockDeviceReadyIn(sysBlock, "/dev/vdb", 0); err != nil {
+		t.Errorf("Expected device to be ready, got %v", err)
+	}
+}
+
+func TestWaitForBlockDeviceNotReady(t *testing.T) {
+	tests := []struct {
+		name     string
+		sysBlock string
+	}{
+		{"no device", t.TempDir()},
+		{"no size", fakeSysBlock(t, "vdb", "")},
+		{"zero size", fakeSysBlock(t, "vdb", "0")},
+	}
+	for _, tt := range tests {
+		start := time.Now()
+		err := WaitForBlockDeviceReadyIn(tt.sysBlock, "/dev/vdb", 20*time.Millisecond)
+		if !errors.Is(err, ErrBlockDeviceNotReady) {
+			t.Errorf("%s: expected ErrBlockDeviceNotReady, got %v", tt.name, err)
+		}
+		if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+			t.Errorf("%s: gave up after %s", tt.name, elapsed)
+		}
+	}
+}
+
+func TestWaitForBlockDeviceBecomesReady(t *testing.T) {
+	sysBlock := fakeSysBlock(t, "vdb", "0")
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		os.WriteFile(filepath.Join(sysBlock, "vdb", "size"), []byte("2048\n"), 0644)
+	}()
+	if err := WaitForBlockDeviceReadyIn(sysBlock, "/dev/vdb", 5*time.Second); err != nil {
+		t.Errorf("Expected device to become ready, got %v", err)
+	}
+}
+
+func TestWaitForBlockDeviceBadSize(t *testing.T) {
+	sysBlock := fakeSysBlock(t, "vdb", "lots")
+	err := WaitForBlockDeviceReadyIn(sysBlock, "/dev/vdb", time.Second)
+	if err == nil || errors.Is(err, ErrBlockDeviceNotReady) {
+		t.Errorf("Expected a parse error, got %v", err)
+	}
+}
+
+func TestDetectFilesystem(t *testing.T) {
+	tests := []struct {
+		name string
+		buf  []byte
+	}{
+		{"ext2", extSuperblock(0, 0)},
+		{"ext3", extSuperblock(0x4, 0)},
+		{"ext4", extSuperblock(0x4, 0x2c0)},
+		{"xfs", withMagic(0, "XFSB")},
+		{"btrfs", withMagic(0x10040, "_BHRfS_M")},
+		{"crypto_LUKS", withMagic(0, "LUKS\xba\xbe")},
+		{"squashfs", withMagic(0, "hsqs")},
+		{"LVM2_member", withMagic(536, "LVM2 001")},
+		{"vfat", withMagic(82, "FAT32   ")},
+		{"vfat", withMagic(54, "FAT16   ")},
+		{"swap", withMagic(4086, "SWAPSPACE2")},
+		{"iso9660", withMagic(0x8001, "CD001")},
+		{"raw", make([]byte, probeSize)},
+		{"raw", nil},
+		{"raw", withMagic(0, "XFS")},
+	}
+	for _, test := range tests {
+		if got := detectFilesystem(test.buf); got != test.name {
+			t.Errorf("Expected %s, got %s", test.name, got)
+		}
+	}
+}
+
+func TestDetectFilesystemSmallDevice(t *testing.T) {
+	device := filepath.Join(t.TempDir(), "vdb")
+	if err := os.WriteFile(device, []byte("XFSB"), 0444); err != nil {
+		t.Fatal(err)
+	}
+	if filesystem, err := DetectFilesystem(device); err != nil || filesystem != "xfs" {
+		t.Errorf("Expected xfs, got %q, %v", filesystem, err)
+	}
+	if _, err := DetectFilesystem(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("Expected error for a missing device")
+	}
+}
+
+func TestWatchFollowSymlinks(t *testing.T) {
+	realDir := t.TempDir()
+	baseDir := t.TempDir()
+	watchDir := filepath.Join(baseDir, "by-id")
+	if err := os.Symlink(realDir, watchDir); err != nil {
+		t.Fatal(err)
+	}
+	watch := NewWatchDir(watchDir, WithFollowSymlinks(true))
+	defer watch.Cancel()
+	if event := nextEvent(t, watch); len(event) != 0 {
+		t.Errorf("Expected no volumes, got %v", event)
+	}
+	touch(t, realDir, "virtio-vol-abcde")
+	event := nextEvent(t, watch)
+	if len(event) != 1 || event[0] != "vol-abcde" {
+		t.Errorf("Expected [vol-abcde], got %v", event)
+	}
+}
+
+func TestWatchSnapshot(t *testing.T) {
+	baseDir := t.TempDir()
+	watchDir := filepath.Join(baseDir, "by-id")
+	os.Mkdir(watchDir, 0755)
+	touch(t, watchDir, "virtio-vol-abcde")
+	touch(t, watchDir, "virtio-cinder-abcde")
+	watch := NewWatchDir(watchDir)
+	defer watch.Cancel()
+	volumes, err := watch.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(volumes) != 1 || volumes[0] != "vol-abcde" {
+		t.Errorf("Expected [vol-abcde], got %v", volumes)
+	}
+}
+
+func TestWatchSnapshotDuringEvents(t *testing.T) {
+	baseDir := t.TempDir()
+	watchDir := filepath.Join(baseDir, "by-id")
+	os.Mkdir(watchDir, 0755)
+	watch := NewWatchDir(watchDir)
+	defer watch.Cancel()
+	nextEvent(t, watch)
+
+	stop := make(chan struct{})
+	snapshotErrs := make(chan error, 1)
+	go func() {
+		defer close(snapshotErrs)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if _, err := watch.Snapshot(); err != nil {
+				snapshotErrs <- err
+				return
+			}
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		touch(t, watchDir, fmt.Sprintf("virtio-vol-%05d", i))
+		if event := nextEvent(t, watch); len(event) != i+1 {
+			t.Errorf("Expected %d volumes, got %v", i+1, event)
+		}
+	}
+	close(stop)
+	if err := <-snapshotErrs; err != nil {
+		t.Errorf("Snapshot failed: %s", err)
+	}
+}
+
+// failingNotifiers returns a notifier factory that fails the given number
+// of times before creating real fsnotify notifiers
+func failingNotifiers(failures int32) func() (WatchBackend, error) {
+	return func() (WatchBackend, error) {
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			return nil, errors.New("too many open files")
+		}
+		return newFsnotifyBackend()
+	}
+}
+
+func TestWatchNoPollingFallback(t *testing.T) {
+	watchDir := filepath.Join(t.TempDir(), "by-id")
+	if watch := NewWatchDir(watchDir, withNotifierFactory(failingNotifiers(1))); watch != nil {
+		watch.Cancel()
+		t.Error("Expected no watcher without a polling fallback")
+	}
+}
+
+func TestWatchPollingFallback(t *testing.T) {
+	watchDir := filepath.Join(t.TempDir(), "by-id")
+	os.Mkdir(watchDir, 0755)
+	watch := NewWatchDir(watchDir,
+		withNotifierFactory(failingNotifiers(1000)),
+		WithPollingFallback(10*time.Millisecond),
+	)
+	defer watch.Cancel()
+	if event := nextEvent(t, watch); len(event) != 0 {
+		t.Errorf("Expected no volumes, got %v", event)
+	}
+	if !watch.Polling() {
+		t.Error("Expected watcher to be polling")
+	}
+	if err := watch.HealthCheck(); err != nil {
+		t.Errorf("Expected polling watcher to be healthy, got %s", err)
+	}
+	touch(t, watchDir, "virtio-vol-abcde")
+	if event := nextEvent(t, watch); len(event) != 1 || event[0] != "vol-abcde" {
+		t.Errorf("Expected [vol-abcde], got %v", event)
+	}
+	select {
+	case event := <-watch.Events():
+		t.Errorf("Unexpected event %v without a change", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWatchPollingRecovers(t *testing.T) {
+	watchDir := filepath.Join(t.TempDir(), "by-id")
+	os.Mkdir(watchDir, 0755)
+	watch := NewWatchDir(watchDir,
+		withNotifierFactory(failingNotifiers(3)),
+		WithPollingFallback(10*time.Millisecond),
+	)
+	defer watch.Cancel()
+	nextEvent(t, watch)
+	deadline := time.Now().Add(5 * time.Second)
+	for watch.Polling() {
+		if time.Now().After(deadline) {
+			t.Fatal("Watcher did not switch back to notifications")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	nextEvent(t, watch)
+	touch(t, watchDir, "virtio-vol-abcde")
+	if event := nextEvent(t, watch); len(event) != 1 || event[0] != "vol-abcde" {
+		t.Errorf("Expected [vol-abcde], got %v", event)
+	}
+}
+
+func TestWatchNotifierErrorFallsBackToPolling(t *testing.T) {
+	watchDir := filepath.Join(t.TempDir(), "by-id")
+	os.Mkdir(watchDir, 0755)
+	failing := newPanicNotifier(0)
+	watch := NewWatchDir(watchDir,
+		WithWatchBackend(failing),
+		withNotifierFactory(failingNotifiers(1000)),
+		WithPollingFallback(10*time.Millisecond),
+	)
+	defer watch.Cancel()
+	nextEvent(t, watch)
+	failing.errors <- errors.New("inotify queue overflow")
+	select {
+	case err := <-watch.Errors():
+		if !strings.Contains(err.Error(), "inotify queue overflow") {
+			t.Errorf("Unexpected error %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected notifier error to be reported")
+	}
+	touch(t, watchDir, "virtio-vol-abcde")
+	if event := nextEvent(t, watch); len(event) != 1 || event[0] != "vol-abcde" {
+		t.Errorf("Expected [vol-abcde], got %v", event)
+	}
+	if !watch.Polling() {
+		t.Error("Expected watcher to be polling")
+	}
+	if watch.Err() != nil {
+		t.Errorf("Expected watcher to keep running, got %s", watch.Err())
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected ErrorClass
+	}{
+		{syscall.EINTR, Transient},
+		{syscall.EAGAIN, Transient},
+		{fmt.Errorf("read inotify: %w", syscall.EINTR), Transient},
+		{syscall.EBADF, Fatal},
+		{syscall.ENODEV, Fatal},
+		{errors.New("inotify queue overflow"), Fatal},
+	}
+	for _, tt := range tests {
+		if class := ClassifyError(tt.err); class != tt.expected {
+			t.Errorf("%v: expected %s, got %s", tt.err, tt.expected, class)
+		}
+	}
+}
+
+func TestWatchReconcileInterval(t *testing.T) {
+	watchDir := filepath.Join(t.TempDir(), "by-id")
+	os.Mkdir(watchDir, 0755)
+	watch := NewWatchDir(watchDir, WithReconcileInterval(10*time.Millisecond))
+	defer watch.Cancel()
+	nextEvent(t, watch)
+	watch.watchMutex.Lock()
+	err := watch.watch.RemoveWatch(watchDir)
+	watch.watchMutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	touch(t, watchDir, "virtio-vol-abcde")
+	if event := nextEvent(t, watch); len(event) != 1 || event[0] != "vol-abcde" {
+		t.Errorf("Expected [vol-abcde], got %v", event)
+	}
+}
+
+// fakeBackend forwards events sent by the test until it is stopped,
+// returning the error given to stop
+type fakeBackend struct {
+	events chan Event
+	stop   chan error
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{events: make(chan Event), stop: make(chan error, 1)}
+}
+
+func (b *fakeBackend) Start(ctx context.Context, events chan<- Event) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-b.stop:
+			return err
+		case event := <-b.events:
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+}
+
+func TestWatchBackend(t *testing.T) {
+	watchDir := filepath.Join(t.TempDir(), "by-id")
+	os.Mkdir(watchDir, 0755)
+	backend := newFakeBackend()
+	watch := NewWatchDir(watchDir, WithBackend(backend))
+	defer watch.Cancel()
+	if event := nextEvent(t, watch); len(event) != 0 {
+		t.Errorf("Expected no volumes, got %v", event)
+	}
+	if err := watch.HealthCheck(); err != nil {
+		t.Errorf("Expected healthy watcher, got %v", err)
+	}
+	touch(t, watchDir, "virtio-vol-abcde")
+	backend.events <- Event{}
+	if event := nextEvent(t, watch); len(event) != 1 || event[0] != "vol-abcde" {
+		t.Errorf("Expected [vol-abcde], got %v", event)
+	}
+}
+
+func TestWatchBackendFailure(t *testing.T) {
+	watchDir := filepath.Join(t.TempDir(), "by-id")
+	os.Mkdir(watchDir, 0755)
+	backend := newFakeBackend()
+	watch := NewWatchDir(watchDir, WithBackend(backend))
+	defer watch.Cancel()
+	nextEvent(t, watch)
+	failure := errors.New("netlink closed")
+	backend.stop <- failure
+	select {
+	case <-watch.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Watcher did not cancel after backend failure")
+	}
+	if err := <-watch.Errors(); !errors.Is(err, failure) {
+		t.Errorf("Expected backend failure to be reported, got %v", err)
+	}
+}
+
+func TestIsBlockDiskChange(t *testing.T) {
+	tests := []struct {
+		action netlink.KObjAction
+		env    map[string]string
+		want   bool
+	}{
+		{netlink.ADD, map[string]string{"SUBSYSTEM": "block", "DEVTYPE": "disk"}, true},
+		{netlink.REMOVE, map[string]string{"SUBSYSTEM": "block", "DEVTYPE": "disk"}, true},
+		{netlink.CHANGE, map[string]string{"SUBSYSTEM": "block", "DEVTYPE": "disk"}, false},
+		{netlink.ADD, map[string]string{"SUBSYSTEM": "block", "DEVTYPE": "partition"}, false},
+		{netlink.ADD, map[string]string{"SUBSYSTEM": "net"}, false},
+	}
+	for _, test := range tests {
+		uevent := &netlink.UEvent{Action: test.action, Env: test.env}
+		if got := isBlockDiskChange(uevent); got != test.want {
+			t.Errorf("isBlockDiskChange(%s %v) = %t, want %t", test.action, test.env, got, test.want)
+		}
+	}
+}
+
+// checkNoLeaks fails the test if more goroutines are running than
+// before. A goroutine may still be unwinding for a moment after
+// signalling that it has finished, so the count is given a short time to
+// settle. The leak tests repeat internally, but are also worth running
+// with -count=100 to catch intermittent leaks.
+func checkNoLeaks(t *testing.T, before int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("%d goroutines leaked:\n%s", runtime.NumGoroutine()-before, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWatchCancelNoLeak(t *testing.T) {
+	watchDir := filepath.Join(t.TempDir(), "by-id")
+	os.Mkdir(watchDir, 0755)
+	touch(t, watchDir, "virtio-vol-abcde")
+	before := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		for _, opts := range [][]Option{nil, {WithDeltaEvents()}} {
+			watch := NewWatchDir(watchDir, opts...)
+			// Wait for the initial scan, leaving it blocked posting
+			// an event that is never read
+			time.Sleep(10 * time.Millisecond)
+			watch.Cancel()
+		}
+	}
+	checkNoLeaks(t, before)
+}
+
+func TestWatchImmediateCancelNoLeak(t *testing.T) {
+	watchDir := filepath.Join(t.TempDir(), "by-id")
+	os.Mkdir(watchDir, 0755)
+	before := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		NewWatchDir(watchDir).Cancel()
+	}
+	checkNoLeaks(t, before)
+}
+
+func TestWatchBackendCancelNoLeak(t *testing.T) {
+	watchDir := filepath.Join(t.TempDir(), "by-id")
+	os.Mkdir(watchDir, 0755)
+	before := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		NewWatchDir(watchDir, WithBackend(newFakeBackend())).Cancel()
+	}
+	checkNoLeaks(t, before)
+}
+
+// lockedBuffer is a bytes.Buffer the watcher goroutines can log to while
+// the test reads it
+type lockedBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
+
+func TestWatchJSONLogging(t *testing.T) {
+	var b lockedBuffer
+	logger, err := logging.New(&b, "json", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := logging.Logger()
+	logging.SetLogger(logger)
+	defer logging.SetLogger(old)
+
+	baseDir := t.TempDir()
+	watchDir := filepath.Join(baseDir, "by-id")
+	os.Mkdir(watchDir, 0755)
+	watch := NewWatchDir(watchDir, WithDeltaEvents())
+	defer watch.Cancel()
+	touch(t, watchDir, "virtio-vol-aaaaa")
+	nextDeltaEvent(t, watch)
+
+	scanner := bufio.NewScanner(strings.NewReader(b.String()))
+	for scanner.Scan() {
+		var record map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("Expected newline-delimited JSON, got %q: %s", scanner.Text(), err)
+		}
+		if record["msg"] == "Volume changed" {
+			if record["volumeID"] != "vol-aaaaa" || record["watchDir"] != watchDir || record["eventType"] != "Create" {
+				t.Errorf("Expected volumeID, watchDir and eventType fields, got %v", record)
+			}
+			return
+		}
+	}
+	t.Errorf("Expected a volume change record, got %q", b.String())
+}